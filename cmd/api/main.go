@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,32 +13,34 @@ import (
 	"time"
 
 	api "github.com/animeshs34/transaction_routine/internal/api"
+	"github.com/animeshs34/transaction_routine/internal/auth"
 	"github.com/animeshs34/transaction_routine/internal/config"
+	"github.com/animeshs34/transaction_routine/internal/domain"
 	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
 	"github.com/animeshs34/transaction_routine/internal/respository"
 	"github.com/animeshs34/transaction_routine/internal/service"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
 	"go.uber.org/zap"
 )
 
 func main() {
 	configFile := flag.String("config", "", "config file path")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration, with secrets redacted, and exit")
+	config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
-	var cfg *config.Config
-	var err error
 
-	if *configFile != "" {
-		cfg, err = config.LoadFromFile(*configFile)
-		if err != nil {
-			fmt.Printf("Failed to load configuration from file: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Printf("Loaded configuration from file: %s\n", *configFile)
-	} else {
-		cfg, err = config.Load()
-		if err != nil {
-			fmt.Printf("Failed to load configuration: %v\n", err)
+	cfg, err := config.Load(*configFile, flag.CommandLine)
+	if err != nil {
+		fmt.Printf("Failed to load configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		if err := cfg.Redact().WriteYAML(os.Stdout); err != nil {
+			fmt.Printf("Failed to print configuration: %v\n", err)
 			os.Exit(1)
 		}
+		return
 	}
 
 	if err := logger.Init(cfg.Logging.Level); err != nil {
@@ -45,12 +48,40 @@ func main() {
 		os.Exit(1)
 	}
 	defer logger.Sync()
+	if *configFile != "" {
+		logger.Info("Loaded configuration from file", zap.String("path", *configFile))
+	}
+
+	var tracer *tracing.Tracer
+	switch cfg.Tracing.Exporter {
+	case "", "none":
+	case "stdout":
+		tracer = tracing.NewTracer(tracing.NewStdoutExporter(), tracing.WithSampleRatio(cfg.Tracing.SampleRatio))
+	case "otlp":
+		exporter := tracing.NewOTLPExporter(cfg.Tracing.OTLPEndpoint, cfg.Tracing.ServiceName)
+		tracer = tracing.NewTracer(exporter, tracing.WithSampleRatio(cfg.Tracing.SampleRatio))
+	default:
+		logger.Fatal("Unsupported tracing exporter", zap.String("exporter", cfg.Tracing.Exporter))
+	}
+	if tracer != nil {
+		tracing.SetTracer(tracer)
+		logger.Info("Tracing enabled", zap.String("exporter", cfg.Tracing.Exporter))
+	}
+
+	reg := metrics.NewRegistry()
+
+	monitorCtx, stopMonitors := context.WithCancel(context.Background())
+	defer stopMonitors()
 
 	var repo respository.Respository
+	var idempotencyStore respository.IdempotencyStore
+	var apiKeyStore respository.APIKeyStore
 	var dbConn *respository.DBConn
+	var fileStore *respository.FileStore
 	switch cfg.Database.Type {
 	case "memory":
-		repo = respository.NewInMemoryStore()
+		store := respository.NewInMemoryStore()
+		repo, idempotencyStore, apiKeyStore = store, store, store
 	case "postgres":
 		var err error
 		dbConn, err = respository.NewPostgresConn(
@@ -60,23 +91,131 @@ func main() {
 			cfg.Database.Password,
 			cfg.Database.DBName,
 			cfg.Database.SSLMode,
+			respository.WithPool(respository.PoolConfig{
+				MaxOpenConns:    cfg.Database.MaxOpenConns,
+				MaxIdleConns:    cfg.Database.MaxIdleConns,
+				ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+				ConnMaxIdleTime: cfg.Database.ConnMaxIdleTime,
+			}),
+			respository.WithConnectRetry(cfg.Database.ConnectAttempts, cfg.Database.ConnectBackoff, cfg.Database.ConnectMaxBackoff),
+			respository.WithReplicas(cfg.Database.ReplicaAddrs(), cfg.Database.ReadYourWrites),
 		)
 		if err != nil {
 			logger.Fatal("Failed to initialize PostgresStore connection", zap.Error(err))
 		}
-		repo = respository.NewPostgresStore(dbConn)
+		if replicas := cfg.Database.ReplicaAddrs(); len(replicas) > 0 {
+			go dbConn.MonitorReplicas(monitorCtx, cfg.Database.ReplicaCheckInterval, cfg.Database.ReplicaMaxLag)
+			logger.Info("Reading from replicas", zap.Strings("replicas", replicas))
+		}
+		dbConn.RegisterMetrics(reg)
+		if cfg.Database.AutoMigrate {
+			applied, err := dbConn.Migrate(context.Background())
+			if err != nil {
+				logger.Fatal("Failed to apply database migrations", zap.Error(err))
+			}
+			logger.Info("Database migrations applied", zap.Int("count", applied))
+		}
+		store := respository.NewPostgresStore(dbConn, respository.WithQueryTimeout(cfg.Database.QueryTimeout))
+		repo, idempotencyStore, apiKeyStore = store, store, store
+	case "file":
+		var err error
+		fileStore, err = respository.OpenFileStore(cfg.Database.FileDir,
+			respository.WithSyncPolicy(respository.SyncPolicy(cfg.Database.FileSync), cfg.Database.FileSyncInterval),
+			respository.WithSnapshotEvery(cfg.Database.FileSnapshotEvery),
+		)
+		if err != nil {
+			logger.Fatal("Failed to open FileStore", zap.String("dir", cfg.Database.FileDir), zap.Error(err))
+		}
+		logger.Info("FileStore opened", zap.String("dir", cfg.Database.FileDir), zap.String("sync", cfg.Database.FileSync))
+		repo, idempotencyStore, apiKeyStore = fileStore, fileStore, fileStore
 	default:
 		logger.Fatal("Unsupported database type", zap.String("type", cfg.Database.Type))
 	}
 
-	svc := service.New(repo)
-	handler := api.New(svc)
+	svcOpts := []service.Option{service.WithMetrics(reg)}
+	if cfg.Accounts.DefaultCreditLimit != "" {
+		limit, err := domain.ParseMoney(cfg.Accounts.DefaultCreditLimit, domain.DefaultCurrency)
+		if err != nil {
+			logger.Fatal("Invalid default credit limit", zap.Error(err))
+		}
+		svcOpts = append(svcOpts, service.WithDefaultCreditLimit(limit))
+	}
+	if cfg.FX.Rates != "" || cfg.FX.RatesFile != "" {
+		rates, err := service.ParseRates(cfg.FX.Rates)
+		if err != nil {
+			logger.Fatal("Invalid exchange rates", zap.Error(err))
+		}
+		if cfg.FX.RatesFile != "" {
+			fileRates, err := service.LoadRateFile(cfg.FX.RatesFile)
+			if err != nil {
+				logger.Fatal("Invalid exchange rate file", zap.Error(err))
+			}
+			rates = append(rates, fileRates...)
+		}
+		table, err := service.NewRateTable(rates)
+		if err != nil {
+			logger.Fatal("Invalid exchange rates", zap.Error(err))
+		}
+		svcOpts = append(svcOpts, service.WithExchangeRates(table))
+	}
+
+	limits, err := velocityLimits(cfg)
+	if err != nil {
+		logger.Fatal("Invalid velocity max amount", zap.Error(err))
+	}
+	svcOpts = append(svcOpts, service.WithVelocityLimits(limits), service.WithFeatures(features(cfg)))
+
+	svc := service.New(repo, svcOpts...)
 
-	middlewareChainedHandler := api.Chain(
-		handler.Router(),
-		api.Recoverer(),
-		api.LoggingMiddleware,
-	)
+	// The limiter is always installed so that reloading can turn it on.
+	var rlOpts []api.RateLimitOption
+	if cfg.RateLimit.TrustForwardedFor {
+		rlOpts = append(rlOpts, api.WithForwardedFor())
+	}
+	limiter := api.NewRateLimiter(cfg.RateLimit.RequestsPerSecond, cfg.RateLimit.Burst, rlOpts...)
+	reloader := &reloader{path: *configFile, flags: flag.CommandLine, limiter: limiter, svc: svc, cfg: cfg}
+
+	apiOpts := []api.Option{api.WithMetrics(reg), api.WithReload(reloader.reload)}
+	if cfg.Idempotency.TTL > 0 {
+		apiOpts = append(apiOpts, api.WithIdempotency(idempotencyStore, cfg.Idempotency.TTL, cfg.Idempotency.Lease))
+	}
+	if dbConn != nil {
+		apiOpts = append(apiOpts, api.WithReadiness(dbConn.Ping))
+	}
+	if fileStore != nil {
+		apiOpts = append(apiOpts, api.WithReadiness(fileStore.Ping))
+	}
+	handler := api.New(svc, apiOpts...)
+
+	middlewares := []api.Middleware{api.RequestID(), api.Recoverer(), api.Tracing(), api.Metrics(reg), api.LoggingMiddleware}
+	if cfg.Server.WriteTimeout > 0 {
+		middlewares = append(middlewares, api.RequestTimeout(cfg.Server.WriteTimeout))
+	}
+	if cfg.Auth.Enabled {
+		authOpts := []auth.Option{auth.WithAPIKeys(apiKeyStore)}
+		if cfg.Auth.JWKSFile != "" {
+			keySet, err := auth.LoadKeySet(cfg.Auth.JWKSFile)
+			if err != nil {
+				logger.Fatal("Invalid JWT key set", zap.Error(err))
+			}
+			authOpts = append(authOpts, auth.WithJWT(keySet, auth.Validation{Issuer: cfg.Auth.Issuer, Audience: cfg.Auth.Audience}))
+		}
+		// Bad credentials are limited by address before they are checked;
+		// RateLimit below limits authenticated clients by principal.
+		middlewares = append(middlewares, api.RateLimitFailedAuth(limiter), api.Authenticate(auth.NewAuthenticator(authOpts...)))
+	} else {
+		logger.Warn("Authentication is disabled; every endpoint is open to anyone who can reach the server")
+	}
+	middlewares = append(middlewares, api.RateLimit(limiter))
+	if len(cfg.Database.ReplicaAddrs()) > 0 {
+		middlewares = append(middlewares, api.ReadYourWrites())
+	}
+	middlewareChainedHandler := api.Chain(handler.Router(), middlewares...)
+
+	// Every request context derives from baseCtx, so cancelling it aborts the
+	// queries still running once the shutdown grace period is over.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
 
 	addr := fmt.Sprintf(":%d", cfg.Server.Port)
 	srv := &http.Server{
@@ -85,6 +224,7 @@ func main() {
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
 
 	go func() {
@@ -94,18 +234,45 @@ func main() {
 		}
 	}()
 
+	// SIGHUP reloads the configuration; requests in flight are unaffected.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("Received SIGHUP, reloading configuration")
+			_, _ = reloader.reload(context.Background())
+		}
+	}()
+
 	// Graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
+	signal.Stop(hup)
+
+	// Fail readiness first, and give load balancers time to notice, so that
+	// no new requests arrive once the server stops accepting connections.
+	handler.Drain()
+	if cfg.Server.ShutdownDelay > 0 {
+		logger.Info("Draining before shutdown", zap.Duration("delay", cfg.Server.ShutdownDelay))
+		time.Sleep(cfg.Server.ShutdownDelay)
+	}
 
 	logger.Info("Shutting down server...")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Error("Graceful shutdown failed", zap.Error(err))
+		cancelBase()
+	}
+
+	if tracer != nil {
+		if err := tracer.Shutdown(ctx); err != nil {
+			logger.Error("Failed to flush traces", zap.Error(err))
+		}
 	}
 
+	stopMonitors()
 	if dbConn != nil {
 		if err := dbConn.Close(); err != nil {
 			logger.Error("Failed to close PostgresStore connection", zap.Error(err))
@@ -113,6 +280,13 @@ func main() {
 			logger.Info("PostgresStore connection closed")
 		}
 	}
+	if fileStore != nil {
+		if err := fileStore.Close(); err != nil {
+			logger.Error("Failed to close FileStore", zap.Error(err))
+		} else {
+			logger.Info("FileStore closed")
+		}
+	}
 
 	logger.Info("Server stopped")
 }
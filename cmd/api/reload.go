@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+
+	api "github.com/animeshs34/transaction_routine/internal/api"
+	"github.com/animeshs34/transaction_routine/internal/config"
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/service"
+	"go.uber.org/zap"
+)
+
+// reloader re-reads the configuration on SIGHUP or POST /admin/reload and
+// applies the settings that can change while serving: the log level, rate
+// limits, velocity limits and feature toggles. Changes to any other setting are logged and
+// left for the next restart.
+type reloader struct {
+	path    string
+	flags   *flag.FlagSet
+	limiter *api.RateLimiter
+	svc     *service.Service
+
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+func (r *reloader) reload(ctx context.Context) (api.ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log := logger.FromContext(ctx)
+	next, err := config.Load(r.path, r.flags)
+	if err != nil {
+		log.Error("Configuration reload rejected", zap.Error(err))
+		return api.ReloadResult{}, err
+	}
+	// Check everything before applying anything, so a bad value cannot leave
+	// the settings half applied.
+	limits, err := velocityLimits(next)
+	if err != nil {
+		log.Error("Configuration reload rejected", zap.Error(err))
+		return api.ReloadResult{}, err
+	}
+
+	cfg := *r.cfg
+	applied, restart := cfg.Reload(next)
+	if err := logger.SetLevel(cfg.Logging.Level); err != nil {
+		log.Error("Configuration reload rejected", zap.Error(err))
+		return api.ReloadResult{}, err
+	}
+	r.limiter.SetLimit(cfg.RateLimit.RequestsPerSecond, cfg.RateLimit.Burst)
+	r.limiter.SetForwardedFor(cfg.RateLimit.TrustForwardedFor)
+	r.svc.SetVelocityLimits(limits)
+	r.svc.SetFeatures(features(&cfg))
+	r.cfg = &cfg
+
+	if len(restart) > 0 {
+		log.Warn("Configuration changes need a restart and were not applied", zap.Strings("settings", restart))
+	}
+	log.Info("Configuration reloaded", zap.Strings("applied", applied))
+	return api.ReloadResult{Applied: applied, RequiresRestart: restart}, nil
+}
+
+// velocityLimits returns the limits configured in cfg; none are enforced
+// when neither maximum is set.
+func velocityLimits(cfg *config.Config) (service.VelocityLimits, error) {
+	limits := service.VelocityLimits{Window: cfg.Velocity.Window, MaxDebits: cfg.Velocity.MaxDebits}
+	if cfg.Velocity.MaxAmount != "" {
+		var err error
+		if limits.MaxAmount, err = domain.ParseMoney(cfg.Velocity.MaxAmount, domain.DefaultCurrency); err != nil {
+			return service.VelocityLimits{}, err
+		}
+	}
+	return limits, nil
+}
+
+// features returns the feature toggles configured in cfg.
+func features(cfg *config.Config) service.Features {
+	return service.Features{
+		Installments:    cfg.Features.Installments,
+		Reversals:       cfg.Features.Reversals,
+		ForeignCurrency: cfg.Features.ForeignCurrency,
+	}
+}
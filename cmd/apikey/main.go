@@ -0,0 +1,118 @@
+// Command apikey manages the API keys clients authenticate with.
+//
+//	apikey [-config file] create -name <name> -scopes <scope,...>
+//	apikey [-config file] list
+//	apikey [-config file] revoke <id>
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/auth"
+	"github.com/animeshs34/transaction_routine/internal/config"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+)
+
+func main() {
+	configFile := flag.String("config", "", "config file path")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] create -name <name> -scopes <scope,...> | list | revoke <id>\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Scopes: %s\n", strings.Join(auth.Scopes, ", "))
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configFile, nil)
+	if err != nil {
+		fail("Failed to load configuration: %v", err)
+	}
+	// Keys in the memory store would be gone before the server could see them,
+	// and the file store is only read by the server when it starts.
+	if cfg.Database.Type != "postgres" {
+		fail("API keys can only be managed for database type postgres, got %q", cfg.Database.Type)
+	}
+
+	dbConn, err := respository.NewPostgresConn(
+		cfg.Database.Host,
+		cfg.Database.Port,
+		cfg.Database.User,
+		cfg.Database.Password,
+		cfg.Database.DBName,
+		cfg.Database.SSLMode,
+	)
+	if err != nil {
+		fail("Failed to connect to database: %v", err)
+	}
+	defer dbConn.Close()
+	store := respository.NewPostgresStore(dbConn)
+
+	ctx := context.Background()
+	switch action := flag.Arg(0); action {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		name := fs.String("name", "", "name of the client the key is for")
+		scopes := fs.String("scopes", "", "comma-separated scopes granted to the key")
+		fs.Parse(flag.Args()[1:])
+		if *name == "" || *scopes == "" {
+			fail("create needs -name and -scopes")
+		}
+		key, record, err := auth.GenerateAPIKey(*name, strings.Split(*scopes, ","))
+		if err != nil {
+			fail("Invalid key: %v", err)
+		}
+		created, err := store.CreateAPIKey(ctx, record)
+		if err != nil {
+			fail("Failed to create key: %v", err)
+		}
+		fmt.Printf("Created key %d for %s\n", created.ID, created.Name)
+		fmt.Printf("%s\n", key)
+		fmt.Fprintln(os.Stderr, "Store the key now; it cannot be shown again.")
+	case "list":
+		keys, err := store.ListAPIKeys(ctx)
+		if err != nil {
+			fail("Failed to list keys: %v", err)
+		}
+		for _, k := range keys {
+			state := "active"
+			if k.Revoked() {
+				state = "revoked " + k.RevokedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-20s  trk_%s  %-45s  %s\n", k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","), state)
+		}
+	case "revoke":
+		if flag.NArg() != 2 {
+			fail("revoke needs a key id")
+		}
+		id, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		if err != nil || id <= 0 {
+			fail("Invalid key id %q", flag.Arg(1))
+		}
+		revoked, err := store.RevokeAPIKey(ctx, id, time.Now())
+		if errors.Is(err, respository.ErrAPIKeyNotFound) {
+			fail("No key with id %d", id)
+		}
+		if err != nil {
+			fail("Failed to revoke key: %v", err)
+		}
+		fmt.Printf("Revoked key %d (%s)\n", revoked.ID, revoked.Name)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
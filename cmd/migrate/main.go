@@ -0,0 +1,117 @@
+// Command migrate manages the Postgres schema.
+//
+//	migrate [-config file] up
+//	migrate [-config file] down [steps]
+//	migrate [-config file] status
+//	migrate [-config file] force <version>
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/animeshs34/transaction_routine/internal/config"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+)
+
+func main() {
+	configFile := flag.String("config", "", "config file path")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] up | down [steps] | status | force <version>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configFile, nil)
+	if err != nil {
+		fail("Failed to load configuration: %v", err)
+	}
+	if cfg.Database.Type != "postgres" {
+		fail("Migrations only apply to database type postgres, got %q", cfg.Database.Type)
+	}
+
+	dbConn, err := respository.NewPostgresConn(
+		cfg.Database.Host,
+		cfg.Database.Port,
+		cfg.Database.User,
+		cfg.Database.Password,
+		cfg.Database.DBName,
+		cfg.Database.SSLMode,
+		respository.WithConnectRetry(cfg.Database.ConnectAttempts, cfg.Database.ConnectBackoff, cfg.Database.ConnectMaxBackoff),
+	)
+	if err != nil {
+		fail("Failed to connect to database: %v", err)
+	}
+	defer dbConn.Close()
+
+	m, err := respository.NewMigrator(dbConn.GetDB())
+	if err != nil {
+		fail("Failed to load migrations: %v", err)
+	}
+
+	ctx := context.Background()
+	switch action := flag.Arg(0); action {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			fail("Migration failed after %d applied: %v", n, err)
+		}
+		fmt.Printf("Applied %d migration(s)\n", n)
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			steps, err = strconv.Atoi(flag.Arg(1))
+			if err != nil || steps <= 0 {
+				fail("Invalid number of steps %q", flag.Arg(1))
+			}
+		}
+		if err := m.Down(ctx, steps); err != nil {
+			fail("Rollback failed: %v", err)
+		}
+		fmt.Printf("Rolled back %d migration(s)\n", steps)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			fail("Failed to read migration status: %v", err)
+		}
+		for _, st := range statuses {
+			state := "pending"
+			switch {
+			case st.Dirty:
+				state = "DIRTY"
+			case st.ChecksumMismatch:
+				state = "CHECKSUM MISMATCH"
+			case st.Applied:
+				state = "applied " + st.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-30s  %s\n", st.Version, st.Name, state)
+		}
+	case "force":
+		if flag.NArg() != 2 {
+			fail("force needs a version")
+		}
+		version, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		if err != nil || version < 0 {
+			fail("Invalid version %q", flag.Arg(1))
+		}
+		if err := m.Force(ctx, version); err != nil {
+			fail("Force failed: %v", err)
+		}
+		fmt.Printf("Forced schema version to %d\n", version)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"net/http"
+)
+
+// ReloadResult lists, by yaml key, the settings a configuration reload
+// changed and those it left alone because they need a restart.
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+// ReloadFunc re-reads the configuration and applies what it can. It returns
+// an error, and changes nothing, when the configuration is invalid.
+type ReloadFunc func(ctx context.Context) (ReloadResult, error)
+
+// WithReload serves POST /admin/reload, which calls fn.
+func WithReload(fn ReloadFunc) Option {
+	return func(h *Handler) {
+		h.reload = fn
+	}
+}
+
+func (h *Handler) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	res, err := h.reload(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "configuration rejected: "+err.Error())
+		return
+	}
+	if res.Applied == nil {
+		res.Applied = []string{}
+	}
+	if res.RequiresRestart == nil {
+		res.RequiresRestart = []string{}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/animeshs34/transaction_routine/internal/auth"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+)
+
+// routeScopes is the scope each endpoint requires, by method and route as
+// returned by routePattern. HEAD requests need the scope of GET.
+var routeScopes = map[string]string{
+	"POST /accounts":                      auth.ScopeAccountsWrite,
+	"GET /accounts/{id}":                  auth.ScopeAccountsRead,
+	"GET /accounts/{id}/transactions":     auth.ScopeTransactionsRead,
+	"POST /accounts/{id}/block":           auth.ScopeAccountsWrite,
+	"POST /accounts/{id}/unblock":         auth.ScopeAccountsWrite,
+	"POST /accounts/{id}/close":           auth.ScopeAccountsWrite,
+	"GET /accounts/{id}/status-history":   auth.ScopeAccountsRead,
+	"GET /transactions":                   auth.ScopeTransactionsRead,
+	"POST /transactions":                  auth.ScopeTransactionsWrite,
+	"GET /transactions/{id}":              auth.ScopeTransactionsRead,
+	"POST /transactions/{id}/reversal":    auth.ScopeTransactionsWrite,
+	"GET /transactions/{id}/installments": auth.ScopeTransactionsRead,
+	"GET /operation-types":                auth.ScopeOperationTypesRead,
+	"POST /operation-types":               auth.ScopeOperationTypesWrite,
+	"GET /operation-types/{id}":           auth.ScopeOperationTypesRead,
+	"PUT /operation-types/{id}":           auth.ScopeOperationTypesWrite,
+	"DELETE /operation-types/{id}":        auth.ScopeOperationTypesWrite,
+	"GET /metrics":                        auth.ScopeMetricsRead,
+	"POST /admin/reload":                  auth.ScopeConfigReload,
+}
+
+// knownRoutes are the routes of routeScopes, whatever the method.
+var knownRoutes = func() map[string]bool {
+	known := make(map[string]bool, len(routeScopes))
+	for key := range routeScopes {
+		_, route, _ := strings.Cut(key, " ")
+		known[route] = true
+	}
+	return known
+}()
+
+// publicRoutes are the health checks, served without credentials or rate
+// limits.
+var publicRoutes = map[string]bool{
+	"/healthz": true,
+	"/livez":   true,
+	"/readyz":  true,
+}
+
+// Authenticate rejects requests without valid credentials with 401, and
+// those whose principal lacks the scope of the route with 403. Methods a
+// route does not support only need to be authenticated, and then get their
+// 405. Paths routePattern does not recognise get 404 here rather than reach
+// a handler that might serve them, such as /accounts/1/, unchecked.
+func Authenticate(a *auth.Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routePattern(r.URL.Path)
+			if publicRoutes[route] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, err := a.Authenticate(r.Context(), r)
+			if err != nil {
+				if errors.Is(err, auth.ErrUnauthenticated) {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="transaction_routine"`)
+					writeError(w, http.StatusUnauthorized, err.Error())
+					return
+				}
+				writeInternalError(w, err, "could not authenticate request")
+				return
+			}
+			tracing.SpanFromContext(r.Context()).SetAttributes(tracing.String("enduser.id", p.Subject))
+
+			method := r.Method
+			if method == http.MethodHead {
+				method = http.MethodGet
+			}
+			scope, ok := routeScopes[method+" "+route]
+			if !ok && !knownRoutes[route] {
+				http.NotFound(w, r)
+				return
+			}
+			if ok && !p.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="transaction_routine", error="insufficient_scope", scope=%q`, scope))
+				writeError(w, http.StatusForbidden, fmt.Sprintf("missing scope %s", scope))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), p)))
+		})
+	}
+}
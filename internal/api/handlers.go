@@ -1,44 +1,98 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
 	"github.com/animeshs34/transaction_routine/internal/respository"
 	"github.com/animeshs34/transaction_routine/internal/service"
 )
 
 type Handler struct {
 	svc *service.Service
+
+	idempotencyStore respository.IdempotencyStore
+	idempotencyTTL   time.Duration
+	idempotencyLease time.Duration
+
+	metrics *metrics.Registry
+	reload  ReloadFunc
+
+	ready    func(ctx context.Context) error
+	draining atomic.Bool
 }
 
-func New(svc *service.Service) *Handler {
-	return &Handler{svc: svc}
+type Option func(*Handler)
+
+// WithIdempotency enables Idempotency-Key handling on the POST endpoints,
+// keeping responses for ttl and reserving keys for requests in flight for
+// lease.
+func WithIdempotency(store respository.IdempotencyStore, ttl, lease time.Duration) Option {
+	return func(h *Handler) {
+		h.idempotencyStore = store
+		h.idempotencyTTL = ttl
+		h.idempotencyLease = lease
+	}
+}
+
+func New(svc *service.Service, opts ...Option) *Handler {
+	h := &Handler{svc: svc}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *Handler) Router() http.Handler {
 	mux := http.NewServeMux()
 
 	// Accounts
-	mux.HandleFunc("/accounts", h.accountsRoot) // POST
-	mux.HandleFunc("/accounts/", h.accountsOne) // GET /accounts/{id}
+	mux.Handle("/accounts", h.idempotent(h.accountsRoot)) // POST
+	mux.Handle("/accounts/", h.idempotent(h.accountsOne)) // GET /accounts/{id}, GET /accounts/{id}/transactions, POST /accounts/{id}/{block,unblock,close}, GET /accounts/{id}/status-history
 
 	// Transactions
-	mux.HandleFunc("/transactions", h.transactionsRoot) // POST
+	mux.Handle("/transactions", h.idempotent(h.transactionsRoot)) // POST, GET
+	mux.Handle("/transactions/", h.idempotent(h.transactionsOne)) // GET /transactions/{id}, POST /transactions/{id}/reversal
+
+	// Operation types
+	mux.Handle("/operation-types", h.idempotent(h.operationTypesRoot)) // GET, POST
+	mux.HandleFunc("/operation-types/", h.operationTypesOne)           // GET, PUT, DELETE /operation-types/{id}
 
-	// Health - this is probing endpoints
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-	})
+	// Health - this is probing endpoints. /healthz is the liveness probe
+	// under its old name.
+	mux.HandleFunc("/livez", h.livez)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/healthz", h.livez)
+
+	if h.metrics != nil {
+		mux.Handle("/metrics", h.metrics.Handler())
+	}
+	if h.reload != nil {
+		mux.HandleFunc("/admin/reload", h.reloadConfig) // POST
+	}
 
 	return mux
 }
 
+func (h *Handler) idempotent(fn http.HandlerFunc) http.Handler {
+	if h.idempotencyStore == nil {
+		return fn
+	}
+	return Idempotency(h.idempotencyStore, h.idempotencyTTL, h.idempotencyLease)(fn)
+}
+
 func (h *Handler) accountsRoot(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
@@ -49,36 +103,152 @@ func (h *Handler) accountsRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) accountsOne(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		// /accounts/{id}
-		idStr := strings.TrimPrefix(r.URL.Path, "/accounts/")
-		if idStr == "" || strings.Contains(idStr, "/") {
-			http.NotFound(w, r)
-			return
+	// /accounts/{id}, /accounts/{id}/transactions, /accounts/{id}/status-history
+	// or /accounts/{id}/{block,unblock,close}
+	idStr, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/")
+	if idStr == "" || strings.Contains(sub, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch sub {
+	case "":
+		h.getAccount(w, r, idStr)
+	case "transactions":
+		h.accountTransactions(w, r, idStr)
+	case "block", "unblock", "close":
+		h.changeAccountStatus(w, r, idStr, sub)
+	case "status-history":
+		h.accountStatusHistory(w, r, idStr)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type accountStatusRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *Handler) changeAccountStatus(w http.ResponseWriter, r *http.Request, idStr, action string) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	id, ok := parseAccountID(w, idStr)
+	if !ok {
+		return
+	}
+	var req accountStatusRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var (
+		acc domain.Account
+		err error
+	)
+	switch action {
+	case "block":
+		acc, err = h.svc.BlockAccount(r.Context(), id, req.Reason)
+	case "unblock":
+		acc, err = h.svc.UnblockAccount(r.Context(), id, req.Reason)
+	case "close":
+		acc, err = h.svc.CloseAccount(r.Context(), id, req.Reason)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, respository.ErrAccountNotFound):
+			writeError(w, http.StatusNotFound, "account not found")
+		case errors.Is(err, domain.ErrStatusReasonRequired):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, domain.ErrInvalidStatusTransition), errors.Is(err, domain.ErrAccountHasBalance):
+			writeError(w, http.StatusConflict, err.Error())
+		default:
+			writeInternalError(w, err, "could not change account status")
 		}
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil || id <= 0 {
-			writeError(w, http.StatusBadRequest, "invalid account id")
+		return
+	}
+	writeJSON(w, http.StatusOK, acc)
+}
+
+func (h *Handler) accountStatusHistory(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id, ok := parseAccountID(w, idStr)
+	if !ok {
+		return
+	}
+	changes, err := h.svc.ListAccountStatusChanges(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, respository.ErrAccountNotFound) {
+			writeError(w, http.StatusNotFound, "account not found")
 			return
 		}
-		acc, err := h.svc.GetAccount(id)
-		if err != nil {
-			if errors.Is(err, respository.ErrAccountNotFound) {
-				writeError(w, http.StatusNotFound, "account not found")
-				return
-			}
-			writeError(w, http.StatusInternalServerError, "could not get account")
+		writeInternalError(w, err, "could not list status changes")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]domain.AccountStatusChange{"status_changes": changes})
+}
+
+func (h *Handler) getAccount(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id, ok := parseAccountID(w, idStr)
+	if !ok {
+		return
+	}
+	acc, err := h.svc.GetAccount(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, respository.ErrAccountNotFound) {
+			writeError(w, http.StatusNotFound, "account not found")
 			return
 		}
-		writeJSON(w, http.StatusOK, acc)
-	default:
+		writeInternalError(w, err, "could not get account")
+		return
+	}
+	writeJSON(w, http.StatusOK, acc)
+}
+
+func (h *Handler) accountTransactions(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
 		methodNotAllowed(w, http.MethodGet)
+		return
 	}
+	id, ok := parseAccountID(w, idStr)
+	if !ok {
+		return
+	}
+	f, err := parseTransactionFilter(r.URL.Query(), false)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := h.svc.ListAccountTransactions(r.Context(), id, f)
+	if err != nil {
+		writeListError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTransactionPageResponse(page))
+}
+
+func parseAccountID(w http.ResponseWriter, idStr string) (int64, bool) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid account id")
+		return 0, false
+	}
+	return id, true
 }
 
 type createAccountRequest struct {
-	DocumentNumber string `json:"document_number"`
+	DocumentType   string       `json:"document_type,omitempty"` // optional; CPF or CNPJ inferred from length
+	DocumentNumber string       `json:"document_number"`
+	Currency       string       `json:"currency,omitempty"`     // optional; BRL when omitted
+	CreditLimit    *json.Number `json:"credit_limit,omitempty"` // optional; service default when omitted
 }
 
 func (h *Handler) createAccount(w http.ResponseWriter, r *http.Request) {
@@ -87,23 +257,76 @@ func (h *Handler) createAccount(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	acc, err := h.svc.CreateAccount(req.DocumentNumber)
-	if err != nil {
-		if errors.Is(err, service.ErrInvalidDocument) {
+	currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+	if currency == "" {
+		currency = domain.DefaultCurrency
+	}
+	var limit *domain.Money
+	if req.CreditLimit != nil {
+		parsed, err := domain.ParseMoney(req.CreditLimit.String(), currency)
+		if err != nil {
 			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		writeError(w, http.StatusInternalServerError, "could not create account")
+		limit = &parsed
+	}
+	acc, err := h.svc.CreateAccount(r.Context(), req.DocumentType, req.DocumentNumber, currency, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidDocument),
+			errors.Is(err, service.ErrUnsupportedDocumentType),
+			errors.Is(err, domain.ErrInvalidCurrency),
+			errors.Is(err, service.ErrInvalidCreditLimit):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, respository.ErrDuplicateDocument):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, service.ErrRateUnavailable):
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+		default:
+			writeInternalError(w, err, "could not create account")
+		}
 		return
 	}
 	writeJSON(w, http.StatusCreated, acc)
 }
 
 type createTransactionRequest struct {
-	AccountID       int64   `json:"account_id"`
-	OperationTypeID int     `json:"operation_type_id"`
-	Amount          float64 `json:"amount"`
-	EventDate       *string `json:"event_date,omitempty"` // optional; RFC3339
+	AccountID       int64       `json:"account_id"`
+	OperationTypeID int         `json:"operation_type_id"`
+	Amount          json.Number `json:"amount"`               // number or decimal string
+	Currency        string      `json:"currency,omitempty"`   // optional; the account currency when omitted
+	EventDate       *string     `json:"event_date,omitempty"` // optional; RFC3339
+	// Installments and InterestRate (percent per month) only apply to
+	// installment purchases.
+	Installments int          `json:"installments,omitempty"`
+	InterestRate *json.Number `json:"interest_rate,omitempty"`
+}
+
+// installmentPlan validates the installment fields of req.
+func (req createTransactionRequest) installmentPlan() (service.InstallmentPlan, error) {
+	plan := service.InstallmentPlan{Count: req.Installments}
+	if req.OperationTypeID != domain.OpInstallmentPurchase {
+		if req.Installments != 0 || req.InterestRate != nil {
+			return plan, errors.New("installments and interest_rate require an installment purchase")
+		}
+		return plan, nil
+	}
+	// Without installments this is a plain purchase, so a negative count or
+	// a rate would otherwise be dropped silently.
+	if req.Installments < 0 {
+		return plan, service.ErrInvalidInstallments
+	}
+	if req.InterestRate != nil && req.Installments == 0 {
+		return plan, fmt.Errorf("%w; it requires installments", service.ErrInvalidInterestRate)
+	}
+	if req.InterestRate != nil {
+		rate, ok := new(big.Rat).SetString(req.InterestRate.String())
+		if !ok {
+			return plan, service.ErrInvalidInterestRate
+		}
+		plan.MonthlyRate = rate.Quo(rate, big.NewRat(100, 1))
+	}
+	return plan, nil
 }
 
 func (h *Handler) transactionsRoot(w http.ResponseWriter, r *http.Request) {
@@ -123,8 +346,39 @@ func (h *Handler) transactionsRoot(w http.ResponseWriter, r *http.Request) {
 			}
 			t = &parsed
 		}
+		currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+		if currency == "" {
+			acc, err := h.svc.GetAccount(r.Context(), req.AccountID)
+			if err != nil {
+				if errors.Is(err, respository.ErrAccountNotFound) {
+					writeError(w, http.StatusNotFound, "account not found")
+					return
+				}
+				writeInternalError(w, err, "could not create transaction")
+				return
+			}
+			currency = acc.Currency
+		} else if !domain.ValidCurrency(currency) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%v: %q", domain.ErrInvalidCurrency, currency))
+			return
+		}
+		amount, err := domain.ParseMoney(req.Amount.String(), currency)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		plan, err := req.installmentPlan()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		tx, err := h.svc.CreateTransaction(req.AccountID, req.OperationTypeID, req.Amount, t)
+		var tx service.TransactionResult
+		if plan.Count > 0 {
+			tx, err = h.svc.CreateInstallmentPurchase(r.Context(), req.AccountID, amount, t, plan)
+		} else {
+			tx, err = h.svc.CreateTransaction(r.Context(), req.AccountID, req.OperationTypeID, amount, t)
+		}
 		if err != nil {
 			switch {
 			case errors.Is(err, respository.ErrAccountNotFound):
@@ -133,15 +387,402 @@ func (h *Handler) transactionsRoot(w http.ResponseWriter, r *http.Request) {
 				writeError(w, http.StatusBadRequest, "invalid operation_type_id")
 			case errors.Is(err, service.ErrInvalidAmount):
 				writeError(w, http.StatusBadRequest, "amount must be greater than zero")
+			case errors.Is(err, service.ErrInvalidInstallments), errors.Is(err, service.ErrInvalidInterestRate):
+				writeError(w, http.StatusBadRequest, err.Error())
+			case errors.Is(err, domain.ErrAmountOutOfRange), errors.Is(err, domain.ErrOutsideAllowedHours),
+				errors.Is(err, domain.ErrMoneyOverflow):
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+			case errors.Is(err, domain.ErrCurrencyMismatch), errors.Is(err, service.ErrRateUnavailable):
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+			case errors.Is(err, service.ErrFeatureDisabled):
+				writeError(w, http.StatusForbidden, err.Error())
+			case errors.Is(err, domain.ErrInsufficientBalance), errors.Is(err, domain.ErrAccountBlocked):
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+			case errors.Is(err, service.ErrVelocityLimitExceeded):
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+			case errors.Is(err, domain.ErrAccountClosed):
+				writeError(w, http.StatusConflict, err.Error())
 			default:
-				writeError(w, http.StatusInternalServerError, "could not create transaction")
+				writeInternalError(w, err, "could not create transaction")
 			}
 			return
 		}
 		writeJSON(w, http.StatusCreated, tx)
+	case http.MethodGet:
+		f, err := parseTransactionFilter(r.URL.Query(), true)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err := h.svc.ListTransactions(r.Context(), f)
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newTransactionPageResponse(page))
 	default:
+		methodNotAllowed(w, http.MethodPost, http.MethodGet)
+	}
+}
+
+func (h *Handler) transactionsOne(w http.ResponseWriter, r *http.Request) {
+	// /transactions/{id}, /transactions/{id}/reversal or
+	// /transactions/{id}/installments
+	idStr, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/transactions/"), "/")
+	if idStr == "" || strings.Contains(sub, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch sub {
+	case "":
+		h.getTransaction(w, r, idStr)
+	case "reversal":
+		h.reverseTransaction(w, r, idStr)
+	case "installments":
+		h.listInstallments(w, r, idStr)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) getTransaction(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id, ok := parseTransactionID(w, idStr)
+	if !ok {
+		return
+	}
+	tx, err := h.svc.GetTransaction(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, respository.ErrTransactionNotFound) {
+			writeError(w, http.StatusNotFound, "transaction not found")
+			return
+		}
+		writeInternalError(w, err, "could not get transaction")
+		return
+	}
+	writeJSON(w, http.StatusOK, tx)
+}
+
+func (h *Handler) listInstallments(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id, ok := parseTransactionID(w, idStr)
+	if !ok {
+		return
+	}
+	installments, err := h.svc.ListInstallments(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, respository.ErrTransactionNotFound):
+			writeError(w, http.StatusNotFound, "transaction not found")
+		case errors.Is(err, service.ErrNotInstallmentPlan):
+			writeError(w, http.StatusNotFound, err.Error())
+		default:
+			writeInternalError(w, err, "could not list installments")
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]domain.Transaction{"installments": installments})
+}
+
+type reverseTransactionRequest struct {
+	Amount    *json.Number `json:"amount,omitempty"`     // optional; everything not yet reversed when omitted
+	EventDate *string      `json:"event_date,omitempty"` // optional; RFC3339
+}
+
+func (h *Handler) reverseTransaction(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodPost {
 		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	id, ok := parseTransactionID(w, idStr)
+	if !ok {
+		return
+	}
+	// The body is optional; without one, chunked or not, everything left is
+	// reversed.
+	var req reverseTransactionRequest
+	if err := decodeJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var amount *domain.Money
+	if req.Amount != nil {
+		// Partial reversals are given in the currency of the original.
+		original, err := h.svc.GetTransaction(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, respository.ErrTransactionNotFound) {
+				writeError(w, http.StatusNotFound, "transaction not found")
+				return
+			}
+			writeInternalError(w, err, "could not reverse transaction")
+			return
+		}
+		parsed, err := domain.ParseMoney(req.Amount.String(), original.Amount.Currency())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		amount = &parsed
+	}
+	var t *time.Time
+	if req.EventDate != nil && *req.EventDate != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, *req.EventDate)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid event_date; must be RFC3339")
+			return
+		}
+		t = &parsed
+	}
+
+	reversal, err := h.svc.ReverseTransaction(r.Context(), id, amount, t)
+	if err != nil {
+		switch {
+		case errors.Is(err, respository.ErrTransactionNotFound):
+			writeError(w, http.StatusNotFound, "transaction not found")
+		case errors.Is(err, service.ErrInvalidAmount):
+			writeError(w, http.StatusBadRequest, "amount must be greater than zero")
+		case errors.Is(err, service.ErrAlreadyReversed), errors.Is(err, domain.ErrAccountClosed):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, service.ErrFeatureDisabled):
+			writeError(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, service.ErrNotReversible),
+			errors.Is(err, service.ErrInstallmentNotReversible),
+			errors.Is(err, service.ErrPartialInstallmentReversal),
+			errors.Is(err, service.ErrReversalExceedsOriginal),
+			errors.Is(err, domain.ErrInsufficientBalance),
+			errors.Is(err, domain.ErrAccountBlocked):
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+		default:
+			writeInternalError(w, err, "could not reverse transaction")
+		}
+		return
+	}
+	writeJSON(w, http.StatusCreated, reversal)
+}
+
+func parseTransactionID(w http.ResponseWriter, idStr string) (int64, bool) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid transaction id")
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *Handler) operationTypesRoot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		types, err := h.svc.ListOperationTypes(r.Context())
+		if err != nil {
+			writeInternalError(w, err, "could not list operation types")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]domain.OperationType{"operation_types": types})
+	case http.MethodPost:
+		ot, ok := decodeOperationType(w, r)
+		if !ok {
+			return
+		}
+		created, err := h.svc.CreateOperationType(r.Context(), ot)
+		if err != nil {
+			writeOperationTypeError(w, err, "could not create operation type")
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (h *Handler) operationTypesOne(w http.ResponseWriter, r *http.Request) {
+	// /operation-types/{id}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/operation-types/"))
+	if err != nil || id <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid operation type id")
+		return
+	}
+	var ot domain.OperationType
+	switch r.Method {
+	case http.MethodGet:
+		ot, err = h.svc.GetOperationType(r.Context(), id)
+	case http.MethodPut:
+		var ok bool
+		if ot, ok = decodeOperationType(w, r); !ok {
+			return
+		}
+		ot.ID = id
+		ot, err = h.svc.UpdateOperationType(r.Context(), ot)
+	case http.MethodDelete:
+		ot, err = h.svc.DeactivateOperationType(r.Context(), id)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+	if err != nil {
+		writeOperationTypeError(w, err, "could not process operation type")
+		return
+	}
+	writeJSON(w, http.StatusOK, ot)
+}
+
+type operationTypeRequest struct {
+	Description  string             `json:"description"`
+	Direction    string             `json:"direction"`
+	MinAmount    *json.Number       `json:"min_amount,omitempty"`
+	MaxAmount    *json.Number       `json:"max_amount,omitempty"`
+	AllowedHours *domain.HourWindow `json:"allowed_hours,omitempty"`
+	Active       *bool              `json:"active,omitempty"` // PUT only; defaults to true
+}
+
+// decodeOperationType reads an operationTypeRequest, writing a 400 and
+// returning false when it is malformed.
+func decodeOperationType(w http.ResponseWriter, r *http.Request) (domain.OperationType, bool) {
+	var req operationTypeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return domain.OperationType{}, false
+	}
+	ot := domain.OperationType{
+		Description:  req.Description,
+		Direction:    strings.ToLower(strings.TrimSpace(req.Direction)),
+		AllowedHours: req.AllowedHours,
+		Active:       req.Active == nil || *req.Active,
+	}
+	for _, f := range []struct {
+		name string
+		in   *json.Number
+		out  **domain.Money
+	}{{"min_amount", req.MinAmount, &ot.MinAmount}, {"max_amount", req.MaxAmount, &ot.MaxAmount}} {
+		if f.in == nil {
+			continue
+		}
+		// Limits are set in the default currency and converted into each
+		// account's when checked.
+		m, err := domain.ParseMoney(f.in.String(), domain.DefaultCurrency)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %v", f.name, err))
+			return domain.OperationType{}, false
+		}
+		*f.out = &m
 	}
+	return ot, true
+}
+
+func writeOperationTypeError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, respository.ErrOperationTypeNotFound):
+		writeError(w, http.StatusNotFound, "operation type not found")
+	case errors.Is(err, service.ErrInvalidOperationTypeDefinition):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeInternalError(w, err, msg)
+	}
+}
+
+type transactionPageResponse struct {
+	Transactions []domain.Transaction `json:"transactions"`
+	NextCursor   string               `json:"next_cursor,omitempty"`
+}
+
+func newTransactionPageResponse(page respository.TransactionPage) transactionPageResponse {
+	resp := transactionPageResponse{Transactions: page.Transactions}
+	if resp.Transactions == nil {
+		resp.Transactions = []domain.Transaction{}
+	}
+	if page.Next != nil {
+		resp.NextCursor = page.Next.String()
+	}
+	return resp
+}
+
+func writeListError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, respository.ErrAccountNotFound):
+		writeError(w, http.StatusNotFound, "account not found")
+	case errors.Is(err, service.ErrInvalidFilter):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeInternalError(w, err, "could not list transactions")
+	}
+}
+
+// parseTransactionFilter reads the listing query parameters. account_id is
+// only honoured when allowAccount is set; the per-account route takes it from
+// the path instead.
+func parseTransactionFilter(q url.Values, allowAccount bool) (respository.TransactionFilter, error) {
+	var f respository.TransactionFilter
+	if v := q.Get("account_id"); v != "" && allowAccount {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return f, errors.New("invalid account_id")
+		}
+		f.AccountID = &id
+	}
+	if v := q.Get("operation_type_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return f, errors.New("invalid operation_type_id")
+		}
+		f.OperationTypeID = &id
+	}
+	currency := domain.DefaultCurrency
+	if v := q.Get("currency"); v != "" {
+		if currency = strings.ToUpper(v); !domain.ValidCurrency(currency) {
+			return f, errors.New("invalid currency")
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  **domain.Money
+	}{{"min_amount", &f.MinAmount}, {"max_amount", &f.MaxAmount}} {
+		if v := q.Get(p.name); v != "" {
+			m, err := domain.ParseMoney(v, currency)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s: %w", p.name, err)
+			}
+			*p.dst = &m
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := q.Get(p.name); v != "" {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s; must be RFC3339", p.name)
+			}
+			*p.dst = &ts
+		}
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		f.Descending = true
+	default:
+		return f, errors.New("invalid order; must be asc or desc")
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := respository.ParseCursor(v)
+		if err != nil {
+			return f, err
+		}
+		f.After = &c
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return f, errors.New("invalid limit")
+		}
+		f.Limit = n
+	}
+	return f, nil
 }
 
 // Helpers
@@ -164,8 +805,30 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 	_ = enc.Encode(payload)
 }
 
+// writeError writes {"error": msg}, with the request_id set by RequestID.
 func writeError(w http.ResponseWriter, status int, msg string) {
-	writeJSON(w, status, map[string]string{"error": msg})
+	body := map[string]string{"error": msg}
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	writeJSON(w, status, body)
+}
+
+// StatusClientClosedRequest is the non-standard code (from nginx) recorded when
+// the client disconnects before the response is ready.
+const StatusClientClosedRequest = 499
+
+// writeInternalError reports an unexpected error, telling deadline and
+// cancellation apart from genuine failures.
+func writeInternalError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "request timed out")
+	case errors.Is(err, context.Canceled):
+		writeError(w, StatusClientClosedRequest, "request cancelled")
+	default:
+		writeError(w, http.StatusInternalServerError, msg)
+	}
 }
 
 func methodNotAllowed(w http.ResponseWriter, methods ...string) {
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"go.uber.org/zap"
+)
+
+// readinessTimeout bounds the store check behind /readyz, so that a hung
+// database fails the probe rather than the probe timing out.
+const readinessTimeout = 2 * time.Second
+
+// WithReadiness makes /readyz fail while check does, e.g. while the database
+// cannot be reached.
+func WithReadiness(check func(ctx context.Context) error) Option {
+	return func(h *Handler) {
+		h.ready = check
+	}
+}
+
+// Drain makes /readyz fail from now on, so that load balancers stop sending
+// requests before the server shuts down. Requests are still served.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// livez reports that the process is up and serving. It checks nothing else,
+// so an orchestrator does not restart the service when the database fails.
+func (h *Handler) livez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the service should receive traffic: it is not
+// shutting down and its store is reachable.
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if h.ready != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		if err := h.ready(ctx); err != nil {
+			// The probe is public; the cause only goes to the log.
+			logger.FromContext(r.Context()).Warn("Readiness check failed", zap.Error(err))
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
@@ -1,12 +1,34 @@
 package api_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/animeshs34/transaction_routine/internal/api"
+	"github.com/animeshs34/transaction_routine/internal/auth"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/animeshs34/transaction_routine/internal/service"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+func newTestRouter() http.Handler {
+	return api.New(service.New(respository.NewInMemoryStore())).Router()
+}
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
 // Unit test: Recoverer should convert a panic into 500 and not crash the server.
 func TestRecoverer_PanicReturns500(t *testing.T) {
 	panicHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -24,3 +46,795 @@ func TestRecoverer_PanicReturns500(t *testing.T) {
 		t.Fatalf("expected status 500; got %d", w.Code)
 	}
 }
+
+// Amounts are exact decimals: strings and numbers are both accepted, sub-cent values are rejected.
+func TestCreateTransaction_AmountScale(t *testing.T) {
+	h := newTestRouter()
+	if w := do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create account: %d %s", w.Code, w.Body)
+	}
+
+	w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":"0.10"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"amount":0.10`) {
+		t.Fatalf("string amount: %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":0.105}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for sub-cent amount; got %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":1.5e1}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"amount":15.00`) {
+		t.Fatalf("exponent amount: %d %s", w.Code, w.Body)
+	}
+}
+
+// A debit beyond the available balance is rejected with 422 and leaves the balance untouched.
+func TestCreateTransaction_InsufficientBalance(t *testing.T) {
+	h := newTestRouter()
+	if w := do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"50.00"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create account: %d %s", w.Code, w.Body)
+	}
+
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":50.01}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":20}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201; got %d %s", w.Code, w.Body)
+	}
+
+	w := do(h, http.MethodGet, "/accounts/1", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"available_balance":30.00`) {
+		t.Fatalf("get account: %d %s", w.Code, w.Body)
+	}
+}
+
+// A payment settles the oldest open debits first and reports what it settled.
+func TestCreateTransaction_PaymentSettlesDebits(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":50,"event_date":"2024-01-01T10:00:00Z"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":3,"amount":20,"event_date":"2024-01-02T10:00:00Z"}`)
+
+	w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":60}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("payment: %d %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`"balance":0.00`,
+		`"settlements":[{"transaction_id":1,"amount":50.00},{"transaction_id":2,"amount":10.00}]`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in %s", want, body)
+		}
+	}
+}
+
+// Listings filter, paginate with an opaque cursor and 404 for unknown accounts.
+func TestListTransactions(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":10,"event_date":"2024-01-01T10:00:00Z"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":3,"amount":20,"event_date":"2024-01-02T10:00:00Z"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":5,"event_date":"2024-01-03T10:00:00Z"}`)
+
+	var page struct {
+		Transactions []struct {
+			ID int64 `json:"transaction_id"`
+		} `json:"transactions"`
+		NextCursor string `json:"next_cursor"`
+	}
+	w := do(h, http.MethodGet, "/accounts/1/transactions?limit=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Transactions) != 2 || page.NextCursor == "" {
+		t.Fatalf("first page: %s", w.Body)
+	}
+	w = do(h, http.MethodGet, "/accounts/1/transactions?limit=2&cursor="+page.NextCursor, "")
+	page.NextCursor = ""
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Transactions) != 1 || page.Transactions[0].ID != 3 || page.NextCursor != "" {
+		t.Fatalf("second page: %s", w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/transactions?operation_type_id=3&from=2024-01-02T00:00:00Z", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"transaction_id":2`) || strings.Contains(w.Body.String(), `"transaction_id":1`) {
+		t.Fatalf("filtered list: %d %s", w.Code, w.Body)
+	}
+
+	if w := do(h, http.MethodGet, "/transactions?min_amount=abc", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad min_amount; got %d", w.Code)
+	}
+	if w := do(h, http.MethodGet, "/accounts/99/transactions", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown account; got %d", w.Code)
+	}
+	if w := do(h, http.MethodGet, "/transactions?account_id=99", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"transactions":[]`) {
+		t.Fatalf("expected empty list; got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGetTransactionAndOperationTypes(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":5}`)
+
+	if w := do(h, http.MethodGet, "/transactions/1", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"amount":5.00`) {
+		t.Fatalf("get transaction: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/transactions/2", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404; got %d", w.Code)
+	}
+	if w := do(h, http.MethodGet, "/transactions/abc", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400; got %d", w.Code)
+	}
+
+	w := do(h, http.MethodGet, "/operation-types", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `{"id":4,"description":"PAYMENT","direction":"credit","active":true}`) {
+		t.Fatalf("operation types: %d %s", w.Code, w.Body)
+	}
+}
+
+// A request past its deadline gets 504 rather than a generic 500.
+func TestRequestTimeout_Returns504(t *testing.T) {
+	h := api.Chain(newTestRouter(), api.RequestTimeout(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	w := do(h, http.MethodGet, "/operation-types", "")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504; got %d %s", w.Code, w.Body)
+	}
+}
+
+// A client that hung up is reported as 499, not as a server failure.
+func TestCancelledRequest_Returns499(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/accounts", strings.NewReader(`{"document_number":"52998224725"}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	newTestRouter().ServeHTTP(w, req)
+	if w.Code != api.StatusClientClosedRequest {
+		t.Fatalf("expected 499; got %d %s", w.Code, w.Body)
+	}
+}
+
+// Documents are validated, normalised and may open only one account.
+func TestCreateAccount_DocumentRules(t *testing.T) {
+	h := newTestRouter()
+	w := do(h, http.MethodPost, "/accounts", `{"document_number":"529.982.247-25"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"document_number":"52998224725"`) {
+		t.Fatalf("create account: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/accounts", `{"document_type":"CPF","document_number":"52998224725"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for duplicate document; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/accounts", `{"document_number":"abc"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid document; got %d %s", w.Code, w.Body)
+	}
+}
+
+// Reversals compensate the original, may be partial and never exceed it.
+func TestReverseTransaction(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"40.00"}`)
+
+	w := do(h, http.MethodPost, "/transactions/1/reversal", `{"amount":"15.00"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"reverses_transaction_id":1`) || !strings.Contains(w.Body.String(), `"operation_type_id":5`) {
+		t.Fatalf("partial reversal: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions/1/reversal", `{"amount":"30.00"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 reversing more than is left; got %d %s", w.Code, w.Body)
+	}
+	// An empty chunked body, of unknown length, is no body too.
+	req := httptest.NewRequest(http.MethodPost, "/transactions/1/reversal", strings.NewReader(""))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("full reversal: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions/1/reversal", ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 reversing twice; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/accounts/1", ""); !strings.Contains(w.Body.String(), `"available_balance":100.00`) {
+		t.Fatalf("expected available balance restored: %s", w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions/2/reversal", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 reversing a reversal; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":5,"amount":"1.00"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for direct refund; got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestInstallmentPurchase(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"200.00"}`)
+
+	w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":2,"amount":"100.00","installments":3}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create installment purchase: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		InstallmentCount int `json:"installment_count"`
+		Installments     []struct {
+			Amount            json.Number `json:"amount"`
+			InstallmentNumber int         `json:"installment_number"`
+		} `json:"installments"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.InstallmentCount != 3 || len(res.Installments) != 3 || res.Installments[2].Amount != "-33.34" {
+		t.Fatalf("unexpected schedule: %s", w.Body)
+	}
+	if w := do(h, http.MethodGet, "/accounts/1", ""); !strings.Contains(w.Body.String(), `"available_balance":166.67`) {
+		t.Fatalf("expected only the first installment posted: %s", w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/transactions/1/installments", "")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"parent_transaction_id":1`) != 3 {
+		t.Fatalf("list installments: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/transactions/2/installments", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an installment itself; got %d %s", w.Code, w.Body)
+	}
+
+	for _, body := range []string{
+		`{"account_id":1,"operation_type_id":2,"amount":"10.00","installments":1}`,
+		`{"account_id":1,"operation_type_id":2,"amount":"10.00","installments":3,"interest_rate":"abc"}`,
+		`{"account_id":1,"operation_type_id":2,"amount":"10.00","installments":-3}`,
+		`{"account_id":1,"operation_type_id":2,"amount":"10.00","interest_rate":"1.5"}`,
+		`{"account_id":1,"operation_type_id":1,"amount":"10.00","installments":3}`,
+	} {
+		if w := do(h, http.MethodPost, "/transactions", body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s; got %d %s", body, w.Code, w.Body)
+		}
+	}
+}
+
+func TestOperationTypeAdmin(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+
+	w := do(h, http.MethodPost, "/operation-types", `{"description":"fee","direction":"debit","max_amount":"5.00"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"id":100`) || !strings.Contains(w.Body.String(), `"description":"FEE"`) {
+		t.Fatalf("create operation type: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/operation-types", `{"description":"fee","direction":"up"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown direction; got %d %s", w.Code, w.Body)
+	}
+
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":100,"amount":"3.00"}`); w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"amount":-3.00`) {
+		t.Fatalf("expected a debit of the new type: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":100,"amount":"6.00"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 above max_amount; got %d %s", w.Code, w.Body)
+	}
+
+	if w := do(h, http.MethodPut, "/operation-types/100", `{"description":"fee","direction":"credit"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 changing direction; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPut, "/operation-types/100", `{"description":"late fee"}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "max_amount") {
+		t.Fatalf("update operation type: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodDelete, "/operation-types/100", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":false`) {
+		t.Fatalf("deactivate operation type: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":100,"amount":"3.00"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an inactive type; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/operation-types/999", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404; got %d %s", w.Code, w.Body)
+	}
+}
+
+// Accounts hold one currency; foreign amounts are converted at the rate of the event date.
+func TestMultiCurrency(t *testing.T) {
+	rates, err := service.ParseRates("USD/JPY=150,USD/JPY@2024-06-01=155.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := service.NewRateTable(rates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := api.New(service.New(respository.NewInMemoryStore(), service.WithExchangeRates(table))).Router()
+
+	w := do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","currency":"JPY","credit_limit":"100000"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"currency":"JPY","credit_limit":100000,`) {
+		t.Fatalf("create account: %d %s", w.Code, w.Body)
+	}
+	// Without a currency the amount is in the account's; yen have no minor unit.
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"0.50"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for fractional yen; got %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"10.01","currency":"USD","event_date":"2024-06-02T10:00:00Z"}`)
+	body := w.Body.String()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("foreign purchase: %d %s", w.Code, body)
+	}
+	for _, want := range []string{`"amount":-1557`, `"currency":"JPY"`, `"original_amount":-10.01`, `"original_currency":"USD"`, `"exchange_rate":155.5`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in %s", want, body)
+		}
+	}
+
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"10","currency":"EUR"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 without a rate; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/accounts", `{"document_number":"11144477735","currency":"yen!"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid currency; got %d %s", w.Code, w.Body)
+	}
+}
+
+// Blocked accounts refuse debits, closed accounts refuse everything, and a
+// close needs a settled account.
+func TestAccountLifecycle(t *testing.T) {
+	h := newTestRouter()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"40.00"}`)
+
+	if w := do(h, http.MethodPost, "/accounts/1/block", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a reason; got %d %s", w.Code, w.Body)
+	}
+	w := do(h, http.MethodPost, "/accounts/1/block", `{"reason":"chargeback"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"blocked"`) {
+		t.Fatalf("block: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"1.00"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a debit on a blocked account; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/accounts/1/close", `{"reason":"customer request"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 closing with a balance; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":"40.00"}`); w.Code != http.StatusCreated {
+		t.Fatalf("payment on a blocked account: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/accounts/1/close", `{"reason":"customer request"}`); w.Code != http.StatusOK {
+		t.Fatalf("close: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":"1.00"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 on a closed account; got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/accounts/1/unblock", `{"reason":"reopen"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 reopening; got %d %s", w.Code, w.Body)
+	}
+
+	w = do(h, http.MethodGet, "/accounts/1/status-history", "")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"reason"`) != 2 ||
+		!strings.Contains(w.Body.String(), `"from":"blocked","to":"closed","reason":"customer request"`) {
+		t.Fatalf("status history: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/accounts/9/status-history", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404; got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	svc := service.New(respository.NewInMemoryStore(), service.WithMetrics(reg))
+	h := api.Chain(api.New(svc, api.WithMetrics(reg)).Router(), api.Metrics(reg))
+
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+	do(h, http.MethodGet, "/accounts/1", "")
+	do(h, http.MethodGet, "/accounts/2", "")
+	do(h, http.MethodGet, "/accounts/1/transactions", "")
+	do(h, http.MethodGet, "/wp-login.php", "")
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"40.00"}`)
+	do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":1,"amount":"400.00"}`)
+	do(h, http.MethodPost, "/transactions/1/reversal", `{}`)
+
+	w := do(h, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("metrics: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/accounts/{id}",status="200"} 1`,
+		`http_requests_total{method="GET",route="/accounts/{id}",status="404"} 1`,
+		`http_requests_total{method="GET",route="/accounts/{id}/transactions",status="200"} 1`,
+		`http_requests_total{method="GET",route="other",status="404"} 1`,
+		`http_requests_total{method="POST",route="/transactions/{id}/reversal",status="201"} 1`,
+		`http_request_duration_seconds_count{method="POST",route="/accounts",status="201"} 1`,
+		`transactions_total{operation_type="1",outcome="created"} 1`,
+		`transactions_total{operation_type="1",outcome="rejected"} 1`,
+		`transactions_total{operation_type="5",outcome="created"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exp := tracing.NewInMemoryExporter()
+	tr := tracing.NewTracer(exp)
+	tracing.SetTracer(tr)
+	defer tracing.SetTracer(nil)
+	h := api.Chain(newTestRouter(), api.Tracing())
+
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+	req := httptest.NewRequest(http.MethodPost, "/transactions", strings.NewReader(`{"account_id":1,"operation_type_id":1,"amount":"400.00"}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var server, svc *tracing.SpanData
+	for _, s := range exp.Spans() {
+		if s.SpanContext.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			continue
+		}
+		switch s.Name {
+		case "POST /transactions":
+			server = &s
+		case "Service.CreateTransaction":
+			svc = &s
+		}
+	}
+	if server == nil || svc == nil {
+		t.Fatalf("missing spans of the incoming trace: %+v", exp.Spans())
+	}
+	if server.ParentSpanID.String() != "00f067aa0ba902b7" || server.Kind != tracing.SpanKindServer || server.Error {
+		t.Errorf("unexpected server span %+v", *server)
+	}
+	if svc.ParentSpanID != server.SpanContext.SpanID || !svc.Error {
+		t.Errorf("service span should be a failed child of the server span: %+v", *svc)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	h := api.Chain(newTestRouter(), api.RequestID())
+
+	req := httptest.NewRequest(http.MethodGet, "/accounts/9", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Request-ID"); got != "req-123" {
+		t.Fatalf("expected the incoming id to be echoed, got %q", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["request_id"] != "req-123" || body["error"] == "" {
+		t.Fatalf("expected request_id in the error body: %s", w.Body)
+	}
+
+	for _, incoming := range []string{"", "has space", "bad\nid", strings.Repeat("x", 129)} {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.Header.Set("X-Request-ID", incoming)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get("X-Request-ID"); len(got) != 36 || got == incoming {
+			t.Errorf("expected a generated id instead of %q, got %q", incoming, got)
+		}
+	}
+
+	w = do(h, http.MethodGet, "/healthz", "")
+	if strings.Contains(w.Body.String(), "request_id") {
+		t.Errorf("successful responses keep their body: %s", w.Body)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	newKey := func(scopes ...string) string {
+		key, record, err := auth.GenerateAPIKey("test", scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateAPIKey(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	reader := newKey(auth.ScopeAccountsRead)
+	writer := newKey(auth.ScopeAccountsRead, auth.ScopeAccountsWrite)
+	router := api.New(service.New(store)).Router()
+	h := api.Chain(router, api.RequestID(), api.Authenticate(auth.NewAuthenticator(auth.WithAPIKeys(store))))
+
+	call := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	errorBody := func(w *httptest.ResponseRecorder) map[string]string {
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" || body["request_id"] == "" {
+			t.Errorf("expected an error body with request_id: %s", w.Body)
+		}
+		return body
+	}
+
+	for _, probe := range []string{"/healthz", "/livez", "/readyz"} {
+		if w := call(http.MethodGet, probe, "", ""); w.Code != http.StatusOK {
+			t.Errorf("%s should be public, got %d", probe, w.Code)
+		}
+	}
+
+	w := call(http.MethodGet, "/accounts/1", "", "")
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Fatalf("expected 401 with a challenge, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	errorBody(w)
+	if w := call(http.MethodGet, "/accounts/1", "trk_0000000000000000_nope", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown key, got %d", w.Code)
+	}
+
+	w = call(http.MethodPost, "/accounts", reader, `{"document_number":"52998224725"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+		t.Fatalf("expected 403 for a missing scope, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if body := errorBody(w); !strings.Contains(body["error"], auth.ScopeAccountsWrite) {
+		t.Errorf("expected the missing scope in the error: %v", body)
+	}
+
+	if w := call(http.MethodPost, "/accounts", writer, `{"document_number":"52998224725"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 with accounts:write, got %d: %s", w.Code, w.Body)
+	}
+	if w := call(http.MethodGet, "/accounts/1", reader, ""); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with accounts:read, got %d: %s", w.Code, w.Body)
+	}
+	if w := call(http.MethodHead, "/accounts/1", reader, ""); w.Code == http.StatusForbidden {
+		t.Errorf("HEAD should need the scope of GET, got %d", w.Code)
+	}
+	if w := call(http.MethodGet, "/transactions", reader, ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without transactions:read, got %d", w.Code)
+	}
+	if w := call(http.MethodGet, "/nowhere", reader, ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown routes only need credentials, got %d", w.Code)
+	}
+	if w := call(http.MethodDelete, "/accounts/1", reader, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unsupported methods only need credentials, got %d", w.Code)
+	}
+	// A trailing slash must not dodge the scope of the route.
+	if w := call(http.MethodGet, "/accounts/1/", newKey(auth.ScopeTransactionsRead), ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a trailing slash, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := api.NewRateLimiter(0.01, 2)
+	h := api.Chain(newTestRouter(), api.RateLimit(limiter))
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/operation-types", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := get("10.0.0.1:1234")
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("request %d: got %d, headers %v", i, w.Code, w.Header())
+		}
+	}
+	w := get("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the burst is used, got %d", w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 90 || retry > 100 {
+		t.Errorf("expected Retry-After of about 100s, got %q", w.Header().Get("Retry-After"))
+	}
+	if reset, err := strconv.Atoi(w.Header().Get("RateLimit-Reset")); err != nil || reset < 190 || reset > 200 {
+		t.Errorf("expected RateLimit-Reset of about 200s, got %q", w.Header().Get("RateLimit-Reset"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Errorf("expected an error body: %s", w.Body)
+	}
+
+	if w := get("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("other clients have their own bucket, got %d", w.Code)
+	}
+	if w := do(h, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("health checks are not limited, got %d", w.Code)
+	}
+}
+
+func TestRateLimit_ByPrincipal(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	key, record, err := auth.GenerateAPIKey("test", []string{auth.ScopeOperationTypesRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateAPIKey(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	router := api.New(service.New(store)).Router()
+	h := api.Chain(router, api.Authenticate(auth.NewAuthenticator(auth.WithAPIKeys(store))), api.RateLimit(api.NewRateLimiter(0.01, 1, api.WithForwardedFor())))
+	get := func(forwardedFor string, withKey bool) int {
+		req := httptest.NewRequest(http.MethodGet, "/operation-types", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		if withKey {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The key is limited wherever it comes from.
+	if code := get("1.1.1.1", true); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := get("2.2.2.2", true); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for the same key, got %d", code)
+	}
+
+	// Without credentials the address the proxy appended is used; entries
+	// the client sent itself are ignored.
+	h = api.Chain(router, api.RateLimit(api.NewRateLimiter(0.01, 1, api.WithForwardedFor())))
+	if code := get("9.9.9.9, 3.3.3.3", false); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := get("8.8.8.8, 3.3.3.3", false); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for the same forwarded address, got %d", code)
+	}
+	if code := get("4.4.4.4", false); code != http.StatusOK {
+		t.Errorf("expected 200 for another address, got %d", code)
+	}
+}
+
+func TestRateLimitFailedAuth(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	key, record, err := auth.GenerateAPIKey("test", []string{auth.ScopeOperationTypesRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateAPIKey(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	router := api.New(service.New(store)).Router()
+	limiter := api.NewRateLimiter(0.01, 2)
+	h := api.Chain(router, api.RateLimitFailedAuth(limiter), api.Authenticate(auth.NewAuthenticator(auth.WithAPIKeys(store))), api.RateLimit(limiter))
+	get := func(remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/operation-types", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", apiKey)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Successful requests do not count against the address.
+	for i := 0; i < 2; i++ {
+		if w := get("10.0.0.1:1234", key); w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, w.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if w := get("10.0.0.1:1234", "trk_0000000000000000_nope"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("bad key %d: got %d", i, w.Code)
+		}
+	}
+	w := get("10.0.0.1:1234", "trk_0000000000000000_nope")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 once the address used its bucket on bad keys, got %d %v", w.Code, w.Header())
+	}
+	if w := get("10.0.0.2:1234", "trk_0000000000000000_nope"); w.Code != http.StatusUnauthorized {
+		t.Errorf("other addresses have their own bucket, got %d", w.Code)
+	}
+}
+
+func TestCreateTransaction_VelocityLimit(t *testing.T) {
+	svc := service.New(respository.NewInMemoryStore(), service.WithVelocityLimits(service.VelocityLimits{Window: time.Hour, MaxDebits: 2}))
+	h := api.New(svc).Router()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725","credit_limit":"100.00"}`)
+
+	purchase := `{"account_id":1,"operation_type_id":1,"amount":"1.00"}`
+	for i := 0; i < 2; i++ {
+		if w := do(h, http.MethodPost, "/transactions", purchase); w.Code != http.StatusCreated {
+			t.Fatalf("debit %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	if w := do(h, http.MethodPost, "/transactions", `{"account_id":1,"operation_type_id":4,"amount":"1.00"}`); w.Code != http.StatusCreated {
+		t.Fatalf("payments are not limited: %d %s", w.Code, w.Body)
+	}
+	w := do(h, http.MethodPost, "/transactions", purchase)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "velocity limit exceeded") {
+		t.Errorf("expected 422 for the third debit, got %d %s", w.Code, w.Body)
+	}
+}
+
+// Limits changed at runtime apply to the next request; a rate of zero turns
+// limiting off.
+func TestRateLimit_SetLimit(t *testing.T) {
+	limiter := api.NewRateLimiter(0.01, 1)
+	h := api.Chain(newTestRouter(), api.RateLimit(limiter))
+	do(h, http.MethodGet, "/operation-types", "")
+	if w := do(h, http.MethodGet, "/operation-types", ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+
+	limiter.SetLimit(0, 1)
+	if w := do(h, http.MethodGet, "/operation-types", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("expected limiting to be off, got %d, headers %v", w.Code, w.Header())
+	}
+
+	// Clients keep the tokens they had left; the new burst caps the refill.
+	limiter.SetLimit(0.01, 3)
+	w := do(h, http.MethodGet, "/operation-types", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("RateLimit-Limit") != "3" || w.Header().Get("RateLimit-Reset") != "300" {
+		t.Errorf("expected the new burst, got %d, headers %v", w.Code, w.Header())
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	var fail bool
+	reload := func(ctx context.Context) (api.ReloadResult, error) {
+		if fail {
+			return api.ReloadResult{}, errors.New("logging.level: unknown level \"loud\"")
+		}
+		return api.ReloadResult{Applied: []string{"logging.level"}}, nil
+	}
+	h := api.New(service.New(respository.NewInMemoryStore()), api.WithReload(reload)).Router()
+
+	w := do(h, http.MethodPost, "/admin/reload", "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"applied":["logging.level"],"requires_restart":[]}`+"\n" {
+		t.Fatalf("reload: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/admin/reload", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", w.Code)
+	}
+
+	fail = true
+	w = do(h, http.MethodPost, "/admin/reload", "")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "unknown level") {
+		t.Errorf("expected the validation error, got %d %s", w.Code, w.Body)
+	}
+
+	if w := do(newTestRouter(), http.MethodPost, "/admin/reload", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without WithReload, got %d", w.Code)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	var storeErr error
+	handler := api.New(service.New(respository.NewInMemoryStore()), api.WithReadiness(func(ctx context.Context) error {
+		return storeErr
+	}))
+	h := handler.Router()
+	status := func(w *httptest.ResponseRecorder) string {
+		var body map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return body["status"]
+	}
+
+	if w := do(h, http.MethodGet, "/livez", ""); w.Code != http.StatusOK || status(w) != "ok" {
+		t.Errorf("livez: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK || status(w) != "ready" {
+		t.Errorf("readyz: %d %s", w.Code, w.Body)
+	}
+
+	// Losing the store fails readiness, not liveness, and does not leak the cause.
+	storeErr = errors.New("dial tcp 10.0.0.5:5432: connection refused")
+	w := do(h, http.MethodGet, "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable || status(w) != "unavailable" || strings.Contains(w.Body.String(), "10.0.0.5") {
+		t.Errorf("readyz without the store: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/livez", ""); w.Code != http.StatusOK {
+		t.Errorf("livez without the store: %d", w.Code)
+	}
+
+	storeErr = nil
+	handler.Drain()
+	if w := do(h, http.MethodGet, "/readyz", ""); w.Code != http.StatusServiceUnavailable || status(w) != "draining" {
+		t.Errorf("readyz while draining: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodGet, "/operation-types", ""); w.Code != http.StatusOK {
+		t.Errorf("requests are still served while draining, got %d", w.Code)
+	}
+}
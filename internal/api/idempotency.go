@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/auth"
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"go.uber.org/zap"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// Idempotency makes POST requests carrying an Idempotency-Key header safe to
+// retry. The first response (status and body) is stored against the key and a
+// fingerprint of the request; replays within ttl get the stored response, a
+// replay with a different request gets 422 and a replay racing the original
+// gets 409. Responses with a 5xx status are not stored so the client can retry.
+// A request holds its key for lease only, so that a key left in flight by a
+// process that died can be retried once the lease runs out.
+func Idempotency(store respository.IdempotencyStore, ttl, lease time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if r.Method != http.MethodPost || key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				writeError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "could not read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// Keys are scoped to the route and the principal, so the same key
+			// on different endpoints or from different clients does not
+			// collide, nor replay one client's response to another.
+			storeKey := r.Method + " " + r.URL.Path + " " + key
+			if p, ok := auth.FromContext(r.Context()); ok {
+				storeKey = p.Subject + " " + storeKey
+			}
+			rec := respository.IdempotencyRecord{
+				Key:         storeKey,
+				Fingerprint: fingerprint(r, body),
+				ExpiresAt:   time.Now().Add(lease),
+			}
+			existing, reserved, err := store.ReserveIdempotencyKey(r.Context(), rec)
+			if err != nil {
+				logger.FromContext(r.Context()).Error("Failed to reserve idempotency key", zap.Error(err))
+				writeError(w, http.StatusInternalServerError, "could not process Idempotency-Key")
+				return
+			}
+			if !reserved {
+				switch {
+				case existing.Fingerprint != rec.Fingerprint:
+					writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request")
+				case existing.StatusCode == 0:
+					writeError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+				default:
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(existing.StatusCode)
+					_, _ = w.Write(existing.Body)
+				}
+				return
+			}
+
+			// The outcome must be recorded even if the client has gone away.
+			ctx := context.WithoutCancel(r.Context())
+			cw := &captureWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				if err := store.ReleaseIdempotencyKey(ctx, storeKey, rec.Fingerprint); err != nil {
+					logger.FromContext(r.Context()).Error("Failed to release idempotency key", zap.Error(err))
+				}
+			}()
+
+			next.ServeHTTP(cw, r)
+
+			if cw.statusCode >= http.StatusInternalServerError || cw.statusCode == StatusClientClosedRequest {
+				return
+			}
+			if err := store.CompleteIdempotencyKey(ctx, storeKey, rec.Fingerprint, cw.statusCode, cw.body.Bytes(), time.Now().Add(ttl)); err != nil {
+				logger.FromContext(r.Context()).Error("Failed to store idempotent response", zap.Error(err))
+				return
+			}
+			completed = true
+		})
+	}
+}
+
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method)
+	io.WriteString(h, "\n")
+	io.WriteString(h, r.URL.Path)
+	io.WriteString(h, "\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// captureWriter passes the response through while keeping a copy of it.
+type captureWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	cw.statusCode = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
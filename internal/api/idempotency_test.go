@@ -0,0 +1,140 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/api"
+	"github.com/animeshs34/transaction_routine/internal/auth"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/animeshs34/transaction_routine/internal/service"
+)
+
+func doWithKey(h http.Handler, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(api.IdempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotency_ReplaysFirstResponse(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	h := api.New(service.New(store), api.WithIdempotency(store, time.Hour, time.Minute)).Router()
+	do(h, http.MethodPost, "/accounts", `{"document_number":"52998224725"}`)
+
+	body := `{"account_id":1,"operation_type_id":4,"amount":10}`
+	first := doWithKey(h, "/transactions", "k1", body)
+	second := doWithKey(h, "/transactions", "k1", body)
+	if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+		t.Fatalf("expected 201 twice; got %d and %d", first.Code, second.Code)
+	}
+	if first.Body.String() != second.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected replayed body; got %s vs %s", first.Body, second.Body)
+	}
+	if w := do(h, http.MethodGet, "/transactions/2", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("replay must not create a second transaction; got %d", w.Code)
+	}
+
+	if w := doWithKey(h, "/transactions", "k1", `{"account_id":1,"operation_type_id":4,"amount":11}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for reused key with different body; got %d", w.Code)
+	}
+	// The same key on another route is independent.
+	if w := doWithKey(h, "/accounts", "k1", `{"document_number":"11144477735"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 on another route; got %d", w.Code)
+	}
+}
+
+func TestIdempotency_InFlightAndFailures(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	var calls int
+	status := http.StatusInternalServerError
+	h := api.Idempotency(store, time.Hour, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+
+	// A 5xx is not stored, so a retry reaches the handler again.
+	doWithKey(h, "/transactions", "k", "{}")
+	status = http.StatusCreated
+	if w := doWithKey(h, "/transactions", "k", "{}"); w.Code != http.StatusCreated || calls != 2 {
+		t.Fatalf("expected retry after 5xx to run; got %d after %d calls", w.Code, calls)
+	}
+
+	// A duplicate arriving while the first request is still running gets 409.
+	var nested *httptest.ResponseRecorder
+	var inner http.Handler
+	inner = api.Idempotency(store, time.Hour, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nested == nil {
+			nested = doWithKey(inner, "/transactions", "busy", "{}")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	doWithKey(inner, "/transactions", "busy", "{}")
+	if nested == nil || nested.Code != http.StatusConflict {
+		t.Fatalf("expected 409 while in flight; got %v", nested)
+	}
+}
+
+func TestIdempotency_LeaseRunsOut(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	var calls int
+	h := api.Idempotency(store, time.Hour, time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	// A process that died mid-request leaves its reservation behind.
+	store.ReserveIdempotencyKey(context.Background(), respository.IdempotencyRecord{Key: "POST /transactions k", Fingerprint: "fp", ExpiresAt: time.Now().Add(time.Millisecond)})
+	time.Sleep(5 * time.Millisecond)
+	if w := doWithKey(h, "/transactions", "k", "{}"); w.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("expected the expired reservation to be taken over; got %d after %d calls", w.Code, calls)
+	}
+	// The completed response is kept for the ttl, not the lease.
+	time.Sleep(5 * time.Millisecond)
+	if w := doWithKey(h, "/transactions", "k", "{}"); w.Header().Get("Idempotent-Replayed") != "true" || calls != 1 {
+		t.Fatalf("expected a replay; got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestIdempotency_PerPrincipal(t *testing.T) {
+	store := respository.NewInMemoryStore()
+	newKey := func() string {
+		key, record, err := auth.GenerateAPIKey("test", []string{auth.ScopeAccountsWrite})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateAPIKey(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	alice, bob := newKey(), newKey()
+	router := api.New(service.New(store), api.WithIdempotency(store, time.Hour, time.Minute)).Router()
+	h := api.Chain(router, api.Authenticate(auth.NewAuthenticator(auth.WithAPIKeys(store))))
+	post := func(apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/accounts", strings.NewReader(body))
+		req.Header.Set("X-API-Key", apiKey)
+		req.Header.Set(api.IdempotencyKeyHeader, "k1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(alice, `{"document_number":"52998224725"}`); w.Code != http.StatusCreated {
+		t.Fatalf("first client: %d %s", w.Code, w.Body)
+	}
+	// The same key from another client is a request of its own, neither a
+	// mismatch nor a replay of the first client's response.
+	w := post(bob, `{"document_number":"11144477735"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" || !strings.Contains(w.Body.String(), "11144477735") {
+		t.Fatalf("second client: %d %s", w.Code, w.Body)
+	}
+	if w := post(bob, `{"document_number":"11144477735"}`); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the second client's own replay; got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/metrics"
+)
+
+// WithMetrics serves reg at /metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(h *Handler) {
+		h.metrics = reg
+	}
+}
+
+// Metrics counts requests and observes their latency per method, route and
+// status. Routes are the patterns in Router with ids replaced by {id}, so a
+// series is kept per endpoint rather than per resource.
+func Metrics(reg *metrics.Registry) Middleware {
+	requests := reg.NewCounterVec("http_requests_total",
+		"HTTP requests served, by method, route and status.",
+		"method", "route", "status")
+	latency := reg.NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds, by method, route and status.",
+		metrics.DefaultBuckets, "method", "route", "status")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			defer func() {
+				// Record panics too; Recoverer, further out, turns them into 500s.
+				status := ww.statusCode
+				if rec := recover(); rec != nil {
+					status = http.StatusInternalServerError
+					defer panic(rec)
+				}
+				labels := []string{r.Method, routePattern(r.URL.Path), strconv.Itoa(status)}
+				requests.Inc(labels...)
+				latency.Observe(time.Since(start).Seconds(), labels...)
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+// subRoutes are the path segments served below /{collection}/{id}.
+var subRoutes = map[string]map[string]bool{
+	"accounts":        {"transactions": true, "block": true, "unblock": true, "close": true, "status-history": true},
+	"transactions":    {"reversal": true, "installments": true},
+	"operation-types": {},
+}
+
+// routePattern maps path to the route serving it, e.g.
+// /accounts/42/transactions to /accounts/{id}/transactions. Paths no route
+// serves become "other" so that scanners cannot grow the label set.
+func routePattern(path string) string {
+	collection, rest, hasRest := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	subs, ok := subRoutes[collection]
+	if !ok {
+		switch collection {
+		case "healthz", "livez", "readyz", "metrics":
+			if !hasRest {
+				return path
+			}
+		case "admin":
+			if rest == "reload" {
+				return path
+			}
+		}
+		return "other"
+	}
+	if !hasRest {
+		return "/" + collection
+	}
+	id, sub, hasSub := strings.Cut(rest, "/")
+	if id == "" {
+		return "other"
+	}
+	pattern := "/" + collection + "/{id}"
+	if !hasSub {
+		return pattern
+	}
+	if !subs[sub] {
+		return "other"
+	}
+	return pattern + "/" + sub
+}
@@ -1,9 +1,13 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
 	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
 	"go.uber.org/zap"
-	"log"
 	"net/http"
 	"runtime/debug"
 	"time"
@@ -24,7 +28,8 @@ func Recoverer() Middleware {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if rec := recover(); rec != nil {
-					log.Printf("panic recovered: %v\n%s", rec, debug.Stack())
+					logger.FromContext(r.Context()).Error("Panic recovered",
+						zap.Any("panic", rec), zap.ByteString("stack", debug.Stack()))
 					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				}
 			}()
@@ -33,6 +38,113 @@ func Recoverer() Middleware {
 	}
 }
 
+// RequestIDHeader carries the id correlating a request's log lines, response
+// and error body.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds ids accepted from clients.
+const maxRequestIDLength = 128
+
+// RequestID takes the request id from the X-Request-ID header, or generates
+// one when it is missing or unusable, and echoes it in the response. The
+// request context gets a logger with a request_id field; see
+// logger.FromContext.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			ctx := logger.NewContext(r.Context(), logger.GetLogger().With(zap.String("request_id", id)))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// validRequestID accepts up to maxRequestIDLength visible ASCII characters,
+// so client ids cannot forge log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random UUID (version 4).
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// RequestTimeout gives every request a deadline, so repository calls stop
+// once the response could no longer be written anyway.
+func RequestTimeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Tracing starts a server span per request, continuing the trace of an
+// incoming W3C traceparent header. Spans are named after the route, like
+// metrics, and 5xx responses mark them as failed.
+func Tracing() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if sc, err := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader)); err == nil {
+				ctx = tracing.ContextWithRemoteSpanContext(ctx, sc)
+			}
+			route := routePattern(r.URL.Path)
+			ctx, span := tracing.Start(ctx, r.Method+" "+route, tracing.SpanKindServer,
+				tracing.String("http.request.method", r.Method),
+				tracing.String("http.route", route),
+				tracing.String("url.path", r.URL.Path))
+			ww := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			defer func() {
+				status := ww.statusCode
+				if rec := recover(); rec != nil {
+					status = http.StatusInternalServerError
+					defer panic(rec)
+				}
+				span.SetAttributes(tracing.Int("http.response.status_code", status))
+				if status >= http.StatusInternalServerError {
+					span.SetError(http.StatusText(status))
+				}
+				span.End()
+			}()
+			next.ServeHTTP(ww, r.WithContext(ctx))
+		})
+	}
+}
+
+// ReadYourWrites names the client of each request to the store, by principal
+// or else peer address, so that a client reads its own writes back from the
+// primary rather than a replica that may not have them yet. Clients behind
+// the same proxy share an address, which only keeps more of their reads on
+// the primary. Place it after Authenticate.
+func ReadYourWrites() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := respository.NewClientContext(r.Context(), clientKey(r, false))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -43,7 +155,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 
 		duration := time.Since(start)
 
-		logger.Info("HTTP request",
+		logger.FromContext(r.Context()).Info("HTTP request",
 			zap.String("method", r.Method),
 			zap.String("path", r.URL.Path),
 			zap.String("remote_addr", r.RemoteAddr),
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/auth"
+)
+
+// sweepInterval is how often buckets that have refilled are dropped.
+const sweepInterval = time.Minute
+
+// RateLimiter keeps a token bucket per client. Each bucket holds up to burst
+// tokens and refills at rate tokens per second; every request takes one.
+// A rate of zero lets every request through.
+type RateLimiter struct {
+	trustForwardedFor atomic.Bool
+	now               func() time.Time
+
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+type RateLimitOption func(*RateLimiter)
+
+// WithForwardedFor keys clients without credentials by the last address in
+// X-Forwarded-For, the one appended by the proxy in front of the API, rather
+// than by the peer address. Only use it behind such a proxy.
+func WithForwardedFor() RateLimitOption {
+	return func(l *RateLimiter) {
+		l.trustForwardedFor.Store(true)
+	}
+}
+
+// SetForwardedFor turns WithForwardedFor on or off.
+func (l *RateLimiter) SetForwardedFor(trust bool) {
+	l.trustForwardedFor.Store(trust)
+}
+
+// NewRateLimiter allows each client rate requests per second on average, and
+// bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int, opts ...RateLimitOption) *RateLimiter {
+	l := &RateLimiter{
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.SetLimit(rate, burst)
+	return l
+}
+
+// SetLimit changes the rate and burst of every client, keeping the tokens
+// each has left up to the new burst. It is safe to call while serving.
+func (l *RateLimiter) SetLimit(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = max(rate, 0)
+	l.burst = float64(max(burst, 1))
+	for _, b := range l.buckets {
+		b.tokens = math.Min(b.tokens, l.burst)
+	}
+}
+
+// take removes a token from the bucket of key if it has one. It returns the
+// burst, the tokens left, and how long until the bucket is full and until it
+// next holds a token. A limit of zero means the limiter is off.
+func (l *RateLimiter) take(key string) (ok bool, limit, remaining int, reset, retry time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return true, 0, 0, 0, 0
+	}
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retry = l.wait(1 - b.tokens)
+	}
+	return ok, int(l.burst), int(b.tokens), l.wait(l.burst - b.tokens), retry
+}
+
+// peek reports whether the bucket of key holds a token, without taking it,
+// and if not how long until it does.
+func (l *RateLimiter) peek(key string) (ok bool, retry time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if l.rate == 0 || !found {
+		return true, 0
+	}
+	if tokens := l.refill(b, l.now()); tokens < 1 {
+		return false, l.wait(1 - tokens)
+	}
+	return true, 0
+}
+
+func (l *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+}
+
+// wait is how long refilling the given number of tokens takes.
+func (l *RateLimiter) wait(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// clientKey identifies the client of r: its principal when authenticated,
+// otherwise its address. With trustForwardedFor the address is the last
+// X-Forwarded-For entry, the one added by the proxy, instead of the peer's.
+func clientKey(r *http.Request, trustForwardedFor bool) string {
+	if p, ok := auth.FromContext(r.Context()); ok {
+		return "principal:" + p.Subject
+	}
+	if trustForwardedFor {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			hops := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return "ip:" + ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// RateLimit answers 429 with Retry-After once a client has used up its
+// bucket. Every limited response carries RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset, in seconds. Place it after Authenticate so
+// authenticated clients are limited by identity rather than address.
+func RateLimit(l *RateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if publicRoutes[routePattern(r.URL.Path)] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ok, limit, remaining, reset, retry := l.take(clientKey(r, l.trustForwardedFor.Load()))
+			if limit == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+			if !ok {
+				h.Set("Retry-After", strconv.Itoa(max(seconds(retry), 1)))
+				writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimitFailedAuth limits by address the requests that fail
+// authentication: once an address has used up its bucket on 401s, its
+// requests get 429 before their credentials are checked. Only 401s take a
+// token, so clients sharing an address are still limited by principal, by
+// RateLimit, once authenticated. Place it before Authenticate.
+func RateLimitFailedAuth(l *RateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if publicRoutes[routePattern(r.URL.Path)] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Before Authenticate there is no principal, so this is the
+			// address; the prefix keeps the bucket apart from RateLimit's.
+			key := "failed-auth:" + clientKey(r, l.trustForwardedFor.Load())
+			if ok, retry := l.peek(key); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds(retry), 1)))
+				writeError(w, http.StatusTooManyRequests, "too many failed authentication attempts")
+				return
+			}
+			rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(rw, r)
+			if rw.statusCode == http.StatusUnauthorized {
+				l.take(key)
+			}
+		})
+	}
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,137 @@
+// Package auth authenticates API clients, either with API keys kept in the
+// repository or with JWT bearer tokens signed by a configured key set, and
+// describes what they may do with scopes.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/respository"
+)
+
+// ErrUnauthenticated is wrapped by every error caused by missing or
+// unacceptable credentials, as opposed to a failure looking them up.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Scopes granted to clients.
+const (
+	ScopeAccountsRead        = "accounts:read"
+	ScopeAccountsWrite       = "accounts:write"
+	ScopeTransactionsRead    = "transactions:read"
+	ScopeTransactionsWrite   = "transactions:write"
+	ScopeOperationTypesRead  = "operation-types:read"
+	ScopeOperationTypesWrite = "operation-types:write"
+	ScopeMetricsRead         = "metrics:read"
+	ScopeConfigReload        = "config:reload"
+)
+
+// Scopes lists every scope, for validating the ones given to API keys.
+var Scopes = []string{
+	ScopeAccountsRead, ScopeAccountsWrite,
+	ScopeTransactionsRead, ScopeTransactionsWrite,
+	ScopeOperationTypesRead, ScopeOperationTypesWrite,
+	ScopeMetricsRead, ScopeConfigReload,
+}
+
+// ValidScope reports whether s is one of Scopes.
+func ValidScope(s string) bool {
+	return slices.Contains(Scopes, s)
+}
+
+// Principal is an authenticated client.
+type Principal struct {
+	// Subject is "api_key:<prefix>" for API keys and the sub claim for JWTs.
+	Subject string
+	// Method is "api_key" or "jwt".
+	Method string
+	Scopes []string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the request, if it was authenticated.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticator checks the credentials of a request. A request may carry an
+// API key in X-API-Key or as a bearer token, or a JWT as a bearer token.
+type Authenticator struct {
+	keys       respository.APIKeyStore
+	keySet     *KeySet
+	validation Validation
+	now        func() time.Time
+}
+
+type Option func(*Authenticator)
+
+// WithAPIKeys accepts the API keys in store.
+func WithAPIKeys(store respository.APIKeyStore) Option {
+	return func(a *Authenticator) {
+		a.keys = store
+	}
+}
+
+// WithJWT accepts bearer tokens signed by a key in ks and passing v.
+func WithJWT(ks *KeySet, v Validation) Option {
+	return func(a *Authenticator) {
+		a.keySet = ks
+		a.validation = v
+	}
+}
+
+func NewAuthenticator(opts ...Option) *Authenticator {
+	a := &Authenticator{now: time.Now}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Authenticate returns the principal r was made by. Errors wrapping
+// ErrUnauthenticated are the client's; any other is a failure to look the
+// credentials up.
+func (a *Authenticator) Authenticate(ctx context.Context, r *http.Request) (Principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return a.authenticateAPIKey(ctx, key)
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return Principal{}, fmt.Errorf("%w: missing credentials", ErrUnauthenticated)
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return Principal{}, fmt.Errorf("%w: expected a bearer token", ErrUnauthenticated)
+	}
+	token = strings.TrimSpace(token)
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return a.authenticateAPIKey(ctx, token)
+	}
+	return a.authenticateJWT(token)
+}
+
+func (a *Authenticator) authenticateJWT(token string) (Principal, error) {
+	if a.keySet == nil {
+		return Principal{}, fmt.Errorf("%w: bearer tokens are not accepted", ErrUnauthenticated)
+	}
+	claims, err := a.keySet.Verify(token, a.validation, a.now())
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{Subject: claims.Subject, Method: "jwt", Scopes: claims.Scopes}, nil
+}
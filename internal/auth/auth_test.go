@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/respository"
+)
+
+var hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+// sign builds a JWT; signer gets the signing input and returns the signature.
+func sign(t *testing.T, header, claims map[string]any, signer func([]byte) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := b64(h) + "." + b64(c)
+	return input + "." + b64(signer([]byte(input)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func TestKeySet_Verify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsKey, err := NewHS256Key("hs", hmacSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsKey, err := NewRS256Key("rs", &rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeySet(hsKey, rsKey)
+	v := Validation{Issuer: "idp", Audience: "api"}
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "client-1", "iss": "idp", "aud": "api", "exp": now.Add(time.Minute).Unix(), "scope": "accounts:read transactions:write"}
+		for k, val := range changes {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	c, err := ks.Verify(sign(t, map[string]any{"alg": "HS256", "kid": "hs"}, claims(nil), hs256(hmacSecret)), v, now)
+	if err != nil || c.Subject != "client-1" || len(c.Scopes) != 2 || c.Scopes[1] != ScopeTransactionsWrite {
+		t.Errorf("HS256: %+v, %v", c, err)
+	}
+	c, err = ks.Verify(sign(t, map[string]any{"alg": "RS256"}, claims(map[string]any{"scope": nil, "scp": []string{"accounts:write"}, "aud": []string{"other", "api"}}), rs256(t, rsaKey)), v, now)
+	if err != nil || len(c.Scopes) != 1 || c.Scopes[0] != ScopeAccountsWrite {
+		t.Errorf("RS256: %+v, %v", c, err)
+	}
+
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"malformed", "a.b"},
+		{"none algorithm", sign(t, map[string]any{"alg": "none"}, claims(nil), func([]byte) []byte { return nil })},
+		{"wrong secret", sign(t, map[string]any{"alg": "HS256"}, claims(nil), hs256([]byte(strings.Repeat("x", 32))))},
+		{"wrong rsa key", sign(t, map[string]any{"alg": "RS256"}, claims(nil), rs256(t, otherRSA))},
+		{"unknown kid", sign(t, map[string]any{"alg": "HS256", "kid": "nope"}, claims(nil), hs256(hmacSecret))},
+		{"alg of another key", sign(t, map[string]any{"alg": "HS256", "kid": "rs"}, claims(nil), hs256(hmacSecret))},
+		{"critical header", sign(t, map[string]any{"alg": "HS256", "crit": []string{"b64"}}, claims(nil), hs256(hmacSecret))},
+		{"expired", sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"exp": now.Add(-time.Minute).Unix()}), hs256(hmacSecret))},
+		{"missing exp", sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"exp": nil}), hs256(hmacSecret))},
+		{"not valid yet", sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"nbf": now.Add(time.Minute).Unix()}), hs256(hmacSecret))},
+		{"missing sub", sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"sub": nil}), hs256(hmacSecret))},
+		{"wrong issuer", sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"iss": "evil"}), hs256(hmacSecret))},
+		{"wrong audience", sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"aud": "other"}), hs256(hmacSecret))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ks.Verify(tt.token, v, now); !errors.Is(err, ErrUnauthenticated) {
+				t.Errorf("expected ErrUnauthenticated, got %v", err)
+			}
+		})
+	}
+
+	// Within the leeway a just-expired token is still accepted.
+	token := sign(t, map[string]any{"alg": "HS256"}, claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()}), hs256(hmacSecret))
+	if _, err := ks.Verify(token, v, now); err != nil {
+		t.Errorf("expected the token to pass within the leeway: %v", err)
+	}
+}
+
+func TestParseKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "hs", "alg": "HS256", "k": %q},
+		{"kty": "RSA", "kid": "rs", "use": "sig", "n": %q, "e": %q},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256"}
+	]}`, b64(hmacSecret), b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()))
+	ks, err := ParseKeySet([]byte(doc))
+	if err != nil {
+		t.Fatalf("ParseKeySet: %v", err)
+	}
+	if len(ks.keys) != 2 {
+		t.Fatalf("expected the encryption and EC keys to be skipped, got %d keys", len(ks.keys))
+	}
+	token := sign(t, map[string]any{"alg": "RS256", "kid": "rs"}, map[string]any{"sub": "s", "exp": time.Now().Add(time.Minute).Unix()}, rs256(t, rsaKey))
+	if _, err := ks.Verify(token, Validation{}, time.Now()); err != nil {
+		t.Errorf("expected the parsed RSA key to verify: %v", err)
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "k": "c2hvcnQ"}]}`,
+		`{"keys": [{"kty": "RSA", "n": "AQAB", "e": "AQAB"}]}`,
+	} {
+		if _, err := ParseKeySet([]byte(bad)); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	store := respository.NewInMemoryStore()
+	key, record, err := GenerateAPIKey("ci", []string{ScopeAccountsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "trk_"+record.Prefix+"_") || record.Hash != HashAPIKey(key) {
+		t.Fatalf("unexpected key %q for %+v", key, record)
+	}
+	if _, _, err := GenerateAPIKey("ci", []string{"everything"}); err == nil {
+		t.Errorf("expected an error for an unknown scope")
+	}
+	stored, err := store.CreateAPIKey(ctx, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsKey, _ := NewHS256Key("", hmacSecret)
+	a := NewAuthenticator(WithAPIKeys(store), WithJWT(NewKeySet(hsKey), Validation{}))
+
+	authenticate := func(header, value string) (Principal, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return a.Authenticate(ctx, r)
+	}
+
+	for _, p := range []func() (Principal, error){
+		func() (Principal, error) { return authenticate("X-API-Key", key) },
+		func() (Principal, error) { return authenticate("Authorization", "Bearer "+key) },
+	} {
+		got, err := p()
+		if err != nil || got.Method != "api_key" || got.Subject != "api_key:"+record.Prefix || !got.HasScope(ScopeAccountsRead) || got.HasScope(ScopeAccountsWrite) {
+			t.Errorf("api key: %+v, %v", got, err)
+		}
+	}
+
+	token := sign(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": "svc", "exp": time.Now().Add(time.Minute).Unix(), "scope": "transactions:write"}, hs256(hmacSecret))
+	if got, err := authenticate("Authorization", "bearer "+token); err != nil || got.Method != "jwt" || got.Subject != "svc" || !got.HasScope(ScopeTransactionsWrite) {
+		t.Errorf("jwt: %+v, %v", got, err)
+	}
+
+	for name, creds := range map[string][2]string{
+		"none":          {"", ""},
+		"basic":         {"Authorization", "Basic dXNlcjpwYXNz"},
+		"empty bearer":  {"Authorization", "Bearer "},
+		"malformed key": {"X-API-Key", "trk_short"},
+		"unknown key":   {"X-API-Key", "trk_0000000000000000_secret"},
+		"wrong secret":  {"X-API-Key", "trk_" + record.Prefix + "_secret"},
+		"bad jwt":       {"Authorization", "Bearer a.b.c"},
+	} {
+		if _, err := authenticate(creds[0], creds[1]); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: expected ErrUnauthenticated, got %v", name, err)
+		}
+	}
+
+	if _, err := store.RevokeAPIKey(ctx, stored.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate("X-API-Key", key); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected a revoked key to be rejected, got %v", err)
+	}
+
+	if _, err := NewAuthenticator().Authenticate(ctx, httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected ErrUnauthenticated without credentials, got %v", err)
+	}
+}
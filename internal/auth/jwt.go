@@ -0,0 +1,310 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Signing algorithms accepted for JWTs.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+// minHMACKeySize is the shortest HS256 secret accepted, per RFC 7518 §3.2.
+const minHMACKeySize = 32
+
+// defaultLeeway absorbs clock skew when checking exp and nbf.
+const defaultLeeway = 30 * time.Second
+
+// Key verifies the signatures of one algorithm.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	public    *rsa.PublicKey
+}
+
+// NewHS256Key returns a key verifying HS256 tokens signed with secret.
+func NewHS256Key(id string, secret []byte) (Key, error) {
+	if len(secret) < minHMACKeySize {
+		return Key{}, fmt.Errorf("HS256 key %q: secret must be at least %d bytes", id, minHMACKeySize)
+	}
+	return Key{ID: id, Algorithm: AlgHS256, secret: secret}, nil
+}
+
+// NewRS256Key returns a key verifying RS256 tokens signed by the private
+// half of pub.
+func NewRS256Key(id string, pub *rsa.PublicKey) (Key, error) {
+	if pub.N.BitLen() < 2048 {
+		return Key{}, fmt.Errorf("RS256 key %q: modulus must be at least 2048 bits", id)
+	}
+	return Key{ID: id, Algorithm: AlgRS256, public: pub}, nil
+}
+
+func (k Key) verify(signingInput, signature []byte) bool {
+	switch k.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signingInput)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case AlgRS256:
+		sum := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(k.public, crypto.SHA256, sum[:], signature) == nil
+	}
+	return false
+}
+
+// KeySet holds the keys JWTs may be signed with.
+type KeySet struct {
+	keys []Key
+}
+
+func NewKeySet(keys ...Key) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// jwk is the subset of RFC 7517 read by ParseKeySet.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseKeySet reads a JSON Web Key Set. Symmetric ("oct") keys are used for
+// HS256 and RSA keys for RS256; keys for anything else, such as encryption,
+// are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+	ks := &KeySet{}
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key Key
+		var err error
+		switch {
+		case k.Kty == "oct" && (k.Alg == "" || k.Alg == AlgHS256):
+			var secret []byte
+			if secret, err = base64.RawURLEncoding.DecodeString(k.K); err == nil {
+				key, err = NewHS256Key(k.Kid, secret)
+			}
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == AlgRS256):
+			var pub *rsa.PublicKey
+			if pub, err = rsaPublicKey(k.N, k.E); err == nil {
+				key, err = NewRS256Key(k.Kid, pub)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d in key set: %w", i, err)
+		}
+		ks.keys = append(ks.keys, key)
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("key set has no HS256 or RS256 signing keys")
+	}
+	return ks, nil
+}
+
+// LoadKeySet reads a JSON Web Key Set from a file.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set: %w", err)
+	}
+	return ParseKeySet(data)
+}
+
+func rsaPublicKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil || len(eb) == 0 || len(eb) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	exp := 0
+	for _, b := range eb {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: exp}, nil
+}
+
+// key returns the key a token with the given header was signed with. The
+// key must be for the algorithm the header names, so an RSA public key is
+// never used as an HMAC secret.
+func (ks *KeySet) key(alg, kid string) (Key, bool) {
+	var found []Key
+	for _, k := range ks.keys {
+		if k.Algorithm == alg && (kid == "" || k.ID == kid) {
+			found = append(found, k)
+		}
+	}
+	// Without a kid the choice must be unambiguous.
+	if len(found) != 1 {
+		return Key{}, false
+	}
+	return found[0], true
+}
+
+// Validation holds the claims a token must carry besides a valid signature
+// and lifetime. Empty fields are not checked.
+type Validation struct {
+	Issuer   string
+	Audience string
+	// Leeway absorbs clock skew; zero means 30s.
+	Leeway time.Duration
+}
+
+// Claims are the registered and scope claims of a verified token.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	// Scopes come from the space-separated scope claim, or the scp array.
+	Scopes []string
+}
+
+type rawClaims struct {
+	Sub   string          `json:"sub"`
+	Iss   string          `json:"iss"`
+	Aud   json.RawMessage `json:"aud"`
+	Exp   *json.Number    `json:"exp"`
+	Nbf   *json.Number    `json:"nbf"`
+	Scope string          `json:"scope"`
+	Scp   []string        `json:"scp"`
+}
+
+// Verify checks the signature, lifetime and v of token and returns its
+// claims. Tokens must have sub and exp. Every error wraps
+// ErrUnauthenticated.
+func (ks *KeySet) Verify(token string, v Validation, now time.Time) (Claims, error) {
+	fail := func(reason string) (Claims, error) {
+		return Claims{}, fmt.Errorf("%w: invalid token: %s", ErrUnauthenticated, reason)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fail("malformed")
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fail("malformed header")
+	}
+	if header.Alg != AlgHS256 && header.Alg != AlgRS256 {
+		return fail(fmt.Sprintf("unsupported algorithm %q", header.Alg))
+	}
+	if len(header.Crit) > 0 {
+		return fail("unsupported critical header")
+	}
+	key, ok := ks.key(header.Alg, header.Kid)
+	if !ok {
+		return fail("unknown signing key")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return fail("bad signature")
+	}
+
+	var raw rawClaims
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return fail("malformed claims")
+	}
+	c := Claims{Subject: raw.Sub, Issuer: raw.Iss, Scopes: raw.Scp}
+	if raw.Scope != "" {
+		c.Scopes = strings.Fields(raw.Scope)
+	}
+	if c.Audience, err = audience(raw.Aud); err != nil {
+		return fail("malformed aud")
+	}
+	if raw.Exp == nil {
+		return fail("missing exp")
+	}
+	if c.ExpiresAt, err = numericDate(*raw.Exp); err != nil {
+		return fail("malformed exp")
+	}
+	if raw.Nbf != nil {
+		if c.NotBefore, err = numericDate(*raw.Nbf); err != nil {
+			return fail("malformed nbf")
+		}
+	}
+
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = defaultLeeway
+	}
+	switch {
+	case c.Subject == "":
+		return fail("missing sub")
+	case !now.Before(c.ExpiresAt.Add(leeway)):
+		return fail("expired")
+	case !c.NotBefore.IsZero() && now.Add(leeway).Before(c.NotBefore):
+		return fail("not valid yet")
+	case v.Issuer != "" && c.Issuer != v.Issuer:
+		return fail("wrong issuer")
+	case v.Audience != "" && !slices.Contains(c.Audience, v.Audience):
+		return fail("wrong audience")
+	}
+	return c, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// audience reads aud, which may be a single string or an array.
+func audience(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	err := json.Unmarshal(raw, &many)
+	return many, err
+}
+
+func numericDate(n json.Number) (time.Time, error) {
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+}
@@ -1,98 +1,229 @@
 package config
 
 import (
-	"fmt"
-	"os"
-	"strconv"
+	"strings"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
+// Config is the service configuration. Every setting has a yaml key, nested
+// under its section, and an APP_* environment variable; see Load. Settings
+// tagged reload can be changed without a restart; see Reload.
 type Config struct {
-	Server   ServerConfig
-	Logging  LoggingConfig
-	Database DatabaseConfig
+	Server      ServerConfig      `yaml:"server"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Database    DatabaseConfig    `yaml:"database"`
+	Accounts    AccountsConfig    `yaml:"accounts"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	FX          FXConfig          `yaml:"fx"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Auth        AuthConfig        `yaml:"auth"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Velocity    VelocityConfig    `yaml:"velocity"`
+	Features    FeaturesConfig    `yaml:"features"`
 }
 type ServerConfig struct {
-	Port         int
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-	IdleTimeout  time.Duration
+	Port         int           `yaml:"port" env:"APP_SERVER_PORT"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"APP_SERVER_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"APP_SERVER_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env:"APP_SERVER_IDLE_TIMEOUT"`
+	// ShutdownDelay is how long /readyz reports draining before the server
+	// stops accepting connections, for load balancers to stop routing to it.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" env:"APP_SERVER_SHUTDOWN_DELAY"`
 }
 type LoggingConfig struct {
-	Level string
+	Level string `yaml:"level" env:"APP_LOGGING_LEVEL" reload:"true"`
 }
-type DatabaseConfig struct {
-	Type     string
-	Host     string
-	Port     int
-	User     string
-	Password string
-	DBName   string
-	SSLMode  string
+type AccountsConfig struct {
+	DefaultCreditLimit string `yaml:"default_credit_limit" env:"APP_ACCOUNTS_DEFAULT_CREDIT_LIMIT"`
+}
+type IdempotencyConfig struct {
+	TTL time.Duration `yaml:"ttl" env:"APP_IDEMPOTENCY_TTL"`
+	// Lease is how long a request in flight holds its key; a key left behind
+	// by a process that died can be retried after it.
+	Lease time.Duration `yaml:"lease" env:"APP_IDEMPOTENCY_LEASE"`
 }
 
-func LoadFromFile(filePath string) (*Config, error) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
-	}
+// FXConfig holds the exchange rates used to convert transactions made in a
+// currency other than the account's. With neither set, such transactions are
+// rejected.
+type FXConfig struct {
+	// Rates is a comma-separated list of FROM/TO[@YYYY-MM-DD]=RATE entries.
+	Rates string `yaml:"rates" env:"APP_FX_RATES"`
+	// RatesFile is a CSV file of since,from,to,rate rows, merged with Rates.
+	RatesFile string `yaml:"rates_file" env:"APP_FX_RATES_FILE"`
+}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
-	}
+// TracingConfig selects where spans are exported.
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp.
+	Exporter string `yaml:"exporter" env:"APP_TRACING_EXPORTER"`
+	// OTLPEndpoint is the OTLP/HTTP traces URL of the collector.
+	OTLPEndpoint string `yaml:"otlp_endpoint" env:"APP_TRACING_OTLP_ENDPOINT"`
+	ServiceName  string `yaml:"service_name" env:"APP_TRACING_SERVICE_NAME"`
+	// SampleRatio is the fraction of new traces kept; incoming sampled
+	// traces are always continued.
+	SampleRatio float64 `yaml:"sample_ratio" env:"APP_TRACING_SAMPLE_RATIO"`
+}
 
-	return &cfg, nil
+// AuthConfig controls authentication of API clients. API keys are always
+// accepted once enabled; JWTs only when JWKSFile is set.
+type AuthConfig struct {
+	Enabled bool `yaml:"enabled" env:"APP_AUTH_ENABLED"`
+	// JWKSFile is a JSON Web Key Set of the HS256 and RS256 keys JWTs may be
+	// signed with.
+	JWKSFile string `yaml:"jwks_file" env:"APP_AUTH_JWKS_FILE"`
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string `yaml:"jwt_issuer" env:"APP_AUTH_JWT_ISSUER"`
+	Audience string `yaml:"jwt_audience" env:"APP_AUTH_JWT_AUDIENCE"`
 }
 
-func Load() (*Config, error) {
-	cfg := &Config{
-		Server: ServerConfig{
-			Port:         getEnvInt("APP_SERVER_PORT", 8080),
-			ReadTimeout:  getEnvDuration("APP_SERVER_READ_TIMEOUT", 5*time.Second),
-			WriteTimeout: getEnvDuration("APP_SERVER_WRITE_TIMEOUT", 10*time.Second),
-			IdleTimeout:  getEnvDuration("APP_SERVER_IDLE_TIMEOUT", 60*time.Second),
-		},
-		Logging: LoggingConfig{
-			Level: getEnvString("APP_LOGGING_LEVEL", "info"),
-		},
-		Database: DatabaseConfig{
-			Type:     getEnvString("APP_DATABASE_TYPE", "memory"),
-			Host:     getEnvString("APP_DATABASE_HOST", "localhost"),
-			Port:     getEnvInt("APP_DATABASE_PORT", 5432),
-			User:     getEnvString("APP_DATABASE_USER", "postgres"),
-			Password: getEnvString("APP_DATABASE_PASSWORD", "postgres"),
-			DBName:   getEnvString("APP_DATABASE_DBNAME", "transaction_routine"),
-			SSLMode:  getEnvString("APP_DATABASE_SSLMODE", "disable"),
-		},
-	}
+// RateLimitConfig throttles each client, identified by its credentials or
+// else its address, with a token bucket.
+type RateLimitConfig struct {
+	// RequestsPerSecond refills each bucket; zero disables rate limiting.
+	RequestsPerSecond float64 `yaml:"requests_per_second" env:"APP_RATE_LIMIT_RPS" reload:"true"`
+	Burst             int     `yaml:"burst" env:"APP_RATE_LIMIT_BURST" reload:"true"`
+	// TrustForwardedFor takes the address of clients without credentials
+	// from the X-Forwarded-For entry added by a proxy.
+	TrustForwardedFor bool `yaml:"trust_forwarded_for" env:"APP_RATE_LIMIT_TRUST_FORWARDED_FOR" reload:"true"`
+}
 
-	return cfg, nil
+// VelocityConfig caps the debits each account may make over a rolling
+// window. Zero limits are not enforced.
+type VelocityConfig struct {
+	Window    time.Duration `yaml:"window" env:"APP_VELOCITY_WINDOW" reload:"true"`
+	MaxDebits int           `yaml:"max_debits" env:"APP_VELOCITY_MAX_DEBITS" reload:"true"`
+	// MaxAmount is in BRL and converted into each account's currency at the
+	// fx rates.
+	MaxAmount string `yaml:"max_amount" env:"APP_VELOCITY_MAX_AMOUNT" reload:"true"`
 }
 
-func getEnvString(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return defaultValue
+// FeaturesConfig switches optional API features on and off; a disabled
+// feature answers 403.
+type FeaturesConfig struct {
+	Installments    bool `yaml:"installments" env:"APP_FEATURES_INSTALLMENTS" reload:"true"`
+	Reversals       bool `yaml:"reversals" env:"APP_FEATURES_REVERSALS" reload:"true"`
+	ForeignCurrency bool `yaml:"foreign_currency" env:"APP_FEATURES_FOREIGN_CURRENCY" reload:"true"`
+}
+type DatabaseConfig struct {
+	Type     string `yaml:"type" env:"APP_DATABASE_TYPE"`
+	Host     string `yaml:"host" env:"APP_DATABASE_HOST"`
+	Port     int    `yaml:"port" env:"APP_DATABASE_PORT"`
+	User     string `yaml:"user" env:"APP_DATABASE_USER"`
+	Password string `yaml:"password" env:"APP_DATABASE_PASSWORD" secret:"true"`
+	DBName   string `yaml:"dbname" env:"APP_DATABASE_DBNAME"`
+	SSLMode  string `yaml:"sslmode" env:"APP_DATABASE_SSLMODE"`
+	// AutoMigrate applies pending schema migrations on startup.
+	AutoMigrate bool `yaml:"auto_migrate" env:"APP_DATABASE_AUTO_MIGRATE"`
+	// QueryTimeout bounds each repository call; zero leaves only the request deadline.
+	QueryTimeout time.Duration `yaml:"query_timeout" env:"APP_DATABASE_QUERY_TIMEOUT"`
+	// Connection pool; zero leaves the database/sql default.
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"APP_DATABASE_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"APP_DATABASE_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"APP_DATABASE_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"APP_DATABASE_CONN_MAX_IDLE_TIME"`
+	// ConnectAttempts is how many times the database is pinged on startup,
+	// waiting ConnectBackoff after the first failure and twice as long after
+	// each further one, up to ConnectMaxBackoff.
+	ConnectAttempts   int           `yaml:"connect_attempts" env:"APP_DATABASE_CONNECT_ATTEMPTS"`
+	ConnectBackoff    time.Duration `yaml:"connect_backoff" env:"APP_DATABASE_CONNECT_BACKOFF"`
+	ConnectMaxBackoff time.Duration `yaml:"connect_max_backoff" env:"APP_DATABASE_CONNECT_MAX_BACKOFF"`
+	// Replicas lists read replicas as comma-separated host or host:port
+	// entries; see ReplicaAddrs. They share the user, password and dbname of
+	// the primary.
+	Replicas             string        `yaml:"replicas" env:"APP_DATABASE_REPLICAS"`
+	ReplicaMaxLag        time.Duration `yaml:"replica_max_lag" env:"APP_DATABASE_REPLICA_MAX_LAG"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval" env:"APP_DATABASE_REPLICA_CHECK_INTERVAL"`
+	// ReadYourWrites is how long after a write a client's reads stay on the
+	// primary.
+	ReadYourWrites time.Duration `yaml:"read_your_writes" env:"APP_DATABASE_READ_YOUR_WRITES"`
+	// The file store keeps its log and snapshots in FileDir. FileSync is
+	// always, interval (every FileSyncInterval) or never; FileSnapshotEvery
+	// is how many writes pass between snapshots, zero for none.
+	FileDir           string        `yaml:"file_dir" env:"APP_DATABASE_FILE_DIR"`
+	FileSync          string        `yaml:"file_sync" env:"APP_DATABASE_FILE_SYNC"`
+	FileSyncInterval  time.Duration `yaml:"file_sync_interval" env:"APP_DATABASE_FILE_SYNC_INTERVAL"`
+	FileSnapshotEvery int           `yaml:"file_snapshot_every" env:"APP_DATABASE_FILE_SNAPSHOT_EVERY"`
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value, exists := os.LookupEnv(key); exists {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// ReplicaAddrs splits Replicas into its entries.
+func (d DatabaseConfig) ReplicaAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(d.Replicas, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
 		}
 	}
-	return defaultValue
+	return addrs
 }
 
-func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	if value, exists := os.LookupEnv(key); exists {
-		if duration, err := time.ParseDuration(value); err == nil {
-			return duration
-		}
+// Default returns the configuration used for every setting that neither the
+// file, the environment nor a flag sets.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:         8080,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+		Database: DatabaseConfig{
+			Type:     "memory",
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "postgres",
+			DBName:   "transaction_routine",
+			SSLMode:  "disable",
+
+			AutoMigrate:  true,
+			QueryTimeout: 5 * time.Second,
+
+			MaxOpenConns:    25,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+
+			ConnectAttempts:   10,
+			ConnectBackoff:    500 * time.Millisecond,
+			ConnectMaxBackoff: 10 * time.Second,
+
+			ReplicaMaxLag:        5 * time.Second,
+			ReplicaCheckInterval: 5 * time.Second,
+			ReadYourWrites:       5 * time.Second,
+
+			FileDir:           "data",
+			FileSync:          "always",
+			FileSyncInterval:  time.Second,
+			FileSnapshotEvery: 10000,
+		},
+		Accounts: AccountsConfig{
+			DefaultCreditLimit: "1000.00",
+		},
+		Idempotency: IdempotencyConfig{
+			TTL:   24 * time.Hour,
+			Lease: time.Minute,
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "http://localhost:4318/v1/traces",
+			ServiceName:  "transaction-routine",
+			SampleRatio:  1,
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: 50,
+			Burst:             100,
+		},
+		Velocity: VelocityConfig{
+			Window: time.Hour,
+		},
+		Features: FeaturesConfig{
+			Installments:    true,
+			Reversals:       true,
+			ForeignCurrency: true,
+		},
 	}
-	return defaultValue
 }
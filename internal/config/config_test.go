@@ -0,0 +1,233 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The shipped config.yaml must load, and every key in it must map to a
+// setting.
+func TestLoad_ShippedConfig(t *testing.T) {
+	cfg, err := Load("../../config/config.yaml", nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server.ReadTimeout != 5*time.Second || cfg.Database.DBName != "transaction_routine" || cfg.Database.SSLMode != "disable" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
+
+func TestLoad_Layers(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+server:
+  port: 9000
+  read_timeout: 2s
+database:
+  type: postgres
+  dbname: from_file
+  sslmode: require
+`)
+	t.Setenv("APP_SERVER_PORT", "9100")
+	t.Setenv("APP_DATABASE_HOST", "db.internal")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-server.port", "9200", "-tracing.sample_ratio", "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path, fs)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"flag over env over file", cfg.Server.Port, 9200},
+		{"file over default", cfg.Server.ReadTimeout, 2 * time.Second},
+		{"default", cfg.Server.WriteTimeout, 10 * time.Second},
+		{"file", cfg.Database.DBName, "from_file"},
+		{"file", cfg.Database.SSLMode, "require"},
+		{"env over default", cfg.Database.Host, "db.internal"},
+		{"flag", cfg.Tracing.SampleRatio, 0.5},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	if _, err := Load(writeFile(t, "typo.yaml", "server:\n  prot: 80\n"), nil); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("expected an error naming the unknown key, got %v", err)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), nil); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+
+	t.Setenv("APP_SERVER_IDLE_TIMEOUT", "soon")
+	t.Setenv("APP_SERVER_PORT", "70000")
+	t.Setenv("APP_DATABASE_TYPE", "mysql")
+	t.Setenv("APP_SERVER_READ_TIMEOUT", "0s")
+	t.Setenv("APP_TRACING_EXPORTER", "jaeger")
+	_, err := Load("", nil)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"APP_SERVER_IDLE_TIMEOUT", "server.port", "database.type", "server.read_timeout", "tracing.exporter"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s to be reported in:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("defaults must be valid: %v", err)
+	}
+	cfg := Default()
+	cfg.Database.Type = "postgres"
+	cfg.Database.Host = ""
+	cfg.Logging.Level = "loud"
+	cfg.Accounts.DefaultCreditLimit = "-5"
+	cfg.RateLimit.Burst = 0
+	cfg.Velocity.MaxDebits = 5
+	cfg.Velocity.Window = 0
+	cfg.Idempotency.Lease = time.Second
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 6 {
+		t.Errorf("expected 6 problems, got:\n%v", err)
+	}
+}
+
+func TestValidate_Replicas(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Type = "postgres"
+	cfg.Database.Replicas = " replica-1:5433, replica-2 ,"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if got := strings.Join(cfg.Database.ReplicaAddrs(), "|"); got != "replica-1:5433|replica-2" {
+		t.Errorf("unexpected replica addresses %q", got)
+	}
+
+	cfg.Database.Replicas = "replica-1:http,replica-2:5433:1"
+	cfg.Database.ReplicaCheckInterval = 0
+	err := cfg.Validate()
+	for _, want := range []string{`invalid port in "replica-1:http"`, `invalid address "replica-2:5433:1"`, "database.replica_check_interval"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestValidate_File(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Type = "file"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	cfg.Database.FileDir = ""
+	cfg.Database.FileSync = "interval"
+	cfg.Database.FileSyncInterval = 0
+	cfg.Database.FileSnapshotEvery = -1
+	err := cfg.Validate()
+	for _, want := range []string{"database.file_dir", "database.file_sync_interval", "database.file_snapshot_every"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+	cfg.Database.FileSync = "sometimes"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `got "sometimes"`) {
+		t.Errorf("expected the unknown sync policy to be refused, got %v", err)
+	}
+}
+
+func TestLoad_SecretFromFile(t *testing.T) {
+	t.Setenv("APP_DATABASE_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+	cfg, err := Load("", nil)
+	if err != nil || cfg.Database.Password != "s3cret" {
+		t.Fatalf("expected the password from the file: %+v, %v", cfg, err)
+	}
+
+	t.Setenv("APP_DATABASE_PASSWORD", "other")
+	if _, err := Load("", nil); err == nil {
+		t.Errorf("expected an error when both the variable and its file are set")
+	}
+}
+
+func TestRedactAndWriteYAML(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Password = "s3cret"
+	var buf bytes.Buffer
+	if err := cfg.Redact().WriteYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "s3cret") || !strings.Contains(out, "password: "+Redacted) {
+		t.Errorf("expected the password to be redacted:\n%s", out)
+	}
+	if cfg.Database.Password != "s3cret" {
+		t.Errorf("Redact must not change the original")
+	}
+	if !strings.Contains(out, "read_timeout: 5s") {
+		t.Errorf("expected durations to be written as text:\n%s", out)
+	}
+
+	// The output is a valid config file.
+	loaded, err := Load(writeFile(t, "printed.yaml", out), nil)
+	if err != nil || loaded.Server.IdleTimeout != cfg.Server.IdleTimeout || loaded.Database.Password != Redacted {
+		t.Errorf("reloading printed config: %+v, %v", loaded, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg := Default()
+	next := Default()
+	next.Logging.Level = "debug"
+	next.RateLimit.Burst = 7
+	next.Velocity.MaxAmount = "500"
+	next.Features.Reversals = false
+	next.Server.Port = 9090
+	next.Database.Type = "postgres"
+
+	applied, restart := cfg.Reload(next)
+	if strings.Join(applied, ",") != "logging.level,rate_limit.burst,velocity.max_amount,features.reversals" {
+		t.Errorf("unexpected applied settings %v", applied)
+	}
+	if strings.Join(restart, ",") != "server.port,database.type" {
+		t.Errorf("unexpected restart settings %v", restart)
+	}
+	if cfg.Logging.Level != "debug" || cfg.RateLimit.Burst != 7 || cfg.Velocity.MaxAmount != "500" {
+		t.Errorf("expected the reloadable settings to be copied: %+v", cfg)
+	}
+	if cfg.Server.Port != Default().Server.Port || cfg.Database.Type != "memory" {
+		t.Errorf("settings that need a restart must keep their value: %+v", cfg)
+	}
+
+	// Until the restart, the same settings are still reported.
+	applied, restart = cfg.Reload(next)
+	if len(applied) != 0 || len(restart) != 2 {
+		t.Errorf("expected only the restart settings, got %v and %v", applied, restart)
+	}
+}
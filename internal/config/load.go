@@ -0,0 +1,221 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces the value of secret settings in Redact output.
+const Redacted = "REDACTED"
+
+// setting is one leaf of Config: a field tagged with its yaml key and
+// environment variable.
+type setting struct {
+	// key is the dotted yaml path, e.g. server.read_timeout; it is also the
+	// name of the setting's flag.
+	key    string
+	env    string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+// settings returns the leaves of cfg, in declaration order.
+func settings(cfg *Config) []setting {
+	var out []setting
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i)
+		sv := root.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			f := sv.Type().Field(j)
+			out = append(out, setting{
+				key:    section.Tag.Get("yaml") + "." + f.Tag.Get("yaml"),
+				env:    f.Tag.Get("env"),
+				secret: f.Tag.Get("secret") == "true",
+				reload: f.Tag.Get("reload") == "true",
+				value:  sv.Field(j),
+			})
+		}
+	}
+	return out
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses raw into the setting. Strings are kept as they are, so secrets
+// may have surrounding spaces.
+func (s setting) set(raw string) error {
+	v := s.value
+	if v.Kind() == reflect.String {
+		v.SetString(raw)
+		return nil
+	}
+	raw = strings.TrimSpace(raw)
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Load builds the configuration in layers, each overriding the one before:
+// the defaults, the YAML file at path when not empty, APP_* environment
+// variables, and the flags set in fs when not nil, as registered by
+// RegisterFlags. Secret settings such as the database password may also be
+// read from the file named by their variable with a _FILE suffix, e.g.
+// APP_DATABASE_PASSWORD_FILE. The result is validated; every problem found
+// is reported in one error.
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := loadFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	byKey := make(map[string]setting)
+	for _, s := range settings(cfg) {
+		byKey[s.key] = s
+		if err := loadEnv(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			if s, ok := byKey[f.Name]; ok {
+				if err := s.set(f.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", f.Name, err))
+				}
+			}
+		})
+	}
+	if err := errors.Join(append(errs, cfg.Validate())...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads the YAML file at path over cfg. Keys that match no setting
+// are an error, so typos do not go unnoticed.
+func loadFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func loadEnv(s setting) error {
+	value, ok := os.LookupEnv(s.env)
+	if s.secret {
+		if file, fromFile := os.LookupEnv(s.env + "_FILE"); fromFile {
+			if ok {
+				return fmt.Errorf("%s and %s_FILE are both set", s.env, s.env)
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", s.env, err)
+			}
+			value, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+	}
+	if !ok {
+		return nil
+	}
+	if err := s.set(value); err != nil {
+		return fmt.Errorf("%s: %w", s.env, err)
+	}
+	return nil
+}
+
+// RegisterFlags adds a flag to fs for every setting, named by its yaml key,
+// e.g. -server.port, for Load to apply over the file and environment.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, s := range settings(Default()) {
+		fs.String(s.key, "", fmt.Sprintf("overrides %s and $%s", s.key, s.env))
+	}
+}
+
+// Reload copies into c the settings of next that can change at runtime, those
+// tagged reload, and returns the keys of the ones that differed. The keys of
+// the other settings that differ are returned in restart; c keeps their
+// values, as they only take effect on a restart.
+func (c *Config) Reload(next *Config) (applied, restart []string) {
+	current := settings(c)
+	for i, s := range settings(next) {
+		if current[i].value.Equal(s.value) {
+			continue
+		}
+		if s.reload {
+			current[i].value.Set(s.value)
+			applied = append(applied, s.key)
+		} else {
+			restart = append(restart, s.key)
+		}
+	}
+	return applied, restart
+}
+
+// Redact returns a copy of c with the value of every secret setting that is
+// set replaced by Redacted.
+func (c *Config) Redact() *Config {
+	redacted := *c
+	for _, s := range settings(&redacted) {
+		if s.secret && !s.value.IsZero() {
+			s.value.SetString(Redacted)
+		}
+	}
+	return &redacted
+}
+
+// WriteYAML writes c in the format Load reads.
+func (c *Config) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"go.uber.org/zap/zapcore"
+)
+
+// Validate checks every setting and reports all problems found, one per
+// line, keyed by yaml path.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			fail(key, "must be positive, got %s", d)
+		}
+	}
+	notNegative := func(key string, d time.Duration) {
+		if d < 0 {
+			fail(key, "must not be negative, got %s", d)
+		}
+	}
+	port := func(key string, p int) {
+		if p < 1 || p > 65535 {
+			fail(key, "must be between 1 and 65535, got %d", p)
+		}
+	}
+	money := func(key, amount string) {
+		if amount == "" {
+			return
+		}
+		m, err := domain.ParseMoney(amount, domain.DefaultCurrency)
+		if err != nil {
+			fail(key, "%v", err)
+		} else if m.IsNegative() {
+			fail(key, "must not be negative, got %s", amount)
+		}
+	}
+
+	port("server.port", c.Server.Port)
+	positive("server.read_timeout", c.Server.ReadTimeout)
+	positive("server.write_timeout", c.Server.WriteTimeout)
+	positive("server.idle_timeout", c.Server.IdleTimeout)
+	notNegative("server.shutdown_delay", c.Server.ShutdownDelay)
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+		fail("logging.level", "unknown level %q", c.Logging.Level)
+	}
+
+	switch c.Database.Type {
+	case "memory":
+	case "postgres":
+		if c.Database.Host == "" {
+			fail("database.host", "must be set for postgres")
+		}
+		port("database.port", c.Database.Port)
+		if c.Database.DBName == "" {
+			fail("database.dbname", "must be set for postgres")
+		}
+	case "file":
+		if c.Database.FileDir == "" {
+			fail("database.file_dir", "must be set for file")
+		}
+		switch c.Database.FileSync {
+		case "always", "never":
+		case "interval":
+			positive("database.file_sync_interval", c.Database.FileSyncInterval)
+		default:
+			fail("database.file_sync", "must be always, interval or never, got %q", c.Database.FileSync)
+		}
+		if c.Database.FileSnapshotEvery < 0 {
+			fail("database.file_snapshot_every", "must not be negative, got %d", c.Database.FileSnapshotEvery)
+		}
+	default:
+		fail("database.type", "must be memory, postgres or file, got %q", c.Database.Type)
+	}
+	notNegative("database.query_timeout", c.Database.QueryTimeout)
+	if c.Database.MaxOpenConns < 0 {
+		fail("database.max_open_conns", "must not be negative, got %d", c.Database.MaxOpenConns)
+	}
+	if c.Database.MaxIdleConns < 0 {
+		fail("database.max_idle_conns", "must not be negative, got %d", c.Database.MaxIdleConns)
+	}
+	notNegative("database.conn_max_lifetime", c.Database.ConnMaxLifetime)
+	notNegative("database.conn_max_idle_time", c.Database.ConnMaxIdleTime)
+	if c.Database.ConnectAttempts < 1 {
+		fail("database.connect_attempts", "must be at least 1, got %d", c.Database.ConnectAttempts)
+	}
+	if c.Database.ConnectAttempts > 1 {
+		positive("database.connect_backoff", c.Database.ConnectBackoff)
+	}
+	notNegative("database.connect_max_backoff", c.Database.ConnectMaxBackoff)
+	if replicas := c.Database.ReplicaAddrs(); len(replicas) > 0 {
+		if c.Database.Type != "postgres" {
+			fail("database.replicas", "only apply to postgres")
+		}
+		for _, addr := range replicas {
+			if _, p, err := net.SplitHostPort(addr); err == nil {
+				if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+					fail("database.replicas", "invalid port in %q", addr)
+				}
+			} else if strings.Contains(addr, ":") {
+				fail("database.replicas", "invalid address %q", addr)
+			}
+		}
+		positive("database.replica_max_lag", c.Database.ReplicaMaxLag)
+		positive("database.replica_check_interval", c.Database.ReplicaCheckInterval)
+	}
+	notNegative("database.read_your_writes", c.Database.ReadYourWrites)
+
+	money("accounts.default_credit_limit", c.Accounts.DefaultCreditLimit)
+	notNegative("idempotency.ttl", c.Idempotency.TTL)
+	if c.Idempotency.TTL > 0 {
+		positive("idempotency.lease", c.Idempotency.Lease)
+		// A request outliving its lease could run twice.
+		if c.Idempotency.Lease < c.Server.WriteTimeout {
+			fail("idempotency.lease", "must be at least server.write_timeout (%s), got %s", c.Server.WriteTimeout, c.Idempotency.Lease)
+		}
+	}
+
+	if !slices.Contains([]string{"", "none", "stdout", "otlp"}, c.Tracing.Exporter) {
+		fail("tracing.exporter", "must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.Exporter == "otlp" && c.Tracing.OTLPEndpoint == "" {
+		fail("tracing.otlp_endpoint", "must be set for the otlp exporter")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+
+	if c.RateLimit.RequestsPerSecond < 0 {
+		fail("rate_limit.requests_per_second", "must not be negative, got %g", c.RateLimit.RequestsPerSecond)
+	}
+	if c.RateLimit.RequestsPerSecond > 0 && c.RateLimit.Burst < 1 {
+		fail("rate_limit.burst", "must be at least 1, got %d", c.RateLimit.Burst)
+	}
+
+	if c.Velocity.MaxDebits < 0 {
+		fail("velocity.max_debits", "must not be negative, got %d", c.Velocity.MaxDebits)
+	}
+	money("velocity.max_amount", c.Velocity.MaxAmount)
+	if c.Velocity.MaxDebits > 0 || c.Velocity.MaxAmount != "" {
+		positive("velocity.window", c.Velocity.Window)
+	}
+
+	return errors.Join(errs...)
+}
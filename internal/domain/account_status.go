@@ -0,0 +1,86 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Account statuses. Blocked accounts still accept credits, closed accounts
+// accept nothing; a closed account cannot be reopened.
+const (
+	AccountActive  = "active"
+	AccountBlocked = "blocked"
+	AccountClosed  = "closed"
+)
+
+var (
+	ErrAccountBlocked          = errors.New("account is blocked")
+	ErrAccountClosed           = errors.New("account is closed")
+	ErrInvalidStatusTransition = errors.New("invalid account status transition")
+	ErrAccountHasBalance       = errors.New("account has a non-zero balance")
+	ErrStatusReasonRequired    = errors.New("reason is required")
+)
+
+// AccountStatusChange is one entry of an account's status history.
+type AccountStatusChange struct {
+	ID        int64     `json:"id"`
+	AccountID int64     `json:"account_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// IsActive reports whether the account is active. Accounts stored before
+// statuses existed have none and count as active.
+func (a Account) IsActive() bool {
+	return a.Status == "" || a.Status == AccountActive
+}
+
+// CanPost reports whether a transaction of amount (negative for debits) may
+// be posted to the account in its current status.
+func (a Account) CanPost(amount Money) error {
+	switch {
+	case a.Status == AccountClosed:
+		return ErrAccountClosed
+	case a.Status == AccountBlocked && amount.IsNegative():
+		return ErrAccountBlocked
+	}
+	return nil
+}
+
+// Outstanding returns what the account owes, or is owed when negative: the
+// credit limit less the available balance.
+func (a Account) Outstanding() (Money, error) {
+	return a.CreditLimit.Sub(a.AvailableBalance)
+}
+
+// ChangeStatus returns the history entry moving the account to status at t.
+// Active and blocked accounts may switch between each other or be closed,
+// the latter only once nothing is outstanding.
+func (a Account) ChangeStatus(status, reason string, t time.Time) (AccountStatusChange, error) {
+	if reason == "" {
+		return AccountStatusChange{}, ErrStatusReasonRequired
+	}
+	from := a.Status
+	if from == "" {
+		from = AccountActive
+	}
+	switch {
+	case from == AccountClosed:
+		return AccountStatusChange{}, fmt.Errorf("%w: %w", ErrInvalidStatusTransition, ErrAccountClosed)
+	case from == status,
+		status != AccountActive && status != AccountBlocked && status != AccountClosed:
+		return AccountStatusChange{}, fmt.Errorf("%w: %s to %s", ErrInvalidStatusTransition, from, status)
+	case status == AccountClosed:
+		outstanding, err := a.Outstanding()
+		if err != nil {
+			return AccountStatusChange{}, err
+		}
+		if !outstanding.IsZero() {
+			return AccountStatusChange{}, fmt.Errorf("%w: %s outstanding", ErrAccountHasBalance, outstanding)
+		}
+	}
+	return AccountStatusChange{AccountID: a.ID, From: from, To: status, Reason: reason, ChangedAt: t}, nil
+}
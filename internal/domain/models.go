@@ -1,36 +1,112 @@
 package domain
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+var ErrInsufficientBalance = errors.New("insufficient available balance")
 
+// Account carries a credit limit and the running available balance, both in
+// the account's currency. Debits reduce the available balance and may not
+// take it below zero; payments restore it. Status restricts what may be
+// posted; see CanPost.
 type Account struct {
-	ID             int64  `json:"account_id"`
-	DocumentNumber string `json:"document_number"`
+	ID               int64  `json:"account_id"`
+	DocumentType     string `json:"document_type"`
+	DocumentNumber   string `json:"document_number"`
+	Currency         string `json:"currency"`
+	CreditLimit      Money  `json:"credit_limit"`
+	AvailableBalance Money  `json:"available_balance"`
+	Status           string `json:"status"`
 }
 
+// Transaction amounts are negative for debits and positive for payments.
+// Balance is the part of the amount not yet settled: a debit's balance moves
+// towards zero as payments discharge it, and a payment keeps whatever surplus
+// was left after settling the account's open debits.
 type Transaction struct {
 	ID              int64     `json:"transaction_id"`
 	AccountID       int64     `json:"account_id"`
 	OperationTypeID int       `json:"operation_type_id"`
-	Amount          float64   `json:"amount"`
+	Amount          Money     `json:"amount"`
+	Balance         Money     `json:"balance"`
 	EventDate       time.Time `json:"event_date"`
+	// ReversesTransactionID is set on refunds and payment reversals and
+	// points at the transaction they compensate.
+	ReversesTransactionID *int64 `json:"reverses_transaction_id,omitempty"`
+	// An installment purchase is a parent with InstallmentCount set and a zero
+	// balance, plus one child per installment carrying ParentTransactionID,
+	// its InstallmentNumber (from 1) and its due date as EventDate.
+	InstallmentCount    int    `json:"installment_count,omitempty"`
+	ParentTransactionID *int64 `json:"parent_transaction_id,omitempty"`
+	InstallmentNumber   int    `json:"installment_number,omitempty"`
+	// Currency is the account currency, which Amount and Balance are in.
+	Currency string `json:"currency"`
+	// For transactions made in another currency, the amount as made and the
+	// rate used to convert it into the account currency at event_date.
+	OriginalAmount   *Money `json:"original_amount,omitempty"`
+	OriginalCurrency string `json:"original_currency,omitempty"`
+	ExchangeRate     *Rate  `json:"exchange_rate,omitempty"`
 }
 
-type OperationType struct {
-	ID          int    `json:"id"`
-	Description string `json:"description"`
+// Settlement records how much of a payment went towards one debit.
+type Settlement struct {
+	TransactionID int64 `json:"transaction_id"`
+	Amount        Money `json:"amount"`
 }
 
+const (
+	DirectionDebit  = "debit"
+	DirectionCredit = "credit"
+)
+
+// IDs of the built-in operation types. Everything else about them, including
+// their direction, lives with the operation type data; the IDs are only
+// needed where a type has behaviour of its own.
 const (
 	OpCashPurchase        = 1
 	OpInstallmentPurchase = 2
 	OpWithdrawal          = 3
 	OpPayment             = 4
+	// OpRefund reverses a purchase or withdrawal; OpPaymentReversal reverses a
+	// payment. Both are only created through the reversal endpoint.
+	OpRefund          = 5
+	OpPaymentReversal = 6
 )
 
-func IsDebitOperation(opID int) bool {
-	return opID == OpCashPurchase || opID == OpInstallmentPurchase || opID == OpWithdrawal
+// IsReversalOperation reports whether opID is one of the built-in types that
+// only the reversal flow may create.
+func IsReversalOperation(opID int) bool {
+	return opID == OpRefund || opID == OpPaymentReversal
+}
+
+// ReversalOperation returns the operation type that compensates a transaction
+// of type opID with the given signed amount: a refund for debits and a
+// payment reversal for credits. Reversals themselves cannot be reversed.
+func ReversalOperation(opID int, amount Money) (int, bool) {
+	switch {
+	case IsReversalOperation(opID) || amount.IsZero():
+		return 0, false
+	case amount.IsNegative():
+		return OpRefund, true
+	}
+	return OpPaymentReversal, true
 }
 
-func IsCreditOperation(opID int) bool {
-	return opID == OpPayment
+// BalanceAfter returns the available balance once amount (negative for
+// debits) is posted, or ErrInsufficientBalance if a debit would take it
+// below zero. The account's status must allow the posting.
+func (a Account) BalanceAfter(amount Money) (Money, error) {
+	if err := a.CanPost(amount); err != nil {
+		return Money{}, err
+	}
+	next, err := a.AvailableBalance.Add(amount)
+	if err != nil {
+		return Money{}, err
+	}
+	if amount.IsNegative() && next.IsNegative() {
+		return Money{}, ErrInsufficientBalance
+	}
+	return next, nil
 }
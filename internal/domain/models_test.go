@@ -1,41 +1,151 @@
 package domain
 
 import (
+	"errors"
 	"testing"
+	"time"
 )
 
-func TestIsDebitOperation(t *testing.T) {
-	if !IsDebitOperation(OpCashPurchase) {
-		t.Errorf("OpCashPurchase should be debit")
+func TestAccountBalanceAfter(t *testing.T) {
+	acc := Account{AvailableBalance: MustParseMoney("100", DefaultCurrency)}
+
+	next, err := acc.BalanceAfter(MustParseMoney("-100", DefaultCurrency))
+	if err != nil || !next.IsZero() {
+		t.Errorf("debit of full balance: got %s, %v", next, err)
+	}
+	if _, err := acc.BalanceAfter(MustParseMoney("-100.01", DefaultCurrency)); err != ErrInsufficientBalance {
+		t.Errorf("expected ErrInsufficientBalance, got %v", err)
+	}
+
+	acc.AvailableBalance = MustParseMoney("-5", DefaultCurrency)
+	next, err = acc.BalanceAfter(MustParseMoney("3", DefaultCurrency))
+	if err != nil || next != MustParseMoney("-2", DefaultCurrency) {
+		t.Errorf("payment: got %s, %v", next, err)
+	}
+}
+
+func TestReversalOperation(t *testing.T) {
+	cases := []struct {
+		op     int
+		amount string
+		want   int
+		ok     bool
+	}{
+		{OpCashPurchase, "-10", OpRefund, true},
+		{OpWithdrawal, "-10", OpRefund, true},
+		{OpPayment, "10", OpPaymentReversal, true},
+		{100, "10", OpPaymentReversal, true},
+		{OpRefund, "10", 0, false},
+		{OpPaymentReversal, "-10", 0, false},
+		{OpCashPurchase, "0", 0, false},
+	}
+	for _, c := range cases {
+		if got, ok := ReversalOperation(c.op, MustParseMoney(c.amount, DefaultCurrency)); got != c.want || ok != c.ok {
+			t.Errorf("ReversalOperation(%d, %s) = %d, %v; want %d, %v", c.op, c.amount, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestOperationTypeSigned(t *testing.T) {
+	amount := MustParseMoney("10", DefaultCurrency)
+	if got, _ := (OperationType{Direction: DirectionDebit}).Signed(amount); got != amount.Neg() {
+		t.Errorf("debit: got %s", got)
+	}
+	if got, _ := (OperationType{Direction: DirectionCredit}).Signed(amount.Neg()); got != amount {
+		t.Errorf("credit: got %s", got)
+	}
+	if _, err := (OperationType{ID: 7}).Signed(amount); !errors.Is(err, ErrUnknownDirection) {
+		t.Errorf("expected ErrUnknownDirection, got %v", err)
+	}
+}
+
+func TestOperationTypeCheck(t *testing.T) {
+	min, max := MustParseMoney("5", DefaultCurrency), MustParseMoney("100", DefaultCurrency)
+	ot := OperationType{MinAmount: &min, MaxAmount: &max, AllowedHours: &HourWindow{From: 22, To: 6}}
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	if err := ot.Check(MustParseMoney("-50", DefaultCurrency), night); err != nil {
+		t.Errorf("expected amount and hour to pass, got %v", err)
 	}
-	if !IsDebitOperation(OpInstallmentPurchase) {
-		t.Errorf("OpInstallmentPurchase should be debit")
+	if err := ot.Check(MustParseMoney("4.99", DefaultCurrency), night); !errors.Is(err, ErrAmountOutOfRange) {
+		t.Errorf("expected ErrAmountOutOfRange below minimum, got %v", err)
 	}
-	if !IsDebitOperation(OpWithdrawal) {
-		t.Errorf("OpWithdrawal should be debit")
+	if err := ot.Check(MustParseMoney("100.01", DefaultCurrency), night); !errors.Is(err, ErrAmountOutOfRange) {
+		t.Errorf("expected ErrAmountOutOfRange above maximum, got %v", err)
 	}
-	if IsDebitOperation(OpPayment) {
-		t.Errorf("OpPayment should not be debit")
+	if err := ot.Check(MustParseMoney("50", DefaultCurrency), night.Add(-12*time.Hour)); !errors.Is(err, ErrOutsideAllowedHours) {
+		t.Errorf("expected ErrOutsideAllowedHours at 11:00, got %v", err)
 	}
-	if IsDebitOperation(999) {
-		t.Errorf("Unknown op should not be debit")
+	if err := ot.Check(MustParseMoney("50", DefaultCurrency), night.Add(6*time.Hour)); err != nil {
+		t.Errorf("expected 05:00 to be inside a wrapping window, got %v", err)
+	}
+	if err := ot.Check(MustParseMoney("1000000", "JPY"), night); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("expected limits in another currency to fail, got %v", err)
 	}
 }
 
-func TestIsCreditOperation(t *testing.T) {
-	if !IsCreditOperation(OpPayment) {
-		t.Errorf("OpPayment should be credit")
+func TestHourWindowValid(t *testing.T) {
+	for _, w := range []HourWindow{{0, 0}, {-1, 5}, {5, 24}} {
+		if w.Valid() {
+			t.Errorf("expected %+v to be invalid", w)
+		}
 	}
-	if IsCreditOperation(OpCashPurchase) {
-		t.Errorf("OpCashPurchase should not be credit")
+	if !(HourWindow{From: 9, To: 18}).Valid() {
+		t.Errorf("expected 9-18 to be valid")
 	}
-	if IsCreditOperation(OpInstallmentPurchase) {
-		t.Errorf("OpInstallmentPurchase should not be credit")
+}
+
+func TestAccountCanPost(t *testing.T) {
+	debit, credit := MustParseMoney("-1", DefaultCurrency), MustParseMoney("1", DefaultCurrency)
+	for _, c := range []struct {
+		status        string
+		debit, credit error
+	}{
+		{"", nil, nil},
+		{AccountActive, nil, nil},
+		{AccountBlocked, ErrAccountBlocked, nil},
+		{AccountClosed, ErrAccountClosed, ErrAccountClosed},
+	} {
+		acc := Account{Status: c.status}
+		if err := acc.CanPost(debit); err != c.debit {
+			t.Errorf("%q debit: got %v, want %v", c.status, err, c.debit)
+		}
+		if err := acc.CanPost(credit); err != c.credit {
+			t.Errorf("%q credit: got %v, want %v", c.status, err, c.credit)
+		}
 	}
-	if IsCreditOperation(OpWithdrawal) {
-		t.Errorf("OpWithdrawal should not be credit")
+}
+
+func TestAccountChangeStatus(t *testing.T) {
+	now := time.Now()
+	brl := func(s string) Money { return MustParseMoney(s, DefaultCurrency) }
+	acc := Account{ID: 7, Status: AccountActive, CreditLimit: brl("100"), AvailableBalance: brl("100")}
+
+	c, err := acc.ChangeStatus(AccountBlocked, "fraud suspicion", now)
+	if err != nil || c != (AccountStatusChange{AccountID: 7, From: AccountActive, To: AccountBlocked, Reason: "fraud suspicion", ChangedAt: now}) {
+		t.Errorf("block: %+v, %v", c, err)
 	}
-	if IsCreditOperation(999) {
-		t.Errorf("Unknown op should not be credit")
+	if _, err := acc.ChangeStatus(AccountBlocked, "", now); !errors.Is(err, ErrStatusReasonRequired) {
+		t.Errorf("expected ErrStatusReasonRequired, got %v", err)
+	}
+	if _, err := acc.ChangeStatus(AccountActive, "again", now); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Errorf("expected ErrInvalidStatusTransition, got %v", err)
+	}
+	if _, err := acc.ChangeStatus("frozen", "x", now); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Errorf("expected ErrInvalidStatusTransition for unknown status, got %v", err)
+	}
+
+	acc.AvailableBalance = brl("60")
+	if _, err := acc.ChangeStatus(AccountClosed, "customer request", now); !errors.Is(err, ErrAccountHasBalance) {
+		t.Errorf("expected ErrAccountHasBalance, got %v", err)
+	}
+	acc.AvailableBalance = brl("100")
+	if _, err := acc.ChangeStatus(AccountClosed, "customer request", now); err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	acc.Status = AccountClosed
+	if _, err := acc.ChangeStatus(AccountActive, "reopen", now); !errors.Is(err, ErrInvalidStatusTransition) || !errors.Is(err, ErrAccountClosed) {
+		t.Errorf("expected ErrInvalidStatusTransition reopening, got %v", err)
 	}
 }
@@ -0,0 +1,335 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used whenever an amount arrives without an explicit currency.
+const DefaultCurrency = "BRL"
+
+var (
+	ErrInvalidMoney     = errors.New("invalid monetary amount")
+	ErrMoneyScale       = errors.New("amount has more decimal places than the currency allows")
+	ErrMoneyOverflow    = errors.New("amount out of range")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+)
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit is not cents.
+var currencyExponents = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"IQD": 3,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"PYG": 0,
+	"TND": 3,
+	"VND": 0,
+}
+
+// CurrencyExponent returns the number of decimal places used by the currency.
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Money is an exact monetary amount: an integer number of minor units
+// (cents for BRL) together with its ISO 4217 currency code.
+type Money struct {
+	units    int64
+	currency string
+}
+
+func NewMoney(units int64, currency string) Money {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Money{units: units, currency: currency}
+}
+
+// ParseMoney parses a decimal string such as "-123.45", or the same in the
+// exponent form JSON numbers may take, such as "-1.2345e2". Inputs with more
+// significant decimal places than the currency allows are rejected rather than
+// rounded; trailing zeros beyond the currency's scale are accepted.
+func ParseMoney(s, currency string) (Money, error) {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	exp := CurrencyExponent(currency)
+
+	str := s
+	if i := strings.IndexAny(str, "eE"); i >= 0 {
+		plain, err := expandExponent(str[:i], str[i+1:])
+		if err != nil {
+			return Money{}, fmt.Errorf("%w: %q", err, s)
+		}
+		str = plain
+	}
+	neg := false
+	if strings.HasPrefix(str, "-") {
+		neg = true
+		str = str[1:]
+	}
+	intPart, fracPart, hasDot := strings.Cut(str, ".")
+	if intPart == "" || !isDigits(intPart) || (hasDot && (fracPart == "" || !isDigits(fracPart))) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	if len(fracPart) > exp {
+		if strings.Trim(fracPart[exp:], "0") != "" {
+			return Money{}, fmt.Errorf("%w: %q (%s allows %d)", ErrMoneyScale, s, currency, exp)
+		}
+		fracPart = fracPart[:exp]
+	}
+	fracPart += strings.Repeat("0", exp-len(fracPart))
+
+	var units int64
+	if digits := strings.TrimLeft(intPart+fracPart, "0"); digits != "" {
+		var err error
+		units, err = strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return Money{}, fmt.Errorf("%w: %q", ErrMoneyOverflow, s)
+		}
+	}
+	if neg {
+		units = -units
+	}
+	return Money{units: units, currency: currency}, nil
+}
+
+// maxDigits bounds the digits expandExponent writes out: an int64 holds at
+// most 19, so anything longer with a nonzero digit cannot fit.
+const maxDigits = 20
+
+// expandExponent rewrites mantissa·10^exponent as a plain decimal by moving
+// the decimal point, so no precision is lost. Values too large for Money are
+// ErrMoneyOverflow and nonzero digits too small for any currency
+// ErrMoneyScale.
+func expandExponent(mantissa, exponent string) (string, error) {
+	sign := ""
+	if strings.HasPrefix(mantissa, "-") {
+		sign, mantissa = "-", mantissa[1:]
+	}
+	intPart, fracPart, hasDot := strings.Cut(mantissa, ".")
+	if intPart == "" || !isDigits(intPart) || (hasDot && (fracPart == "" || !isDigits(fracPart))) {
+		return "", ErrInvalidMoney
+	}
+	// ParseInt clamps an exponent out of range, which is still too large or
+	// too small for any amount.
+	e, err := strconv.ParseInt(exponent, 10, 32)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return "", ErrInvalidMoney
+	}
+
+	// The value is 0.digits · 10^point.
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	point := int64(len(intPart)) + e - int64(len(intPart+fracPart)-len(digits))
+	digits = strings.TrimRight(digits, "0")
+	switch {
+	case digits == "":
+		return "0", nil
+	case point > maxDigits:
+		return "", ErrMoneyOverflow
+	case point < -maxDigits:
+		return "", ErrMoneyScale
+	case point <= 0:
+		return sign + "0." + strings.Repeat("0", int(-point)) + digits, nil
+	case point >= int64(len(digits)):
+		return sign + digits + strings.Repeat("0", int(point)-len(digits)), nil
+	}
+	return sign + digits[:point] + "." + digits[point:], nil
+}
+
+// MustParseMoney is like ParseMoney but panics on error. Intended for
+// constants and tests.
+func MustParseMoney(s, currency string) Money {
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Units returns the amount in minor units.
+func (m Money) Units() int64 { return m.units }
+
+func (m Money) Currency() string {
+	if m.currency == "" {
+		return DefaultCurrency
+	}
+	return m.currency
+}
+
+func (m Money) IsZero() bool     { return m.units == 0 }
+func (m Money) IsNegative() bool { return m.units < 0 }
+func (m Money) IsPositive() bool { return m.units > 0 }
+
+func (m Money) Abs() Money {
+	if m.units < 0 {
+		return m.Neg()
+	}
+	return m
+}
+
+func (m Money) Neg() Money {
+	return Money{units: -m.units, currency: m.currency}
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency() != o.Currency() {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency(), o.Currency())
+	}
+	sum := m.units + o.units
+	if (o.units > 0 && sum < m.units) || (o.units < 0 && sum > m.units) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{units: sum, currency: m.Currency()}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if o.units == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return m.Add(o.Neg())
+}
+
+// Cmp returns -1, 0 or +1 depending on whether m is less than, equal to or
+// greater than o.
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency() != o.Currency() {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency(), o.Currency())
+	}
+	switch {
+	case m.units < o.units:
+		return -1, nil
+	case m.units > o.units:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Split divides m into n parts that differ by at most one minor unit and add
+// up to m exactly. The leftover units go to the first parts, or to the last
+// ones when remainderLast is set.
+func (m Money) Split(n int, remainderLast bool) ([]Money, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: cannot split into %d parts", ErrInvalidMoney, n)
+	}
+	base, rem := m.units/int64(n), m.units%int64(n)
+	step := int64(1)
+	if rem < 0 {
+		rem, step = -rem, -1
+	}
+	parts := make([]Money, n)
+	for i := range parts {
+		units := base
+		idx := i
+		if remainderLast {
+			idx = n - 1 - i
+		}
+		if int64(idx) < rem {
+			units += step
+		}
+		parts[i] = Money{units: units, currency: m.currency}
+	}
+	return parts, nil
+}
+
+// String formats the amount as a plain decimal with exactly the currency's
+// number of decimal places, e.g. "-123.40".
+func (m Money) String() string {
+	exp := CurrencyExponent(m.Currency())
+	u := m.units
+	sign := ""
+	var abs uint64
+	if u < 0 {
+		sign = "-"
+		abs = uint64(-(u + 1)) + 1
+	} else {
+		abs = uint64(u)
+	}
+	digits := strconv.FormatUint(abs, 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// MarshalJSON encodes the amount as a JSON number carrying the exact decimal
+// digits, so no float rounding happens on the way out.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts either a JSON number, in exponent form too, or a
+// string holding a decimal. The currency already set on m (or
+// DefaultCurrency) determines the scale.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidMoney, s)
+		}
+		s = unquoted
+	}
+	parsed, err := ParseMoney(s, m.Currency())
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value implements driver.Valuer, sending the amount as an exact decimal string.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan implements sql.Scanner for NUMERIC/DECIMAL columns. The currency already
+// set on m (or DefaultCurrency) determines the scale.
+func (m *Money) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("%w: cannot scan %T", ErrInvalidMoney, src)
+	}
+	parsed, err := ParseMoney(s, m.Currency())
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
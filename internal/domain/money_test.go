@@ -0,0 +1,151 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in       string
+		currency string
+		units    int64
+		str      string
+	}{
+		{"123.45", "BRL", 12345, "123.45"},
+		{"-0.1", "BRL", -10, "-0.10"},
+		{"0", "BRL", 0, "0.00"},
+		{"100.000", "BRL", 10000, "100.00"},
+		{"007.5", "", 750, "7.50"},
+		{"1500", "JPY", 1500, "1500"},
+		{"1.234", "KWD", 1234, "1.234"},
+		{"1e2", "BRL", 10000, "100.00"},
+		{"1.5E1", "BRL", 1500, "15.00"},
+		{"-12345e-2", "BRL", -12345, "-123.45"},
+		{"0.0015e+3", "BRL", 150, "1.50"},
+		{"2000e-3", "JPY", 2, "2"},
+		{"0e999999999999", "BRL", 0, "0.00"},
+	}
+	for _, c := range cases {
+		m, err := ParseMoney(c.in, c.currency)
+		if err != nil {
+			t.Errorf("ParseMoney(%q): %v", c.in, err)
+			continue
+		}
+		if m.Units() != c.units || m.String() != c.str {
+			t.Errorf("ParseMoney(%q) = %d (%s); want %d (%s)", c.in, m.Units(), m, c.units, c.str)
+		}
+	}
+}
+
+func TestParseMoney_Rejects(t *testing.T) {
+	cases := []struct {
+		in       string
+		currency string
+		want     error
+	}{
+		{"", "BRL", ErrInvalidMoney},
+		{"abc", "BRL", ErrInvalidMoney},
+		{"1.", "BRL", ErrInvalidMoney},
+		{".5", "BRL", ErrInvalidMoney},
+		{"1e", "BRL", ErrInvalidMoney},
+		{"1e+", "BRL", ErrInvalidMoney},
+		{"e2", "BRL", ErrInvalidMoney},
+		{"1.e2", "BRL", ErrInvalidMoney},
+		{"1e2.5", "BRL", ErrInvalidMoney},
+		{"1e2e3", "BRL", ErrInvalidMoney},
+		{"1e-3", "BRL", ErrMoneyScale},
+		{"1e-999999999999", "BRL", ErrMoneyScale},
+		{"1e19", "BRL", ErrMoneyOverflow},
+		{"1e999999999999", "BRL", ErrMoneyOverflow},
+		{"--1", "BRL", ErrInvalidMoney},
+		{"0.001", "BRL", ErrMoneyScale},
+		{"1.5", "JPY", ErrMoneyScale},
+		{"99999999999999999999", "BRL", ErrMoneyOverflow},
+	}
+	for _, c := range cases {
+		if _, err := ParseMoney(c.in, c.currency); !errors.Is(err, c.want) {
+			t.Errorf("ParseMoney(%q): got %v; want %v", c.in, err, c.want)
+		}
+	}
+}
+
+func TestMoney_NoFloatDrift(t *testing.T) {
+	a := MustParseMoney("0.1", "BRL")
+	b := MustParseMoney("0.2", "BRL")
+	sum, err := a.Add(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != MustParseMoney("0.3", "BRL") {
+		t.Errorf("0.1+0.2 = %s; want 0.30", sum)
+	}
+}
+
+func TestMoney_CurrencyMismatch(t *testing.T) {
+	_, err := MustParseMoney("1", "BRL").Add(MustParseMoney("1", "USD"))
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("expected ErrCurrencyMismatch, got %v", err)
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	var v struct {
+		Amount Money `json:"amount"`
+	}
+	for _, in := range []string{`{"amount":123.45}`, `{"amount":"123.45"}`, `{"amount":1.2345e2}`} {
+		if err := json.Unmarshal([]byte(in), &v); err != nil {
+			t.Fatalf("unmarshal %s: %v", in, err)
+		}
+		if v.Amount.Units() != 12345 {
+			t.Errorf("unmarshal %s: got %d units", in, v.Amount.Units())
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"amount":1.001}`), &v); !errors.Is(err, ErrMoneyScale) {
+		t.Errorf("expected ErrMoneyScale, got %v", err)
+	}
+
+	v.Amount = MustParseMoney("-10", "BRL")
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"amount":-10.00}` {
+		t.Errorf("marshal: got %s", out)
+	}
+}
+
+func TestMoney_Scan(t *testing.T) {
+	for _, src := range []any{[]byte("12.30"), "12.30", 12.3} {
+		var m Money
+		if err := m.Scan(src); err != nil {
+			t.Fatalf("Scan(%v): %v", src, err)
+		}
+		if m.Units() != 1230 {
+			t.Errorf("Scan(%v) = %d units", src, m.Units())
+		}
+	}
+	v, err := MustParseMoney("12.3", "BRL").Value()
+	if err != nil || v != "12.30" {
+		t.Errorf("Value() = %v, %v", v, err)
+	}
+}
+
+func TestMoney_Split(t *testing.T) {
+	total := MustParseMoney("100", "BRL")
+	first, err := total.Split(3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0].Units() != 3334 || first[1].Units() != 3333 || first[2].Units() != 3333 {
+		t.Errorf("remainder first: %v", first)
+	}
+	last, _ := total.Neg().Split(3, true)
+	if last[0].Units() != -3333 || last[2].Units() != -3334 {
+		t.Errorf("remainder last: %v", last)
+	}
+	if _, err := total.Split(0, false); !errors.Is(err, ErrInvalidMoney) {
+		t.Errorf("expected ErrInvalidMoney, got %v", err)
+	}
+}
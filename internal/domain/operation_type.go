@@ -0,0 +1,100 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUnknownDirection    = errors.New("operation type has no direction")
+	ErrAmountOutOfRange    = errors.New("amount is outside the range allowed for this operation type")
+	ErrOutsideAllowedHours = errors.New("operation type is not allowed at this time")
+)
+
+// OperationType describes how transactions of one type are posted: Direction
+// gives the sign of their amount, and the optional limits restrict the
+// absolute amount and the UTC hour of the event. Inactive types are kept for
+// existing transactions but accept no new ones.
+type OperationType struct {
+	ID           int         `json:"id"`
+	Description  string      `json:"description"`
+	Direction    string      `json:"direction"`
+	MinAmount    *Money      `json:"min_amount,omitempty"`
+	MaxAmount    *Money      `json:"max_amount,omitempty"`
+	AllowedHours *HourWindow `json:"allowed_hours,omitempty"`
+	Active       bool        `json:"active"`
+}
+
+// HourWindow is the range of UTC hours [From, To). A window with From after
+// To wraps past midnight, e.g. {22, 6}.
+type HourWindow struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// Valid reports whether both ends are hours of the day and the window is not
+// empty.
+func (w HourWindow) Valid() bool {
+	return w.From >= 0 && w.From < 24 && w.To >= 0 && w.To < 24 && w.From != w.To
+}
+
+// Contains reports whether t falls inside the window.
+func (w HourWindow) Contains(t time.Time) bool {
+	h := t.UTC().Hour()
+	if w.From < w.To {
+		return h >= w.From && h < w.To
+	}
+	return h >= w.From || h < w.To
+}
+
+// BuiltinOperationTypes are the types every store starts with.
+var BuiltinOperationTypes = []OperationType{
+	{ID: OpCashPurchase, Description: "CASH PURCHASE", Direction: DirectionDebit, Active: true},
+	{ID: OpInstallmentPurchase, Description: "INSTALLMENT PURCHASE", Direction: DirectionDebit, Active: true},
+	{ID: OpWithdrawal, Description: "WITHDRAWAL", Direction: DirectionDebit, Active: true},
+	{ID: OpPayment, Description: "PAYMENT", Direction: DirectionCredit, Active: true},
+	{ID: OpRefund, Description: "REFUND", Direction: DirectionCredit, Active: true},
+	{ID: OpPaymentReversal, Description: "PAYMENT REVERSAL", Direction: DirectionDebit, Active: true},
+}
+
+// Signed returns amount with the sign of the type's direction: negative for
+// debits and positive for credits.
+func (ot OperationType) Signed(amount Money) (Money, error) {
+	switch ot.Direction {
+	case DirectionDebit:
+		return amount.Abs().Neg(), nil
+	case DirectionCredit:
+		return amount.Abs(), nil
+	}
+	return Money{}, fmt.Errorf("%w: operation type %d", ErrUnknownDirection, ot.ID)
+}
+
+// Check enforces the type's amount range and allowed hours on a transaction
+// of amount happening at t. An amount in another currency than the limits
+// cannot be checked and is ErrCurrencyMismatch.
+func (ot OperationType) Check(amount Money, t time.Time) error {
+	a := amount.Abs()
+	if ot.MinAmount != nil {
+		c, err := a.Cmp(*ot.MinAmount)
+		if err != nil {
+			return fmt.Errorf("min_amount: %w", err)
+		}
+		if c < 0 {
+			return fmt.Errorf("%w: minimum is %s", ErrAmountOutOfRange, *ot.MinAmount)
+		}
+	}
+	if ot.MaxAmount != nil {
+		c, err := a.Cmp(*ot.MaxAmount)
+		if err != nil {
+			return fmt.Errorf("max_amount: %w", err)
+		}
+		if c > 0 {
+			return fmt.Errorf("%w: maximum is %s", ErrAmountOutOfRange, *ot.MaxAmount)
+		}
+	}
+	if w := ot.AllowedHours; w != nil && !w.Contains(t) {
+		return fmt.Errorf("%w: allowed from %02d:00 to %02d:00 UTC", ErrOutsideAllowedHours, w.From, w.To)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// RateScale is the number of decimal places an exchange rate may carry.
+const RateScale = 10
+
+var (
+	ErrInvalidRate     = errors.New("invalid exchange rate")
+	ErrInvalidCurrency = errors.New("invalid currency")
+)
+
+// ValidCurrency reports whether code looks like an ISO 4217 code: three
+// upper-case letters.
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Rate is an exchange rate: how many units of the target currency one unit
+// of the source currency buys. It is kept as an exact decimal.
+type Rate struct {
+	r *big.Rat
+}
+
+// ParseRate parses a positive decimal with at most RateScale places.
+func ParseRate(s string) (Rate, error) {
+	_, frac, _ := strings.Cut(s, ".")
+	if s == "" || strings.ContainsAny(s, "eE/+-") || len(frac) > RateScale {
+		return Rate{}, fmt.Errorf("%w: %q", ErrInvalidRate, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || r.Sign() <= 0 {
+		return Rate{}, fmt.Errorf("%w: %q", ErrInvalidRate, s)
+	}
+	return Rate{r: r}, nil
+}
+
+// MustParseRate is like ParseRate but panics on error. Intended for tests.
+func MustParseRate(s string) Rate {
+	r, err := ParseRate(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r Rate) IsZero() bool { return r.r == nil }
+
+// String formats the rate without trailing zeros, e.g. "5.1".
+func (r Rate) String() string {
+	if r.r == nil {
+		return "0"
+	}
+	s := strings.TrimRight(r.r.FloatString(RateScale), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// Convert returns m expressed in currency at this rate, rounded half away
+// from zero to the currency's minor unit.
+func (r Rate) Convert(m Money, currency string) (Money, error) {
+	if r.r == nil {
+		return Money{}, ErrInvalidRate
+	}
+	// units_to = units_from · rate · 10^(exp_to − exp_from)
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Units()), r.r)
+	shift := CurrencyExponent(currency) - CurrencyExponent(m.Currency())
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(shift))), nil))
+	if shift >= 0 {
+		v.Mul(v, scale)
+	} else {
+		v.Quo(v, scale)
+	}
+
+	num, den := new(big.Int).Abs(v.Num()), v.Denom()
+	units := new(big.Int).Mul(num, big.NewInt(2))
+	units.Add(units, den)
+	units.Quo(units, new(big.Int).Mul(den, big.NewInt(2)))
+	if v.Sign() < 0 {
+		units.Neg(units)
+	}
+	if !units.IsInt64() {
+		return Money{}, ErrMoneyOverflow
+	}
+	return NewMoney(units.Int64(), currency), nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// MarshalJSON encodes the rate as a JSON number with its exact digits.
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON accepts either a JSON number or a string holding a decimal.
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidRate, s)
+		}
+		s = unquoted
+	}
+	parsed, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// Value implements driver.Valuer, sending the rate as an exact decimal string.
+func (r Rate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns.
+func (r *Rate) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("%w: cannot scan %T", ErrInvalidRate, src)
+	}
+	// NUMERIC columns pad to their scale; trailing zeros are not precision.
+	if strings.Contains(s, ".") {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	parsed, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
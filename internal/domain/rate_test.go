@@ -0,0 +1,59 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, s := range []string{"", "0", "-1.5", "1e3", "1/3", "abc", "0.00000000001"} {
+		if _, err := ParseRate(s); !errors.Is(err, ErrInvalidRate) {
+			t.Errorf("ParseRate(%q): expected ErrInvalidRate, got %v", s, err)
+		}
+	}
+	r, err := ParseRate("5.1000")
+	if err != nil || r.String() != "5.1" {
+		t.Errorf("ParseRate(5.1000) = %s, %v", r, err)
+	}
+}
+
+func TestRateConvert(t *testing.T) {
+	cases := []struct {
+		amount, from, rate, to, want string
+	}{
+		{"10.00", "USD", "5.1234", "BRL", "51.23"},
+		{"-10.01", "USD", "0.5", "EUR", "-5.01"}, // -5.005 rounds away from zero
+		{"1000", "JPY", "0.0337", "BRL", "33.70"},
+		{"1.00", "BRL", "29.6", "JPY", "30"},
+		{"1.00", "USD", "0.307", "KWD", "0.307"},
+	}
+	for _, c := range cases {
+		got, err := MustParseRate(c.rate).Convert(MustParseMoney(c.amount, c.from), c.to)
+		if err != nil || got != MustParseMoney(c.want, c.to) {
+			t.Errorf("%s %s at %s: got %s %s, %v; want %s", c.amount, c.from, c.rate, got, got.Currency(), err, c.want)
+		}
+	}
+}
+
+func TestRateJSONAndScan(t *testing.T) {
+	var r Rate
+	if err := json.Unmarshal([]byte(`"5.25"`), &r); err != nil || r.String() != "5.25" {
+		t.Fatalf("unmarshal: %s, %v", r, err)
+	}
+	out, _ := json.Marshal(r)
+	if string(out) != "5.25" {
+		t.Errorf("marshal: %s", out)
+	}
+	if err := r.Scan([]byte("4.5000000000")); err != nil || r.String() != "4.5" {
+		t.Errorf("scan: %s, %v", r, err)
+	}
+}
+
+func TestValidCurrency(t *testing.T) {
+	for code, want := range map[string]bool{"BRL": true, "usd": false, "EU": false, "EURO": false} {
+		if ValidCurrency(code) != want {
+			t.Errorf("ValidCurrency(%q) != %v", code, want)
+		}
+	}
+}
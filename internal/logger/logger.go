@@ -1,23 +1,31 @@
 package logger
 
 import (
+	"context"
 	"os"
 
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 var log *zap.Logger
 
-func Init(level string) error {
+// level is the level of the logger built by Init, which SetLevel changes at
+// runtime.
+var level = zap.NewAtomicLevel()
+
+func Init(lvl string) error {
 	var zapLevel zapcore.Level
-	err := zapLevel.UnmarshalText([]byte(level))
+	err := zapLevel.UnmarshalText([]byte(lvl))
 	if err != nil {
 		return err
 	}
+	level.SetLevel(zapLevel)
 
 	config := zap.Config{
-		Level:            zap.NewAtomicLevelAt(zapLevel),
+		Level:            level,
 		Development:      false,
 		Encoding:         "json",
 		OutputPaths:      []string{"stdout"},
@@ -39,6 +47,22 @@ func Init(level string) error {
 	return nil
 }
 
+// SetLevel changes the level of the logger built by Init, for every logger
+// derived from it.
+func SetLevel(lvl string) error {
+	var zapLevel zapcore.Level
+	if err := zapLevel.UnmarshalText([]byte(lvl)); err != nil {
+		return err
+	}
+	level.SetLevel(zapLevel)
+	return nil
+}
+
+// Level returns the current level of the logger built by Init.
+func Level() string {
+	return level.Level().String()
+}
+
 func GetLogger() *zap.Logger {
 	if log == nil {
 		log, _ = zap.NewProduction()
@@ -46,6 +70,37 @@ func GetLogger() *zap.Logger {
 	return log
 }
 
+// TraceFields returns the trace_id and span_id of the span in ctx, or none
+// outside a trace, so log lines can be joined with their trace.
+func TraceFields(ctx context.Context) []zap.Field {
+	sc := tracing.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []zap.Field{zap.String("trace_id", sc.TraceID.String()), zap.String("span_id", sc.SpanID.String())}
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying l, typically the global logger
+// with the fields of one request such as its request_id.
+func NewContext(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx by NewContext, or the global
+// logger, with the trace fields of the current span.
+func FromContext(ctx context.Context) *zap.Logger {
+	l, ok := ctx.Value(loggerKey{}).(*zap.Logger)
+	if !ok {
+		l = GetLogger()
+	}
+	if fields := TraceFields(ctx); fields != nil {
+		l = l.With(fields...)
+	}
+	return l
+}
+
 func Info(msg string, fields ...zap.Field) {
 	GetLogger().Info(msg, fields...)
 }
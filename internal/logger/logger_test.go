@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestFromContext(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	prev := log
+	log = zap.New(core)
+	defer func() { log = prev }()
+
+	FromContext(context.Background()).Info("global")
+
+	ctx := NewContext(context.Background(), GetLogger().With(zap.String("request_id", "req-1")))
+	FromContext(ctx).Info("scoped")
+
+	sc := tracing.SpanContext{TraceID: tracing.TraceID{1}, SpanID: tracing.SpanID{2}, Sampled: true}
+	FromContext(tracing.ContextWithRemoteSpanContext(ctx, sc)).Info("traced")
+
+	entries := logs.All()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if len(entries[0].Context) != 0 {
+		t.Errorf("global logger should have no fields: %v", entries[0].Context)
+	}
+	if f := entries[1].ContextMap(); f["request_id"] != "req-1" || f["trace_id"] != nil {
+		t.Errorf("unexpected scoped fields: %v", f)
+	}
+	f := entries[2].ContextMap()
+	if f["request_id"] != "req-1" || f["trace_id"] != sc.TraceID.String() || f["span_id"] != sc.SpanID.String() {
+		t.Errorf("unexpected traced fields: %v", f)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	core, logs := observer.New(level)
+	prev, prevLevel := log, level.Level()
+	log = zap.New(core)
+	defer func() { log, _ = prev, SetLevel(prevLevel.String()) }()
+
+	if err := SetLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	child := With(zap.String("k", "v"))
+	Info("dropped")
+	child.Warn("kept")
+	if err := SetLevel("debug"); err != nil || Level() != "debug" {
+		t.Fatalf("SetLevel: %v, level %s", err, Level())
+	}
+	child.Debug("kept too")
+	if err := SetLevel("loud"); err == nil || Level() != "debug" {
+		t.Errorf("expected an unknown level to be refused, level %s", Level())
+	}
+
+	if n := logs.Len(); n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "Requests served.", "route", "status")
+	c.Inc("/accounts/{id}", "200")
+	c.Inc("/accounts/{id}", "200")
+	c.Add(3, "/transactions", "422")
+	h := r.NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(2, "/a")
+	r.NewGaugeFunc("open_connections", "Open connections.", func() float64 { return 4 })
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 2.55
+latency_seconds_count{route="/a"} 3
+# HELP open_connections Open connections.
+# TYPE open_connections gauge
+open_connections 4
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/accounts/{id}",status="200"} 2
+requests_total{route="/transactions",status="422"} 3
+`
+	if got := sb.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistry_EscapesLabels(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("x_total", "Help with \\ and\nnewline.", "v").Inc("a\"b\\c\nd")
+
+	var sb strings.Builder
+	r.WriteTo(&sb)
+	for _, want := range []string{
+		`# HELP x_total Help with \\ and\nnewline.`,
+		`x_total{v="a\"b\\c\nd"} 1`,
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterFunc("waits_total", "Waits.", func() float64 { return 7 })
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "waits_total 7\n") {
+		t.Fatalf("unexpected body:\n%s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST got %d", w.Code)
+	}
+}
+
+func TestRegistry_DuplicateNamePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("dup_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	r.NewGaugeFunc("dup_total", "", func() float64 { return 0 })
+}
@@ -0,0 +1,37 @@
+package respository
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is a client credential. Only a hash of the key is stored; the
+// plaintext is shown once, when the key is created.
+type APIKey struct {
+	ID   int64
+	Name string
+	// Prefix is the public part of the key that identifies it.
+	Prefix string
+	// Hash is the hex-encoded SHA-256 of the whole key.
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+func (k APIKey) Revoked() bool { return k.RevokedAt != nil }
+
+// APIKeyStore persists API keys.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error)
+	// GetAPIKey returns the key with the given prefix, revoked or not, or
+	// ErrAPIKeyNotFound.
+	GetAPIKey(ctx context.Context, prefix string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey marks the key revoked at the given time; revoking a revoked
+	// key keeps the original time.
+	RevokeAPIKey(ctx context.Context, id int64, at time.Time) (APIKey, error)
+}
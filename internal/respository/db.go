@@ -1,116 +1,252 @@
 package respository
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"time"
 
-	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
 	_ "github.com/lib/pq"
+	"go.uber.org/zap"
 )
 
 type DBConn struct {
-	db *sql.DB
+	db       *sql.DB
+	replicas *replicaSet
 }
 
-func NewPostgresConn(host string, port int, user, password, dbname, sslmode string) (*DBConn, error) {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		host, port, user, password, dbname, sslmode)
+// PoolConfig sizes the connection pool of sql.DB. Zero values keep the
+// database/sql defaults: no limit on open connections or on their lifetime.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %w", err)
-	}
+type connOptions struct {
+	pool       PoolConfig
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	sleep      func(time.Duration)
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
-	}
+	replicas       []string
+	readYourWrites time.Duration
+}
 
-	if err := initSchema(db); err != nil {
-		return nil, fmt.Errorf("failed to initialize database schema: %w", err)
-	}
+type ConnOption func(*connOptions)
 
-	if err := seedOperationTypes(db); err != nil {
-		return nil, fmt.Errorf("failed to seed operation types: %w", err)
+// WithPool applies p to the connection pool.
+func WithPool(p PoolConfig) ConnOption {
+	return func(o *connOptions) {
+		o.pool = p
 	}
-
-	return &DBConn{db: db}, nil
 }
 
-func (c *DBConn) GetDB() *sql.DB {
-	return c.db
+// WithConnectRetry pings the database up to attempts times before giving up,
+// waiting backoff after the first failure and doubling the wait after each
+// one up to maxBackoff, so that the service can start before the database
+// accepts connections.
+func WithConnectRetry(attempts int, backoff, maxBackoff time.Duration) ConnOption {
+	return func(o *connOptions) {
+		o.attempts = attempts
+		o.backoff = backoff
+		o.maxBackoff = maxBackoff
+	}
 }
 
-func (c *DBConn) Close() error {
-	return c.db.Close()
+// WithReplicas reads from the replicas at addrs, given as host or host:port,
+// the port defaulting to the primary's, and reached with the credentials of
+// the primary; see PostgresStore for which reads. After a write, reads by the same client, as named with
+// NewClientContext, go to the primary for readYourWrites. Replicas are out of
+// rotation until MonitorReplicas finds them healthy.
+func WithReplicas(addrs []string, readYourWrites time.Duration) ConnOption {
+	return func(o *connOptions) {
+		o.replicas = addrs
+		o.readYourWrites = readYourWrites
+	}
 }
 
-func initSchema(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS accounts (
-			id SERIAL PRIMARY KEY,
-			document_number TEXT NOT NULL
-		)
-	`)
+func NewPostgresConn(host string, port int, user, password, dbname, sslmode string, opts ...ConnOption) (*DBConn, error) {
+	o := connOptionsOf(opts)
+	open := func(host string, port int) (*sql.DB, error) {
+		connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+			host, port, user, password, dbname, sslmode)
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to database: %w", err)
+		}
+		setPool(db, o.pool)
+		return db, nil
+	}
+
+	db, err := open(host, port)
 	if err != nil {
-		return fmt.Errorf("failed to create accounts table: %w", err)
+		return nil, err
+	}
+	conn, err := newConn(db, o)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(o.replicas) == 0 {
+		return conn, nil
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS operation_types (
-			id INT PRIMARY KEY,
-			description TEXT NOT NULL
-		)
-	`)
+	// Replicas are not pinged: one that is down must not stop the service,
+	// and MonitorReplicas brings it into rotation once it is up.
+	conn.replicas = newReplicaSet(nil, o.readYourWrites)
+	for _, addr := range o.replicas {
+		rhost, rport, err := splitHostPort(addr, port)
+		var rdb *sql.DB
+		if err == nil {
+			rdb, err = open(rhost, rport)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("replica %s: %w", addr, err)
+		}
+		conn.replicas.replicas = append(conn.replicas.replicas, &replica{addr: addr, db: rdb})
+	}
+	return conn, nil
+}
+
+// splitHostPort splits a replica address; the port defaults to that of the
+// primary.
+func splitHostPort(addr string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return fmt.Errorf("failed to create operation_types table: %w", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS transactions (
-			id SERIAL PRIMARY KEY,
-			account_id INT NOT NULL REFERENCES accounts(id),
-			operation_type_id INT NOT NULL REFERENCES operation_types(id),
-			amount DECIMAL(15,2) NOT NULL,
-			event_date TIMESTAMP WITH TIME ZONE NOT NULL,
-			CONSTRAINT fk_account FOREIGN KEY (account_id) REFERENCES accounts(id),
-			CONSTRAINT fk_operation_type FOREIGN KEY (operation_type_id) REFERENCES operation_types(id)
-		)
-	`)
+		return addr, defaultPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("failed to create transactions table: %w", err)
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
 	}
+	return host, port, nil
+}
 
-	return nil
+func setPool(db *sql.DB, p PoolConfig) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	// Zero would keep no idle connections at all, rather than the default.
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
 }
 
-func seedOperationTypes(db *sql.DB) error {
+func connOptionsOf(opts []ConnOption) connOptions {
+	o := connOptions{attempts: 1, sleep: time.Sleep}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
 
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM operation_types").Scan(&count)
-	if err != nil {
-		return fmt.Errorf("failed to check operation types: %w", err)
+// newConn pings db, retrying as o allows.
+func newConn(db *sql.DB, o connOptions) (*DBConn, error) {
+	wait := o.backoff
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			return &DBConn{db: db}, nil
+		}
+		if attempt >= o.attempts {
+			return nil, fmt.Errorf("failed to ping database after %d attempts: %w", attempt, err)
+		}
+		logger.Warn("Database not reachable, retrying",
+			zap.Int("attempt", attempt), zap.Duration("wait", wait), zap.Error(err))
+		o.sleep(wait)
+		wait *= 2
+		if o.maxBackoff > 0 {
+			wait = min(wait, o.maxBackoff)
+		}
 	}
+}
+
+func (c *DBConn) GetDB() *sql.DB {
+	return c.db
+}
 
-	if count > 0 {
-		return nil
+// Migrate applies all pending schema migrations.
+func (c *DBConn) Migrate(ctx context.Context) (int, error) {
+	m, err := NewMigrator(c.db)
+	if err != nil {
+		return 0, err
 	}
+	return m.Up(ctx)
+}
 
-	operationTypes := []struct {
-		ID          int
-		Description string
-	}{
-		{domain.OpCashPurchase, "CASH PURCHASE"},
-		{domain.OpInstallmentPurchase, "INSTALLMENT PURCHASE"},
-		{domain.OpWithdrawal, "WITHDRAWAL"},
-		{domain.OpPayment, "PAYMENT"},
+// RegisterMetrics exports the connection pool statistics of sql.DB.Stats to
+// reg. They are read at scrape time.
+func (c *DBConn) RegisterMetrics(reg *metrics.Registry) {
+	stat := func(f func(sql.DBStats) float64) func() float64 {
+		return func() float64 { return f(c.db.Stats()) }
+	}
+	reg.NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	reg.NewGaugeFunc("db_open_connections", "Established connections, both in use and idle.",
+		stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	reg.NewGaugeFunc("db_in_use_connections", "Connections currently in use.",
+		stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	reg.NewGaugeFunc("db_idle_connections", "Idle connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	reg.NewCounterFunc("db_wait_count_total", "Connections waited for.",
+		stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	reg.NewCounterFunc("db_wait_duration_seconds_total", "Time spent waiting for new connections.",
+		stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	reg.NewCounterFunc("db_max_idle_closed_total", "Connections closed due to SetMaxIdleConns.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	reg.NewCounterFunc("db_max_idle_time_closed_total", "Connections closed due to SetConnMaxIdleTime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	reg.NewCounterFunc("db_max_lifetime_closed_total", "Connections closed due to SetConnMaxLifetime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+	if c.replicas != nil {
+		reg.NewGaugeFunc("db_replicas", "Configured read replicas.",
+			func() float64 { return float64(len(c.replicas.replicas)) })
+		reg.NewGaugeFunc("db_replicas_healthy", "Read replicas in rotation.",
+			func() float64 { return float64(c.replicas.healthy()) })
 	}
+}
 
-	for _, ot := range operationTypes {
-		_, err := db.Exec("INSERT INTO operation_types (id, description) VALUES ($1, $2)", ot.ID, ot.Description)
-		if err != nil {
-			return fmt.Errorf("failed to insert operation type %d: %w", ot.ID, err)
+// Ping checks that the database can be reached.
+func (c *DBConn) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// MonitorReplicas checks the replicas every interval until ctx is done,
+// keeping in rotation those reachable and at most maxLag behind the primary.
+// The first check runs at once.
+func (c *DBConn) MonitorReplicas(ctx context.Context, interval, maxLag time.Duration) {
+	if c.replicas == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		c.replicas.check(checkCtx, maxLag)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
+}
 
-	return nil
+func (c *DBConn) Close() error {
+	err := c.db.Close()
+	if c.replicas != nil {
+		for _, r := range c.replicas.replicas {
+			err = errors.Join(err, r.db.Close())
+		}
+	}
+	return err
 }
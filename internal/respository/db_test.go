@@ -0,0 +1,88 @@
+package respository
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
+)
+
+func TestDBConn_RegisterMetrics(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+
+	reg := metrics.NewRegistry()
+	(&DBConn{db: db}).RegisterMetrics(reg)
+	var sb strings.Builder
+	if _, err := reg.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE db_max_open_connections gauge\ndb_max_open_connections 7\n",
+		"# TYPE db_wait_count_total counter\ndb_wait_count_total 0\n",
+		"db_in_use_connections 0\n",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestNewConn_Retry(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	down := errors.New("connection refused")
+	mock.ExpectPing().WillReturnError(down)
+	mock.ExpectPing().WillReturnError(down)
+	mock.ExpectPing().WillReturnError(down)
+	mock.ExpectPing()
+
+	var waits []time.Duration
+	sleep := func(o *connOptions) { o.sleep = func(d time.Duration) { waits = append(waits, d) } }
+	pool := PoolConfig{MaxOpenConns: 10, MaxIdleConns: 5, ConnMaxLifetime: time.Hour}
+	setPool(db, pool)
+	conn, err := newConn(db, connOptionsOf([]ConnOption{WithConnectRetry(5, 100*time.Millisecond, 300*time.Millisecond), sleep}))
+	if err != nil {
+		t.Fatalf("newConn: %v", err)
+	}
+	if want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}; !slices.Equal(waits, want) {
+		t.Errorf("expected waits %v, got %v", want, waits)
+	}
+	if conn.db.Stats().MaxOpenConnections != 10 {
+		t.Errorf("expected the pool to be sized, got %+v", conn.db.Stats())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewConn_GivesUp(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	down := errors.New("connection refused")
+	mock.ExpectPing().WillReturnError(down)
+	mock.ExpectPing().WillReturnError(down)
+
+	sleep := func(o *connOptions) { o.sleep = func(time.Duration) {} }
+	_, err = newConn(db, connOptionsOf([]ConnOption{WithConnectRetry(2, time.Second, time.Second), sleep}))
+	if !errors.Is(err, down) || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("expected the last ping error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,897 @@
+package respository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"go.uber.org/zap"
+)
+
+// SyncPolicy is when a FileStore flushes its log to stable storage.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs every write before returning it: nothing
+	// acknowledged is lost, even on power failure.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs in the background; a power failure loses up to
+	// an interval of writes, a process crash none.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// errStoreClosed is returned by writes to a closed FileStore.
+var errStoreClosed = errors.New("file store is closed")
+
+// FileStore is an InMemoryStore made durable by a write-ahead log in a
+// directory. Every write is applied in memory and appended to the log as the
+// rows it changed before it returns; one that cannot be logged is undone.
+// Every snapshotEvery records the whole state is written to a snapshot and
+// the log before it is deleted. Opening the store loads the snapshot and
+// replays the log after it, dropping a record torn by a crash.
+//
+// Reads are served from memory, so the data set must fit in it.
+type FileStore struct {
+	mem           *InMemoryStore
+	dir           string
+	sync          SyncPolicy
+	syncInterval  time.Duration
+	snapshotEvery int
+
+	// mu serialises writes, so that the log holds them in the order they
+	// were applied. It is taken before mem.mu.
+	mu           sync.Mutex
+	segment      *os.File
+	segmentStart uint64
+	size         int64
+	seq          uint64
+	sinceSnap    int
+	// failed is set once the log could not be written; the store then
+	// refuses writes, as what is on disk is no longer known.
+	failed error
+
+	// snapMu makes snapshots run one at a time, so that they are written in
+	// order. It is taken before mu.
+	snapMu       sync.Mutex
+	snapshotting atomic.Bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type FileOption func(*FileStore)
+
+// WithSyncPolicy sets when the log is synced; interval applies to
+// SyncInterval. The default is SyncAlways.
+func WithSyncPolicy(p SyncPolicy, interval time.Duration) FileOption {
+	return func(s *FileStore) {
+		s.sync = p
+		s.syncInterval = interval
+	}
+}
+
+// WithSnapshotEvery snapshots the store and compacts its log after every n
+// records; zero only snapshots when Snapshot is called.
+func WithSnapshotEvery(n int) FileOption {
+	return func(s *FileStore) {
+		s.snapshotEvery = n
+	}
+}
+
+// OpenFileStore opens the store kept in dir, creating it if needed, and
+// recovers its state.
+func OpenFileStore(dir string, opts ...FileOption) (*FileStore, error) {
+	s := &FileStore{
+		mem:           NewInMemoryStore(),
+		dir:           dir,
+		sync:          SyncAlways,
+		syncInterval:  time.Second,
+		snapshotEvery: 10000,
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	switch s.sync {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if s.syncInterval <= 0 {
+			return nil, fmt.Errorf("sync interval must be positive, got %s", s.syncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", s.sync)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	if s.sync == SyncInterval {
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// recover loads the snapshot, replays the log records after it and opens
+// the last segment for appending.
+func (s *FileStore) recover() error {
+	snap, ok, err := readSnapshot(s.dir)
+	if err != nil {
+		return err
+	}
+	if ok {
+		for _, op := range snap.Ops {
+			if err := s.mem.restore(op); err != nil {
+				return fmt.Errorf("%w: snapshot: %v", ErrCorruptLog, err)
+			}
+		}
+		s.seq = snap.Seq
+	}
+
+	starts, err := segments(s.dir)
+	if err != nil {
+		return err
+	}
+	for i, start := range starts {
+		path := filepath.Join(s.dir, segmentName(start))
+		last := i == len(starts)-1
+		// Segments whose records the snapshot already holds are left over
+		// from a compaction cut short.
+		if !last && starts[i+1] <= snap.Seq+1 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		valid, torn, err := readSegment(path, func(rec walRecord) error {
+			if rec.Seq <= s.seq {
+				return nil
+			}
+			if rec.Seq != s.seq+1 {
+				return fmt.Errorf("%w: record %d follows %d", ErrCorruptLog, rec.Seq, s.seq)
+			}
+			for _, op := range rec.Ops {
+				if err := s.mem.restore(op); err != nil {
+					return fmt.Errorf("%w: record %d: %v", ErrCorruptLog, rec.Seq, err)
+				}
+			}
+			s.seq = rec.Seq
+			s.sinceSnap++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if torn {
+			if !last {
+				return fmt.Errorf("%w: %s is cut short at offset %d", ErrCorruptLog, segmentName(start), valid)
+			}
+			// The write that was cut short was never acknowledged.
+			logger.Warn("Dropping torn record at the end of the log",
+				zap.String("segment", path), zap.Int64("offset", valid))
+			if err := os.Truncate(path, valid); err != nil {
+				return err
+			}
+		}
+		if last {
+			s.segmentStart, s.size = start, valid
+		}
+	}
+	s.mem.recount()
+
+	if len(starts) == 0 {
+		return s.openSegment(s.seq + 1)
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(s.segmentStart)), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.segment = f
+	return nil
+}
+
+// openSegment starts a new segment whose first record will be start.
+func (s *FileStore) openSegment(start uint64) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(start)), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.segment, s.segmentStart, s.size = f, start, 0
+	return nil
+}
+
+// append logs ops as the next record; s.mu is held. A record that cannot be
+// written is cut from the log and the store refuses further writes.
+func (s *FileStore) append(ops []walOp) error {
+	if s.failed != nil {
+		return s.failed
+	}
+	rec := walRecord{Seq: s.seq + 1, Ops: ops}
+	n, err := writeFrame(s.segment, rec)
+	if err == nil && s.sync == SyncAlways {
+		err = s.segment.Sync()
+	}
+	if err != nil {
+		if truncErr := s.segment.Truncate(s.size); truncErr != nil {
+			err = errors.Join(err, truncErr)
+		}
+		s.failed = fmt.Errorf("file store refuses writes after failing to write its log: %w", err)
+		logger.Error("Failed to write the log", zap.String("dir", s.dir), zap.Error(err))
+		return s.failed
+	}
+	s.size += int64(n)
+	s.seq = rec.Seq
+	s.sinceSnap++
+	if s.snapshotEvery > 0 && s.sinceSnap >= s.snapshotEvery && s.snapshotting.CompareAndSwap(false, true) {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.snapshotting.Store(false)
+			if err := s.Snapshot(); err != nil {
+				logger.Error("Failed to snapshot the file store", zap.String("dir", s.dir), zap.Error(err))
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *FileStore) syncLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		if s.failed == nil {
+			if err := s.segment.Sync(); err != nil {
+				s.failed = fmt.Errorf("file store refuses writes after failing to sync its log: %w", err)
+				logger.Error("Failed to sync the log", zap.String("dir", s.dir), zap.Error(err))
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Snapshot writes the whole state to the snapshot and deletes the log
+// segments it makes redundant. Writes are only held up while the state is
+// copied.
+func (s *FileStore) Snapshot() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	// A store being closed still finishes the snapshot it started.
+	if s.segment == nil {
+		s.mu.Unlock()
+		return errStoreClosed
+	}
+	if s.failed != nil && s.failed != errStoreClosed {
+		s.mu.Unlock()
+		return s.failed
+	}
+	s.mem.mu.RLock()
+	snap := walRecord{Seq: s.seq, Ops: s.mem.dump(time.Now())}
+	s.mem.mu.RUnlock()
+	// Later records go to a new segment, so that every older one can go
+	// once the snapshot is in place.
+	if s.size > 0 {
+		if err := s.rotate(); err != nil {
+			s.failed = fmt.Errorf("file store refuses writes after failing to start a log segment: %w", err)
+			s.mu.Unlock()
+			return s.failed
+		}
+	}
+	s.sinceSnap = 0
+	s.mu.Unlock()
+
+	if err := writeSnapshot(s.dir, snap); err != nil {
+		return err
+	}
+	starts, err := segments(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, start := range starts {
+		if start <= snap.Seq {
+			if err := os.Remove(filepath.Join(s.dir, segmentName(start))); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// rotate closes the current segment and starts the next one; s.mu is held.
+func (s *FileStore) rotate() error {
+	if err := s.segment.Sync(); err != nil {
+		return err
+	}
+	if err := s.segment.Close(); err != nil {
+		return err
+	}
+	return s.openSegment(s.seq + 1)
+}
+
+// Close syncs the log and closes it. The store accepts no writes after.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	if s.segment == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	// Refusing writes first means no snapshot can start once we wait below.
+	s.failed = errStoreClosed
+	s.mu.Unlock()
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.segment.Sync()
+	if closeErr := s.segment.Close(); err == nil {
+		err = closeErr
+	}
+	s.segment = nil
+	return err
+}
+
+// Ping fails once the store refuses writes, so that readiness takes it out
+// of rotation.
+func (s *FileStore) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+// write applies a change outside a unit of work. do makes it in memory and
+// returns the rows it wrote, none if it changed nothing, and how to take it
+// back should logging them fail.
+func (s *FileStore) write(do func() (ops []walOp, undo func(), err error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed != nil {
+		return s.failed
+	}
+	ops, undo, err := do()
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	if err := s.append(ops); err != nil {
+		s.mem.mu.Lock()
+		undo()
+		s.mem.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) CreateAccount(ctx context.Context, acc domain.Account) (created domain.Account, err error) {
+	err = s.write(func() ([]walOp, func(), error) {
+		if created, err = s.mem.CreateAccount(ctx, acc); err != nil {
+			return nil, nil, err
+		}
+		undo := func() {
+			delete(s.mem.accounts, created.ID)
+			delete(s.mem.documents, created.DocumentType+":"+created.DocumentNumber)
+			s.mem.nextAccountID = created.ID
+		}
+		return []walOp{accountOp(created, time.Time{})}, undo, nil
+	})
+	return created, err
+}
+
+func (s *FileStore) GetAccount(ctx context.Context, id int64) (domain.Account, error) {
+	return s.mem.GetAccount(ctx, id)
+}
+
+func (s *FileStore) ChangeAccountStatus(ctx context.Context, id int64, change StatusChangeFunc) (domain.Account, error) {
+	return changeAccountStatus(ctx, s, id, change)
+}
+
+func (s *FileStore) ListAccountStatusChanges(ctx context.Context, accountID int64) ([]domain.AccountStatusChange, error) {
+	return s.mem.ListAccountStatusChanges(ctx, accountID)
+}
+
+func (s *FileStore) GetOperationType(ctx context.Context, id int) (domain.OperationType, error) {
+	return s.mem.GetOperationType(ctx, id)
+}
+
+func (s *FileStore) ListOperationTypes(ctx context.Context) ([]domain.OperationType, error) {
+	return s.mem.ListOperationTypes(ctx)
+}
+
+func (s *FileStore) CreateOperationType(ctx context.Context, ot domain.OperationType) (created domain.OperationType, err error) {
+	err = s.write(func() ([]walOp, func(), error) {
+		if created, err = s.mem.CreateOperationType(ctx, ot); err != nil {
+			return nil, nil, err
+		}
+		undo := func() {
+			delete(s.mem.operationTypes, created.ID)
+			s.mem.nextOperationTypeID = created.ID
+		}
+		return []walOp{{OperationType: &created}}, undo, nil
+	})
+	return created, err
+}
+
+func (s *FileStore) UpdateOperationType(ctx context.Context, ot domain.OperationType) (updated domain.OperationType, err error) {
+	err = s.write(func() ([]walOp, func(), error) {
+		previous, err := s.mem.GetOperationType(ctx, ot.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if updated, err = s.mem.UpdateOperationType(ctx, ot); err != nil {
+			return nil, nil, err
+		}
+		undo := func() { s.mem.operationTypes[previous.ID] = previous }
+		return []walOp{{OperationType: &updated}}, undo, nil
+	})
+	return updated, err
+}
+
+func (s *FileStore) CreateTransaction(ctx context.Context, t domain.Transaction, velocity *VelocityCheck) (domain.Transaction, error) {
+	return createTransaction(ctx, s, t, nil, velocity)
+}
+
+func (s *FileStore) CreatePayment(ctx context.Context, t domain.Transaction, discharge DischargeFunc) (domain.Transaction, error) {
+	return createTransaction(ctx, s, t, discharge, nil)
+}
+
+func (s *FileStore) CreateInstallmentPurchase(ctx context.Context, parent domain.Transaction, installments []domain.Transaction, velocity *VelocityCheck) (domain.Transaction, []domain.Transaction, error) {
+	return createInstallmentPurchase(ctx, s, parent, installments, velocity)
+}
+
+func (s *FileStore) CreateReversal(ctx context.Context, originalID int64, reverse ReversalFunc) (domain.Transaction, error) {
+	return createReversal(ctx, s, originalID, reverse)
+}
+
+func (s *FileStore) GetTransaction(ctx context.Context, id int64) (domain.Transaction, error) {
+	return s.mem.GetTransaction(ctx, id)
+}
+
+func (s *FileStore) ListTransactions(ctx context.Context, f TransactionFilter) (TransactionPage, error) {
+	return s.mem.ListTransactions(ctx, f)
+}
+
+// WithinTx runs fn as an InMemoryStore unit of work and logs the rows it
+// wrote as one record before committing; if they cannot be logged, the unit
+// of work is rolled back.
+func (s *FileStore) WithinTx(ctx context.Context, fn func(ctx context.Context, tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed != nil {
+		return s.failed
+	}
+	return s.mem.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		ftx := &fileTx{Tx: tx, accounts: map[int64]bool{}, transactions: map[int64]bool{}}
+		if err := fn(ctx, ftx); err != nil {
+			return err
+		}
+		ops := ftx.ops(s.mem)
+		if len(ops) == 0 {
+			return nil
+		}
+		return s.append(ops)
+	})
+}
+
+// fileTx notes the rows a unit of work writes, to log them once it is done.
+type fileTx struct {
+	Tx
+	accounts      map[int64]bool
+	transactions  map[int64]bool
+	statusChanges []domain.AccountStatusChange
+}
+
+func (tx *fileTx) InsertTransaction(ctx context.Context, t domain.Transaction) (domain.Transaction, error) {
+	t, err := tx.Tx.InsertTransaction(ctx, t)
+	if err == nil {
+		tx.transactions[t.ID] = true
+	}
+	return t, err
+}
+
+func (tx *fileTx) SetTransactionBalance(ctx context.Context, accountID, id int64, balance domain.Money) error {
+	err := tx.Tx.SetTransactionBalance(ctx, accountID, id, balance)
+	if err == nil {
+		tx.transactions[id] = true
+	}
+	return err
+}
+
+func (tx *fileTx) SetAvailableBalance(ctx context.Context, accountID int64, balance domain.Money) error {
+	err := tx.Tx.SetAvailableBalance(ctx, accountID, balance)
+	if err == nil {
+		tx.accounts[accountID] = true
+	}
+	return err
+}
+
+func (tx *fileTx) SetInstallmentsPosted(ctx context.Context, accountID int64, t time.Time) error {
+	err := tx.Tx.SetInstallmentsPosted(ctx, accountID, t)
+	if err == nil {
+		tx.accounts[accountID] = true
+	}
+	return err
+}
+
+func (tx *fileTx) SetAccountStatus(ctx context.Context, accountID int64, status string) error {
+	err := tx.Tx.SetAccountStatus(ctx, accountID, status)
+	if err == nil {
+		tx.accounts[accountID] = true
+	}
+	return err
+}
+
+func (tx *fileTx) InsertStatusChange(ctx context.Context, c domain.AccountStatusChange) (domain.AccountStatusChange, error) {
+	c, err := tx.Tx.InsertStatusChange(ctx, c)
+	if err == nil {
+		tx.statusChanges = append(tx.statusChanges, c)
+	}
+	return c, err
+}
+
+// ops returns the rows written, as they now are in r, whose lock is held.
+func (tx *fileTx) ops(r *InMemoryStore) []walOp {
+	var ops []walOp
+	for _, id := range sortedKeys(tx.accounts) {
+		ops = append(ops, accountOp(*r.accounts[id], r.postedThrough[id]))
+	}
+	for _, id := range sortedKeys(tx.transactions) {
+		ops = append(ops, transactionOp(*r.transactions[id], r.storedAt[id]))
+	}
+	for _, c := range tx.statusChanges {
+		ops = append(ops, walOp{StatusChange: &c})
+	}
+	return ops
+}
+
+func sortedKeys(m map[int64]bool) []int64 {
+	keys := make([]int64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func (s *FileStore) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) (existing IdempotencyRecord, reserved bool, err error) {
+	err = s.write(func() ([]walOp, func(), error) {
+		existing, reserved, err = s.mem.ReserveIdempotencyKey(ctx, rec)
+		if err != nil || !reserved {
+			return nil, nil, err
+		}
+		undo := func() { delete(s.mem.idempotency, rec.Key) }
+		return []walOp{{Idempotency: &existing}}, undo, nil
+	})
+	return existing, reserved, err
+}
+
+func (s *FileStore) CompleteIdempotencyKey(ctx context.Context, key, fingerprint string, statusCode int, body []byte, expiresAt time.Time) error {
+	return s.write(func() ([]walOp, func(), error) {
+		previous, ok := s.idempotencyRecord(key)
+		if !ok || !previous.reservedBy(fingerprint) {
+			return nil, nil, nil
+		}
+		if err := s.mem.CompleteIdempotencyKey(ctx, key, fingerprint, statusCode, body, expiresAt); err != nil {
+			return nil, nil, err
+		}
+		completed, _ := s.idempotencyRecord(key)
+		undo := func() { s.mem.idempotency[key] = previous }
+		return []walOp{{Idempotency: &completed}}, undo, nil
+	})
+}
+
+func (s *FileStore) ReleaseIdempotencyKey(ctx context.Context, key, fingerprint string) error {
+	return s.write(func() ([]walOp, func(), error) {
+		previous, ok := s.idempotencyRecord(key)
+		if !ok || !previous.reservedBy(fingerprint) {
+			return nil, nil, nil
+		}
+		if err := s.mem.ReleaseIdempotencyKey(ctx, key, fingerprint); err != nil {
+			return nil, nil, err
+		}
+		undo := func() { s.mem.idempotency[key] = previous }
+		return []walOp{{ReleaseIdempotency: key}}, undo, nil
+	})
+}
+
+func (s *FileStore) idempotencyRecord(key string) (IdempotencyRecord, bool) {
+	s.mem.mu.RLock()
+	defer s.mem.mu.RUnlock()
+	rec, ok := s.mem.idempotency[key]
+	return rec, ok
+}
+
+func (s *FileStore) CreateAPIKey(ctx context.Context, key APIKey) (created APIKey, err error) {
+	err = s.write(func() ([]walOp, func(), error) {
+		if created, err = s.mem.CreateAPIKey(ctx, key); err != nil {
+			return nil, nil, err
+		}
+		undo := func() {
+			delete(s.mem.apiKeys, created.ID)
+			s.mem.nextAPIKeyID = created.ID
+		}
+		return []walOp{{APIKey: &created}}, undo, nil
+	})
+	return created, err
+}
+
+func (s *FileStore) GetAPIKey(ctx context.Context, prefix string) (APIKey, error) {
+	return s.mem.GetAPIKey(ctx, prefix)
+}
+
+func (s *FileStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return s.mem.ListAPIKeys(ctx)
+}
+
+func (s *FileStore) RevokeAPIKey(ctx context.Context, id int64, at time.Time) (revoked APIKey, err error) {
+	err = s.write(func() ([]walOp, func(), error) {
+		s.mem.mu.RLock()
+		k, ok := s.mem.apiKeys[id]
+		wasRevoked := ok && k.Revoked()
+		s.mem.mu.RUnlock()
+		if revoked, err = s.mem.RevokeAPIKey(ctx, id, at); err != nil || wasRevoked {
+			return nil, nil, err
+		}
+		undo := func() { s.mem.apiKeys[id].RevokedAt = nil }
+		return []walOp{{APIKey: &revoked}}, undo, nil
+	})
+	return revoked, err
+}
+
+// walOp is one row as a change left it; applying it again is harmless. Money
+// is kept as decimal strings, since its JSON form does not carry a currency.
+type walOp struct {
+	Account       *fileAccount                `json:"account,omitempty"`
+	Transaction   *fileTransaction            `json:"transaction,omitempty"`
+	StatusChange  *domain.AccountStatusChange `json:"status_change,omitempty"`
+	OperationType *domain.OperationType       `json:"operation_type,omitempty"`
+	Idempotency   *IdempotencyRecord          `json:"idempotency,omitempty"`
+	// ReleaseIdempotency is the key of a dropped reservation.
+	ReleaseIdempotency string  `json:"release_idempotency,omitempty"`
+	APIKey             *APIKey `json:"api_key,omitempty"`
+}
+
+type fileAccount struct {
+	ID               int64  `json:"id"`
+	DocumentType     string `json:"document_type"`
+	DocumentNumber   string `json:"document_number"`
+	Currency         string `json:"currency"`
+	CreditLimit      string `json:"credit_limit"`
+	AvailableBalance string `json:"available_balance"`
+	Status           string `json:"status"`
+	// InstallmentsPostedThrough is up to when the account's installments
+	// are posted to its available balance.
+	InstallmentsPostedThrough time.Time `json:"installments_posted_through"`
+}
+
+type fileTransaction struct {
+	ID                    int64        `json:"id"`
+	AccountID             int64        `json:"account_id"`
+	OperationTypeID       int          `json:"operation_type_id"`
+	Currency              string       `json:"currency"`
+	Amount                string       `json:"amount"`
+	Balance               string       `json:"balance"`
+	EventDate             time.Time    `json:"event_date"`
+	ReversesTransactionID *int64       `json:"reverses_transaction_id,omitempty"`
+	InstallmentCount      int          `json:"installment_count,omitempty"`
+	ParentTransactionID   *int64       `json:"parent_transaction_id,omitempty"`
+	InstallmentNumber     int          `json:"installment_number,omitempty"`
+	OriginalAmount        *string      `json:"original_amount,omitempty"`
+	OriginalCurrency      string       `json:"original_currency,omitempty"`
+	ExchangeRate          *domain.Rate `json:"exchange_rate,omitempty"`
+	StoredAt              time.Time    `json:"stored_at"`
+}
+
+func accountOp(a domain.Account, postedThrough time.Time) walOp {
+	return walOp{Account: &fileAccount{
+		ID:                        a.ID,
+		DocumentType:              a.DocumentType,
+		DocumentNumber:            a.DocumentNumber,
+		Currency:                  a.Currency,
+		CreditLimit:               a.CreditLimit.String(),
+		AvailableBalance:          a.AvailableBalance.String(),
+		Status:                    a.Status,
+		InstallmentsPostedThrough: postedThrough,
+	}}
+}
+
+func transactionOp(t domain.Transaction, storedAt time.Time) walOp {
+	ft := &fileTransaction{
+		ID:                    t.ID,
+		AccountID:             t.AccountID,
+		OperationTypeID:       t.OperationTypeID,
+		Currency:              t.Currency,
+		Amount:                t.Amount.String(),
+		Balance:               t.Balance.String(),
+		EventDate:             t.EventDate,
+		ReversesTransactionID: t.ReversesTransactionID,
+		InstallmentCount:      t.InstallmentCount,
+		ParentTransactionID:   t.ParentTransactionID,
+		InstallmentNumber:     t.InstallmentNumber,
+		OriginalCurrency:      t.OriginalCurrency,
+		ExchangeRate:          t.ExchangeRate,
+		StoredAt:              storedAt,
+	}
+	if t.OriginalAmount != nil {
+		original := t.OriginalAmount.String()
+		ft.OriginalAmount = &original
+	}
+	return walOp{Transaction: ft}
+}
+
+func (fa fileAccount) account() (domain.Account, error) {
+	a := domain.Account{
+		ID:             fa.ID,
+		DocumentType:   fa.DocumentType,
+		DocumentNumber: fa.DocumentNumber,
+		Currency:       fa.Currency,
+		Status:         fa.Status,
+	}
+	var err error
+	if a.CreditLimit, err = domain.ParseMoney(fa.CreditLimit, fa.Currency); err != nil {
+		return domain.Account{}, err
+	}
+	if a.AvailableBalance, err = domain.ParseMoney(fa.AvailableBalance, fa.Currency); err != nil {
+		return domain.Account{}, err
+	}
+	return a, nil
+}
+
+func (ft fileTransaction) transaction() (domain.Transaction, error) {
+	t := domain.Transaction{
+		ID:                    ft.ID,
+		AccountID:             ft.AccountID,
+		OperationTypeID:       ft.OperationTypeID,
+		EventDate:             ft.EventDate,
+		ReversesTransactionID: ft.ReversesTransactionID,
+		InstallmentCount:      ft.InstallmentCount,
+		ParentTransactionID:   ft.ParentTransactionID,
+		InstallmentNumber:     ft.InstallmentNumber,
+		Currency:              ft.Currency,
+		OriginalCurrency:      ft.OriginalCurrency,
+		ExchangeRate:          ft.ExchangeRate,
+	}
+	var err error
+	if t.Amount, err = domain.ParseMoney(ft.Amount, ft.Currency); err != nil {
+		return domain.Transaction{}, err
+	}
+	if t.Balance, err = domain.ParseMoney(ft.Balance, ft.Currency); err != nil {
+		return domain.Transaction{}, err
+	}
+	if ft.OriginalAmount != nil {
+		original, err := domain.ParseMoney(*ft.OriginalAmount, ft.OriginalCurrency)
+		if err != nil {
+			return domain.Transaction{}, err
+		}
+		t.OriginalAmount = &original
+	}
+	return t, nil
+}
+
+// restore writes the row held by op into r; it is only called while r is
+// not yet shared. Counters are left to recount.
+func (r *InMemoryStore) restore(op walOp) error {
+	switch {
+	case op.Account != nil:
+		a, err := op.Account.account()
+		if err != nil {
+			return err
+		}
+		r.accounts[a.ID] = &a
+		r.documents[a.DocumentType+":"+a.DocumentNumber] = a.ID
+		if !op.Account.InstallmentsPostedThrough.IsZero() {
+			r.postedThrough[a.ID] = op.Account.InstallmentsPostedThrough
+		}
+	case op.Transaction != nil:
+		t, err := op.Transaction.transaction()
+		if err != nil {
+			return err
+		}
+		r.transactions[t.ID] = &t
+		r.storedAt[t.ID] = op.Transaction.StoredAt
+	case op.StatusChange != nil:
+		c := *op.StatusChange
+		history := r.statusChanges[c.AccountID]
+		if n := len(history); n == 0 || history[n-1].ID < c.ID {
+			r.statusChanges[c.AccountID] = append(history, c)
+		}
+	case op.OperationType != nil:
+		r.operationTypes[op.OperationType.ID] = *op.OperationType
+	case op.Idempotency != nil:
+		r.idempotency[op.Idempotency.Key] = *op.Idempotency
+	case op.ReleaseIdempotency != "":
+		delete(r.idempotency, op.ReleaseIdempotency)
+	case op.APIKey != nil:
+		k := copyAPIKey(op.APIKey)
+		r.apiKeys[k.ID] = &k
+	default:
+		return errors.New("empty operation")
+	}
+	return nil
+}
+
+// recount sets the ID counters past the rows restored.
+func (r *InMemoryStore) recount() {
+	for id := range r.accounts {
+		r.nextAccountID = max(r.nextAccountID, id+1)
+	}
+	for id := range r.transactions {
+		r.nextTransactionID = max(r.nextTransactionID, id+1)
+	}
+	for id := range r.operationTypes {
+		r.nextOperationTypeID = max(r.nextOperationTypeID, id+1)
+	}
+	for _, history := range r.statusChanges {
+		for _, c := range history {
+			r.nextStatusChangeID = max(r.nextStatusChangeID, c.ID+1)
+		}
+	}
+	for id := range r.apiKeys {
+		r.nextAPIKeyID = max(r.nextAPIKeyID, id+1)
+	}
+}
+
+// dump returns every row of r, whose lock is held, leaving out idempotency
+// records expired by now.
+func (r *InMemoryStore) dump(now time.Time) []walOp {
+	var ops []walOp
+	otIDs := make([]int, 0, len(r.operationTypes))
+	for id := range r.operationTypes {
+		otIDs = append(otIDs, id)
+	}
+	sort.Ints(otIDs)
+	for _, id := range otIDs {
+		ot := r.operationTypes[id]
+		ops = append(ops, walOp{OperationType: &ot})
+	}
+	for _, id := range sortedIDs(r.accounts) {
+		ops = append(ops, accountOp(*r.accounts[id], r.postedThrough[id]))
+		for _, c := range r.statusChanges[id] {
+			ops = append(ops, walOp{StatusChange: &c})
+		}
+	}
+	for _, id := range sortedIDs(r.transactions) {
+		ops = append(ops, transactionOp(*r.transactions[id], r.storedAt[id]))
+	}
+	for _, rec := range r.idempotency {
+		if rec.ExpiresAt.After(now) {
+			ops = append(ops, walOp{Idempotency: &rec})
+		}
+	}
+	for _, id := range sortedIDs(r.apiKeys) {
+		k := copyAPIKey(r.apiKeys[id])
+		ops = append(ops, walOp{APIKey: &k})
+	}
+	return ops
+}
+
+func sortedIDs[V any](m map[int64]V) []int64 {
+	ids := make([]int64, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
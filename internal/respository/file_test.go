@@ -0,0 +1,211 @@
+package respository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+func TestFileStore_Recovers(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	usd := func(s string) domain.Money { return domain.MustParseMoney(s, "USD") }
+
+	s, err := OpenFileStore(dir, WithSyncPolicy(SyncNever, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, _ := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: usd("100")})
+	debit, err := s.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: usd("-12.34"), Balance: usd("-12.34")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fee, _ := s.CreateOperationType(ctx, domain.OperationType{Description: "FEE", Direction: domain.DirectionDebit, Active: true})
+	s.ReserveIdempotencyKey(ctx, IdempotencyRecord{Key: "k", ExpiresAt: time.Now().Add(time.Hour)})
+	s.CompleteIdempotencyKey(ctx, "k", "", 201, []byte(`{}`), time.Now().Add(time.Hour))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2"}); !errors.Is(err, errStoreClosed) {
+		t.Errorf("expected writes to a closed store to fail, got %v", err)
+	}
+
+	s, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := s.GetAccount(ctx, acc.ID); err != nil || got != (domain.Account{ID: acc.ID, DocumentNumber: "doc1", Currency: "USD", CreditLimit: usd("100"), AvailableBalance: usd("87.66"), Status: domain.AccountActive}) {
+		t.Errorf("GetAccount after reopening: %+v, %v", got, err)
+	}
+	if got, err := s.GetTransaction(ctx, debit.ID); err != nil || got.Amount != usd("-12.34") || !got.EventDate.Equal(debit.EventDate) {
+		t.Errorf("GetTransaction after reopening: %+v, %v", got, err)
+	}
+	if existing, reserved, _ := s.ReserveIdempotencyKey(ctx, IdempotencyRecord{Key: "k", ExpiresAt: time.Now().Add(time.Hour)}); reserved || existing.StatusCode != 201 {
+		t.Errorf("expected the completed key to survive, got %+v", existing)
+	}
+	// IDs carry on after the recovered rows.
+	if next, _ := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2"}); next.ID != acc.ID+1 {
+		t.Errorf("expected account id %d, got %d", acc.ID+1, next.ID)
+	}
+	if next, _ := s.CreateOperationType(ctx, domain.OperationType{Description: "FEE2", Direction: domain.DirectionDebit}); next.ID != fee.ID+1 {
+		t.Errorf("expected operation type id %d, got %d", fee.ID+1, next.ID)
+	}
+	// Velocity windows count debits by when they were stored, so that time
+	// survives too.
+	var recent DebitActivity
+	velocity := &VelocityCheck{Window: time.Hour, Check: func(a DebitActivity, t domain.Transaction) error {
+		recent = a
+		return nil
+	}}
+	if _, err := s.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: usd("-1"), Balance: usd("-1")}, velocity); err != nil || recent.Count != 1 {
+		t.Errorf("expected the recovered debit in the window, got %+v, %v", recent, err)
+	}
+}
+
+func TestFileStore_DropsTornRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, _ := OpenFileStore(dir)
+	first, _ := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1"})
+	s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2"})
+	s.Close()
+
+	// Cut the last record short, as a crash in the middle of writing it would.
+	path := filepath.Join(dir, segmentName(1))
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore: %v", err)
+	}
+	if _, err := s.GetAccount(ctx, first.ID); err != nil {
+		t.Errorf("expected the whole record to survive: %v", err)
+	}
+	if _, err := s.GetAccount(ctx, first.ID+1); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected the torn record to be dropped, got %v", err)
+	}
+	// The torn bytes are gone, so new records are readable after reopening.
+	again, err := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2"})
+	if err != nil || again.ID != first.ID+1 {
+		t.Fatalf("CreateAccount: %+v, %v", again, err)
+	}
+	s.Close()
+	s, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.GetAccount(ctx, again.ID); err != nil {
+		t.Errorf("GetAccount: %v", err)
+	}
+}
+
+func TestFileStore_RefusesCorruptLog(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := OpenFileStore(dir)
+	s.CreateAccount(context.Background(), domain.Account{DocumentNumber: "doc1"})
+	s.Close()
+
+	path := filepath.Join(dir, segmentName(1))
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(path, data, 0o600)
+	// A second segment makes the damaged one not the last: the damage
+	// cannot be a torn append.
+	os.WriteFile(filepath.Join(dir, segmentName(2)), nil, 0o600)
+
+	if _, err := OpenFileStore(dir); !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("expected ErrCorruptLog, got %v", err)
+	}
+}
+
+func TestFileStore_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, _ := OpenFileStore(dir, WithSnapshotEvery(0))
+	acc, _ := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: domain.MustParseMoney("100", domain.DefaultCurrency)})
+	s.ChangeAccountStatus(ctx, acc.ID, func(acc domain.Account) (domain.AccountStatusChange, error) {
+		return acc.ChangeStatus(domain.AccountBlocked, "test", time.Time{})
+	})
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2"})
+	s.Close()
+
+	// The log the snapshot holds is gone; later writes are in a new segment.
+	if starts, _ := segments(dir); len(starts) != 1 || starts[0] != 3 {
+		t.Errorf("expected one segment starting at record 3, got %v", starts)
+	}
+
+	s, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, _ := s.GetAccount(ctx, acc.ID); got.Status != domain.AccountBlocked {
+		t.Errorf("expected the snapshot to be loaded, got %+v", got)
+	}
+	if changes, _ := s.ListAccountStatusChanges(ctx, acc.ID); len(changes) != 1 {
+		t.Errorf("expected the status history to be loaded, got %+v", changes)
+	}
+	if _, err := s.GetAccount(ctx, acc.ID+1); err != nil {
+		t.Errorf("expected the log after the snapshot to be replayed: %v", err)
+	}
+}
+
+func TestFileStore_SnapshotsEveryN(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, _ := OpenFileStore(dir, WithSnapshotEvery(2), WithSyncPolicy(SyncInterval, time.Millisecond))
+	for _, doc := range []string{"doc1", "doc2", "doc3"} {
+		s.CreateAccount(ctx, domain.Account{DocumentNumber: doc})
+	}
+	// Close waits for the snapshot started in the background.
+	s.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err != nil {
+		t.Fatalf("expected a snapshot: %v", err)
+	}
+	s, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id := int64(1); id <= 3; id++ {
+		if _, err := s.GetAccount(ctx, id); err != nil {
+			t.Errorf("GetAccount(%d): %v", id, err)
+		}
+	}
+}
+
+func TestFileStore_UndoesUnloggedWrite(t *testing.T) {
+	ctx := context.Background()
+	s, _ := OpenFileStore(t.TempDir())
+	defer s.Close()
+	acc, _ := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: domain.MustParseMoney("100", domain.DefaultCurrency)})
+
+	// Appends to a closed file fail like those to a full disk.
+	s.segment.Close()
+	if _, err := s.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: domain.MustParseMoney("-10", domain.DefaultCurrency)}, nil); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if _, err := s.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2"}); err == nil {
+		t.Fatal("expected the store to refuse writes")
+	}
+	if got, _ := s.GetAccount(ctx, acc.ID); got.AvailableBalance != got.CreditLimit {
+		t.Errorf("expected the debit to be undone, got %+v", got)
+	}
+	if _, err := s.GetAccount(ctx, acc.ID+1); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected the account to be undone, got %v", err)
+	}
+}
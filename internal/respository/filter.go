@@ -0,0 +1,118 @@
+package respository
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TransactionFilter selects transactions for listing. Nil fields do not
+// filter. Amount bounds apply to the signed stored amount and are inclusive;
+// they only match transactions in their own currency. From is inclusive and
+// To exclusive.
+type TransactionFilter struct {
+	AccountID       *int64
+	OperationTypeID *int
+	MinAmount       *domain.Money
+	MaxAmount       *domain.Money
+	From            *time.Time
+	To              *time.Time
+	// ParentTransactionID selects the installments of one installment purchase.
+	ParentTransactionID *int64
+
+	// Results are ordered by event_date then id; Descending reverses both.
+	Descending bool
+	// After continues a listing from the last row of a previous page.
+	After *Cursor
+	// Limit is the maximum number of rows returned; it must be positive.
+	Limit int
+}
+
+// TransactionPage is one page of a listing. Next is nil on the last page.
+type TransactionPage struct {
+	Transactions []domain.Transaction
+	Next         *Cursor
+}
+
+// Cursor identifies a position in the (event_date, id) ordering.
+type Cursor struct {
+	EventDate time.Time
+	ID        int64
+}
+
+// String encodes the cursor as an opaque URL-safe token.
+func (c Cursor) String() string {
+	raw := c.EventDate.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(token string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	ts, idStr, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	eventDate, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{EventDate: eventDate, ID: id}, nil
+}
+
+func cursorOf(t domain.Transaction) *Cursor {
+	return &Cursor{EventDate: t.EventDate, ID: t.ID}
+}
+
+// matches reports whether t passes every filter except the cursor.
+func (f TransactionFilter) matches(t domain.Transaction) bool {
+	if f.AccountID != nil && t.AccountID != *f.AccountID {
+		return false
+	}
+	if f.OperationTypeID != nil && t.OperationTypeID != *f.OperationTypeID {
+		return false
+	}
+	if f.MinAmount != nil {
+		if c, err := t.Amount.Cmp(*f.MinAmount); err != nil || c < 0 {
+			return false
+		}
+	}
+	if f.MaxAmount != nil {
+		if c, err := t.Amount.Cmp(*f.MaxAmount); err != nil || c > 0 {
+			return false
+		}
+	}
+	if f.From != nil && t.EventDate.Before(*f.From) {
+		return false
+	}
+	if f.To != nil && !t.EventDate.Before(*f.To) {
+		return false
+	}
+	if f.ParentTransactionID != nil && (t.ParentTransactionID == nil || *t.ParentTransactionID != *f.ParentTransactionID) {
+		return false
+	}
+	return true
+}
+
+// less orders cursors by event_date then id, honouring Descending.
+func (f TransactionFilter) less(a, b Cursor) bool {
+	if f.Descending {
+		a, b = b, a
+	}
+	if !a.EventDate.Equal(b.EventDate) {
+		return a.EventDate.Before(b.EventDate)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,41 @@
+package respository
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyRecord is the stored outcome of the first request made with an
+// Idempotency-Key. StatusCode is zero while that request is still in flight;
+// ExpiresAt is then the end of its lease, after which another request may
+// take the key over.
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// reservedBy reports whether rec is in flight for a request with fingerprint.
+func (rec IdempotencyRecord) reservedBy(fingerprint string) bool {
+	return rec.StatusCode == 0 && rec.Fingerprint == fingerprint
+}
+
+// IdempotencyStore persists Idempotency-Key outcomes. Expired records are
+// treated as absent.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey stores rec as in flight until rec.ExpiresAt and
+	// returns reserved=true, unless a live record with the same key exists, in
+	// which case that record is returned with reserved=false. Concurrent callers with the same key
+	// see exactly one reservation succeed.
+	ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) (existing IdempotencyRecord, reserved bool, err error)
+	// CompleteIdempotencyKey stores the response of a key reserved with
+	// fingerprint, kept until expiresAt. It does nothing if the reservation
+	// is no longer in flight with that fingerprint, as when its lease ran out
+	// and another request took the key over.
+	CompleteIdempotencyKey(ctx context.Context, key, fingerprint string, statusCode int, body []byte, expiresAt time.Time) error
+	// ReleaseIdempotencyKey drops an in-flight reservation made with
+	// fingerprint so the request can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, key, fingerprint string) error
+}
@@ -1,54 +1,103 @@
 package respository
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/animeshs34/transaction_routine/internal/domain"
 )
 
+// idempotencySweepInterval is how often expired idempotency records are
+// dropped; until then they are only skipped.
+const idempotencySweepInterval = time.Minute
+
+// InMemoryStore keeps everything in maps behind one lock. Its calls never
+// block on I/O, so the only use of ctx is to refuse work for a request that is
+// already cancelled or past its deadline.
 type InMemoryStore struct {
 	mu sync.RWMutex
 
-	accounts       map[int64]*domain.Account
-	transactions   map[int64]*domain.Transaction
+	accounts     map[int64]*domain.Account
+	transactions map[int64]*domain.Transaction
+	// storedAt records when each transaction was inserted, for DebitActivity.
+	storedAt map[int64]time.Time
+	// postedThrough records, per account, up to when its installments are
+	// posted to the available balance.
+	postedThrough  map[int64]time.Time
 	operationTypes map[int]domain.OperationType
+	idempotency    map[string]IdempotencyRecord
+	// lastSweep is when expired idempotency records were last dropped.
+	lastSweep time.Time
+	// documents indexes account IDs by document type and number.
+	documents map[string]int64
+	// statusChanges holds each account's status history, oldest first.
+	statusChanges map[int64][]domain.AccountStatusChange
+	apiKeys       map[int64]*APIKey
 
-	nextAccountID     int64
-	nextTransactionID int64
+	nextAccountID       int64
+	nextTransactionID   int64
+	nextOperationTypeID int
+	nextStatusChangeID  int64
+	nextAPIKeyID        int64
 }
 
 func NewInMemoryStore() *InMemoryStore {
 	r := &InMemoryStore{
-		accounts:          make(map[int64]*domain.Account),
-		transactions:      make(map[int64]*domain.Transaction),
-		operationTypes:    make(map[int]domain.OperationType),
-		nextAccountID:     1,
-		nextTransactionID: 1,
+		accounts:           make(map[int64]*domain.Account),
+		transactions:       make(map[int64]*domain.Transaction),
+		storedAt:           make(map[int64]time.Time),
+		postedThrough:      make(map[int64]time.Time),
+		operationTypes:     make(map[int]domain.OperationType),
+		idempotency:        make(map[string]IdempotencyRecord),
+		documents:          make(map[string]int64),
+		statusChanges:      make(map[int64][]domain.AccountStatusChange),
+		apiKeys:            make(map[int64]*APIKey),
+		nextAccountID:      1,
+		nextTransactionID:  1,
+		nextStatusChangeID: 1,
+		nextAPIKeyID:       1,
+		// Matches the operation_types id sequence, which leaves room below
+		// 100 for built-in types.
+		nextOperationTypeID: 100,
+	}
+	for _, ot := range domain.BuiltinOperationTypes {
+		r.operationTypes[ot.ID] = ot
 	}
-
-	r.operationTypes[domain.OpCashPurchase] = domain.OperationType{ID: domain.OpCashPurchase, Description: "CASH PURCHASE"}
-	r.operationTypes[domain.OpInstallmentPurchase] = domain.OperationType{ID: domain.OpInstallmentPurchase, Description: "INSTALLMENT PURCHASE"}
-	r.operationTypes[domain.OpWithdrawal] = domain.OperationType{ID: domain.OpWithdrawal, Description: "WITHDRAWAL"}
-	r.operationTypes[domain.OpPayment] = domain.OperationType{ID: domain.OpPayment, Description: "PAYMENT"}
-
 	return r
 }
 
-func (r *InMemoryStore) CreateAccount(document string) (domain.Account, error) {
+func (r *InMemoryStore) CreateAccount(ctx context.Context, acc domain.Account) (domain.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Account{}, err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	acc := domain.Account{
-		ID:             r.nextAccountID,
-		DocumentNumber: document,
+	docKey := acc.DocumentType + ":" + acc.DocumentNumber
+	if _, ok := r.documents[docKey]; ok {
+		return domain.Account{}, ErrDuplicateDocument
+	}
+	acc.ID = r.nextAccountID
+	if acc.Currency == "" {
+		acc.Currency = acc.CreditLimit.Currency()
 	}
+	if acc.Status == "" {
+		acc.Status = domain.AccountActive
+	}
+	acc.AvailableBalance = acc.CreditLimit
 	r.accounts[acc.ID] = &acc
+	r.documents[docKey] = acc.ID
 	r.nextAccountID++
 	return acc, nil
 }
 
-func (r *InMemoryStore) GetAccount(id int64) (domain.Account, error) {
+func (r *InMemoryStore) GetAccount(ctx context.Context, id int64) (domain.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Account{}, err
+	}
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -56,33 +105,509 @@ func (r *InMemoryStore) GetAccount(id int64) (domain.Account, error) {
 	if !ok {
 		return domain.Account{}, ErrAccountNotFound
 	}
-	return *a, nil
+	return r.withDueInstallments(*a, time.Now())
+}
+
+// withDueInstallments returns acc with the installments that fell due since
+// they were last posted taken off its available balance, as the next unit of
+// work to lock it will post them.
+func (r *InMemoryStore) withDueInstallments(acc domain.Account, now time.Time) (domain.Account, error) {
+	unposted, _ := (&memTx{r: r}).UnpostedInstallments(context.Background(), acc.ID)
+	due, err := dueInstallments(unposted, now, acc.Currency)
+	if err != nil {
+		return domain.Account{}, err
+	}
+	if acc.AvailableBalance, err = acc.AvailableBalance.Add(due); err != nil {
+		return domain.Account{}, err
+	}
+	return acc, nil
+}
+
+func (r *InMemoryStore) ChangeAccountStatus(ctx context.Context, id int64, change StatusChangeFunc) (domain.Account, error) {
+	return changeAccountStatus(ctx, r, id, change)
+}
+
+func (r *InMemoryStore) ListAccountStatusChanges(ctx context.Context, accountID int64) ([]domain.AccountStatusChange, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.accounts[accountID]; !ok {
+		return nil, ErrAccountNotFound
+	}
+	return append([]domain.AccountStatusChange{}, r.statusChanges[accountID]...), nil
 }
 
-func (r *InMemoryStore) HasOperationType(id int) bool {
+func (r *InMemoryStore) GetOperationType(ctx context.Context, id int) (domain.OperationType, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.OperationType{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ot, ok := r.operationTypes[id]
+	if !ok {
+		return domain.OperationType{}, ErrOperationTypeNotFound
+	}
+	return ot, nil
+}
+
+func (r *InMemoryStore) CreateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.OperationType{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ot.ID = r.nextOperationTypeID
+	r.operationTypes[ot.ID] = ot
+	r.nextOperationTypeID++
+	return ot, nil
+}
+
+func (r *InMemoryStore) UpdateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.OperationType{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.operationTypes[ot.ID]; !ok {
+		return domain.OperationType{}, ErrOperationTypeNotFound
+	}
+	r.operationTypes[ot.ID] = ot
+	return ot, nil
+}
+
+func (r *InMemoryStore) ListOperationTypes(ctx context.Context) ([]domain.OperationType, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	_, ok := r.operationTypes[id]
-	return ok
+
+	types := make([]domain.OperationType, 0, len(r.operationTypes))
+	for _, ot := range r.operationTypes {
+		types = append(types, ot)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].ID < types[j].ID })
+	return types, nil
+}
+
+func (r *InMemoryStore) CreateTransaction(ctx context.Context, t domain.Transaction, velocity *VelocityCheck) (domain.Transaction, error) {
+	return createTransaction(ctx, r, t, nil, velocity)
+}
+
+func (r *InMemoryStore) CreatePayment(ctx context.Context, t domain.Transaction, discharge DischargeFunc) (domain.Transaction, error) {
+	return createTransaction(ctx, r, t, discharge, nil)
 }
 
-func (r *InMemoryStore) CreateTransaction(t domain.Transaction) (domain.Transaction, error) {
+func (r *InMemoryStore) CreateInstallmentPurchase(ctx context.Context, parent domain.Transaction, installments []domain.Transaction, velocity *VelocityCheck) (domain.Transaction, []domain.Transaction, error) {
+	return createInstallmentPurchase(ctx, r, parent, installments, velocity)
+}
+
+func (r *InMemoryStore) CreateReversal(ctx context.Context, originalID int64, reverse ReversalFunc) (domain.Transaction, error) {
+	return createReversal(ctx, r, originalID, reverse)
+}
+
+// WithinTx runs fn under the store lock. Writes are applied immediately and
+// undone in reverse order if fn fails.
+func (r *InMemoryStore) WithinTx(ctx context.Context, fn func(ctx context.Context, tx Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	tx := &memTx{r: r}
+	if err := fn(ctx, tx); err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+// memTx implements Tx for InMemoryStore; r.mu is held for its lifetime.
+type memTx struct {
+	r    *InMemoryStore
+	undo []func()
+}
+
+func (tx *memTx) LockAccount(ctx context.Context, id int64) (domain.Account, error) {
+	a, ok := tx.r.accounts[id]
+	if !ok {
+		return domain.Account{}, ErrAccountNotFound
+	}
+	return *a, nil
+}
+
+func (tx *memTx) GetTransaction(ctx context.Context, id int64) (domain.Transaction, error) {
+	t, ok := tx.r.transactions[id]
+	if !ok {
+		return domain.Transaction{}, ErrTransactionNotFound
+	}
+	return *t, nil
+}
+
+func (tx *memTx) Installments(ctx context.Context, parentID int64) ([]domain.Transaction, error) {
+	var installments []domain.Transaction
+	for _, t := range tx.r.transactions {
+		if t.ParentTransactionID != nil && *t.ParentTransactionID == parentID {
+			installments = append(installments, *t)
+		}
+	}
+	sort.Slice(installments, func(i, j int) bool { return installments[i].InstallmentNumber < installments[j].InstallmentNumber })
+	return installments, nil
+}
+
+func (tx *memTx) Reversals(ctx context.Context, id int64) ([]domain.Transaction, error) {
+	var reversals []domain.Transaction
+	for _, t := range tx.r.transactions {
+		if t.ReversesTransactionID != nil && *t.ReversesTransactionID == id {
+			reversals = append(reversals, *t)
+		}
+	}
+	sort.Slice(reversals, func(i, j int) bool { return reversals[i].ID < reversals[j].ID })
+	return reversals, nil
+}
+
+func (tx *memTx) OpenDebits(ctx context.Context, accountID int64) ([]domain.Transaction, error) {
+	now := time.Now()
+	var open []domain.Transaction
+	for _, t := range tx.r.transactions {
+		if t.AccountID == accountID && t.Balance.IsNegative() && !t.EventDate.After(now) {
+			open = append(open, *t)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		if !open[i].EventDate.Equal(open[j].EventDate) {
+			return open[i].EventDate.Before(open[j].EventDate)
+		}
+		return open[i].ID < open[j].ID
+	})
+	return open, nil
+}
+
+func (tx *memTx) UnpostedInstallments(ctx context.Context, accountID int64) ([]domain.Transaction, error) {
+	through := tx.r.postedThrough[accountID]
+	reversed := make(map[int64]bool)
+	for _, t := range tx.r.transactions {
+		if t.AccountID == accountID && t.ReversesTransactionID != nil {
+			reversed[*t.ReversesTransactionID] = true
+		}
+	}
+	var unposted []domain.Transaction
+	for _, t := range tx.r.transactions {
+		if t.AccountID == accountID && t.ParentTransactionID != nil && t.EventDate.After(through) && !reversed[*t.ParentTransactionID] {
+			unposted = append(unposted, *t)
+		}
+	}
+	sort.Slice(unposted, func(i, j int) bool {
+		if !unposted[i].EventDate.Equal(unposted[j].EventDate) {
+			return unposted[i].EventDate.Before(unposted[j].EventDate)
+		}
+		return unposted[i].ID < unposted[j].ID
+	})
+	return unposted, nil
+}
+
+func (tx *memTx) SetInstallmentsPosted(ctx context.Context, accountID int64, t time.Time) error {
+	r := tx.r
+	if _, ok := r.accounts[accountID]; !ok {
+		return ErrAccountNotFound
+	}
+	previous, had := r.postedThrough[accountID]
+	r.postedThrough[accountID] = t
+	tx.undo = append(tx.undo, func() {
+		if had {
+			r.postedThrough[accountID] = previous
+		} else {
+			delete(r.postedThrough, accountID)
+		}
+	})
+	return nil
+}
+
+func (tx *memTx) DebitActivity(ctx context.Context, accountID int64, since time.Time, currency string) (DebitActivity, error) {
+	activity := DebitActivity{Total: domain.NewMoney(0, currency)}
+	for id, t := range tx.r.transactions {
+		if t.AccountID != accountID || !t.Amount.IsNegative() || t.ParentTransactionID != nil || t.ReversesTransactionID != nil {
+			continue
+		}
+		if tx.r.storedAt[id].Before(since) {
+			continue
+		}
+		total, err := activity.Total.Add(t.Amount.Abs())
+		if err != nil {
+			return DebitActivity{}, err
+		}
+		activity.Count++
+		activity.Total = total
+	}
+	return activity, nil
+}
+
+func (tx *memTx) InsertTransaction(ctx context.Context, t domain.Transaction) (domain.Transaction, error) {
+	r := tx.r
 	if _, ok := r.accounts[t.AccountID]; !ok {
 		return domain.Transaction{}, ErrAccountNotFound
 	}
 	if _, ok := r.operationTypes[t.OperationTypeID]; !ok {
 		return domain.Transaction{}, ErrOperationTypeNotFound
 	}
-
-	t.ID = r.nextTransactionID
-	if t.EventDate.IsZero() {
-		t.EventDate = time.Now().UTC()
+	if t.ReversesTransactionID != nil {
+		if _, ok := r.transactions[*t.ReversesTransactionID]; !ok {
+			return domain.Transaction{}, ErrTransactionNotFound
+		}
+		id := *t.ReversesTransactionID
+		t.ReversesTransactionID = &id
 	}
-
+	if t.ParentTransactionID != nil {
+		if _, ok := r.transactions[*t.ParentTransactionID]; !ok {
+			return domain.Transaction{}, ErrTransactionNotFound
+		}
+		id := *t.ParentTransactionID
+		t.ParentTransactionID = &id
+	}
+	t.Currency = t.Amount.Currency()
+	t.ID = r.nextTransactionID
 	r.transactions[t.ID] = &t
+	r.storedAt[t.ID] = time.Now()
 	r.nextTransactionID++
+	tx.undo = append(tx.undo, func() {
+		delete(r.transactions, t.ID)
+		delete(r.storedAt, t.ID)
+		r.nextTransactionID--
+	})
 	return t, nil
 }
+
+func (tx *memTx) SetTransactionBalance(ctx context.Context, accountID, id int64, balance domain.Money) error {
+	t, ok := tx.r.transactions[id]
+	if !ok || t.AccountID != accountID {
+		return fmt.Errorf("discharge returned foreign transaction %d", id)
+	}
+	previous := t.Balance
+	t.Balance = balance
+	tx.undo = append(tx.undo, func() { t.Balance = previous })
+	return nil
+}
+
+func (tx *memTx) SetAvailableBalance(ctx context.Context, accountID int64, balance domain.Money) error {
+	a, ok := tx.r.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	previous := a.AvailableBalance
+	a.AvailableBalance = balance
+	tx.undo = append(tx.undo, func() { a.AvailableBalance = previous })
+	return nil
+}
+
+func (tx *memTx) SetAccountStatus(ctx context.Context, accountID int64, status string) error {
+	a, ok := tx.r.accounts[accountID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	previous := a.Status
+	a.Status = status
+	tx.undo = append(tx.undo, func() { a.Status = previous })
+	return nil
+}
+
+func (tx *memTx) InsertStatusChange(ctx context.Context, c domain.AccountStatusChange) (domain.AccountStatusChange, error) {
+	r := tx.r
+	if _, ok := r.accounts[c.AccountID]; !ok {
+		return domain.AccountStatusChange{}, ErrAccountNotFound
+	}
+	c.ID = r.nextStatusChangeID
+	r.statusChanges[c.AccountID] = append(r.statusChanges[c.AccountID], c)
+	r.nextStatusChangeID++
+	tx.undo = append(tx.undo, func() {
+		history := r.statusChanges[c.AccountID]
+		r.statusChanges[c.AccountID] = history[:len(history)-1]
+		r.nextStatusChangeID--
+	})
+	return c, nil
+}
+
+func (r *InMemoryStore) GetTransaction(ctx context.Context, id int64) (domain.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Transaction{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.transactions[id]
+	if !ok {
+		return domain.Transaction{}, ErrTransactionNotFound
+	}
+	return *t, nil
+}
+
+func (r *InMemoryStore) ListTransactions(ctx context.Context, f TransactionFilter) (TransactionPage, error) {
+	if err := ctx.Err(); err != nil {
+		return TransactionPage{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var matched []domain.Transaction
+	for _, t := range r.transactions {
+		if !f.matches(*t) {
+			continue
+		}
+		if f.After != nil && !f.less(*f.After, *cursorOf(*t)) {
+			continue
+		}
+		matched = append(matched, *t)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return f.less(*cursorOf(matched[i]), *cursorOf(matched[j]))
+	})
+
+	var page TransactionPage
+	if len(matched) > f.Limit {
+		matched = matched[:f.Limit]
+		page.Next = cursorOf(matched[len(matched)-1])
+	}
+	page.Transactions = matched
+	return page, nil
+}
+
+func (r *InMemoryStore) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= idempotencySweepInterval {
+		for key, existing := range r.idempotency {
+			if !existing.ExpiresAt.After(now) {
+				delete(r.idempotency, key)
+			}
+		}
+		r.lastSweep = now
+	}
+	// An expired record, including an in-flight one whose lease ran out, is
+	// taken over.
+	if existing, ok := r.idempotency[rec.Key]; ok && existing.ExpiresAt.After(now) {
+		return existing, false, nil
+	}
+	rec.StatusCode = 0
+	rec.Body = nil
+	r.idempotency[rec.Key] = rec
+	return rec, true, nil
+}
+
+func (r *InMemoryStore) CompleteIdempotencyKey(ctx context.Context, key, fingerprint string, statusCode int, body []byte, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.idempotency[key]
+	if !ok || !rec.reservedBy(fingerprint) {
+		return nil
+	}
+	rec.StatusCode = statusCode
+	rec.Body = append([]byte(nil), body...)
+	rec.ExpiresAt = expiresAt
+	r.idempotency[key] = rec
+	return nil
+}
+
+func (r *InMemoryStore) ReleaseIdempotencyKey(ctx context.Context, key, fingerprint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rec, ok := r.idempotency[key]; ok && rec.reservedBy(fingerprint) {
+		delete(r.idempotency, key)
+	}
+	return nil
+}
+
+func (r *InMemoryStore) CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, k := range r.apiKeys {
+		if k.Prefix == key.Prefix {
+			return APIKey{}, fmt.Errorf("api key prefix %q already exists", key.Prefix)
+		}
+	}
+	key.ID = r.nextAPIKeyID
+	r.nextAPIKeyID++
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now().UTC()
+	}
+	key.Scopes = append([]string(nil), key.Scopes...)
+	key.RevokedAt = nil
+	stored := key
+	r.apiKeys[key.ID] = &stored
+	return key, nil
+}
+
+func (r *InMemoryStore) GetAPIKey(ctx context.Context, prefix string) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, k := range r.apiKeys {
+		if k.Prefix == prefix {
+			return copyAPIKey(k), nil
+		}
+	}
+	return APIKey{}, ErrAPIKeyNotFound
+}
+
+func (r *InMemoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(r.apiKeys))
+	for _, k := range r.apiKeys {
+		keys = append(keys, copyAPIKey(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (r *InMemoryStore) RevokeAPIKey(ctx context.Context, id int64, at time.Time) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, ok := r.apiKeys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if k.RevokedAt == nil {
+		at = at.UTC()
+		k.RevokedAt = &at
+	}
+	return copyAPIKey(k), nil
+}
+
+// copyAPIKey keeps callers from mutating stored keys through the slice and
+// pointer fields.
+func copyAPIKey(k *APIKey) APIKey {
+	c := *k
+	c.Scopes = append([]string(nil), k.Scopes...)
+	if k.RevokedAt != nil {
+		at := *k.RevokedAt
+		c.RevokedAt = &at
+	}
+	return c
+}
@@ -1,41 +1,47 @@
 package respository
 
 import (
+	"context"
+	"errors"
 	"github.com/animeshs34/transaction_routine/internal/domain"
 	"testing"
 	"time"
 )
 
 func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
 	r := NewInMemoryStore()
 
-	acc, err := r.CreateAccount("doc1")
+	acc, err := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: domain.MustParseMoney("500", domain.DefaultCurrency)})
 	if err != nil {
 		t.Fatalf("CreateAccount failed: %v", err)
 	}
-	if acc.ID == 0 || acc.DocumentNumber != "doc1" {
+	if _, err := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1"}); !errors.Is(err, ErrDuplicateDocument) {
+		t.Errorf("expected ErrDuplicateDocument, got %v", err)
+	}
+	if acc.ID == 0 || acc.DocumentNumber != "doc1" || acc.AvailableBalance != acc.CreditLimit {
 		t.Errorf("unexpected account: %+v", acc)
 	}
 
-	got, err := r.GetAccount(acc.ID)
+	got, err := r.GetAccount(ctx, acc.ID)
 	if err != nil || got.ID != acc.ID {
 		t.Errorf("GetAccount failed: %v", err)
 	}
 
-	_, err = r.GetAccount(9999)
+	_, err = r.GetAccount(ctx, 9999)
 	if err == nil {
 		t.Errorf("expected error for missing account")
 	}
 
-	if !r.HasOperationType(domain.OpCashPurchase) {
-		t.Errorf("expected true for OpCashPurchase")
+	if ot, err := r.GetOperationType(ctx, domain.OpCashPurchase); err != nil || ot.Direction != domain.DirectionDebit || !ot.Active {
+		t.Errorf("GetOperationType(OpCashPurchase): %+v, %v", ot, err)
 	}
-	if r.HasOperationType(999) {
-		t.Errorf("expected false for unknown op type")
+	if _, err := r.GetOperationType(ctx, 999); !errors.Is(err, ErrOperationTypeNotFound) {
+		t.Errorf("expected ErrOperationTypeNotFound for unknown op type, got %v", err)
 	}
 
-	tx := domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: 100}
-	txResult, err := r.CreateTransaction(tx)
+	tx := domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: domain.MustParseMoney("-100", domain.DefaultCurrency)}
+	txResult, err := r.CreateTransaction(ctx, tx, nil)
 	if err != nil {
 		t.Errorf("CreateTransaction failed: %v", err)
 	}
@@ -43,25 +49,531 @@ func TestMemoryStore(t *testing.T) {
 		t.Errorf("unexpected transaction: %+v", txResult)
 	}
 
-	tx = domain.Transaction{AccountID: 9999, OperationTypeID: domain.OpCashPurchase, Amount: 100}
-	_, err = r.CreateTransaction(tx)
+	tx = domain.Transaction{AccountID: 9999, OperationTypeID: domain.OpCashPurchase, Amount: domain.MustParseMoney("100", domain.DefaultCurrency)}
+	_, err = r.CreateTransaction(ctx, tx, nil)
 	if err == nil {
 		t.Errorf("expected error for missing account")
 	}
 
-	tx = domain.Transaction{AccountID: acc.ID, OperationTypeID: 999, Amount: 100}
-	_, err = r.CreateTransaction(tx)
+	tx = domain.Transaction{AccountID: acc.ID, OperationTypeID: 999, Amount: domain.MustParseMoney("100", domain.DefaultCurrency)}
+	_, err = r.CreateTransaction(ctx, tx, nil)
 	if err == nil {
 		t.Errorf("expected error for missing operation type")
 	}
 
-	tx = domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: 100}
+	tx = domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: domain.MustParseMoney("-100", domain.DefaultCurrency)}
 	tx.EventDate = time.Time{} // zero
-	txResult, err = r.CreateTransaction(tx)
+	txResult, err = r.CreateTransaction(ctx, tx, nil)
 	if err != nil {
 		t.Errorf("CreateTransaction failed: %v", err)
 	}
 	if txResult.EventDate.IsZero() {
 		t.Errorf("expected EventDate to be set")
 	}
+
+	got, _ = r.GetAccount(ctx, acc.ID)
+	if got.AvailableBalance != domain.MustParseMoney("300", domain.DefaultCurrency) {
+		t.Errorf("expected available balance 300 after two debits, got %s", got.AvailableBalance)
+	}
+
+	tx = domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpWithdrawal, Amount: domain.MustParseMoney("-300.01", domain.DefaultCurrency)}
+	if _, err = r.CreateTransaction(ctx, tx, nil); !errors.Is(err, domain.ErrInsufficientBalance) {
+		t.Errorf("expected ErrInsufficientBalance, got %v", err)
+	}
+
+	tx = domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: domain.MustParseMoney("50", domain.DefaultCurrency)}
+	if _, err = r.CreateTransaction(ctx, tx, nil); err != nil {
+		t.Errorf("CreateTransaction failed: %v", err)
+	}
+	got, _ = r.GetAccount(ctx, acc.ID)
+	if got.AvailableBalance != domain.MustParseMoney("350", domain.DefaultCurrency) {
+		t.Errorf("expected available balance 350 after payment, got %s", got.AvailableBalance)
+	}
+}
+
+func TestMemoryStore_CreatePayment(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("500")})
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer, _ := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-30"), Balance: brl("-30"), EventDate: day.AddDate(0, 0, 1)}, nil)
+	older, _ := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-20"), Balance: brl("-20"), EventDate: day}, nil)
+
+	var seen []int64
+	payment := domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: brl("25"), Balance: brl("25")}
+	created, err := r.CreatePayment(ctx, payment, func(p domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		for _, d := range open {
+			seen = append(seen, d.ID)
+		}
+		open[0].Balance = brl("0")
+		open[1].Balance = brl("-25")
+		p.Balance = brl("0")
+		return p, open, nil
+	})
+	if err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+	if len(seen) != 2 || seen[0] != older.ID || seen[1] != newer.ID {
+		t.Errorf("expected open debits oldest first, got %v", seen)
+	}
+	if !created.Balance.IsZero() {
+		t.Errorf("unexpected payment balance %s", created.Balance)
+	}
+	if r.transactions[older.ID].Balance != brl("0") || r.transactions[newer.ID].Balance != brl("-25") {
+		t.Errorf("debit balances not persisted")
+	}
+
+	_, err = r.CreatePayment(ctx, payment, func(p domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		return p, nil, errors.New("boom")
+	})
+	if err == nil {
+		t.Errorf("expected discharge error to abort the payment")
+	}
+	if len(r.transactions) != 3 {
+		t.Errorf("failed payment must not be stored")
+	}
+}
+
+func TestMemoryStore_WithinTxRollsBack(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("100")})
+	debit, _ := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-40"), Balance: brl("-40")}, nil)
+
+	err := r.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		if _, err := tx.InsertTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: brl("40")}); err != nil {
+			return err
+		}
+		if err := tx.SetTransactionBalance(ctx, acc.ID, debit.ID, brl("0")); err != nil {
+			return err
+		}
+		if err := tx.SetAvailableBalance(ctx, acc.ID, brl("100")); err != nil {
+			return err
+		}
+		return errors.New("boom")
+	})
+	if err == nil {
+		t.Fatal("expected WithinTx to return the error")
+	}
+	if len(r.transactions) != 1 || r.nextTransactionID != 2 {
+		t.Errorf("inserted transaction not rolled back")
+	}
+	if r.transactions[debit.ID].Balance != brl("-40") || r.accounts[acc.ID].AvailableBalance != brl("60") {
+		t.Errorf("balances not rolled back")
+	}
+
+	_, err = r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: 99, Amount: brl("-1")}, nil)
+	if !errors.Is(err, ErrOperationTypeNotFound) || r.accounts[acc.ID].AvailableBalance != brl("60") {
+		t.Errorf("expected ErrOperationTypeNotFound without side effects, got %v", err)
+	}
+}
+
+func TestMemoryStore_CreateReversal(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("100")})
+	debit, _ := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-40"), Balance: brl("-40")}, nil)
+
+	var seen []domain.Transaction
+	reverse := func(original domain.Transaction, previous, posted []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		seen = previous
+		original.Balance = brl("-30")
+		return domain.Transaction{OperationTypeID: domain.OpRefund, Amount: brl("10")}, []domain.Transaction{original}, nil
+	}
+	refund, err := r.CreateReversal(ctx, debit.ID, reverse)
+	if err != nil {
+		t.Fatalf("CreateReversal failed: %v", err)
+	}
+	if refund.ReversesTransactionID == nil || *refund.ReversesTransactionID != debit.ID || refund.AccountID != acc.ID {
+		t.Errorf("reversal not linked to original: %+v", refund)
+	}
+	if r.transactions[debit.ID].Balance != brl("-30") || r.accounts[acc.ID].AvailableBalance != brl("70") {
+		t.Errorf("reversal did not update balances")
+	}
+
+	if _, err := r.CreateReversal(ctx, debit.ID, reverse); err != nil {
+		t.Fatalf("second CreateReversal failed: %v", err)
+	}
+	if len(seen) != 1 || seen[0].ID != refund.ID {
+		t.Errorf("expected earlier reversal to be passed in, got %+v", seen)
+	}
+	if _, err := r.CreateReversal(ctx, 999, reverse); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("expected ErrTransactionNotFound, got %v", err)
+	}
+}
+
+func TestMemoryStore_CreateInstallmentPurchase(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("100")})
+
+	now := time.Now().UTC()
+	parent := domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-60"), Balance: brl("0"), EventDate: now, InstallmentCount: 2}
+	installments := []domain.Transaction{
+		{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-30"), EventDate: now, InstallmentNumber: 1},
+		{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-30"), EventDate: now.AddDate(0, 1, 0), InstallmentNumber: 2},
+	}
+	created, schedule, err := r.CreateInstallmentPurchase(ctx, parent, installments, nil)
+	if err != nil {
+		t.Fatalf("CreateInstallmentPurchase failed: %v", err)
+	}
+	if len(schedule) != 2 || *schedule[1].ParentTransactionID != created.ID || schedule[1].AccountID != acc.ID {
+		t.Fatalf("installments not linked to parent: %+v", schedule)
+	}
+	// Only the installment already due is posted.
+	if r.accounts[acc.ID].AvailableBalance != brl("70") {
+		t.Errorf("expected available balance 70, got %s", r.accounts[acc.ID].AvailableBalance)
+	}
+
+	page, _ := r.ListTransactions(ctx, TransactionFilter{ParentTransactionID: &created.ID, Limit: 10})
+	if len(page.Transactions) != 2 || page.Transactions[0].InstallmentNumber != 1 {
+		t.Errorf("ListTransactions by parent: %+v", page.Transactions)
+	}
+
+	// Only the installment already due is open for payments.
+	var open []domain.Transaction
+	_, err = r.CreatePayment(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: brl("5"), Balance: brl("5")},
+		func(p domain.Transaction, o []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+			open = o
+			return p, nil, nil
+		})
+	if err != nil || len(open) != 1 || open[0].ID != schedule[0].ID {
+		t.Errorf("expected only the first installment to be open, got %+v, %v", open, err)
+	}
+
+	// The installment not yet due is still owed.
+	if _, err := r.CreatePayment(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: brl("25"), Balance: brl("25")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ChangeAccountStatus(ctx, acc.ID, func(acc domain.Account) (domain.AccountStatusChange, error) {
+		return acc.ChangeStatus(domain.AccountClosed, "test", time.Time{})
+	})
+	if !errors.Is(err, domain.ErrAccountHasBalance) {
+		t.Errorf("expected ErrAccountHasBalance, got %v", err)
+	}
+
+	// Installments due now must fit the available balance.
+	large := []domain.Transaction{{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-500"), Balance: brl("-500"), EventDate: now, InstallmentNumber: 1}}
+	if _, _, err := r.CreateInstallmentPurchase(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-500")}, large, nil); !errors.Is(err, domain.ErrInsufficientBalance) {
+		t.Errorf("expected ErrInsufficientBalance, got %v", err)
+	}
+}
+
+func TestMemoryStore_ListTransactions(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	a1, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("1000")})
+	a2, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2", CreditLimit: brl("1000")})
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Same event_date for the first two rows: id breaks the tie.
+	for _, tx := range []domain.Transaction{
+		{AccountID: a1.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-10"), EventDate: day},
+		{AccountID: a1.ID, OperationTypeID: domain.OpWithdrawal, Amount: brl("-20"), EventDate: day},
+		{AccountID: a2.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-30"), EventDate: day.Add(time.Hour)},
+		{AccountID: a1.ID, OperationTypeID: domain.OpPayment, Amount: brl("40"), EventDate: day.Add(-time.Hour)},
+	} {
+		if _, err := r.CreateTransaction(ctx, tx, nil); err != nil {
+			t.Fatalf("CreateTransaction failed: %v", err)
+		}
+	}
+
+	ids := func(page TransactionPage) []int64 {
+		var out []int64
+		for _, tx := range page.Transactions {
+			out = append(out, tx.ID)
+		}
+		return out
+	}
+
+	page, _ := r.ListTransactions(ctx, TransactionFilter{Limit: 2})
+	if got := ids(page); len(got) != 2 || got[0] != 4 || got[1] != 1 || page.Next == nil {
+		t.Fatalf("first page: %v next=%v", got, page.Next)
+	}
+	page, _ = r.ListTransactions(ctx, TransactionFilter{Limit: 2, After: page.Next})
+	if got := ids(page); len(got) != 2 || got[0] != 2 || got[1] != 3 || page.Next != nil {
+		t.Fatalf("second page: %v next=%v", got, page.Next)
+	}
+
+	page, _ = r.ListTransactions(ctx, TransactionFilter{Limit: 10, Descending: true})
+	if got := ids(page); len(got) != 4 || got[0] != 3 || got[1] != 2 || got[3] != 4 {
+		t.Fatalf("descending: %v", got)
+	}
+
+	min, max := brl("-25"), brl("-5")
+	page, _ = r.ListTransactions(ctx, TransactionFilter{Limit: 10, AccountID: &a1.ID, MinAmount: &min, MaxAmount: &max})
+	if got := ids(page); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("amount range: %v", got)
+	}
+
+	op := domain.OpPayment
+	from, to := day.Add(-2*time.Hour), day
+	page, _ = r.ListTransactions(ctx, TransactionFilter{Limit: 10, OperationTypeID: &op, From: &from, To: &to})
+	if got := ids(page); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("operation type and date range: %v", got)
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{EventDate: time.Date(2024, 1, 1, 10, 0, 0, 123456000, time.UTC), ID: 42}
+	got, err := ParseCursor(c.String())
+	if err != nil || !got.EventDate.Equal(c.EventDate) || got.ID != c.ID {
+		t.Errorf("round trip: %+v, %v", got, err)
+	}
+	if _, err := ParseCursor("not-a-cursor"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestMemoryStore_GetTransactionAndOperationTypes(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1"})
+	created, _ := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: domain.MustParseMoney("10", domain.DefaultCurrency)}, nil)
+
+	got, err := r.GetTransaction(ctx, created.ID)
+	if err != nil || got != created {
+		t.Errorf("GetTransaction: %+v, %v", got, err)
+	}
+	if _, err := r.GetTransaction(ctx, 999); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("expected ErrTransactionNotFound, got %v", err)
+	}
+
+	types, err := r.ListOperationTypes(ctx)
+	if err != nil || len(types) != 6 {
+		t.Fatalf("ListOperationTypes: %+v, %v", types, err)
+	}
+	for i, ot := range types {
+		if ot != domain.BuiltinOperationTypes[i] {
+			t.Errorf("unexpected operation type %+v", ot)
+		}
+	}
+
+	max := domain.MustParseMoney("5", domain.DefaultCurrency)
+	fee, err := r.CreateOperationType(ctx, domain.OperationType{Description: "FEE", Direction: domain.DirectionDebit, MaxAmount: &max, Active: true})
+	if err != nil || fee.ID != 100 {
+		t.Fatalf("CreateOperationType: %+v, %v", fee, err)
+	}
+	fee.Active = false
+	if _, err := r.UpdateOperationType(ctx, fee); err != nil {
+		t.Fatalf("UpdateOperationType: %v", err)
+	}
+	if got, _ := r.GetOperationType(ctx, fee.ID); got.Active {
+		t.Errorf("expected the update to be stored, got %+v", got)
+	}
+	if _, err := r.UpdateOperationType(ctx, domain.OperationType{ID: 999}); !errors.Is(err, ErrOperationTypeNotFound) {
+		t.Errorf("expected ErrOperationTypeNotFound, got %v", err)
+	}
+}
+
+func TestMemoryStore_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	rec := IdempotencyRecord{Key: "k", Fingerprint: "fp", ExpiresAt: time.Now().Add(time.Hour)}
+
+	if _, reserved, err := r.ReserveIdempotencyKey(ctx, rec); err != nil || !reserved {
+		t.Fatalf("first reserve: %v, %v", reserved, err)
+	}
+	existing, reserved, _ := r.ReserveIdempotencyKey(ctx, rec)
+	if reserved || existing.StatusCode != 0 {
+		t.Fatalf("expected in-flight record, got %+v reserved=%v", existing, reserved)
+	}
+
+	if err := r.CompleteIdempotencyKey(ctx, "k", "fp", 201, []byte(`{"ok":true}`), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	existing, _, _ = r.ReserveIdempotencyKey(ctx, rec)
+	if existing.StatusCode != 201 || string(existing.Body) != `{"ok":true}` || existing.Fingerprint != "fp" {
+		t.Fatalf("expected completed record, got %+v", existing)
+	}
+	// Completed records survive a release.
+	_ = r.ReleaseIdempotencyKey(ctx, "k", "fp")
+	if _, reserved, _ := r.ReserveIdempotencyKey(ctx, rec); reserved {
+		t.Fatalf("completed record must not be released")
+	}
+
+	released := IdempotencyRecord{Key: "r", ExpiresAt: time.Now().Add(time.Hour)}
+	r.ReserveIdempotencyKey(ctx, released)
+	_ = r.ReleaseIdempotencyKey(ctx, "r", "")
+	if _, reserved, _ := r.ReserveIdempotencyKey(ctx, released); !reserved {
+		t.Fatalf("expected released key to be reservable")
+	}
+
+	expired := IdempotencyRecord{Key: "e", ExpiresAt: time.Now().Add(-time.Second)}
+	r.ReserveIdempotencyKey(ctx, expired)
+	if _, reserved, _ := r.ReserveIdempotencyKey(ctx, expired); !reserved {
+		t.Fatalf("expected expired key to be reservable")
+	}
+}
+
+func TestMemoryStore_Currencies(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	usd := func(s string) domain.Money { return domain.MustParseMoney(s, "USD") }
+
+	acc, err := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: usd("100")})
+	if err != nil || acc.Currency != "USD" || acc.AvailableBalance != usd("100") {
+		t.Fatalf("CreateAccount: %+v, %v", acc, err)
+	}
+	created, err := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: usd("-10"), Balance: usd("-10")}, nil)
+	if err != nil || created.Currency != "USD" {
+		t.Errorf("CreateTransaction: %+v, %v", created, err)
+	}
+	brl := domain.MustParseMoney("-10", domain.DefaultCurrency)
+	if _, err := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl, Balance: brl}, nil); !errors.Is(err, domain.ErrCurrencyMismatch) {
+		t.Errorf("expected ErrCurrencyMismatch, got %v", err)
+	}
+
+	// Amount filters only match their own currency.
+	min := domain.MustParseMoney("-100", domain.DefaultCurrency)
+	page, err := r.ListTransactions(ctx, TransactionFilter{MinAmount: &min, Limit: 10})
+	if err != nil || len(page.Transactions) != 0 {
+		t.Errorf("ListTransactions: %+v, %v", page, err)
+	}
+}
+
+func TestMemoryStore_AccountStatus(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	changeTo := func(status string) StatusChangeFunc {
+		return func(acc domain.Account) (domain.AccountStatusChange, error) {
+			return acc.ChangeStatus(status, "test", time.Time{})
+		}
+	}
+
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("100")})
+	if acc.Status != domain.AccountActive {
+		t.Fatalf("new account status = %q", acc.Status)
+	}
+	if acc, err := r.ChangeAccountStatus(ctx, acc.ID, changeTo(domain.AccountBlocked)); err != nil || acc.Status != domain.AccountBlocked {
+		t.Fatalf("block: %+v, %v", acc, err)
+	}
+	if _, err := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpCashPurchase, Amount: brl("-10"), Balance: brl("-10")}, nil); !errors.Is(err, domain.ErrAccountBlocked) {
+		t.Errorf("expected ErrAccountBlocked for a debit, got %v", err)
+	}
+	if _, err := r.CreateTransaction(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: brl("10"), Balance: brl("10")}, nil); err != nil {
+		t.Errorf("credit on blocked account: %v", err)
+	}
+
+	// The payment left a credit, so the account cannot be closed; the failed
+	// attempt leaves no trace.
+	if _, err := r.ChangeAccountStatus(ctx, acc.ID, changeTo(domain.AccountClosed)); !errors.Is(err, domain.ErrAccountHasBalance) {
+		t.Errorf("expected ErrAccountHasBalance, got %v", err)
+	}
+	changes, err := r.ListAccountStatusChanges(ctx, acc.ID)
+	if err != nil || len(changes) != 1 || changes[0].From != domain.AccountActive || changes[0].ChangedAt.IsZero() {
+		t.Errorf("ListAccountStatusChanges: %+v, %v", changes, err)
+	}
+
+	if _, err := r.ChangeAccountStatus(ctx, 999, changeTo(domain.AccountBlocked)); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+	if _, err := r.ListAccountStatusChanges(ctx, 999); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+}
+
+func TestMemoryStore_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+
+	scopes := []string{"accounts:read"}
+	key, err := r.CreateAPIKey(ctx, APIKey{Name: "ci", Prefix: "0123456789abcdef", Hash: "h", Scopes: scopes})
+	if err != nil || key.ID != 1 || key.CreatedAt.IsZero() {
+		t.Fatalf("CreateAPIKey: %+v, %v", key, err)
+	}
+	scopes[0] = "accounts:write"
+	if _, err := r.CreateAPIKey(ctx, APIKey{Name: "dup", Prefix: "0123456789abcdef"}); err == nil {
+		t.Errorf("expected an error for a duplicate prefix")
+	}
+
+	got, err := r.GetAPIKey(ctx, "0123456789abcdef")
+	if err != nil || got.Name != "ci" || got.Scopes[0] != "accounts:read" || got.Revoked() {
+		t.Errorf("GetAPIKey: %+v, %v", got, err)
+	}
+	if _, err := r.GetAPIKey(ctx, "missing"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if revoked, err := r.RevokeAPIKey(ctx, key.ID, at); err != nil || !revoked.RevokedAt.Equal(at) {
+		t.Errorf("RevokeAPIKey: %+v, %v", revoked, err)
+	}
+	if revoked, err := r.RevokeAPIKey(ctx, key.ID, at.Add(time.Hour)); err != nil || !revoked.RevokedAt.Equal(at) {
+		t.Errorf("revoking again should keep the first time: %+v, %v", revoked, err)
+	}
+	if _, err := r.RevokeAPIKey(ctx, 99, at); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	keys, err := r.ListAPIKeys(ctx)
+	if err != nil || len(keys) != 1 || !keys[0].Revoked() {
+		t.Errorf("ListAPIKeys: %+v, %v", keys, err)
+	}
+}
+
+func TestMemoryStore_Velocity(t *testing.T) {
+	ctx := context.Background()
+	r := NewInMemoryStore()
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	acc, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: brl("1000")})
+	other, _ := r.CreateAccount(ctx, domain.Account{DocumentNumber: "doc2", CreditLimit: brl("1000")})
+
+	var seen []DebitActivity
+	velocity := &VelocityCheck{Window: time.Hour, Check: func(recent DebitActivity, t domain.Transaction) error {
+		seen = append(seen, recent)
+		if recent.Count >= 2 {
+			return errors.New("limit")
+		}
+		return nil
+	}}
+	debit := func(accountID int64, amount string, eventDate time.Time) domain.Transaction {
+		return domain.Transaction{AccountID: accountID, OperationTypeID: domain.OpCashPurchase, Amount: brl(amount).Neg(), Balance: brl(amount).Neg(), EventDate: eventDate}
+	}
+
+	// Backdating does not take a debit out of the window.
+	if _, err := r.CreateTransaction(ctx, debit(acc.ID, "10", time.Now().AddDate(-1, 0, 0)), velocity); err != nil {
+		t.Fatalf("first debit: %v", err)
+	}
+	if _, err := r.CreateTransaction(ctx, debit(other.ID, "99", time.Time{}), velocity); err != nil {
+		t.Fatalf("other account: %v", err)
+	}
+	// Payments are not checked and do not count.
+	keep := func(p domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		return p, nil, nil
+	}
+	if _, err := r.CreatePayment(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpPayment, Amount: brl("5"), Balance: brl("5")}, keep); err != nil {
+		t.Fatalf("payment: %v", err)
+	}
+	// An installment purchase counts once, for its total.
+	installments := []domain.Transaction{
+		{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-15"), Balance: brl("-15"), InstallmentNumber: 1},
+		{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-15"), Balance: brl("-15"), InstallmentNumber: 2},
+	}
+	if _, _, err := r.CreateInstallmentPurchase(ctx, domain.Transaction{AccountID: acc.ID, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), InstallmentCount: 2}, installments, velocity); err != nil {
+		t.Fatalf("installment purchase: %v", err)
+	}
+	if _, err := r.CreateTransaction(ctx, debit(acc.ID, "1", time.Time{}), velocity); err == nil || err.Error() != "limit" {
+		t.Fatalf("expected the third debit to be refused, got %v", err)
+	}
+	last := seen[len(seen)-1]
+	if last.Count != 2 || last.Total.String() != "40.00" {
+		t.Errorf("unexpected activity %+v", last)
+	}
+
+	// The refused debit left nothing behind, and older debits fall out of
+	// the window.
+	if _, err := r.CreateTransaction(ctx, debit(acc.ID, "1", time.Time{}), &VelocityCheck{Window: time.Nanosecond, Check: velocity.Check}); err != nil {
+		t.Errorf("expected an empty window, got %v", err)
+	}
+	if last := seen[len(seen)-1]; last.Count != 0 || !last.Total.IsZero() {
+		t.Errorf("unexpected activity %+v", last)
+	}
 }
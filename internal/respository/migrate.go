@@ -0,0 +1,337 @@
+package respository
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the pg_advisory_lock key that serialises migration runs
+// across replicas starting at the same time.
+const migrationLockKey int64 = 0x7478_726f_7574_696e
+
+var (
+	ErrDirtyMigration    = errors.New("database schema is dirty; fix it and run force")
+	ErrChecksumMismatch  = errors.New("applied migration was edited after it ran")
+	ErrUnknownMigration  = errors.New("unknown migration version")
+	ErrNoMigrationToUndo = errors.New("no applied migration to roll back")
+)
+
+// Migration is one numbered schema change with its rollback.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus describes one known migration against the database.
+type MigrationStatus struct {
+	Version          int64
+	Name             string
+	Applied          bool
+	AppliedAt        time.Time
+	Dirty            bool
+	ChecksumMismatch bool
+}
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// loadMigrations reads NNNN_name.up.sql / NNNN_name.down.sql pairs from fsys,
+// ordered by version.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %q", e.Name())
+		}
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", e.Name(), err)
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+			sum := sha256.Sum256(body)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies the embedded migrations to a Postgres database, recording
+// them in schema_migrations. Every operation holds a session-level advisory
+// lock so concurrent runs wait for each other.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+type appliedMigration struct {
+	checksum  string
+	dirty     bool
+	appliedAt time.Time
+}
+
+// withLock runs fn on a single connection holding the migration lock, after
+// making sure schema_migrations exists.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			dirty BOOLEAN NOT NULL DEFAULT FALSE,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum, dirty, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var v int64
+		var a appliedMigration
+		if err := rows.Scan(&v, &a.checksum, &a.dirty, &a.appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+// verify refuses to proceed on a dirty schema or when an applied migration no
+// longer matches the embedded file.
+func (m *Migrator) verify(applied map[int64]appliedMigration) error {
+	for _, mig := range m.migrations {
+		a, ok := applied[mig.Version]
+		if !ok {
+			continue
+		}
+		if a.dirty {
+			return fmt.Errorf("%w: version %d", ErrDirtyMigration, mig.Version)
+		}
+		if a.checksum != mig.Checksum {
+			return fmt.Errorf("%w: version %d (%s)", ErrChecksumMismatch, mig.Version, mig.Name)
+		}
+	}
+	return nil
+}
+
+// Up applies every pending migration in order and returns how many ran.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			if err := m.run(ctx, conn, mig, true); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down rolls back the most recent steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if err := m.run(ctx, conn, mig, false); err != nil {
+				return err
+			}
+			steps--
+		}
+		if steps > 0 {
+			return ErrNoMigrationToUndo
+		}
+		return nil
+	})
+}
+
+// run marks the version dirty, then executes the migration and clears (up) or
+// removes (down) the record in one transaction. A failure leaves the dirty
+// flag behind for an operator to resolve with Force.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	var err error
+	if up {
+		_, err = conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum, dirty) VALUES ($1, $2, $3, TRUE)",
+			mig.Version, mig.Name, mig.Checksum)
+	} else {
+		_, err = conn.ExecContext(ctx, "UPDATE schema_migrations SET dirty = TRUE WHERE version = $1", mig.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark migration %d dirty: %w", mig.Version, err)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d: %w", mig.Version, err)
+	}
+	defer tx.Rollback()
+
+	script, finish := mig.Up, "UPDATE schema_migrations SET dirty = FALSE, applied_at = now() WHERE version = $1"
+	if !up {
+		script, finish = mig.Down, "DELETE FROM schema_migrations WHERE version = $1"
+	}
+	if script != "" {
+		if _, err := tx.ExecContext(ctx, script); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, finish, mig.Version); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", mig.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", mig.Version, err)
+	}
+	return nil
+}
+
+// Status reports every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+			if a, ok := applied[mig.Version]; ok {
+				st.Applied = true
+				st.AppliedAt = a.appliedAt
+				st.Dirty = a.dirty
+				st.ChecksumMismatch = a.checksum != mig.Checksum
+			}
+			statuses = append(statuses, st)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Force rewrites schema_migrations to say that exactly the migrations up to
+// and including version are applied, cleanly and with current checksums. It
+// does not touch the schema itself. Version 0 records nothing as applied.
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	known := version == 0
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("%w: %d", ErrUnknownMigration, version)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin force: %w", err)
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+			return fmt.Errorf("failed to reset schema_migrations: %w", err)
+		}
+		for _, mig := range m.migrations {
+			if mig.Version > version {
+				break
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum, dirty) VALUES ($1, $2, $3, FALSE)",
+				mig.Version, mig.Name, mig.Checksum)
+			if err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", mig.Version, err)
+			}
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,198 @@
+package respository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("loadMigrations failed: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %d has version %d; versions must be contiguous", i, m.Version)
+		}
+		if m.Up == "" || m.Down == "" || len(m.Checksum) != 64 {
+			t.Errorf("migration %d_%s is incomplete", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"bad name": {"m/1_init.sql": {Data: []byte("SELECT 1")}},
+		"no up":    {"m/0001_init.down.sql": {Data: []byte("SELECT 1")}},
+		"two names": {
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1")},
+			"m/0001_b.up.sql": {Data: []byte("SELECT 1")},
+		},
+	}
+	for name, fsys := range cases {
+		if _, err := loadMigrations(fsys, "m"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func newTestMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	migrations, err := loadMigrations(fstest.MapFS{
+		"m/0001_init.up.sql":     {Data: []byte("CREATE TABLE a (id INT)")},
+		"m/0001_init.down.sql":   {Data: []byte("DROP TABLE a")},
+		"m/0002_second.up.sql":   {Data: []byte("CREATE TABLE b (id INT)")},
+		"m/0002_second.down.sql": {Data: []byte("DROP TABLE b")},
+	}, "m")
+	if err != nil {
+		t.Fatalf("loadMigrations failed: %v", err)
+	}
+	return &Migrator{db: db, migrations: migrations}, mock
+}
+
+func expectLocked(mock sqlmock.Sqlmock, applied *sqlmock.Rows) {
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(migrationLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 0))
+	if applied != nil {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT version, checksum, dirty, applied_at FROM schema_migrations")).WillReturnRows(applied)
+	}
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WithArgs(migrationLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+var appliedCols = []string{"version", "checksum", "dirty", "applied_at"}
+
+func TestMigrator_Up(t *testing.T) {
+	ctx := context.Background()
+	m, mock := newTestMigrator(t)
+	expectLocked(mock, sqlmock.NewRows(appliedCols).AddRow(1, m.migrations[0].Checksum, false, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name, checksum, dirty) VALUES ($1, $2, $3, TRUE)")).
+		WithArgs(2, "second", m.migrations[1].Checksum).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE b (id INT)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE schema_migrations SET dirty = FALSE")).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	n, err := m.Up(ctx)
+	if err != nil || n != 1 {
+		t.Errorf("Up: applied %d, %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrator_UpFailureLeavesDirty(t *testing.T) {
+	ctx := context.Background()
+	m, mock := newTestMigrator(t)
+	expectLocked(mock, sqlmock.NewRows(appliedCols))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations")).WithArgs(1, "init", m.migrations[0].Checksum).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE a (id INT)")).WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	expectUnlock(mock)
+
+	if n, err := m.Up(ctx); err == nil || n != 0 {
+		t.Errorf("expected failure, got %d, %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrator_RefusesDirtyOrEdited(t *testing.T) {
+	ctx := context.Background()
+	m, mock := newTestMigrator(t)
+	expectLocked(mock, sqlmock.NewRows(appliedCols).AddRow(1, m.migrations[0].Checksum, true, time.Now()))
+	expectUnlock(mock)
+	if _, err := m.Up(ctx); !errors.Is(err, ErrDirtyMigration) {
+		t.Errorf("expected ErrDirtyMigration, got %v", err)
+	}
+
+	expectLocked(mock, sqlmock.NewRows(appliedCols).AddRow(1, "edited", false, time.Now()))
+	expectUnlock(mock)
+	if _, err := m.Up(ctx); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrator_Down(t *testing.T) {
+	ctx := context.Background()
+	m, mock := newTestMigrator(t)
+	expectLocked(mock, sqlmock.NewRows(appliedCols).
+		AddRow(1, m.migrations[0].Checksum, false, time.Now()).
+		AddRow(2, m.migrations[1].Checksum, false, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE schema_migrations SET dirty = TRUE WHERE version = $1")).WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE b")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations WHERE version = $1")).WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	if err := m.Down(ctx, 1); err != nil {
+		t.Errorf("Down failed: %v", err)
+	}
+
+	expectLocked(mock, sqlmock.NewRows(appliedCols))
+	expectUnlock(mock)
+	if err := m.Down(ctx, 1); !errors.Is(err, ErrNoMigrationToUndo) {
+		t.Errorf("expected ErrNoMigrationToUndo, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrator_StatusAndForce(t *testing.T) {
+	ctx := context.Background()
+	m, mock := newTestMigrator(t)
+	expectLocked(mock, sqlmock.NewRows(appliedCols).AddRow(1, "edited", false, time.Now()))
+	expectUnlock(mock)
+	statuses, err := m.Status(ctx)
+	if err != nil || len(statuses) != 2 {
+		t.Fatalf("Status: %+v, %v", statuses, err)
+	}
+	if !statuses[0].Applied || !statuses[0].ChecksumMismatch || statuses[1].Applied {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+
+	expectLocked(mock, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name, checksum, dirty) VALUES ($1, $2, $3, FALSE)")).
+		WithArgs(1, "init", m.migrations[0].Checksum).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+	if err := m.Force(ctx, 1); err != nil {
+		t.Errorf("Force failed: %v", err)
+	}
+
+	if err := m.Force(ctx, 42); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("expected ErrUnknownMigration, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS operation_types;
+DROP TABLE IF EXISTS accounts;
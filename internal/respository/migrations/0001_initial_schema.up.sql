@@ -0,0 +1,28 @@
+-- Tables as originally created by initSchema. IF NOT EXISTS lets databases
+-- created before migrations existed adopt this version without changes.
+CREATE TABLE IF NOT EXISTS accounts (
+    id SERIAL PRIMARY KEY,
+    document_number TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS operation_types (
+    id INT PRIMARY KEY,
+    description TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+    id SERIAL PRIMARY KEY,
+    account_id INT NOT NULL REFERENCES accounts(id),
+    operation_type_id INT NOT NULL REFERENCES operation_types(id),
+    amount DECIMAL(15,2) NOT NULL,
+    event_date TIMESTAMP WITH TIME ZONE NOT NULL,
+    CONSTRAINT fk_account FOREIGN KEY (account_id) REFERENCES accounts(id),
+    CONSTRAINT fk_operation_type FOREIGN KEY (operation_type_id) REFERENCES operation_types(id)
+);
+
+INSERT INTO operation_types (id, description) VALUES
+    (1, 'CASH PURCHASE'),
+    (2, 'INSTALLMENT PURCHASE'),
+    (3, 'WITHDRAWAL'),
+    (4, 'PAYMENT')
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,2 @@
+ALTER TABLE accounts DROP COLUMN IF EXISTS available_balance;
+ALTER TABLE accounts DROP COLUMN IF EXISTS credit_limit;
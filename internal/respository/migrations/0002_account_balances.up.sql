@@ -0,0 +1,8 @@
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS credit_limit DECIMAL(15,2) NOT NULL DEFAULT 0;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS available_balance DECIMAL(15,2) NOT NULL DEFAULT 0;
+
+-- Accounts that predate balances start from their limit less what their
+-- transactions already posted, debits being negative.
+UPDATE accounts a
+SET available_balance = a.credit_limit + COALESCE(
+    (SELECT SUM(t.amount) FROM transactions t WHERE t.account_id = a.id), 0);
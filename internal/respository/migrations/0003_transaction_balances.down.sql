@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_transactions_operation_type_event;
+DROP INDEX IF EXISTS idx_transactions_event;
+DROP INDEX IF EXISTS idx_transactions_account_event;
+DROP INDEX IF EXISTS idx_transactions_open_debits;
+ALTER TABLE transactions DROP COLUMN IF EXISTS balance;
@@ -0,0 +1,14 @@
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS balance DECIMAL(15,2) NOT NULL DEFAULT 0;
+
+-- Debits that predate balances are still wholly open to discharge.
+UPDATE transactions SET balance = amount WHERE amount < 0;
+
+-- Open debits are discharged oldest first when a payment arrives.
+CREATE INDEX IF NOT EXISTS idx_transactions_open_debits
+    ON transactions (account_id, event_date, id)
+    WHERE balance < 0;
+
+-- Keyset pagination for transaction listings.
+CREATE INDEX IF NOT EXISTS idx_transactions_account_event ON transactions (account_id, event_date, id);
+CREATE INDEX IF NOT EXISTS idx_transactions_event ON transactions (event_date, id);
+CREATE INDEX IF NOT EXISTS idx_transactions_operation_type_event ON transactions (operation_type_id, event_date, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS accounts_document_key;
+
+ALTER TABLE accounts DROP COLUMN IF EXISTS document_type;
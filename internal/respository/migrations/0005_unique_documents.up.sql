@@ -0,0 +1,37 @@
+-- Accounts record which kind of document identifies them, and each document
+-- may open only one account. Numbers stored before document validation are
+-- brought to the form the API stores: CPF- and CNPJ-shaped values lose the
+-- usual separators and take their type from their length, 11 or 14 digits.
+-- Anything else keeps an empty type.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS document_type TEXT NOT NULL DEFAULT '';
+
+UPDATE accounts
+SET document_number = translate(document_number, './- ', ''),
+    document_type = CASE length(translate(document_number, './- ', ''))
+        WHEN 11 THEN 'CPF'
+        ELSE 'CNPJ'
+    END
+WHERE document_type = ''
+    AND translate(document_number, './- ', '') ~ '^([0-9]{11}|[0-9]{14})$';
+
+-- Normalising can turn distinct numbers into the same document. Name every
+-- clash so it can be resolved, rather than failing on the index below.
+DO $$
+DECLARE
+    duplicates TEXT;
+BEGIN
+    SELECT string_agg(format('%s %s (accounts %s)', NULLIF(document_type, ''), document_number, ids), '; ')
+    INTO duplicates
+    FROM (
+        SELECT document_type, document_number, string_agg(id::TEXT, ', ' ORDER BY id) AS ids
+        FROM accounts
+        GROUP BY document_type, document_number
+        HAVING count(*) > 1
+    ) d;
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'accounts share a document, merge or remove them and run again: %', duplicates;
+    END IF;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS accounts_document_key
+    ON accounts (document_type, document_number);
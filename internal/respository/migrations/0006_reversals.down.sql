@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_transactions_reverses;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS reverses_transaction_id;
+
+DELETE FROM operation_types WHERE id IN (5, 6);
@@ -0,0 +1,12 @@
+-- Refunds and payment reversals point at the transaction they compensate.
+INSERT INTO operation_types (id, description) VALUES
+    (5, 'REFUND'),
+    (6, 'PAYMENT REVERSAL')
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reverses_transaction_id INT
+    CONSTRAINT transactions_reverses_transaction_id_fkey REFERENCES transactions(id);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_reverses
+    ON transactions (reverses_transaction_id)
+    WHERE reverses_transaction_id IS NOT NULL;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_transactions_parent;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS installment_number;
+ALTER TABLE transactions DROP COLUMN IF EXISTS parent_transaction_id;
+ALTER TABLE transactions DROP COLUMN IF EXISTS installment_count;
@@ -0,0 +1,12 @@
+-- An installment purchase is a parent row with installment_count set and one
+-- child row per installment pointing back at it.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS installment_count INT NOT NULL DEFAULT 0;
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS parent_transaction_id INT
+    CONSTRAINT transactions_parent_transaction_id_fkey REFERENCES transactions(id);
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS installment_number INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_transactions_parent
+    ON transactions (parent_transaction_id)
+    WHERE parent_transaction_id IS NOT NULL;
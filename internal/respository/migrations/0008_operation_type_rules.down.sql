@@ -0,0 +1,12 @@
+ALTER TABLE operation_types ALTER COLUMN id DROP DEFAULT;
+DROP SEQUENCE IF EXISTS operation_types_id_seq;
+
+ALTER TABLE operation_types
+    DROP CONSTRAINT IF EXISTS operation_types_hours_check,
+    DROP CONSTRAINT IF EXISTS operation_types_direction_check,
+    DROP COLUMN IF EXISTS active,
+    DROP COLUMN IF EXISTS allowed_to_hour,
+    DROP COLUMN IF EXISTS allowed_from_hour,
+    DROP COLUMN IF EXISTS max_amount,
+    DROP COLUMN IF EXISTS min_amount,
+    DROP COLUMN IF EXISTS direction;
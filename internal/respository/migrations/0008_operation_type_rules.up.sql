@@ -0,0 +1,26 @@
+-- Operation types carry their own direction and posting rules instead of
+-- relying on hardcoded ids.
+ALTER TABLE operation_types
+    ADD COLUMN IF NOT EXISTS direction TEXT NOT NULL DEFAULT 'debit',
+    ADD COLUMN IF NOT EXISTS min_amount DECIMAL(15,2),
+    ADD COLUMN IF NOT EXISTS max_amount DECIMAL(15,2),
+    ADD COLUMN IF NOT EXISTS allowed_from_hour INT,
+    ADD COLUMN IF NOT EXISTS allowed_to_hour INT,
+    ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+
+UPDATE operation_types SET direction = 'credit' WHERE id IN (4, 5);
+
+ALTER TABLE operation_types ALTER COLUMN direction DROP DEFAULT;
+
+ALTER TABLE operation_types
+    ADD CONSTRAINT operation_types_direction_check CHECK (direction IN ('debit', 'credit')),
+    ADD CONSTRAINT operation_types_hours_check CHECK (
+        (allowed_from_hour IS NULL) = (allowed_to_hour IS NULL)
+        AND allowed_from_hour BETWEEN 0 AND 23
+        AND allowed_to_hour BETWEEN 0 AND 23
+    );
+
+-- Types created through the API get ids from 100 up; lower ids stay
+-- reserved for built-in types seeded by migrations.
+CREATE SEQUENCE IF NOT EXISTS operation_types_id_seq START WITH 100 OWNED BY operation_types.id;
+ALTER TABLE operation_types ALTER COLUMN id SET DEFAULT nextval('operation_types_id_seq');
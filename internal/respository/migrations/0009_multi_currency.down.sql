@@ -0,0 +1,18 @@
+ALTER TABLE operation_types
+    ALTER COLUMN max_amount TYPE DECIMAL(15,2),
+    ALTER COLUMN min_amount TYPE DECIMAL(15,2);
+ALTER TABLE transactions
+    ALTER COLUMN balance TYPE DECIMAL(15,2),
+    ALTER COLUMN amount TYPE DECIMAL(15,2);
+ALTER TABLE accounts
+    ALTER COLUMN available_balance TYPE DECIMAL(15,2),
+    ALTER COLUMN credit_limit TYPE DECIMAL(15,2);
+
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS transactions_original_check,
+    DROP COLUMN IF EXISTS exchange_rate,
+    DROP COLUMN IF EXISTS original_currency,
+    DROP COLUMN IF EXISTS original_amount,
+    DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE accounts DROP COLUMN IF EXISTS currency;
@@ -0,0 +1,25 @@
+-- Accounts hold one currency; amounts and balances are in it. Transactions
+-- made in another currency keep the original amount and the rate used.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'BRL';
+
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'BRL',
+    ADD COLUMN IF NOT EXISTS original_amount DECIMAL(18,3),
+    ADD COLUMN IF NOT EXISTS original_currency CHAR(3),
+    ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(24,10);
+
+ALTER TABLE transactions ADD CONSTRAINT transactions_original_check CHECK (
+    (original_amount IS NULL) = (original_currency IS NULL)
+    AND (original_amount IS NULL) = (exchange_rate IS NULL)
+);
+
+-- Three decimal places fit every currency's minor unit (e.g. KWD).
+ALTER TABLE accounts
+    ALTER COLUMN credit_limit TYPE DECIMAL(18,3),
+    ALTER COLUMN available_balance TYPE DECIMAL(18,3);
+ALTER TABLE transactions
+    ALTER COLUMN amount TYPE DECIMAL(18,3),
+    ALTER COLUMN balance TYPE DECIMAL(18,3);
+ALTER TABLE operation_types
+    ALTER COLUMN min_amount TYPE DECIMAL(18,3),
+    ALTER COLUMN max_amount TYPE DECIMAL(18,3);
@@ -0,0 +1,16 @@
+-- Accounts are active, blocked or closed; every change is kept with its
+-- reason.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+    CONSTRAINT accounts_status_check CHECK (status IN ('active', 'blocked', 'closed'));
+
+CREATE TABLE IF NOT EXISTS account_status_changes (
+    id SERIAL PRIMARY KEY,
+    account_id INT NOT NULL REFERENCES accounts(id),
+    from_status TEXT NOT NULL,
+    to_status TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    changed_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_status_changes_account
+    ON account_status_changes (account_id, id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_transactions_account_created;
+ALTER TABLE transactions DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,10 @@
+-- When each transaction was stored, as opposed to its client-supplied
+-- event_date, so velocity limits cannot be dodged by backdating. Existing rows
+-- take their event_date.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE;
+UPDATE transactions SET created_at = event_date WHERE created_at IS NULL;
+ALTER TABLE transactions ALTER COLUMN created_at SET DEFAULT now();
+ALTER TABLE transactions ALTER COLUMN created_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_transactions_account_created
+    ON transactions (account_id, created_at);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_transactions_account_installments;
+
+-- Reserve the installments not yet posted again, as purchases used to.
+UPDATE accounts a
+SET available_balance = a.available_balance + COALESCE(
+    (SELECT SUM(t.amount) FROM transactions t
+     WHERE t.account_id = a.id AND t.parent_transaction_id IS NOT NULL
+         AND t.event_date > a.installments_posted_through), 0);
+ALTER TABLE accounts DROP COLUMN IF EXISTS installments_posted_through;
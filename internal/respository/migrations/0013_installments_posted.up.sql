@@ -0,0 +1,17 @@
+-- Installments are posted to the available balance as they fall due, up to
+-- installments_posted_through, rather than reserved in full with the
+-- purchase. Installments already reserved that are not yet due are credited
+-- back, to be posted again when they fall due.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS installments_posted_through TIMESTAMP WITH TIME ZONE;
+UPDATE accounts a
+SET available_balance = a.available_balance - COALESCE(
+        (SELECT SUM(t.amount) FROM transactions t
+         WHERE t.account_id = a.id AND t.parent_transaction_id IS NOT NULL AND t.event_date > now()), 0),
+    installments_posted_through = now()
+WHERE installments_posted_through IS NULL;
+ALTER TABLE accounts ALTER COLUMN installments_posted_through SET DEFAULT '-infinity';
+ALTER TABLE accounts ALTER COLUMN installments_posted_through SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_transactions_account_installments
+    ON transactions (account_id, event_date)
+    WHERE parent_transaction_id IS NOT NULL;
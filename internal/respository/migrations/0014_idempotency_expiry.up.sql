@@ -0,0 +1,4 @@
+-- Expired idempotency keys are deleted periodically; the index keeps that
+-- sweep from scanning the whole table.
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at
+    ON idempotency_keys (expires_at);
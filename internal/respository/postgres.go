@@ -1,88 +1,881 @@
 package respository
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/animeshs34/transaction_routine/internal/domain"
 	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
+// SQLSTATE codes translated into repository errors.
+const (
+	pqForeignKeyViolation = "23503"
+	pqUniqueViolation     = "23505"
+)
+
+// PostgresStore reads account and transaction lookups, listings and status
+// histories from a replica when its DBConn has healthy ones; everything else,
+// and every read in a transaction, goes to the primary.
 type PostgresStore struct {
-	db *sql.DB
+	db           *sql.DB
+	replicas     *replicaSet
+	queryTimeout time.Duration
+
+	sweepMu sync.Mutex
+	// lastSweep is when expired idempotency keys were last deleted.
+	lastSweep time.Time
 }
 
-func NewPostgresStore(conn *DBConn) *PostgresStore {
-	return &PostgresStore{db: conn.GetDB()}
+type PostgresOption func(*PostgresStore)
+
+// WithQueryTimeout bounds each repository call, on top of whatever deadline
+// the caller's context already carries. Zero disables it.
+func WithQueryTimeout(d time.Duration) PostgresOption {
+	return func(r *PostgresStore) {
+		r.queryTimeout = d
+	}
 }
 
-func (r *PostgresStore) CreateAccount(document string) (domain.Account, error) {
-	var acc domain.Account
-	err := r.db.QueryRow("INSERT INTO accounts (document_number) VALUES ($1) RETURNING id, document_number", document).Scan(&acc.ID, &acc.DocumentNumber)
+func NewPostgresStore(conn *DBConn, opts ...PostgresOption) *PostgresStore {
+	r := &PostgresStore{db: conn.GetDB(), replicas: conn.replicas}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// contextErr makes a failure caused by cancellation or an expired deadline
+// recognisable with errors.Is; the driver reports those as its own errors.
+func contextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	return err
+}
+
+// transactionColumns is the column list scanTransaction expects.
+const transactionColumns = "id, account_id, operation_type_id, amount, balance, event_date, reverses_transaction_id, installment_count, parent_transaction_id, installment_number, currency, original_amount, original_currency, exchange_rate"
+
+// scanTransaction reads amounts as text first: their scale depends on the
+// currency column of the same row.
+func scanTransaction(row interface{ Scan(...any) error }, t *domain.Transaction) error {
+	var (
+		amount, balance            string
+		original, originalCurrency sql.NullString
+	)
+	t.ExchangeRate = nil
+	err := row.Scan(&t.ID, &t.AccountID, &t.OperationTypeID, &amount, &balance, &t.EventDate,
+		&t.ReversesTransactionID, &t.InstallmentCount, &t.ParentTransactionID, &t.InstallmentNumber,
+		&t.Currency, &original, &originalCurrency, &t.ExchangeRate)
+	if err != nil {
+		return err
+	}
+	if t.Amount, err = domain.ParseMoney(amount, t.Currency); err != nil {
+		return err
+	}
+	if t.Balance, err = domain.ParseMoney(balance, t.Currency); err != nil {
+		return err
+	}
+	t.OriginalAmount, t.OriginalCurrency = nil, ""
+	if original.Valid {
+		m, err := domain.ParseMoney(original.String, originalCurrency.String)
+		if err != nil {
+			return err
+		}
+		t.OriginalAmount, t.OriginalCurrency = &m, originalCurrency.String
+	}
+	return nil
+}
+
+// accountColumns is the column list scanAccount expects.
+const accountColumns = "id, document_type, document_number, currency, credit_limit, available_balance, status"
+
+// scanAccount scans accountColumns into acc, and any columns after them into
+// extra.
+func scanAccount(row interface{ Scan(...any) error }, acc *domain.Account, extra ...any) error {
+	var limit, balance string
+	dest := append([]any{&acc.ID, &acc.DocumentType, &acc.DocumentNumber, &acc.Currency, &limit, &balance, &acc.Status}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return err
+	}
+	if acc.CreditLimit, err = domain.ParseMoney(limit, acc.Currency); err != nil {
+		return err
+	}
+	acc.AvailableBalance, err = domain.ParseMoney(balance, acc.Currency)
+	return err
+}
+
+// nullString maps the empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// conn traces the queries run outside a transaction.
+func (r *PostgresStore) conn() queryer {
+	return tracedQueryer{r.db}
+}
+
+// reader is conn for reads that a replica may serve.
+func (r *PostgresStore) reader(ctx context.Context) queryer {
+	if rep := r.replicas.pick(ctx); rep != nil {
+		return tracedQueryer{rep.db}
+	}
+	return r.conn()
+}
+
+func (r *PostgresStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.queryTimeout)
+}
+
+func (r *PostgresStore) CreateAccount(ctx context.Context, acc domain.Account) (domain.Account, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if acc.Currency == "" {
+		acc.Currency = acc.CreditLimit.Currency()
+	}
+	err := scanAccount(r.conn().QueryRowContext(ctx, `
+		INSERT INTO accounts (document_type, document_number, currency, credit_limit, available_balance)
+		VALUES ($1, $2, $3, $4, $4)
+		RETURNING `+accountColumns, acc.DocumentType, acc.DocumentNumber, acc.Currency, acc.CreditLimit), &acc)
 	if err != nil {
-		return domain.Account{}, fmt.Errorf("failed to create account: %w", err)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation && pqErr.Constraint == "accounts_document_key" {
+			return domain.Account{}, ErrDuplicateDocument
+		}
+		return domain.Account{}, fmt.Errorf("failed to create account: %w", contextErr(ctx, err))
 	}
+	r.replicas.wrote(ctx)
 	return acc, nil
 }
 
-func (r *PostgresStore) GetAccount(id int64) (domain.Account, error) {
-	var acc domain.Account
-	err := r.db.QueryRow("SELECT id, document_number FROM accounts WHERE id = $1", id).Scan(&acc.ID, &acc.DocumentNumber)
+func (r *PostgresStore) GetAccount(ctx context.Context, id int64) (domain.Account, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// Installments that fell due since they were last posted are taken off
+	// the balance read, as the next unit of work to lock the account will.
+	var (
+		acc domain.Account
+		due string
+	)
+	err := scanAccount(r.reader(ctx).QueryRowContext(ctx, "SELECT "+accountColumns+`,
+			COALESCE((SELECT SUM(t.amount) FROM transactions t
+				WHERE t.account_id = accounts.id AND t.parent_transaction_id IS NOT NULL
+					AND t.event_date > accounts.installments_posted_through AND t.event_date <= $2), 0)
+		FROM accounts WHERE id = $1`, id, time.Now()), &acc, &due)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return domain.Account{}, ErrAccountNotFound
 		}
+		return domain.Account{}, fmt.Errorf("failed to get account: %w", contextErr(ctx, err))
+	}
+	dueAmount, err := domain.ParseMoney(due, acc.Currency)
+	if err != nil {
+		return domain.Account{}, fmt.Errorf("failed to get account: %w", err)
+	}
+	if acc.AvailableBalance, err = acc.AvailableBalance.Add(dueAmount); err != nil {
 		return domain.Account{}, fmt.Errorf("failed to get account: %w", err)
 	}
 	return acc, nil
 }
 
-func (r *PostgresStore) HasOperationType(id int) bool {
-	var exists bool
-	err := r.db.QueryRow("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)", id).Scan(&exists)
+// operationTypeColumns is the column list scanOperationType expects.
+const operationTypeColumns = "id, description, direction, min_amount, max_amount, allowed_from_hour, allowed_to_hour, active"
+
+func scanOperationType(row interface{ Scan(...any) error }, ot *domain.OperationType) error {
+	var (
+		min, max sql.NullString
+		from, to sql.NullInt32
+	)
+	if err := row.Scan(&ot.ID, &ot.Description, &ot.Direction, &min, &max, &from, &to, &ot.Active); err != nil {
+		return err
+	}
+	ot.MinAmount, ot.MaxAmount, ot.AllowedHours = nil, nil, nil
+	for _, c := range []struct {
+		col sql.NullString
+		dst **domain.Money
+	}{{min, &ot.MinAmount}, {max, &ot.MaxAmount}} {
+		if !c.col.Valid {
+			continue
+		}
+		m, err := domain.ParseMoney(c.col.String, domain.DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		*c.dst = &m
+	}
+	if from.Valid && to.Valid {
+		ot.AllowedHours = &domain.HourWindow{From: int(from.Int32), To: int(to.Int32)}
+	}
+	return nil
+}
+
+// operationTypeArgs returns the values of every column but id, in
+// operationTypeColumns order.
+func operationTypeArgs(ot domain.OperationType) []any {
+	var from, to any
+	if ot.AllowedHours != nil {
+		from, to = ot.AllowedHours.From, ot.AllowedHours.To
+	}
+	return []any{ot.Description, ot.Direction, ot.MinAmount, ot.MaxAmount, from, to, ot.Active}
+}
+
+func (r *PostgresStore) ChangeAccountStatus(ctx context.Context, id int64, change StatusChangeFunc) (domain.Account, error) {
+	return changeAccountStatus(ctx, r, id, change)
+}
+
+func (r *PostgresStore) ListAccountStatusChanges(ctx context.Context, accountID int64) ([]domain.AccountStatusChange, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.reader(ctx).QueryContext(ctx, `
+		SELECT id, account_id, from_status, to_status, reason, changed_at
+		FROM account_status_changes
+		WHERE account_id = $1
+		ORDER BY id
+	`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list status changes: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
+
+	changes := []domain.AccountStatusChange{}
+	for rows.Next() {
+		var c domain.AccountStatusChange
+		if err := rows.Scan(&c.ID, &c.AccountID, &c.From, &c.To, &c.Reason, &c.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan status change: %w", contextErr(ctx, err))
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list status changes: %w", contextErr(ctx, err))
+	}
+	return changes, nil
+}
+
+func (r *PostgresStore) GetOperationType(ctx context.Context, id int) (domain.OperationType, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var ot domain.OperationType
+	err := scanOperationType(r.conn().QueryRowContext(ctx, "SELECT "+operationTypeColumns+" FROM operation_types WHERE id = $1", id), &ot)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.OperationType{}, ErrOperationTypeNotFound
+		}
+		return domain.OperationType{}, fmt.Errorf("failed to get operation type: %w", contextErr(ctx, err))
+	}
+	return ot, nil
+}
+
+// ListOperationTypes returns the operation_types table ordered by id.
+func (r *PostgresStore) ListOperationTypes(ctx context.Context) ([]domain.OperationType, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+operationTypeColumns+" FROM operation_types ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list operation types: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
+
+	types := []domain.OperationType{}
+	for rows.Next() {
+		var ot domain.OperationType
+		if err := scanOperationType(rows, &ot); err != nil {
+			return nil, fmt.Errorf("failed to scan operation type: %w", contextErr(ctx, err))
+		}
+		types = append(types, ot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list operation types: %w", contextErr(ctx, err))
+	}
+	return types, nil
+}
+
+func (r *PostgresStore) CreateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	err := scanOperationType(r.conn().QueryRowContext(ctx, `
+		INSERT INTO operation_types (description, direction, min_amount, max_amount, allowed_from_hour, allowed_to_hour, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+operationTypeColumns, operationTypeArgs(ot)...), &ot)
+	if err != nil {
+		return domain.OperationType{}, fmt.Errorf("failed to create operation type: %w", contextErr(ctx, err))
+	}
+	r.replicas.wrote(ctx)
+	return ot, nil
+}
+
+func (r *PostgresStore) UpdateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	err := scanOperationType(r.conn().QueryRowContext(ctx, `
+		UPDATE operation_types
+		SET description = $1, direction = $2, min_amount = $3, max_amount = $4,
+			allowed_from_hour = $5, allowed_to_hour = $6, active = $7
+		WHERE id = $8
+		RETURNING `+operationTypeColumns, append(operationTypeArgs(ot), ot.ID)...), &ot)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.OperationType{}, ErrOperationTypeNotFound
+		}
+		return domain.OperationType{}, fmt.Errorf("failed to update operation type: %w", contextErr(ctx, err))
+	}
+	r.replicas.wrote(ctx)
+	return ot, nil
+}
+
+// CreateTransaction locks the account row for the duration of the insert so
+// concurrent debits cannot both pass the available balance check.
+func (r *PostgresStore) CreateTransaction(ctx context.Context, t domain.Transaction, velocity *VelocityCheck) (domain.Transaction, error) {
+	return createTransaction(ctx, r, t, nil, velocity)
+}
+
+func (r *PostgresStore) CreatePayment(ctx context.Context, t domain.Transaction, discharge DischargeFunc) (domain.Transaction, error) {
+	return createTransaction(ctx, r, t, discharge, nil)
+}
+
+func (r *PostgresStore) CreateInstallmentPurchase(ctx context.Context, parent domain.Transaction, installments []domain.Transaction, velocity *VelocityCheck) (domain.Transaction, []domain.Transaction, error) {
+	return createInstallmentPurchase(ctx, r, parent, installments, velocity)
+}
+
+func (r *PostgresStore) CreateReversal(ctx context.Context, originalID int64, reverse ReversalFunc) (domain.Transaction, error) {
+	return createReversal(ctx, r, originalID, reverse)
+}
+
+// WithinTx runs fn in a database transaction bounded by the query timeout.
+// The transaction gets a span of its own, parent to those of its queries.
+func (r *PostgresStore) WithinTx(ctx context.Context, fn func(ctx context.Context, tx Tx) error) (err error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "db.transaction", tracing.SpanKindClient, tracing.String("db.system", "postgresql"))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", contextErr(ctx, err))
+	}
+	defer func() {
+		// After a successful commit, or once the context ended, the
+		// transaction is already done.
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			logger.FromContext(ctx).Warn("Failed to roll back transaction", zap.Error(err))
+		}
+	}()
+
+	if err := fn(ctx, pgTx{tracedQueryer{tx}}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", contextErr(ctx, err))
+	}
+	r.replicas.wrote(ctx)
+	return nil
+}
+
+// pgTx implements Tx on top of a database transaction.
+type pgTx struct {
+	tx queryer
+}
+
+func (p pgTx) LockAccount(ctx context.Context, id int64) (domain.Account, error) {
+	var acc domain.Account
+	err := scanAccount(p.tx.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id), &acc)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.Account{}, ErrAccountNotFound
+		}
+		return domain.Account{}, fmt.Errorf("failed to check account: %w", contextErr(ctx, err))
+	}
+	return acc, nil
+}
+
+func (p pgTx) GetTransaction(ctx context.Context, id int64) (domain.Transaction, error) {
+	var t domain.Transaction
+	err := scanTransaction(p.tx.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = $1", id), &t)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.Transaction{}, ErrTransactionNotFound
+		}
+		return domain.Transaction{}, fmt.Errorf("failed to get transaction: %w", contextErr(ctx, err))
+	}
+	return t, nil
+}
+
+func (p pgTx) Installments(ctx context.Context, parentID int64) ([]domain.Transaction, error) {
+	rows, err := p.tx.QueryContext(ctx, "SELECT "+transactionColumns+`
+		FROM transactions
+		WHERE parent_transaction_id = $1
+		ORDER BY installment_number
+	`, parentID)
 	if err != nil {
-		logger.Error("Failed to check operation type", zap.Error(err), zap.Int("operation_type_id", id))
-		return false
+		return nil, fmt.Errorf("failed to load installments: %w", contextErr(ctx, err))
 	}
-	return exists
+	defer rows.Close()
+
+	var installments []domain.Transaction
+	for rows.Next() {
+		var t domain.Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			return nil, fmt.Errorf("failed to scan installment: %w", contextErr(ctx, err))
+		}
+		installments = append(installments, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load installments: %w", contextErr(ctx, err))
+	}
+	return installments, nil
 }
 
-func (r *PostgresStore) CreateTransaction(t domain.Transaction) (domain.Transaction, error) {
+func (p pgTx) Reversals(ctx context.Context, id int64) ([]domain.Transaction, error) {
+	rows, err := p.tx.QueryContext(ctx, "SELECT "+transactionColumns+`
+		FROM transactions
+		WHERE reverses_transaction_id = $1
+		ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reversals: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
 
-	var accountExists bool
-	err := r.db.QueryRow("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)", t.AccountID).Scan(&accountExists)
+	var reversals []domain.Transaction
+	for rows.Next() {
+		var t domain.Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			return nil, fmt.Errorf("failed to scan reversal: %w", contextErr(ctx, err))
+		}
+		reversals = append(reversals, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load reversals: %w", contextErr(ctx, err))
+	}
+	return reversals, nil
+}
+
+func (p pgTx) OpenDebits(ctx context.Context, accountID int64) ([]domain.Transaction, error) {
+	rows, err := p.tx.QueryContext(ctx, "SELECT "+transactionColumns+`
+		FROM transactions
+		WHERE account_id = $1 AND balance < 0 AND event_date <= $2
+		ORDER BY event_date, id
+		FOR UPDATE
+	`, accountID, time.Now())
 	if err != nil {
-		return domain.Transaction{}, fmt.Errorf("failed to check account: %w", err)
+		return nil, fmt.Errorf("failed to load open debits: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
+
+	var open []domain.Transaction
+	for rows.Next() {
+		var d domain.Transaction
+		if err := scanTransaction(rows, &d); err != nil {
+			return nil, fmt.Errorf("failed to scan open debit: %w", contextErr(ctx, err))
+		}
+		open = append(open, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load open debits: %w", contextErr(ctx, err))
 	}
-	if !accountExists {
-		return domain.Transaction{}, ErrAccountNotFound
+	return open, nil
+}
+
+func (p pgTx) UnpostedInstallments(ctx context.Context, accountID int64) ([]domain.Transaction, error) {
+	rows, err := p.tx.QueryContext(ctx, "SELECT "+transactionColumns+`
+		FROM transactions
+		WHERE account_id = $1 AND parent_transaction_id IS NOT NULL
+			AND event_date > (SELECT installments_posted_through FROM accounts WHERE id = $1)
+			AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.reverses_transaction_id = transactions.parent_transaction_id)
+		ORDER BY event_date, id
+	`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load unposted installments: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
+
+	var unposted []domain.Transaction
+	for rows.Next() {
+		var t domain.Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			return nil, fmt.Errorf("failed to scan installment: %w", contextErr(ctx, err))
+		}
+		unposted = append(unposted, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load unposted installments: %w", contextErr(ctx, err))
+	}
+	return unposted, nil
+}
+
+func (p pgTx) SetInstallmentsPosted(ctx context.Context, accountID int64, t time.Time) error {
+	if _, err := p.tx.ExecContext(ctx, "UPDATE accounts SET installments_posted_through = $1 WHERE id = $2", t, accountID); err != nil {
+		return fmt.Errorf("failed to record posted installments: %w", contextErr(ctx, err))
+	}
+	return nil
+}
+
+func (p pgTx) DebitActivity(ctx context.Context, accountID int64, since time.Time, currency string) (DebitActivity, error) {
+	var activity DebitActivity
+	var total string
+	err := p.tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(-amount), 0)
+		FROM transactions
+		WHERE account_id = $1 AND created_at >= $2 AND amount < 0
+			AND parent_transaction_id IS NULL AND reverses_transaction_id IS NULL
+	`, accountID, since).Scan(&activity.Count, &total)
+	if err != nil {
+		return DebitActivity{}, fmt.Errorf("failed to sum recent debits: %w", contextErr(ctx, err))
+	}
+	if activity.Total, err = domain.ParseMoney(total, currency); err != nil {
+		return DebitActivity{}, fmt.Errorf("failed to sum recent debits: %w", err)
+	}
+	return activity, nil
+}
+
+// InsertTransaction relies on the foreign keys rather than checking the
+// account and operation type first.
+func (p pgTx) InsertTransaction(ctx context.Context, t domain.Transaction) (domain.Transaction, error) {
+	err := scanTransaction(p.tx.QueryRowContext(ctx, `
+		INSERT INTO transactions (account_id, operation_type_id, amount, balance, event_date,
+			reverses_transaction_id, installment_count, parent_transaction_id, installment_number,
+			currency, original_amount, original_currency, exchange_rate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+transactionColumns,
+		t.AccountID, t.OperationTypeID, t.Amount, t.Balance, t.EventDate,
+		t.ReversesTransactionID, t.InstallmentCount, t.ParentTransactionID, t.InstallmentNumber,
+		t.Amount.Currency(), t.OriginalAmount, nullString(t.OriginalCurrency), t.ExchangeRate), &t)
+	if err != nil {
+		if fkErr := foreignKeyError(err); fkErr != nil {
+			return domain.Transaction{}, fkErr
+		}
+		return domain.Transaction{}, fmt.Errorf("failed to create transaction: %w", contextErr(ctx, err))
 	}
+	return t, nil
+}
 
-	var operationTypeExists bool
-	err = r.db.QueryRow("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)", t.OperationTypeID).Scan(&operationTypeExists)
+func (p pgTx) SetTransactionBalance(ctx context.Context, accountID, id int64, balance domain.Money) error {
+	res, err := p.tx.ExecContext(ctx, "UPDATE transactions SET balance = $1 WHERE id = $2 AND account_id = $3", balance, id, accountID)
 	if err != nil {
-		return domain.Transaction{}, fmt.Errorf("failed to check operation type: %w", err)
+		return fmt.Errorf("failed to update balance of transaction %d: %w", id, contextErr(ctx, err))
 	}
-	if !operationTypeExists {
-		return domain.Transaction{}, ErrOperationTypeNotFound
+	if n, err := res.RowsAffected(); err == nil && n != 1 {
+		return fmt.Errorf("discharge returned foreign transaction %d", id)
 	}
+	return nil
+}
 
-	if t.EventDate.IsZero() {
-		t.EventDate = time.Now().UTC()
+func (p pgTx) SetAvailableBalance(ctx context.Context, accountID int64, balance domain.Money) error {
+	if _, err := p.tx.ExecContext(ctx, "UPDATE accounts SET available_balance = $1 WHERE id = $2", balance, accountID); err != nil {
+		return fmt.Errorf("failed to update available balance: %w", contextErr(ctx, err))
 	}
+	return nil
+}
+
+func (p pgTx) SetAccountStatus(ctx context.Context, accountID int64, status string) error {
+	if _, err := p.tx.ExecContext(ctx, "UPDATE accounts SET status = $1 WHERE id = $2", status, accountID); err != nil {
+		return fmt.Errorf("failed to update account status: %w", contextErr(ctx, err))
+	}
+	return nil
+}
 
-	err = r.db.QueryRow(`
-		INSERT INTO transactions (account_id, operation_type_id, amount, event_date)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, account_id, operation_type_id, amount, event_date
-	`, t.AccountID, t.OperationTypeID, t.Amount, t.EventDate).Scan(
-		&t.ID, &t.AccountID, &t.OperationTypeID, &t.Amount, &t.EventDate)
+func (p pgTx) InsertStatusChange(ctx context.Context, c domain.AccountStatusChange) (domain.AccountStatusChange, error) {
+	err := p.tx.QueryRowContext(ctx, `
+		INSERT INTO account_status_changes (account_id, from_status, to_status, reason, changed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, c.AccountID, c.From, c.To, c.Reason, c.ChangedAt).Scan(&c.ID)
 	if err != nil {
-		return domain.Transaction{}, fmt.Errorf("failed to create transaction: %w", err)
+		return domain.AccountStatusChange{}, fmt.Errorf("failed to record status change: %w", contextErr(ctx, err))
 	}
+	return c, nil
+}
+
+// foreignKeyError maps a violated transactions foreign key to the matching
+// not-found error, or returns nil. Both the generated and the named
+// constraints from the initial schema are recognised.
+func foreignKeyError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != pqForeignKeyViolation {
+		return nil
+	}
+	switch pqErr.Constraint {
+	case "transactions_account_id_fkey", "fk_account":
+		return ErrAccountNotFound
+	case "transactions_operation_type_id_fkey", "fk_operation_type":
+		return ErrOperationTypeNotFound
+	case "transactions_reverses_transaction_id_fkey", "transactions_parent_transaction_id_fkey":
+		return ErrTransactionNotFound
+	}
+	return nil
+}
+
+func (r *PostgresStore) GetTransaction(ctx context.Context, id int64) (domain.Transaction, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
+	var t domain.Transaction
+	err := scanTransaction(r.reader(ctx).QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = $1", id), &t)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.Transaction{}, ErrTransactionNotFound
+		}
+		return domain.Transaction{}, fmt.Errorf("failed to get transaction: %w", contextErr(ctx, err))
+	}
 	return t, nil
 }
+
+func (r *PostgresStore) ListTransactions(ctx context.Context, f TransactionFilter) (TransactionPage, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		where []string
+		args  []any
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if f.AccountID != nil {
+		where = append(where, "account_id = "+arg(*f.AccountID))
+	}
+	if f.OperationTypeID != nil {
+		where = append(where, "operation_type_id = "+arg(*f.OperationTypeID))
+	}
+	if f.MinAmount != nil {
+		where = append(where, "currency = "+arg(f.MinAmount.Currency()), "amount >= "+arg(*f.MinAmount))
+	}
+	if f.MaxAmount != nil {
+		where = append(where, "currency = "+arg(f.MaxAmount.Currency()), "amount <= "+arg(*f.MaxAmount))
+	}
+	if f.From != nil {
+		where = append(where, "event_date >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "event_date < "+arg(*f.To))
+	}
+	if f.ParentTransactionID != nil {
+		where = append(where, "parent_transaction_id = "+arg(*f.ParentTransactionID))
+	}
+	order, cmp := "ASC", ">"
+	if f.Descending {
+		order, cmp = "DESC", "<"
+	}
+	if f.After != nil {
+		where = append(where, fmt.Sprintf("(event_date, id) %s (%s, %s)", cmp, arg(f.After.EventDate), arg(f.After.ID)))
+	}
+
+	query := "SELECT " + transactionColumns + " FROM transactions"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// One extra row tells us whether there is a next page.
+	query += fmt.Sprintf(" ORDER BY event_date %s, id %s LIMIT %s", order, order, arg(f.Limit+1))
+
+	rows, err := r.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return TransactionPage{}, fmt.Errorf("failed to list transactions: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
+
+	var page TransactionPage
+	for rows.Next() {
+		var t domain.Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			return TransactionPage{}, fmt.Errorf("failed to scan transaction: %w", contextErr(ctx, err))
+		}
+		page.Transactions = append(page.Transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return TransactionPage{}, fmt.Errorf("failed to list transactions: %w", contextErr(ctx, err))
+	}
+	if len(page.Transactions) > f.Limit {
+		page.Transactions = page.Transactions[:f.Limit]
+		page.Next = cursorOf(page.Transactions[len(page.Transactions)-1])
+	}
+	return page, nil
+}
+
+func (r *PostgresStore) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	r.sweepIdempotencyKeys(ctx)
+	for {
+		// A reservation succeeds on a fresh key or by taking over an expired
+		// one; the primary key makes concurrent duplicates race on the same
+		// row.
+		var key string
+		err := r.conn().QueryRowContext(ctx, `
+			INSERT INTO idempotency_keys (key, fingerprint, status_code, body, expires_at)
+			VALUES ($1, $2, 0, NULL, $3)
+			ON CONFLICT (key) DO UPDATE
+			SET fingerprint = EXCLUDED.fingerprint, status_code = 0, body = NULL, expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at <= $4
+			RETURNING key
+		`, rec.Key, rec.Fingerprint, rec.ExpiresAt, time.Now()).Scan(&key)
+		if err == nil {
+			rec.StatusCode = 0
+			rec.Body = nil
+			return rec, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyRecord{}, false, fmt.Errorf("failed to reserve idempotency key: %w", contextErr(ctx, err))
+		}
+
+		existing := IdempotencyRecord{Key: rec.Key}
+		err = r.conn().QueryRowContext(ctx, "SELECT fingerprint, status_code, body, expires_at FROM idempotency_keys WHERE key = $1", rec.Key).
+			Scan(&existing.Fingerprint, &existing.StatusCode, &existing.Body, &existing.ExpiresAt)
+		if err == nil {
+			return existing, false, nil
+		}
+		// The live record was released or swept between the two
+		// statements, so the key is free again.
+		if !errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyRecord{}, false, fmt.Errorf("failed to load idempotency key: %w", contextErr(ctx, err))
+		}
+	}
+}
+
+// sweepIdempotencyKeys deletes expired idempotency keys at most once every
+// idempotencySweepInterval; until then they are only skipped. A failed sweep
+// is logged and left for the next one.
+func (r *PostgresStore) sweepIdempotencyKeys(ctx context.Context) {
+	now := time.Now()
+	r.sweepMu.Lock()
+	if now.Sub(r.lastSweep) < idempotencySweepInterval {
+		r.sweepMu.Unlock()
+		return
+	}
+	r.lastSweep = now
+	r.sweepMu.Unlock()
+
+	if _, err := r.conn().ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", now); err != nil {
+		logger.FromContext(ctx).Warn("Failed to sweep expired idempotency keys", zap.Error(contextErr(ctx, err)))
+	}
+}
+
+func (r *PostgresStore) CompleteIdempotencyKey(ctx context.Context, key, fingerprint string, statusCode int, body []byte, expiresAt time.Time) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.conn().ExecContext(ctx, `
+		UPDATE idempotency_keys SET status_code = $1, body = $2, expires_at = $3
+		WHERE key = $4 AND fingerprint = $5 AND status_code = 0
+	`, statusCode, body, expiresAt, key, fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", contextErr(ctx, err))
+	}
+	return nil
+}
+
+func (r *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key, fingerprint string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.conn().ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = $1 AND fingerprint = $2 AND status_code = 0", key, fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", contextErr(ctx, err))
+	}
+	return nil
+}
+
+// apiKeyColumns is the column list scanAPIKey expects.
+const apiKeyColumns = "id, name, prefix, hash, scopes, created_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...any) error }, k *APIKey) error {
+	return row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, pq.Array(&k.Scopes), &k.CreatedAt, &k.RevokedAt)
+}
+
+func (r *PostgresStore) CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now().UTC()
+	}
+	err := scanAPIKey(r.conn().QueryRowContext(ctx, `
+		INSERT INTO api_keys (name, prefix, hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+apiKeyColumns,
+		key.Name, key.Prefix, key.Hash, pq.Array(key.Scopes), key.CreatedAt), &key)
+	if err != nil {
+		return APIKey{}, fmt.Errorf("failed to create api key: %w", contextErr(ctx, err))
+	}
+	return key, nil
+}
+
+func (r *PostgresStore) GetAPIKey(ctx context.Context, prefix string) (APIKey, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var key APIKey
+	err := scanAPIKey(r.conn().QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = $1", prefix), &key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, ErrAPIKeyNotFound
+		}
+		return APIKey{}, fmt.Errorf("failed to get api key: %w", contextErr(ctx, err))
+	}
+	return key, nil
+}
+
+func (r *PostgresStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.conn().QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", contextErr(ctx, err))
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := scanAPIKey(rows, &k); err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", contextErr(ctx, err))
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", contextErr(ctx, err))
+	}
+	return keys, nil
+}
+
+func (r *PostgresStore) RevokeAPIKey(ctx context.Context, id int64, at time.Time) (APIKey, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var key APIKey
+	err := scanAPIKey(r.conn().QueryRowContext(ctx, `
+		UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $1)
+		WHERE id = $2
+		RETURNING `+apiKeyColumns, at, id), &key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, ErrAPIKeyNotFound
+		}
+		return APIKey{}, fmt.Errorf("failed to revoke api key: %w", contextErr(ctx, err))
+	}
+	return key, nil
+}
@@ -1,151 +1,880 @@
 package respository
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+	"github.com/lib/pq"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
 
+var accountCols = []string{"id", "document_type", "document_number", "currency", "credit_limit", "available_balance", "status"}
+
+// expectNoUnpostedInstallments expects the lookup of the account's unposted
+// installments, finding none.
+func expectNoUnpostedInstallments(mock sqlmock.Sqlmock, accountID int64) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + transactionColumns + " FROM transactions WHERE account_id = $1 AND parent_transaction_id IS NOT NULL")).
+		WithArgs(accountID).
+		WillReturnRows(sqlmock.NewRows(strings.Split(transactionColumns, ", ")))
+}
+
+// selectAccount matches GetAccount, which also sums the installments due
+// since they were last posted.
+var selectAccount = regexp.QuoteMeta("SELECT "+accountColumns+", COALESCE(") + ".*" + regexp.QuoteMeta(" FROM accounts WHERE id = $1")
+
+var selectAccountCols = append(append([]string{}, accountCols...), "due")
+
+var opTypeCols = []string{"id", "description", "direction", "min_amount", "max_amount", "allowed_from_hour", "allowed_to_hour", "active"}
+
 func TestPostgresStore(t *testing.T) {
+	ctx := context.Background()
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("failed to open sqlmock: %v", err)
 	}
 	store := &PostgresStore{db: db}
 
-	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO accounts (document_number) VALUES ($1) RETURNING id, document_number")).
-		WithArgs("doc1").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "document_number"}).AddRow(1, "doc1"))
-	acc, err := store.CreateAccount("doc1")
-	if err != nil || acc.ID != 1 || acc.DocumentNumber != "doc1" {
+	insertAccount := regexp.QuoteMeta(`INSERT INTO accounts (document_type, document_number, currency, credit_limit, available_balance)
+		VALUES ($1, $2, $3, $4, $4)
+		RETURNING id, document_type, document_number, currency, credit_limit, available_balance, status`)
+	mock.ExpectQuery(insertAccount).
+		WithArgs("CPF", "doc1", "BRL", "500.00").
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	acc, err := store.CreateAccount(ctx, domain.Account{DocumentType: "CPF", DocumentNumber: "doc1", CreditLimit: domain.MustParseMoney("500", domain.DefaultCurrency)})
+	if err != nil || acc.ID != 1 || acc.DocumentNumber != "doc1" || acc.AvailableBalance.Units() != 50000 {
 		t.Errorf("CreateAccount failed: %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO accounts (document_number) VALUES ($1) RETURNING id, document_number")).
-		WithArgs("fail").
+	mock.ExpectQuery(insertAccount).
+		WithArgs("CPF", "doc1", "BRL", "0.00").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "accounts_document_key"})
+	_, err = store.CreateAccount(ctx, domain.Account{DocumentType: "CPF", DocumentNumber: "doc1", CreditLimit: domain.NewMoney(0, domain.DefaultCurrency)})
+	if !errors.Is(err, ErrDuplicateDocument) {
+		t.Errorf("expected ErrDuplicateDocument, got %v", err)
+	}
+
+	mock.ExpectQuery(insertAccount).
+		WithArgs("", "fail", "BRL", "0.00").
 		WillReturnError(errors.New("fail"))
-	_, err = store.CreateAccount("fail")
+	_, err = store.CreateAccount(ctx, domain.Account{DocumentNumber: "fail", CreditLimit: domain.NewMoney(0, domain.DefaultCurrency)})
 	if err == nil {
 		t.Errorf("expected error for CreateAccount fail")
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_number FROM accounts WHERE id = $1")).
-		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "document_number"}).AddRow(1, "doc1"))
-	acc, err = store.GetAccount(1)
-	if err != nil || acc.ID != 1 {
+	// Installments due since they were last posted come off the balance.
+	mock.ExpectQuery(selectAccount).
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(selectAccountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "250.00", "active", "-50.00"))
+	acc, err = store.GetAccount(ctx, 1)
+	if err != nil || acc.ID != 1 || acc.AvailableBalance.Units() != 20000 {
 		t.Errorf("GetAccount failed: %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_number FROM accounts WHERE id = $1")).
-		WithArgs(999).
+	mock.ExpectQuery(selectAccount).
+		WithArgs(999, sqlmock.AnyArg()).
 		WillReturnError(sql.ErrNoRows)
-	_, err = store.GetAccount(999)
+	_, err = store.GetAccount(ctx, 999)
 	if !errors.Is(err, ErrAccountNotFound) {
 		t.Errorf("expected ErrAccountNotFound, got %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_number FROM accounts WHERE id = $1")).
-		WithArgs(2).
+	mock.ExpectQuery(selectAccount).
+		WithArgs(2, sqlmock.AnyArg()).
 		WillReturnError(errors.New("fail"))
-	_, err = store.GetAccount(2)
+	_, err = store.GetAccount(ctx, 2)
 	if err == nil {
 		t.Errorf("expected error for GetAccount fail")
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).
+	selectOpType := regexp.QuoteMeta("SELECT id, description, direction, min_amount, max_amount, allowed_from_hour, allowed_to_hour, active FROM operation_types WHERE id = $1")
+	mock.ExpectQuery(selectOpType).
 		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	if !store.HasOperationType(1) {
-		t.Errorf("expected HasOperationType true")
+		WillReturnRows(sqlmock.NewRows(opTypeCols).AddRow(1, "CASH PURCHASE", "debit", nil, "500.00", 8, 20, true))
+	if ot, err := store.GetOperationType(ctx, 1); err != nil || ot.Direction != domain.DirectionDebit || ot.MinAmount != nil ||
+		ot.MaxAmount == nil || ot.MaxAmount.String() != "500.00" || ot.AllowedHours == nil || *ot.AllowedHours != (domain.HourWindow{From: 8, To: 20}) {
+		t.Errorf("GetOperationType: %+v, %v", ot, err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).
+	mock.ExpectQuery(selectOpType).
 		WithArgs(2).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
-	if store.HasOperationType(2) {
-		t.Errorf("expected HasOperationType false")
+		WillReturnError(sql.ErrNoRows)
+	if _, err := store.GetOperationType(ctx, 2); !errors.Is(err, ErrOperationTypeNotFound) {
+		t.Errorf("expected ErrOperationTypeNotFound, got %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).
+	mock.ExpectQuery(selectOpType).
 		WithArgs(3).
 		WillReturnError(errors.New("fail"))
-	if store.HasOperationType(3) {
-		t.Errorf("expected HasOperationType false on error")
+	if _, err := store.GetOperationType(ctx, 3); err == nil || errors.Is(err, ErrOperationTypeNotFound) {
+		t.Errorf("expected a wrapped error, got %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)")).WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	lockAccount := regexp.QuoteMeta("SELECT id, document_type, document_number, currency, credit_limit, available_balance, status FROM accounts WHERE id = $1 FOR UPDATE")
+	insertTx := regexp.QuoteMeta(`INSERT INTO transactions (account_id, operation_type_id, amount, balance, event_date,
+			reverses_transaction_id, installment_count, parent_transaction_id, installment_number,
+			currency, original_amount, original_currency, exchange_rate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id, account_id, operation_type_id, amount, balance, event_date, reverses_transaction_id, installment_count, parent_transaction_id, installment_number, currency, original_amount, original_currency, exchange_rate`)
+	updateBalance := regexp.QuoteMeta("UPDATE accounts SET available_balance = $1 WHERE id = $2")
+	txCols := []string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(insertTx).
+		WithArgs(1, 1, "-100.00", "-100.00", sqlmock.AnyArg(), nil, 0, nil, 0, "BRL", nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(1, 1, 1, "-100.00", "-100.00", time.Now(), nil, 0, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectExec(updateBalance).WithArgs("400.00", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
-	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO transactions (account_id, operation_type_id, amount, event_date)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, account_id, operation_type_id, amount, event_date`)).
-		WithArgs(1, 1, 100.0, sqlmock.AnyArg()).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "account_id", "operation_type_id", "amount", "event_date"}).AddRow(1, 1, 1, 100.0, time.Now()))
-
-	tx := domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: 100}
-
-	txResult, err := store.CreateTransaction(tx)
+	tx := domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: domain.MustParseMoney("-100", domain.DefaultCurrency), Balance: domain.MustParseMoney("-100", domain.DefaultCurrency)}
+	txResult, err := store.CreateTransaction(ctx, tx, nil)
 	if err != nil || txResult.ID != 1 {
 		t.Errorf("CreateTransaction failed: %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)")).WithArgs(999).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
-	tx = domain.Transaction{AccountID: 999, OperationTypeID: 1, Amount: 100}
-	_, err = store.CreateTransaction(tx)
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "50.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectRollback()
+	_, err = store.CreateTransaction(ctx, tx, nil)
+	if !errors.Is(err, domain.ErrInsufficientBalance) {
+		t.Errorf("expected ErrInsufficientBalance, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(999).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	tx = domain.Transaction{AccountID: 999, OperationTypeID: 1, Amount: domain.MustParseMoney("100", domain.DefaultCurrency)}
+	_, err = store.CreateTransaction(ctx, tx, nil)
 	if !errors.Is(err, ErrAccountNotFound) {
 		t.Errorf("expected ErrAccountNotFound, got %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)")).WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).WithArgs(999).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
-	tx = domain.Transaction{AccountID: 1, OperationTypeID: 999, Amount: 100}
-	_, err = store.CreateTransaction(tx)
-
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(insertTx).
+		WithArgs(1, 999, "100.00", "0.00", sqlmock.AnyArg(), nil, 0, nil, 0, "BRL", nil, nil, nil).
+		WillReturnError(&pq.Error{Code: "23503", Constraint: "transactions_operation_type_id_fkey"})
+	mock.ExpectRollback()
+	tx = domain.Transaction{AccountID: 1, OperationTypeID: 999, Amount: domain.MustParseMoney("100", domain.DefaultCurrency)}
+	_, err = store.CreateTransaction(ctx, tx, nil)
 	if !errors.Is(err, ErrOperationTypeNotFound) {
 		t.Errorf("expected ErrOperationTypeNotFound, got %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)")).WithArgs(1).
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(1).
 		WillReturnError(errors.New("fail"))
-	tx = domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: 100}
-	_, err = store.CreateTransaction(tx)
+	mock.ExpectRollback()
+	tx = domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: domain.MustParseMoney("100", domain.DefaultCurrency)}
+	_, err = store.CreateTransaction(ctx, tx, nil)
 	if err == nil {
 		t.Errorf("expected error for account check fail")
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)")).WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).WithArgs(1).
+	// Foreign key violations map to the same errors as missing rows.
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(insertTx).
+		WithArgs(1, 1, "100.00", "0.00", sqlmock.AnyArg(), nil, 0, nil, 0, "BRL", nil, nil, nil).
+		WillReturnError(&pq.Error{Code: "23503", Constraint: "fk_account"})
+	mock.ExpectRollback()
+	_, err = store.CreateTransaction(ctx, tx, nil)
+	if !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("expected ErrAccountNotFound from foreign key, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockAccount).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(insertTx).
+		WithArgs(1, 1, "100.00", "0.00", sqlmock.AnyArg(), nil, 0, nil, 0, "BRL", nil, nil, nil).
 		WillReturnError(errors.New("fail"))
-	tx = domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: 100}
-	_, err = store.CreateTransaction(tx)
+	mock.ExpectRollback()
+	_, err = store.CreateTransaction(ctx, tx, nil)
 	if err == nil {
-		t.Errorf("expected error for operation type check fail")
+		t.Errorf("expected error for insert fail")
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)")).WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM operation_types WHERE id = $1)")).WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO transactions (account_id, operation_type_id, amount, event_date)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, account_id, operation_type_id, amount, event_date`)).
-		WithArgs(1, 1, 100.0, sqlmock.AnyArg()).
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_CreatePayment(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	eventDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_type, document_number, currency, credit_limit, available_balance, status FROM accounts WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "400.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE account_id = $1 AND balance < 0 AND event_date <= $2")).WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}).
+			AddRow(1, 1, 1, "-50.00", "-50.00", eventDate, nil, 0, nil, 0, "BRL", nil, nil, nil).
+			AddRow(2, 1, 1, "-100.00", "-100.00", eventDate, nil, 0, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO transactions")).
+		WithArgs(1, 4, "60.00", "0.00", eventDate, nil, 0, nil, 0, "BRL", nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}).
+			AddRow(3, 1, 4, "60.00", "0.00", eventDate, nil, 0, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET balance = $1 WHERE id = $2 AND account_id = $3")).
+		WithArgs("0.00", 1, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET balance = $1 WHERE id = $2 AND account_id = $3")).
+		WithArgs("-90.00", 2, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE accounts SET available_balance = $1 WHERE id = $2")).
+		WithArgs("460.00", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	payment := domain.Transaction{AccountID: 1, OperationTypeID: 4, Amount: brl("60"), Balance: brl("60"), EventDate: eventDate}
+	got, err := store.CreatePayment(ctx, payment, func(p domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		if len(open) != 2 {
+			t.Fatalf("expected 2 open debits, got %d", len(open))
+		}
+		open[0].Balance = brl("0")
+		open[1].Balance = brl("-90")
+		p.Balance = brl("0")
+		return p, open, nil
+	})
+	if err != nil || got.ID != 3 {
+		t.Errorf("CreatePayment failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_ListTransactions(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	cols := []string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	accountID, op := int64(1), domain.OpCashPurchase
+	min := domain.MustParseMoney("-50", domain.DefaultCurrency)
+	after := Cursor{EventDate: day, ID: 3}
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT id, account_id, operation_type_id, amount, balance, event_date, reverses_transaction_id, installment_count, parent_transaction_id, installment_number, currency, original_amount, original_currency, exchange_rate FROM transactions "+
+			"WHERE account_id = $1 AND operation_type_id = $2 AND currency = $3 AND amount >= $4 AND (event_date, id) < ($5, $6) "+
+			"ORDER BY event_date DESC, id DESC LIMIT $7")).
+		WithArgs(1, 1, "BRL", "-50.00", day, 3, 3).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(2, 1, 1, "-10.00", "-10.00", day, nil, 0, nil, 0, "BRL", nil, nil, nil).
+			AddRow(1, 1, 1, "-20.00", "-20.00", day, nil, 0, nil, 0, "BRL", nil, nil, nil).
+			AddRow(0, 1, 1, "-30.00", "-30.00", day, nil, 0, nil, 0, "BRL", nil, nil, nil))
+	page, err := store.ListTransactions(ctx, TransactionFilter{
+		AccountID: &accountID, OperationTypeID: &op, MinAmount: &min,
+		Descending: true, After: &after, Limit: 2,
+	})
+	if err != nil || len(page.Transactions) != 2 || page.Next == nil || page.Next.ID != 1 {
+		t.Errorf("ListTransactions failed: %+v, %v", page, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT id, account_id, operation_type_id, amount, balance, event_date, reverses_transaction_id, installment_count, parent_transaction_id, installment_number, currency, original_amount, original_currency, exchange_rate FROM transactions ORDER BY event_date ASC, id ASC LIMIT $1")).
+		WithArgs(11).
 		WillReturnError(errors.New("fail"))
-	tx = domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: 100}
-	_, err = store.CreateTransaction(tx)
+	if _, err := store.ListTransactions(ctx, TransactionFilter{Limit: 10}); err == nil {
+		t.Errorf("expected error for ListTransactions fail")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_GetTransactionAndOperationTypes(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+
+	selectTx := regexp.QuoteMeta("SELECT id, account_id, operation_type_id, amount, balance, event_date, reverses_transaction_id, installment_count, parent_transaction_id, installment_number, currency, original_amount, original_currency, exchange_rate FROM transactions WHERE id = $1")
+	mock.ExpectQuery(selectTx).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}).
+			AddRow(1, 1, 4, "10.00", "10.00", time.Now(), nil, 0, nil, 0, "BRL", nil, nil, nil))
+	tx, err := store.GetTransaction(ctx, 1)
+	if err != nil || tx.ID != 1 || tx.Amount.Units() != 1000 {
+		t.Errorf("GetTransaction failed: %+v, %v", tx, err)
+	}
+
+	mock.ExpectQuery(selectTx).WithArgs(2).WillReturnError(sql.ErrNoRows)
+	if _, err := store.GetTransaction(ctx, 2); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("expected ErrTransactionNotFound, got %v", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, description, direction, min_amount, max_amount, allowed_from_hour, allowed_to_hour, active FROM operation_types ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows(opTypeCols).
+			AddRow(1, "CASH PURCHASE", "debit", nil, nil, nil, nil, true).
+			AddRow(4, "PAYMENT", "credit", nil, nil, nil, nil, true))
+	types, err := store.ListOperationTypes(ctx)
+	if err != nil || len(types) != 2 || types[0].Direction != domain.DirectionDebit || types[1].Direction != domain.DirectionCredit {
+		t.Errorf("ListOperationTypes failed: %+v, %v", types, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_Currencies(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+
+	// NUMERIC columns come back padded to their scale; amounts take the
+	// scale of the row's currency.
+	mock.ExpectQuery(selectAccount).
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(selectAccountCols).
+			AddRow(1, "CPF", "doc1", "JPY", "50000.000", "49500.000", "active", "0"))
+	acc, err := store.GetAccount(ctx, 1)
+	if err != nil || acc.Currency != "JPY" || acc.AvailableBalance != domain.MustParseMoney("49500", "JPY") {
+		t.Errorf("GetAccount: %+v, %v", acc, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + transactionColumns + " FROM transactions WHERE id = $1")).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}).
+			AddRow(2, 1, 1, "-500.000", "-500.000", time.Now(), nil, 0, nil, 0, "JPY", "-3.490", "USD", "143.2000000000"))
+	tx, err := store.GetTransaction(ctx, 2)
+	if err != nil || tx.Amount != domain.MustParseMoney("-500", "JPY") || tx.OriginalAmount == nil ||
+		*tx.OriginalAmount != domain.MustParseMoney("-3.49", "USD") || tx.ExchangeRate == nil || tx.ExchangeRate.String() != "143.2" {
+		t.Errorf("GetTransaction: %+v, %v", tx, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_AccountStatus(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	changedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + accountColumns + " FROM accounts WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO account_status_changes (account_id, from_status, to_status, reason, changed_at)")).
+		WithArgs(1, "active", "blocked", "fraud", changedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE accounts SET status = $1 WHERE id = $2")).WithArgs("blocked", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	acc, err := store.ChangeAccountStatus(ctx, 1, func(acc domain.Account) (domain.AccountStatusChange, error) {
+		return acc.ChangeStatus(domain.AccountBlocked, "fraud", changedAt)
+	})
+	if err != nil || acc.Status != domain.AccountBlocked {
+		t.Errorf("ChangeAccountStatus: %+v, %v", acc, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM account_status_changes")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "account_id", "from_status", "to_status", "reason", "changed_at"}).
+			AddRow(1, 1, "active", "blocked", "fraud", changedAt))
+	changes, err := store.ListAccountStatusChanges(ctx, 1)
+	if err != nil || len(changes) != 1 || changes[0].To != domain.AccountBlocked || changes[0].Reason != "fraud" {
+		t.Errorf("ListAccountStatusChanges: %+v, %v", changes, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	expires := time.Now().Add(time.Hour)
+	rec := IdempotencyRecord{Key: "k", Fingerprint: "fp", ExpiresAt: expires}
+	reserve := regexp.QuoteMeta("INSERT INTO idempotency_keys (key, fingerprint, status_code, body, expires_at)")
+	selectKey := regexp.QuoteMeta("SELECT fingerprint, status_code, body, expires_at FROM idempotency_keys WHERE key = $1")
+
+	// The first reservation sweeps expired keys; later ones within the
+	// interval do not.
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys WHERE expires_at <= $1")).
+		WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery(reserve).WithArgs("k", "fp", expires, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}).AddRow("k"))
+	if _, reserved, err := store.ReserveIdempotencyKey(ctx, rec); err != nil || !reserved {
+		t.Errorf("expected reservation: %v, %v", reserved, err)
+	}
+
+	mock.ExpectQuery(reserve).WithArgs("k", "fp", expires, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}))
+	mock.ExpectQuery(selectKey).
+		WithArgs("k").
+		WillReturnRows(sqlmock.NewRows([]string{"fingerprint", "status_code", "body", "expires_at"}).AddRow("fp", 201, []byte("{}"), expires))
+	existing, reserved, err := store.ReserveIdempotencyKey(ctx, rec)
+	if err != nil || reserved || existing.StatusCode != 201 || string(existing.Body) != "{}" {
+		t.Errorf("expected existing record: %+v, %v, %v", existing, reserved, err)
+	}
+
+	// A record released between the upsert and the lookup frees the key.
+	mock.ExpectQuery(reserve).WithArgs("k", "fp", expires, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}))
+	mock.ExpectQuery(selectKey).WithArgs("k").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(reserve).WithArgs("k", "fp", expires, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}).AddRow("k"))
+	if _, reserved, err := store.ReserveIdempotencyKey(ctx, rec); err != nil || !reserved {
+		t.Errorf("expected reservation after the record vanished: %v, %v", reserved, err)
+	}
+
+	mock.ExpectQuery(reserve).WillReturnError(errors.New("fail"))
+	if _, _, err := store.ReserveIdempotencyKey(ctx, rec); err == nil {
+		t.Errorf("expected error for reserve fail")
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("WHERE key = $4 AND fingerprint = $5 AND status_code = 0")).
+		WithArgs(201, []byte("{}"), expires, "k", "fp").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.CompleteIdempotencyKey(ctx, "k", "fp", 201, []byte("{}"), expires); err != nil {
+		t.Errorf("CompleteIdempotencyKey failed: %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys WHERE key = $1 AND fingerprint = $2 AND status_code = 0")).
+		WithArgs("k", "fp").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.ReleaseIdempotencyKey(ctx, "k", "fp"); err != nil {
+		t.Errorf("ReleaseIdempotencyKey failed: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_QueryTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db, queryTimeout: 10 * time.Millisecond}
+
+	mock.ExpectQuery(selectAccount).
+		WithArgs(1, sqlmock.AnyArg()).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows(selectAccountCols))
+	if _, err := store.GetAccount(context.Background(), 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestPostgresStore_CreateReversal(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	eventDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	txCols := []string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}
+	selectTx := regexp.QuoteMeta("SELECT id, account_id, operation_type_id, amount, balance, event_date, reverses_transaction_id, installment_count, parent_transaction_id, installment_number, currency, original_amount, original_currency, exchange_rate FROM transactions WHERE id = $1")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectTx).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(1, 1, 1, "-40.00", "-40.00", eventDate, nil, 0, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_type, document_number, currency, credit_limit, available_balance, status FROM accounts WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "60.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(selectTx).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(1, 1, 1, "-40.00", "-40.00", eventDate, nil, 0, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE reverses_transaction_id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(txCols))
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO transactions")).
+		WithArgs(1, 5, "40.00", "0.00", eventDate, 1, 0, nil, 0, "BRL", nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(2, 1, 5, "40.00", "0.00", eventDate, 1, 0, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET balance = $1 WHERE id = $2 AND account_id = $3")).
+		WithArgs("0.00", 1, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE accounts SET available_balance = $1 WHERE id = $2")).
+		WithArgs("100.00", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	got, err := store.CreateReversal(ctx, 1, func(original domain.Transaction, previous, posted []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		original.Balance = brl("0")
+		return domain.Transaction{OperationTypeID: domain.OpRefund, Amount: brl("40"), Balance: brl("0"), EventDate: eventDate}, []domain.Transaction{original}, nil
+	})
+	if err != nil || got.ID != 2 || got.ReversesTransactionID == nil || *got.ReversesTransactionID != 1 {
+		t.Errorf("CreateReversal failed: %+v, %v", got, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectTx).WithArgs(9).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	if _, err := store.CreateReversal(ctx, 9, nil); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("expected ErrTransactionNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_CreateInstallmentPurchase(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	brl := func(s string) domain.Money { return domain.MustParseMoney(s, domain.DefaultCurrency) }
+	eventDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	txCols := []string{"id", "account_id", "operation_type_id", "amount", "balance", "event_date", "reverses_transaction_id", "installment_count", "parent_transaction_id", "installment_number", "currency", "original_amount", "original_currency", "exchange_rate"}
+	insertTx := regexp.QuoteMeta("INSERT INTO transactions")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_type, document_number, currency, credit_limit, available_balance, status FROM accounts WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "100.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(insertTx).WithArgs(1, 2, "-60.00", "0.00", eventDate, nil, 2, nil, 0, "BRL", nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(1, 1, 2, "-60.00", "0.00", eventDate, nil, 2, nil, 0, "BRL", nil, nil, nil))
+	mock.ExpectQuery(insertTx).WithArgs(1, 2, "-30.00", "-30.00", eventDate, nil, 0, 1, 1, "BRL", nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(2, 1, 2, "-30.00", "-30.00", eventDate, nil, 0, 1, 1, "BRL", nil, nil, nil))
+	mock.ExpectQuery(insertTx).WithArgs(1, 2, "-30.00", "-30.00", eventDate.AddDate(0, 1, 0), nil, 0, 1, 2, "BRL", nil, nil, nil).
+		WillReturnError(&pq.Error{Code: pqForeignKeyViolation, Constraint: "transactions_parent_transaction_id_fkey"})
+	mock.ExpectRollback()
+
+	parent := domain.Transaction{AccountID: 1, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-60"), Balance: brl("0"), EventDate: eventDate, InstallmentCount: 2}
+	installments := []domain.Transaction{
+		{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-30"), EventDate: eventDate, InstallmentNumber: 1},
+		{OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-30"), EventDate: eventDate.AddDate(0, 1, 0), InstallmentNumber: 2},
+	}
+	if _, _, err := store.CreateInstallmentPurchase(ctx, parent, installments, nil); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("expected ErrTransactionNotFound, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, document_type, document_number, currency, credit_limit, available_balance, status FROM accounts WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "100.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(insertTx).WithArgs(1, 2, "-60.00", "0.00", eventDate, nil, 2, nil, 0, "BRL", nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows(txCols).AddRow(1, 1, 2, "-60.00", "0.00", eventDate, nil, 2, nil, 0, "BRL", nil, nil, nil))
+	for i := range installments {
+		mock.ExpectQuery(insertTx).WithArgs(1, 2, "-30.00", "-30.00", installments[i].EventDate, nil, 0, 1, i+1, "BRL", nil, nil, nil).
+			WillReturnRows(sqlmock.NewRows(txCols).AddRow(i+2, 1, 2, "-30.00", "-30.00", installments[i].EventDate, nil, 0, 1, i+1, "BRL", nil, nil, nil))
+	}
+	// Both installments are already due, so both are posted.
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE accounts SET installments_posted_through = $1 WHERE id = $2")).
+		WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE accounts SET available_balance = $1 WHERE id = $2")).
+		WithArgs("40.00", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	created, schedule, err := store.CreateInstallmentPurchase(ctx, parent, installments, nil)
+	if err != nil || created.ID != 1 || len(schedule) != 2 || *schedule[1].ParentTransactionID != 1 || schedule[1].InstallmentNumber != 2 {
+		t.Errorf("CreateInstallmentPurchase failed: %+v %+v, %v", created, schedule, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_OperationTypeAdmin(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	max := domain.MustParseMoney("5", domain.DefaultCurrency)
+	fee := domain.OperationType{Description: "FEE", Direction: domain.DirectionDebit, MaxAmount: &max, AllowedHours: &domain.HourWindow{From: 9, To: 18}, Active: true}
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO operation_types (description, direction, min_amount, max_amount, allowed_from_hour, allowed_to_hour, active)")).
+		WithArgs("FEE", "debit", nil, "5.00", 9, 18, true).
+		WillReturnRows(sqlmock.NewRows(opTypeCols).AddRow(100, "FEE", "debit", nil, "5.00", 9, 18, true))
+	created, err := store.CreateOperationType(ctx, fee)
+	if err != nil || created.ID != 100 || created.MaxAmount == nil || *created.MaxAmount != max {
+		t.Fatalf("CreateOperationType: %+v, %v", created, err)
+	}
+
+	created.Active, created.AllowedHours = false, nil
+	update := regexp.QuoteMeta("UPDATE operation_types")
+	mock.ExpectQuery(update).
+		WithArgs("FEE", "debit", nil, "5.00", nil, nil, false, 100).
+		WillReturnRows(sqlmock.NewRows(opTypeCols).AddRow(100, "FEE", "debit", nil, "5.00", nil, nil, false))
+	if got, err := store.UpdateOperationType(ctx, created); err != nil || got.Active || got.AllowedHours != nil {
+		t.Errorf("UpdateOperationType: %+v, %v", got, err)
+	}
+
+	mock.ExpectQuery(update).WillReturnError(sql.ErrNoRows)
+	if _, err := store.UpdateOperationType(ctx, domain.OperationType{ID: 999}); !errors.Is(err, ErrOperationTypeNotFound) {
+		t.Errorf("expected ErrOperationTypeNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_Tracing(t *testing.T) {
+	exp := tracing.NewInMemoryExporter()
+	tr := tracing.NewTracer(exp)
+	tracing.SetTracer(tr)
+	defer tracing.SetTracer(nil)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE accounts SET status = $1 WHERE id = $2")).
+		WithArgs("blocked", 1).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	ctx, parent := tracing.Start(context.Background(), "parent", tracing.SpanKindInternal)
+	err = store.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		return tx.SetAccountStatus(ctx, 1, "blocked")
+	})
+	parent.End()
 	if err == nil {
-		t.Errorf("expected error for insert fail")
+		t.Fatal("expected the update to fail")
+	}
+	tr.Shutdown(context.Background())
+
+	spans := exp.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("expected query, transaction and parent spans, got %+v", spans)
+	}
+	query, txSpan := spans[0], spans[1]
+	if query.Name != "UPDATE accounts" || query.Kind != tracing.SpanKindClient || !query.Error ||
+		query.ParentSpanID != txSpan.SpanContext.SpanID {
+		t.Errorf("unexpected query span %+v", query)
+	}
+	if txSpan.Name != "db.transaction" || !txSpan.Error || txSpan.ParentSpanID != parent.SpanContext().SpanID {
+		t.Errorf("unexpected transaction span %+v", txSpan)
+	}
+	for _, a := range query.Attributes {
+		if a.Key == "db.statement" && a.Value != "UPDATE accounts SET status = $1 WHERE id = $2" {
+			t.Errorf("unexpected statement %q", a.Value)
+		}
+	}
+}
+
+func TestQuerySpanName(t *testing.T) {
+	for statement, want := range map[string]string{
+		"SELECT " + transactionColumns + " FROM transactions WHERE id = $1": "SELECT transactions",
+		"INSERT INTO idempotency_keys (key) VALUES ($1)":                    "INSERT idempotency_keys",
+		"UPDATE accounts SET status = $1 WHERE id = $2":                     "UPDATE accounts",
+		"DELETE FROM idempotency_keys WHERE key = $1":                       "DELETE idempotency_keys",
+		"select 1": "SELECT",
+	} {
+		if got := querySpanName(statement); got != want {
+			t.Errorf("querySpanName(%q) = %q, want %q", statement, got, want)
+		}
+	}
+}
+
+func TestPostgresStore_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	cols := []string{"id", "name", "prefix", "hash", "scopes", "created_at", "revoked_at"}
+	created := time.Now().UTC()
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO api_keys (name, prefix, hash, scopes, created_at)")).
+		WithArgs("ci", "0123456789abcdef", "h", sqlmock.AnyArg(), created).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(1, "ci", "0123456789abcdef", "h", "{accounts:read,accounts:write}", created, nil))
+	key, err := store.CreateAPIKey(ctx, APIKey{Name: "ci", Prefix: "0123456789abcdef", Hash: "h", Scopes: []string{"accounts:read", "accounts:write"}, CreatedAt: created})
+	if err != nil || key.ID != 1 || len(key.Scopes) != 2 || key.Revoked() {
+		t.Errorf("CreateAPIKey: %+v, %v", key, err)
+	}
+
+	get := regexp.QuoteMeta("SELECT " + apiKeyColumns + " FROM api_keys WHERE prefix = $1")
+	mock.ExpectQuery(get).WithArgs("0123456789abcdef").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(1, "ci", "0123456789abcdef", "h", "{accounts:read}", created, nil))
+	if key, err := store.GetAPIKey(ctx, "0123456789abcdef"); err != nil || key.Scopes[0] != "accounts:read" {
+		t.Errorf("GetAPIKey: %+v, %v", key, err)
+	}
+	mock.ExpectQuery(get).WithArgs("missing").WillReturnError(sql.ErrNoRows)
+	if _, err := store.GetAPIKey(ctx, "missing"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(1, "ci", "0123456789abcdef", "h", "{accounts:read}", created, nil).
+			AddRow(2, "old", "fedcba9876543210", "h2", "{}", created, created))
+	keys, err := store.ListAPIKeys(ctx)
+	if err != nil || len(keys) != 2 || keys[0].Revoked() || !keys[1].Revoked() {
+		t.Errorf("ListAPIKeys: %+v, %v", keys, err)
+	}
+
+	revoke := regexp.QuoteMeta("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $1)")
+	mock.ExpectQuery(revoke).WithArgs(created, int64(1)).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(1, "ci", "0123456789abcdef", "h", "{accounts:read}", created, created))
+	if key, err := store.RevokeAPIKey(ctx, 1, created); err != nil || !key.Revoked() {
+		t.Errorf("RevokeAPIKey: %+v, %v", key, err)
+	}
+	mock.ExpectQuery(revoke).WithArgs(created, int64(9)).WillReturnError(sql.ErrNoRows)
+	if _, err := store.RevokeAPIKey(ctx, 9, created); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_Velocity(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	store := &PostgresStore{db: db}
+	var seen DebitActivity
+	velocity := &VelocityCheck{Window: time.Hour, Check: func(recent DebitActivity, t domain.Transaction) error {
+		seen = recent
+		if recent.Count >= 3 {
+			return errors.New("limit")
+		}
+		return nil
+	}}
+	debit := domain.Transaction{AccountID: 1, OperationTypeID: domain.OpCashPurchase, Amount: domain.MustParseMoney("-10", "BRL"), Balance: domain.MustParseMoney("-10", "BRL")}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + accountColumns + " FROM accounts WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	expectNoUnpostedInstallments(mock, 1)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*), COALESCE(SUM(-amount), 0)")).WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "sum"}).AddRow(3, "75.50"))
+	mock.ExpectRollback()
+	if _, err := store.CreateTransaction(ctx, debit, velocity); err == nil || err.Error() != "limit" {
+		t.Errorf("expected the check to refuse the debit, got %v", err)
+	}
+	if seen.Count != 3 || seen.Total.String() != "75.50" || seen.Total.Currency() != "BRL" {
+		t.Errorf("unexpected activity %+v", seen)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresStore_Replicas(t *testing.T) {
+	newMock := func() (*sql.DB, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db, mock
+	}
+	primary, primaryMock := newMock()
+	db1, mock1 := newMock()
+	db2, mock2 := newMock()
+	r1 := &replica{addr: "replica-1", db: db1}
+	r2 := &replica{addr: "replica-2", db: db2}
+	replicas := newReplicaSet([]*replica{r1, r2}, 5*time.Second)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	replicas.now = func() time.Time { return now }
+	store := &PostgresStore{db: primary, replicas: replicas}
+	ctx := NewClientContext(context.Background(), "ip:10.0.0.1")
+
+	accountRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows(selectAccountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active", "0")
+	}
+	get := func() {
+		t.Helper()
+		if _, err := store.GetAccount(ctx, 1); err != nil {
+			t.Fatalf("GetAccount: %v", err)
+		}
+	}
+
+	// Replicas are out of rotation until checked.
+	primaryMock.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	get()
+
+	lag := regexp.QuoteMeta(replicaLagQuery)
+	mock1.ExpectQuery(lag).WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(0.2))
+	mock2.ExpectQuery(lag).WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(0))
+	replicas.check(context.Background(), time.Second)
+
+	// Reads alternate between healthy replicas.
+	mock1.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	mock2.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	get()
+	get()
+
+	// Operation types are read from the primary so a type just created or
+	// disabled applies to the next transaction.
+	primaryMock.ExpectQuery(regexp.QuoteMeta("FROM operation_types WHERE id = $1")).
+		WillReturnRows(sqlmock.NewRows(opTypeCols).AddRow(1, "CASH PURCHASE", "debit", nil, nil, nil, nil, true))
+	if _, err := store.GetOperationType(ctx, 1); err != nil {
+		t.Fatalf("GetOperationType: %v", err)
+	}
+
+	// After a write the client reads from the primary for the window;
+	// other clients keep using the replicas.
+	primaryMock.ExpectQuery(regexp.QuoteMeta("INSERT INTO accounts")).
+		WillReturnRows(sqlmock.NewRows(accountCols).AddRow(1, "CPF", "doc1", "BRL", "500.00", "500.00", "active"))
+	if _, err := store.CreateAccount(ctx, domain.Account{DocumentNumber: "doc1", CreditLimit: domain.NewMoney(0, domain.DefaultCurrency)}); err != nil {
+		t.Fatal(err)
+	}
+	primaryMock.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	get()
+	mock1.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	if _, err := store.GetAccount(NewClientContext(context.Background(), "ip:10.0.0.2"), 1); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(5 * time.Second)
+	mock2.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	get()
+
+	// A lagging or unreachable replica leaves the rotation; with none left,
+	// reads go to the primary.
+	mock1.ExpectQuery(lag).WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(3))
+	mock2.ExpectQuery(lag).WillReturnError(errors.New("connection refused"))
+	replicas.check(context.Background(), time.Second)
+	if replicas.healthy() != 0 {
+		t.Errorf("expected no healthy replica, got %d", replicas.healthy())
+	}
+	primaryMock.ExpectQuery(selectAccount).WillReturnRows(accountRow())
+	get()
+
+	for _, m := range []sqlmock.Sqlmock{primaryMock, mock1, mock2} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
 	}
 }
@@ -0,0 +1,144 @@
+package respository
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"go.uber.org/zap"
+)
+
+// replicaLagQuery is how far behind the primary a replica is, in seconds. A
+// replica that has replayed everything it received is not lagging, however
+// old its last replayed transaction.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+// replica is a read-only copy of the database. It only serves reads while
+// healthy: reachable and no further behind the primary than allowed.
+type replica struct {
+	addr    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// replicaSet spreads reads over the healthy replicas. Reads by a client that
+// wrote within the read-your-writes window go to the primary instead, so the
+// client sees its own writes whatever the replication lag.
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	window   time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	lastWrite map[string]time.Time
+	lastSweep time.Time
+}
+
+func newReplicaSet(replicas []*replica, window time.Duration) *replicaSet {
+	return &replicaSet{
+		replicas:  replicas,
+		window:    window,
+		now:       time.Now,
+		lastWrite: make(map[string]time.Time),
+	}
+}
+
+type clientKey struct{}
+
+// NewClientContext returns a copy of ctx identifying the client the store
+// works for, so that it can read that client's writes back from the primary.
+func NewClientContext(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFromContext(ctx context.Context) (string, bool) {
+	client, ok := ctx.Value(clientKey{}).(string)
+	return client, ok && client != ""
+}
+
+// pick returns the replica to read from, or nil to read from the primary.
+func (s *replicaSet) pick(ctx context.Context) *replica {
+	if s == nil {
+		return nil
+	}
+	if client, ok := clientFromContext(ctx); ok && s.window > 0 {
+		s.mu.Lock()
+		at, wrote := s.lastWrite[client]
+		s.mu.Unlock()
+		if wrote && s.now().Sub(at) < s.window {
+			return nil
+		}
+	}
+	n := uint64(len(s.replicas))
+	start := s.next.Add(1)
+	for i := range n {
+		if r := s.replicas[(start+i)%n]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// wrote records that the client of ctx has just written.
+func (s *replicaSet) wrote(ctx context.Context) {
+	if s == nil || s.window <= 0 {
+		return
+	}
+	client, ok := clientFromContext(ctx)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= s.window {
+		for c, at := range s.lastWrite {
+			if now.Sub(at) >= s.window {
+				delete(s.lastWrite, c)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.lastWrite[client] = now
+}
+
+// check measures the lag of every replica, taking those that cannot be
+// reached or lag more than maxLag out of rotation until they catch up.
+func (s *replicaSet) check(ctx context.Context, maxLag time.Duration) {
+	for _, r := range s.replicas {
+		var lag float64
+		err := r.db.QueryRowContext(ctx, replicaLagQuery).Scan(&lag)
+		lagging := time.Duration(lag * float64(time.Second))
+		healthy := err == nil && lagging <= maxLag
+		if r.healthy.Swap(healthy) == healthy {
+			continue
+		}
+		switch {
+		case healthy:
+			logger.Info("Replica back in rotation", zap.String("replica", r.addr), zap.Duration("lag", lagging))
+		case err != nil:
+			logger.Warn("Replica unreachable, out of rotation", zap.String("replica", r.addr), zap.Error(err))
+		default:
+			logger.Warn("Replica lagging, out of rotation", zap.String("replica", r.addr), zap.Duration("lag", lagging), zap.Duration("max_lag", maxLag))
+		}
+	}
+}
+
+func (s *replicaSet) healthy() int {
+	n := 0
+	for _, r := range s.replicas {
+		if r.healthy.Load() {
+			n++
+		}
+	}
+	return n
+}
@@ -1,7 +1,9 @@
 package respository
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/animeshs34/transaction_routine/internal/domain"
 )
@@ -9,11 +11,84 @@ import (
 var (
 	ErrAccountNotFound       = errors.New("account not found")
 	ErrOperationTypeNotFound = errors.New("operation type not found")
+	ErrTransactionNotFound   = errors.New("transaction not found")
+	ErrDuplicateDocument     = errors.New("an account with this document already exists")
 )
 
+// DischargeFunc receives a payment and the account's open debits, ordered by
+// event_date then id, and returns the payment and the debits with their new
+// balances.
+type DischargeFunc func(payment domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, error)
+
+// ReversalFunc receives the transaction being reversed, the reversals it
+// already has and, for an installment purchase, its installments already
+// posted to the available balance. It returns the compensating transaction to
+// insert together with the transactions whose balance it changes: the
+// original, or the posted installments of a purchase.
+type ReversalFunc func(original domain.Transaction, previous, posted []domain.Transaction) (domain.Transaction, []domain.Transaction, error)
+
+// StatusChangeFunc receives the locked account and returns the status change
+// to apply to it.
+type StatusChangeFunc func(acc domain.Account) (domain.AccountStatusChange, error)
+
+// DebitActivity is what an account spent over a window: the number of debits
+// and their total, in the account currency. Installments, whose purchase
+// already counts, and reversals are left out.
+type DebitActivity struct {
+	Count int
+	Total domain.Money
+}
+
+// VelocityCheck bounds what an account may spend over a rolling window. With
+// the account locked, Check receives its activity over the last Window,
+// measured by when transactions were stored rather than their event_date, and
+// the debit about to be stored; an error refuses the debit.
+type VelocityCheck struct {
+	Window time.Duration
+	Check  func(recent DebitActivity, t domain.Transaction) error
+}
+
 type Respository interface {
-	CreateAccount(document string) (domain.Account, error)
-	GetAccount(id int64) (domain.Account, error)
-	HasOperationType(id int) bool
-	CreateTransaction(t domain.Transaction) (domain.Transaction, error)
+	// CreateAccount fails with ErrDuplicateDocument when an account with the
+	// same document type and number exists.
+	CreateAccount(ctx context.Context, acc domain.Account) (domain.Account, error)
+	GetAccount(ctx context.Context, id int64) (domain.Account, error)
+	// ChangeAccountStatus locks the account, lets change decide its new
+	// status and stores it together with the history entry atomically. It
+	// returns the updated account.
+	ChangeAccountStatus(ctx context.Context, id int64, change StatusChangeFunc) (domain.Account, error)
+	// ListAccountStatusChanges returns the account's status history, oldest
+	// first.
+	ListAccountStatusChanges(ctx context.Context, accountID int64) ([]domain.AccountStatusChange, error)
+	// GetOperationType fails with ErrOperationTypeNotFound for unknown ids;
+	// inactive types are returned like any other.
+	GetOperationType(ctx context.Context, id int) (domain.OperationType, error)
+	ListOperationTypes(ctx context.Context) ([]domain.OperationType, error)
+	// CreateOperationType stores ot under a newly assigned id.
+	CreateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error)
+	// UpdateOperationType replaces every field of the type with ot.ID.
+	UpdateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error)
+	// CreateTransaction stores t and posts its amount to the account's available
+	// balance atomically, failing with domain.ErrInsufficientBalance when a
+	// debit is not covered. A non-nil velocity is applied to debits in the
+	// same atomic unit.
+	CreateTransaction(ctx context.Context, t domain.Transaction, velocity *VelocityCheck) (domain.Transaction, error)
+	// CreatePayment is CreateTransaction for credits: in the same atomic unit it
+	// passes the account's open debits to discharge and persists the balances
+	// it returns.
+	CreatePayment(ctx context.Context, t domain.Transaction, discharge DischargeFunc) (domain.Transaction, error)
+	// CreateReversal looks up the original transaction, lets reverse build the
+	// compensating one and stores it, the original's new balance and the
+	// account's available balance atomically. Reversals of the same account
+	// are serialised, so reverse always sees every earlier reversal. The
+	// installments of a reversed purchase not yet posted are cancelled: their
+	// balance is cleared and they are never posted.
+	CreateReversal(ctx context.Context, originalID int64, reverse ReversalFunc) (domain.Transaction, error)
+	// CreateInstallmentPurchase stores parent and its installments, linked to
+	// it, and posts the installments already due to the available balance
+	// atomically; each later one is posted once it falls due. It returns both
+	// as stored. A non-nil velocity is applied to the parent as to any debit.
+	CreateInstallmentPurchase(ctx context.Context, parent domain.Transaction, installments []domain.Transaction, velocity *VelocityCheck) (domain.Transaction, []domain.Transaction, error)
+	GetTransaction(ctx context.Context, id int64) (domain.Transaction, error)
+	ListTransactions(ctx context.Context, f TransactionFilter) (TransactionPage, error)
 }
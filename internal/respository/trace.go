@@ -0,0 +1,73 @@
+package respository
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+)
+
+// queryer is the part of *sql.DB and *sql.Tx the Postgres store runs its
+// queries through.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// tracedQueryer runs each query in a client span named after its operation
+// and table, e.g. "SELECT transactions". The statement is recorded with its
+// placeholders only, never the arguments.
+type tracedQueryer struct {
+	q queryer
+}
+
+func (t tracedQueryer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuery(ctx, query)
+	defer span.End()
+	res, err := t.q.ExecContext(ctx, query, args...)
+	span.RecordError(err)
+	return res, err
+}
+
+// QueryContext's span covers running the query, not reading the rows.
+func (t tracedQueryer) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	defer span.End()
+	rows, err := t.q.QueryContext(ctx, query, args...)
+	span.RecordError(err)
+	return rows, err
+}
+
+func (t tracedQueryer) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuery(ctx, query)
+	defer span.End()
+	row := t.q.QueryRowContext(ctx, query, args...)
+	span.RecordError(row.Err())
+	return row
+}
+
+func startQuery(ctx context.Context, query string) (context.Context, *tracing.Span) {
+	statement := strings.Join(strings.Fields(query), " ")
+	return tracing.Start(ctx, querySpanName(statement), tracing.SpanKindClient,
+		tracing.String("db.system", "postgresql"),
+		tracing.String("db.statement", statement))
+}
+
+// querySpanName is the operation of statement followed by the table it
+// reads or writes, when one can be found.
+func querySpanName(statement string) string {
+	words := strings.Fields(statement)
+	if len(words) == 0 {
+		return "query"
+	}
+	op := strings.ToUpper(words[0])
+	for i, w := range words[:len(words)-1] {
+		switch strings.ToUpper(w) {
+		case "FROM", "INTO", "UPDATE":
+			return op + " " + words[i+1]
+		}
+	}
+	return op
+}
@@ -0,0 +1,338 @@
+package respository
+
+import (
+	"context"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+// Tx is the set of row-level operations available inside a unit of work.
+// Each call sees the writes made earlier in the same unit.
+type Tx interface {
+	// LockAccount returns the account and holds it until the unit of work
+	// ends, so concurrent balance changes to it are serialised.
+	LockAccount(ctx context.Context, id int64) (domain.Account, error)
+	GetTransaction(ctx context.Context, id int64) (domain.Transaction, error)
+	// Installments returns the installments of the purchase parentID,
+	// ordered by installment number.
+	Installments(ctx context.Context, parentID int64) ([]domain.Transaction, error)
+	// Reversals returns the transactions that reverse id, oldest first.
+	Reversals(ctx context.Context, id int64) ([]domain.Transaction, error)
+	// OpenDebits returns the account's transactions that still carry a
+	// negative balance and are already due (event_date not after now),
+	// ordered by event_date then id.
+	OpenDebits(ctx context.Context, accountID int64) ([]domain.Transaction, error)
+	// UnpostedInstallments returns the account's installments not yet posted
+	// to its available balance: those due after the time last recorded by
+	// SetInstallmentsPosted, ordered by event_date then id. Installments of a
+	// reversed purchase are left out.
+	UnpostedInstallments(ctx context.Context, accountID int64) ([]domain.Transaction, error)
+	// SetInstallmentsPosted records that the account's installments due up to
+	// t are posted to its available balance.
+	SetInstallmentsPosted(ctx context.Context, accountID int64, t time.Time) error
+	// DebitActivity sums the account's debits stored since the given time,
+	// in the account currency.
+	DebitActivity(ctx context.Context, accountID int64, since time.Time, currency string) (DebitActivity, error)
+	// InsertTransaction stores t as is, failing with ErrAccountNotFound,
+	// ErrOperationTypeNotFound or ErrTransactionNotFound when a reference is
+	// missing.
+	InsertTransaction(ctx context.Context, t domain.Transaction) (domain.Transaction, error)
+	// SetTransactionBalance updates the balance of one of the account's
+	// transactions.
+	SetTransactionBalance(ctx context.Context, accountID, id int64, balance domain.Money) error
+	SetAvailableBalance(ctx context.Context, accountID int64, balance domain.Money) error
+	SetAccountStatus(ctx context.Context, accountID int64, status string) error
+	// InsertStatusChange appends c to the account's status history.
+	InsertStatusChange(ctx context.Context, c domain.AccountStatusChange) (domain.AccountStatusChange, error)
+}
+
+// UnitOfWork runs fn atomically: every write made through tx is kept when fn
+// returns nil, and none is when it returns an error.
+type UnitOfWork interface {
+	WithinTx(ctx context.Context, fn func(ctx context.Context, tx Tx) error) error
+}
+
+// checkVelocity applies v to the debit t of the locked account acc.
+func checkVelocity(ctx context.Context, tx Tx, acc domain.Account, t domain.Transaction, v *VelocityCheck) error {
+	if v == nil || !t.Amount.IsNegative() {
+		return nil
+	}
+	recent, err := tx.DebitActivity(ctx, acc.ID, time.Now().Add(-v.Window), acc.Currency)
+	if err != nil {
+		return err
+	}
+	return v.Check(recent, t)
+}
+
+// dueInstallments sums the installments due by now, in currency.
+func dueInstallments(installments []domain.Transaction, now time.Time, currency string) (domain.Money, error) {
+	due := domain.NewMoney(0, currency)
+	for _, inst := range installments {
+		if inst.EventDate.After(now) {
+			continue
+		}
+		var err error
+		if due, err = due.Add(inst.Amount); err != nil {
+			return domain.Money{}, err
+		}
+	}
+	return due, nil
+}
+
+// lockAccount locks the account and posts the installments that fell due
+// since they were last posted. They are posted even past the available
+// balance: their credit was granted with the purchase.
+func lockAccount(ctx context.Context, tx Tx, id int64, now time.Time) (domain.Account, error) {
+	acc, err := tx.LockAccount(ctx, id)
+	if err != nil {
+		return domain.Account{}, err
+	}
+	unposted, err := tx.UnpostedInstallments(ctx, id)
+	if err != nil {
+		return domain.Account{}, err
+	}
+	due, err := dueInstallments(unposted, now, acc.Currency)
+	if err != nil || due.IsZero() {
+		return acc, err
+	}
+	if acc.AvailableBalance, err = acc.AvailableBalance.Add(due); err != nil {
+		return domain.Account{}, err
+	}
+	if err := tx.SetAvailableBalance(ctx, id, acc.AvailableBalance); err != nil {
+		return domain.Account{}, err
+	}
+	return acc, tx.SetInstallmentsPosted(ctx, id, now)
+}
+
+// createTransaction is the CreateTransaction/CreatePayment algorithm shared by
+// the stores: lock the account, check the balance and velocity, let discharge
+// settle open debits, then write everything in the same unit of work.
+func createTransaction(ctx context.Context, uow UnitOfWork, t domain.Transaction, discharge DischargeFunc, velocity *VelocityCheck) (domain.Transaction, error) {
+	var created domain.Transaction
+	err := uow.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		acc, err := lockAccount(ctx, tx, t.AccountID, time.Now())
+		if err != nil {
+			return err
+		}
+		balance, err := acc.BalanceAfter(t.Amount)
+		if err != nil {
+			return err
+		}
+		if err := checkVelocity(ctx, tx, acc, t, velocity); err != nil {
+			return err
+		}
+
+		var settled []domain.Transaction
+		if discharge != nil {
+			open, err := tx.OpenDebits(ctx, t.AccountID)
+			if err != nil {
+				return err
+			}
+			if t, settled, err = discharge(t, open); err != nil {
+				return err
+			}
+		}
+
+		if t.EventDate.IsZero() {
+			t.EventDate = time.Now().UTC()
+		}
+		if created, err = tx.InsertTransaction(ctx, t); err != nil {
+			return err
+		}
+		for _, d := range settled {
+			if err := tx.SetTransactionBalance(ctx, t.AccountID, d.ID, d.Balance); err != nil {
+				return err
+			}
+		}
+		return tx.SetAvailableBalance(ctx, t.AccountID, balance)
+	})
+	if err != nil {
+		return domain.Transaction{}, err
+	}
+	return created, nil
+}
+
+// createReversal is the CreateReversal algorithm shared by the stores. The
+// account is locked before the original is re-read, so its balance and
+// reversals cannot change underneath reverse.
+func createReversal(ctx context.Context, uow UnitOfWork, originalID int64, reverse ReversalFunc) (domain.Transaction, error) {
+	var created domain.Transaction
+	err := uow.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		original, err := tx.GetTransaction(ctx, originalID)
+		if err != nil {
+			return err
+		}
+		acc, err := lockAccount(ctx, tx, original.AccountID, time.Now())
+		if err != nil {
+			return err
+		}
+		if original, err = tx.GetTransaction(ctx, originalID); err != nil {
+			return err
+		}
+		previous, err := tx.Reversals(ctx, originalID)
+		if err != nil {
+			return err
+		}
+		var posted, unposted []domain.Transaction
+		if original.InstallmentCount > 0 {
+			if posted, unposted, err = installmentsOf(ctx, tx, original); err != nil {
+				return err
+			}
+		}
+
+		reversal, changed, err := reverse(original, previous, posted)
+		if err != nil {
+			return err
+		}
+		balance, err := acc.BalanceAfter(reversal.Amount)
+		if err != nil {
+			return err
+		}
+		reversal.AccountID = original.AccountID
+		reversal.ReversesTransactionID = &originalID
+		if reversal.EventDate.IsZero() {
+			reversal.EventDate = time.Now().UTC()
+		}
+		if created, err = tx.InsertTransaction(ctx, reversal); err != nil {
+			return err
+		}
+		for _, t := range changed {
+			if err := tx.SetTransactionBalance(ctx, original.AccountID, t.ID, t.Balance); err != nil {
+				return err
+			}
+		}
+		// With the purchase reversed the rest of its schedule is never posted;
+		// clearing the balance keeps it from becoming open debits as well.
+		for _, inst := range unposted {
+			if err := tx.SetTransactionBalance(ctx, original.AccountID, inst.ID, domain.NewMoney(0, inst.Balance.Currency())); err != nil {
+				return err
+			}
+		}
+		return tx.SetAvailableBalance(ctx, original.AccountID, balance)
+	})
+	if err != nil {
+		return domain.Transaction{}, err
+	}
+	return created, nil
+}
+
+// installmentsOf splits the installments of parent into those already posted
+// to the available balance and those not yet.
+func installmentsOf(ctx context.Context, tx Tx, parent domain.Transaction) (posted, unposted []domain.Transaction, err error) {
+	all, err := tx.Installments(ctx, parent.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, err := tx.UnpostedInstallments(ctx, parent.AccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	isPending := make(map[int64]bool, len(pending))
+	for _, inst := range pending {
+		isPending[inst.ID] = true
+	}
+	for _, inst := range all {
+		if isPending[inst.ID] {
+			unposted = append(unposted, inst)
+		} else {
+			posted = append(posted, inst)
+		}
+	}
+	return posted, unposted, nil
+}
+
+// createInstallmentPurchase is the CreateInstallmentPurchase algorithm shared
+// by the stores. Only the installments already due are posted to the
+// available balance; lockAccount posts each later one once it falls due.
+func createInstallmentPurchase(ctx context.Context, uow UnitOfWork, parent domain.Transaction, installments []domain.Transaction, velocity *VelocityCheck) (domain.Transaction, []domain.Transaction, error) {
+	var (
+		created  domain.Transaction
+		schedule []domain.Transaction
+	)
+	err := uow.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		now := time.Now()
+		acc, err := lockAccount(ctx, tx, parent.AccountID, now)
+		if err != nil {
+			return err
+		}
+		if err := acc.CanPost(parent.Amount); err != nil {
+			return err
+		}
+		due, err := dueInstallments(installments, now, acc.Currency)
+		if err != nil {
+			return err
+		}
+		balance, err := acc.BalanceAfter(due)
+		if err != nil {
+			return err
+		}
+		if err := checkVelocity(ctx, tx, acc, parent, velocity); err != nil {
+			return err
+		}
+		if parent.EventDate.IsZero() {
+			parent.EventDate = time.Now().UTC()
+		}
+		if created, err = tx.InsertTransaction(ctx, parent); err != nil {
+			return err
+		}
+		schedule = make([]domain.Transaction, 0, len(installments))
+		for _, inst := range installments {
+			inst.AccountID = created.AccountID
+			inst.ParentTransactionID = &created.ID
+			if inst, err = tx.InsertTransaction(ctx, inst); err != nil {
+				return err
+			}
+			schedule = append(schedule, inst)
+		}
+		if err := tx.SetInstallmentsPosted(ctx, created.AccountID, now); err != nil {
+			return err
+		}
+		return tx.SetAvailableBalance(ctx, created.AccountID, balance)
+	})
+	if err != nil {
+		return domain.Transaction{}, nil, err
+	}
+	return created, schedule, nil
+}
+
+// changeAccountStatus is the ChangeAccountStatus algorithm shared by the
+// stores. Locking the account first means a close sees the final balance of
+// any transaction posted concurrently. Installments not yet due are still
+// owed, so change sees them as taken off the available balance.
+func changeAccountStatus(ctx context.Context, uow UnitOfWork, id int64, change StatusChangeFunc) (domain.Account, error) {
+	var acc domain.Account
+	err := uow.WithinTx(ctx, func(ctx context.Context, tx Tx) error {
+		var err error
+		if acc, err = lockAccount(ctx, tx, id, time.Now()); err != nil {
+			return err
+		}
+		unposted, err := tx.UnpostedInstallments(ctx, id)
+		if err != nil {
+			return err
+		}
+		owed := acc
+		for _, inst := range unposted {
+			if owed.AvailableBalance, err = owed.AvailableBalance.Add(inst.Amount); err != nil {
+				return err
+			}
+		}
+		c, err := change(owed)
+		if err != nil {
+			return err
+		}
+		if c.ChangedAt.IsZero() {
+			c.ChangedAt = time.Now().UTC()
+		}
+		c.AccountID = id
+		if _, err := tx.InsertStatusChange(ctx, c); err != nil {
+			return err
+		}
+		acc.Status = c.To
+		return tx.SetAccountStatus(ctx, id, c.To)
+	})
+	if err != nil {
+		return domain.Account{}, err
+	}
+	return acc, nil
+}
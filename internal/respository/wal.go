@@ -0,0 +1,199 @@
+package respository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCorruptLog is returned when the write-ahead log or snapshot of a
+// FileStore cannot be read back, other than a torn final record.
+var ErrCorruptLog = errors.New("corrupt write-ahead log")
+
+const (
+	snapshotFile  = "snapshot"
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+	// maxFrame bounds the size a frame header may claim, so that a corrupt
+	// header cannot make recovery allocate gigabytes.
+	maxFrame = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is what one committed change wrote, numbered by Seq. A snapshot
+// is a single record holding every row, numbered after the last record it
+// includes.
+type walRecord struct {
+	Seq uint64  `json:"seq"`
+	Ops []walOp `json:"ops"`
+}
+
+// Frames are a little-endian uint32 payload length and CRC-32C of the
+// payload, then the payload: a walRecord in JSON.
+func writeFrame(w io.Writer, rec walRecord) (int, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	frame := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[8:], payload)
+	return w.Write(frame)
+}
+
+// errTorn reports a frame cut short or failing its checksum: what a crash
+// in the middle of an append leaves behind.
+var errTorn = errors.New("torn frame")
+
+func readFrame(r io.Reader) (walRecord, int, error) {
+	var header [8]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return walRecord{}, 0, io.EOF
+		}
+		return walRecord{}, n, errTorn
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size > maxFrame {
+		return walRecord{}, 8, errTorn
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, 8, errTorn
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return walRecord{}, 8, errTorn
+	}
+	var rec walRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return walRecord{}, 8, fmt.Errorf("%w: %v", ErrCorruptLog, err)
+	}
+	return rec, 8 + int(size), nil
+}
+
+// readSegment calls fn for each record of the segment at path. It returns
+// the offset just past the last whole record and whether the segment ends in
+// a torn frame there.
+func readSegment(path string, fn func(walRecord) error) (valid int64, torn bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		rec, n, err := readFrame(r)
+		switch {
+		case err == io.EOF:
+			return valid, false, nil
+		case errors.Is(err, errTorn):
+			return valid, true, nil
+		case err != nil:
+			return valid, false, fmt.Errorf("%s at offset %d: %w", filepath.Base(path), valid, err)
+		}
+		if err := fn(rec); err != nil {
+			return valid, false, err
+		}
+		valid += int64(n)
+	}
+}
+
+// segmentName is the file of the segment whose first record is seq; names
+// sort in record order.
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix)
+}
+
+// segments lists the segments in dir by the seq of their first record.
+func segments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// readSnapshot returns the snapshot in dir, or ok=false when there is none.
+func readSnapshot(dir string) (rec walRecord, ok bool, err error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return walRecord{}, false, nil
+	}
+	if err != nil {
+		return walRecord{}, false, err
+	}
+	defer f.Close()
+
+	rec, _, err = readFrame(bufio.NewReader(f))
+	if err != nil {
+		// The snapshot is renamed into place only once synced, so unlike the
+		// log it cannot be torn by a crash.
+		return walRecord{}, false, fmt.Errorf("%w: snapshot: %v", ErrCorruptLog, err)
+	}
+	return rec, true, nil
+}
+
+// writeSnapshot replaces the snapshot in dir with rec. The new snapshot is
+// synced under a temporary name and renamed over the old one, so a crash
+// leaves one or the other.
+func writeSnapshot(dir string, rec walRecord) error {
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, err = writeFrame(w, rec)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the creation, renaming and removal of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
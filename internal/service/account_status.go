@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"go.uber.org/zap"
+)
+
+// BlockAccount stops debits on the account; credits are still accepted.
+func (s *Service) BlockAccount(ctx context.Context, id int64, reason string) (_ domain.Account, err error) {
+	ctx, end := startSpan(ctx, "BlockAccount")
+	defer end(&err)
+	return s.changeAccountStatus(ctx, id, domain.AccountBlocked, reason)
+}
+
+// UnblockAccount makes a blocked account active again.
+func (s *Service) UnblockAccount(ctx context.Context, id int64, reason string) (_ domain.Account, err error) {
+	ctx, end := startSpan(ctx, "UnblockAccount")
+	defer end(&err)
+	return s.changeAccountStatus(ctx, id, domain.AccountActive, reason)
+}
+
+// CloseAccount closes the account for good. It is refused with
+// domain.ErrAccountHasBalance while anything is outstanding.
+func (s *Service) CloseAccount(ctx context.Context, id int64, reason string) (_ domain.Account, err error) {
+	ctx, end := startSpan(ctx, "CloseAccount")
+	defer end(&err)
+	return s.changeAccountStatus(ctx, id, domain.AccountClosed, reason)
+}
+
+func (s *Service) changeAccountStatus(ctx context.Context, id int64, status, reason string) (domain.Account, error) {
+	reason = strings.TrimSpace(reason)
+	now := time.Now().UTC()
+	var change domain.AccountStatusChange
+	acc, err := s.repo.ChangeAccountStatus(ctx, id, func(acc domain.Account) (domain.AccountStatusChange, error) {
+		var err error
+		change, err = acc.ChangeStatus(status, reason, now)
+		return change, err
+	})
+	if err != nil {
+		return domain.Account{}, err
+	}
+	logger.FromContext(ctx).Info("Account status changed",
+		zap.Int64("account_id", id),
+		zap.String("from", change.From),
+		zap.String("to", change.To),
+		zap.String("reason", reason))
+	return acc, nil
+}
+
+// ListAccountStatusChanges returns the account's status history, oldest
+// first.
+func (s *Service) ListAccountStatusChanges(ctx context.Context, id int64) (_ []domain.AccountStatusChange, err error) {
+	ctx, end := startSpan(ctx, "ListAccountStatusChanges")
+	defer end(&err)
+	return s.repo.ListAccountStatusChanges(ctx, id)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAccountStatusChanges(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	acc := domain.Account{ID: 1, Status: domain.AccountActive, CreditLimit: brl("100"), AvailableBalance: brl("100")}
+	repo.On("ChangeAccountStatus", int64(1)).Return(acc, nil)
+
+	blocked, err := svc.BlockAccount(ctx, 1, "  chargeback  ")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.AccountBlocked, blocked.Status)
+
+	_, err = svc.UnblockAccount(ctx, 1, "reviewed")
+	assert.ErrorIs(t, err, domain.ErrInvalidStatusTransition)
+	_, err = svc.BlockAccount(ctx, 1, " ")
+	assert.ErrorIs(t, err, domain.ErrStatusReasonRequired)
+
+	closed, err := svc.CloseAccount(ctx, 1, "customer request")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.AccountClosed, closed.Status)
+
+	repo.On("ChangeAccountStatus", int64(2)).Return(domain.Account{ID: 2, CreditLimit: brl("100"), AvailableBalance: brl("40")}, nil)
+	_, err = svc.CloseAccount(ctx, 2, "customer request")
+	assert.ErrorIs(t, err, domain.ErrAccountHasBalance)
+
+	repo.On("ChangeAccountStatus", int64(3)).Return(domain.Account{}, respository.ErrAccountNotFound)
+	_, err = svc.CloseAccount(ctx, 3, "customer request")
+	assert.ErrorIs(t, err, respository.ErrAccountNotFound)
+}
+
+// The store enforces the status while holding the account lock; its errors
+// reach the caller unchanged.
+func TestCreateTransaction_AccountStatus(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	repo.On("GetOperationType", domain.OpCashPurchase).Return(builtin(domain.OpCashPurchase), nil)
+	repo.On("CreateTransaction", mock.Anything).Return(domain.Transaction{}, domain.ErrAccountBlocked).Once()
+
+	_, err := svc.CreateTransaction(ctx, 1, domain.OpCashPurchase, brl("10"), nil)
+	assert.ErrorIs(t, err, domain.ErrAccountBlocked)
+}
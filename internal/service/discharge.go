@@ -0,0 +1,47 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+// Discharge settles open debits with the payment's balance, oldest first.
+// open must already be ordered by event_date and then id. It returns the
+// payment holding whatever surplus is left, the debits whose balance changed,
+// and one settlement per debit touched.
+func Discharge(payment domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, []domain.Settlement, error) {
+	var (
+		settled     []domain.Transaction
+		settlements []domain.Settlement
+	)
+	remaining := payment.Balance
+	for _, debit := range open {
+		if !remaining.IsPositive() {
+			break
+		}
+		if !debit.Balance.IsNegative() {
+			continue
+		}
+		owed := debit.Balance.Abs()
+		amount := owed
+		cmp, err := remaining.Cmp(owed)
+		if err != nil {
+			return domain.Transaction{}, nil, nil, fmt.Errorf("discharge transaction %d: %w", debit.ID, err)
+		}
+		if cmp < 0 {
+			amount = remaining
+		}
+
+		if debit.Balance, err = debit.Balance.Add(amount); err != nil {
+			return domain.Transaction{}, nil, nil, fmt.Errorf("discharge transaction %d: %w", debit.ID, err)
+		}
+		if remaining, err = remaining.Sub(amount); err != nil {
+			return domain.Transaction{}, nil, nil, fmt.Errorf("discharge transaction %d: %w", debit.ID, err)
+		}
+		settled = append(settled, debit)
+		settlements = append(settlements, domain.Settlement{TransactionID: debit.ID, Amount: amount})
+	}
+	payment.Balance = remaining
+	return payment, settled, settlements, nil
+}
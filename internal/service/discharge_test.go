@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDischarge_SurplusStaysOnPayment(t *testing.T) {
+	payment := domain.Transaction{Amount: brl("100"), Balance: brl("100")}
+	open := []domain.Transaction{
+		{ID: 1, Balance: brl("-50")},
+		{ID: 2, Balance: brl("-23.5")},
+	}
+	got, settled, settlements, err := Discharge(payment, open)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("26.5"), got.Balance)
+	assert.Equal(t, []domain.Transaction{{ID: 1, Balance: brl("0")}, {ID: 2, Balance: brl("0")}}, settled)
+	assert.Equal(t, []domain.Settlement{{TransactionID: 1, Amount: brl("50")}, {TransactionID: 2, Amount: brl("23.5")}}, settlements)
+}
+
+func TestDischarge_PartialSettlement(t *testing.T) {
+	payment := domain.Transaction{Amount: brl("30"), Balance: brl("30")}
+	open := []domain.Transaction{
+		{ID: 1, Balance: brl("-20")},
+		{ID: 2, Balance: brl("-20")},
+		{ID: 3, Balance: brl("-20")},
+	}
+	got, settled, settlements, err := Discharge(payment, open)
+	assert.NoError(t, err)
+	assert.True(t, got.Balance.IsZero())
+	assert.Equal(t, []domain.Transaction{{ID: 1, Balance: brl("0")}, {ID: 2, Balance: brl("-10")}}, settled)
+	assert.Equal(t, []domain.Settlement{{TransactionID: 1, Amount: brl("20")}, {TransactionID: 2, Amount: brl("10")}}, settlements)
+}
+
+func TestDischarge_NoOpenDebits(t *testing.T) {
+	payment := domain.Transaction{Amount: brl("30"), Balance: brl("30")}
+	got, settled, settlements, err := Discharge(payment, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("30"), got.Balance)
+	assert.Empty(t, settled)
+	assert.Empty(t, settlements)
+}
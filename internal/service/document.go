@@ -0,0 +1,118 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DocumentCPF  = "CPF"
+	DocumentCNPJ = "CNPJ"
+)
+
+var ErrUnsupportedDocumentType = errors.New("unsupported document_type")
+
+// DocumentValidator checks a document number of one type and returns it in
+// canonical form, which is what gets stored and compared for uniqueness.
+type DocumentValidator func(document string) (string, error)
+
+func defaultDocumentValidators() map[string]DocumentValidator {
+	return map[string]DocumentValidator{
+		DocumentCPF:  ValidateCPF,
+		DocumentCNPJ: ValidateCNPJ,
+	}
+}
+
+// stripDocumentPunctuation removes the separators commonly used when writing
+// Brazilian documents, e.g. "123.456.789-09" or "11.222.333/0001-81".
+func stripDocumentPunctuation(document string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '-', '/', ' ':
+			return -1
+		}
+		return r
+	}, document)
+}
+
+// detectDocumentType picks CPF or CNPJ by length for requests that don't name
+// a document_type.
+func detectDocumentType(document string) (string, error) {
+	switch len(stripDocumentPunctuation(document)) {
+	case 11:
+		return DocumentCPF, nil
+	case 14:
+		return DocumentCNPJ, nil
+	}
+	return "", fmt.Errorf("%w: document_type is required for this document_number", ErrInvalidDocument)
+}
+
+// ValidateCPF accepts an 11-digit CPF, with or without punctuation, whose two
+// check digits are correct.
+func ValidateCPF(document string) (string, error) {
+	digits := stripDocumentPunctuation(document)
+	if !isDocumentDigits(digits, 11) {
+		return "", fmt.Errorf("%w: CPF must have 11 digits", ErrInvalidDocument)
+	}
+	if checkDigit(digits[:9], 10) != digits[9] || checkDigit(digits[:10], 11) != digits[10] {
+		return "", fmt.Errorf("%w: CPF check digits do not match", ErrInvalidDocument)
+	}
+	return digits, nil
+}
+
+// ValidateCNPJ accepts a 14-digit CNPJ, with or without punctuation, whose two
+// check digits are correct.
+func ValidateCNPJ(document string) (string, error) {
+	digits := stripDocumentPunctuation(document)
+	if !isDocumentDigits(digits, 14) {
+		return "", fmt.Errorf("%w: CNPJ must have 14 digits", ErrInvalidDocument)
+	}
+	if cnpjCheckDigit(digits[:12]) != digits[12] || cnpjCheckDigit(digits[:13]) != digits[13] {
+		return "", fmt.Errorf("%w: CNPJ check digits do not match", ErrInvalidDocument)
+	}
+	return digits, nil
+}
+
+// isDocumentDigits reports whether s has exactly n digits and is not a single
+// repeated digit, which passes the checksum but is never issued.
+func isDocumentDigits(s string, n int) bool {
+	if len(s) != n || strings.Count(s, s[:1]) == n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDigit is the CPF modulo-11 digit over digits, weighted from
+// firstWeight down to 2.
+func checkDigit(digits string, firstWeight int) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		sum += int(digits[i]-'0') * (firstWeight - i)
+	}
+	return mod11Digit(sum)
+}
+
+// cnpjCheckDigit is the CNPJ modulo-11 digit: weights run 2..9 from the right
+// and wrap around.
+func cnpjCheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		weight := 2 + (len(digits)-1-i)%8
+		sum += int(digits[i]-'0') * weight
+	}
+	return mod11Digit(sum)
+}
+
+func mod11Digit(sum int) byte {
+	r := sum % 11
+	if r < 2 {
+		return '0'
+	}
+	return byte('0' + 11 - r)
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrFeatureDisabled = errors.New("feature is disabled")
+
+// Features switches optional behaviour on and off. Every feature is on
+// unless WithFeatures or SetFeatures turns it off.
+type Features struct {
+	// Installments allows installment purchases.
+	Installments bool
+	// Reversals allows full and partial reversals.
+	Reversals bool
+	// ForeignCurrency converts transactions made in a currency other than
+	// the account's; without it they are rejected.
+	ForeignCurrency bool
+}
+
+// AllFeatures returns Features with everything on.
+func AllFeatures() Features {
+	return Features{Installments: true, Reversals: true, ForeignCurrency: true}
+}
+
+// WithFeatures sets the features the service starts with.
+func WithFeatures(f Features) Option {
+	return func(s *Service) {
+		s.SetFeatures(f)
+	}
+}
+
+// SetFeatures replaces the features. Requests already being served keep the
+// features they started with.
+func (s *Service) SetFeatures(f Features) {
+	s.features.Store(&f)
+}
+
+// requireFeature returns ErrFeatureDisabled naming feature unless on.
+func requireFeature(on bool, feature string) error {
+	if !on {
+		return fmt.Errorf("%w: %s", ErrFeatureDisabled, feature)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFeatures(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	table, err := NewRateTable([]ExchangeRate{{From: "USD", To: "BRL", Rate: domain.MustParseRate("5")}})
+	assert.NoError(t, err)
+	svc := New(repo, WithExchangeRates(table), WithFeatures(Features{}))
+	repo.On("GetOperationType", domain.OpCashPurchase).Return(builtin(domain.OpCashPurchase), nil)
+	repo.On("GetAccount", int64(1)).Return(domain.Account{ID: 1, Currency: "BRL"}, nil)
+
+	_, err = svc.CreateInstallmentPurchase(ctx, 1, brl("100"), nil, InstallmentPlan{Count: 2})
+	assert.ErrorIs(t, err, ErrFeatureDisabled)
+	_, err = svc.ReverseTransaction(ctx, 1, nil, nil)
+	assert.ErrorIs(t, err, ErrFeatureDisabled)
+	_, err = svc.CreateTransaction(ctx, 1, domain.OpCashPurchase, domain.MustParseMoney("10", "USD"), nil)
+	assert.ErrorIs(t, err, ErrFeatureDisabled)
+	repo.AssertNotCalled(t, "CreateInstallmentPurchase")
+	repo.AssertNotCalled(t, "CreateReversal")
+
+	// Turning foreign currency back on takes effect for the next request.
+	svc.SetFeatures(Features{ForeignCurrency: true})
+	repo.On("CreateTransaction", mock.MatchedBy(func(tx domain.Transaction) bool { return tx.Amount == brl("-50") })).
+		Return(domain.Transaction{ID: 1}, nil)
+	_, err = svc.CreateTransaction(ctx, 1, domain.OpCashPurchase, domain.MustParseMoney("10", "USD"), nil)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+var ErrRateUnavailable = errors.New("no exchange rate available")
+
+// ExchangeRateProvider returns the rate converting one unit of from into to
+// that applied at the given time.
+type ExchangeRateProvider interface {
+	Rate(ctx context.Context, from, to string, at time.Time) (domain.Rate, error)
+}
+
+// ExchangeRate is one entry of a RateTable: the rate for From→To from Since
+// onwards. A zero Since applies from the beginning of time.
+type ExchangeRate struct {
+	From  string
+	To    string
+	Since time.Time
+	Rate  domain.Rate
+}
+
+// RateTable is an ExchangeRateProvider over a fixed set of dated rates. For a
+// given pair the entry with the latest Since not after the requested time
+// wins; pairs are not inverted automatically.
+type RateTable struct {
+	pairs map[string][]ExchangeRate
+}
+
+func NewRateTable(rates []ExchangeRate) (*RateTable, error) {
+	t := &RateTable{pairs: make(map[string][]ExchangeRate)}
+	for _, r := range rates {
+		if !domain.ValidCurrency(r.From) || !domain.ValidCurrency(r.To) || r.From == r.To {
+			return nil, fmt.Errorf("%w: pair %s/%s", domain.ErrInvalidCurrency, r.From, r.To)
+		}
+		if r.Rate.IsZero() {
+			return nil, fmt.Errorf("%w: %s/%s", domain.ErrInvalidRate, r.From, r.To)
+		}
+		key := r.From + "/" + r.To
+		t.pairs[key] = append(t.pairs[key], r)
+	}
+	for _, entries := range t.pairs {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Since.Before(entries[j].Since) })
+	}
+	return t, nil
+}
+
+// ParseRates reads a comma-separated list of FROM/TO[@YYYY-MM-DD]=RATE
+// entries, e.g. "USD/BRL=5.10,USD/BRL@2024-06-01=5.45". This is the format of
+// the APP_FX_RATES setting.
+func ParseRates(spec string) ([]ExchangeRate, error) {
+	var rates []ExchangeRate
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pair, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid exchange rate entry %q: want FROM/TO[@DATE]=RATE", entry)
+		}
+		pair, since, _ := strings.Cut(pair, "@")
+		from, to, _ := strings.Cut(pair, "/")
+		r, err := newExchangeRate(from, to, since, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exchange rate entry %q: %w", entry, err)
+		}
+		rates = append(rates, r)
+	}
+	return rates, nil
+}
+
+// LoadRateFile reads a CSV file with the columns since,from,to,rate. An empty
+// since applies from the beginning of time; lines starting with # are
+// comments.
+func LoadRateFile(path string) ([]ExchangeRate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exchange rate file: %w", err)
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(f)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 4
+	cr.TrimLeadingSpace = true
+	var rates []ExchangeRate
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exchange rate file: %w", err)
+		}
+		r, err := newExchangeRate(rec[1], rec[2], rec[0], rec[3])
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rates = append(rates, r)
+	}
+	return rates, nil
+}
+
+func newExchangeRate(from, to, since, rate string) (ExchangeRate, error) {
+	r := ExchangeRate{From: strings.ToUpper(strings.TrimSpace(from)), To: strings.ToUpper(strings.TrimSpace(to))}
+	if since = strings.TrimSpace(since); since != "" {
+		var err error
+		if r.Since, err = time.Parse(time.DateOnly, since); err != nil {
+			return ExchangeRate{}, fmt.Errorf("invalid date %q", since)
+		}
+	}
+	var err error
+	r.Rate, err = domain.ParseRate(strings.TrimSpace(rate))
+	return r, err
+}
+
+func (t *RateTable) Rate(ctx context.Context, from, to string, at time.Time) (domain.Rate, error) {
+	entries := t.pairs[from+"/"+to]
+	// The first entry starting after at; the one before it applies.
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Since.After(at) })
+	if i == 0 {
+		return domain.Rate{}, fmt.Errorf("%w: %s/%s at %s", ErrRateUnavailable, from, to, at.Format(time.RFC3339))
+	}
+	return entries[i-1].Rate, nil
+}
+
+// conversion is a foreign-currency amount turned into the account currency.
+type conversion struct {
+	amount   domain.Money
+	original *domain.Money
+	rate     *domain.Rate
+}
+
+// toAccountCurrency converts amount into the currency of the account when the
+// two differ, at the rate in force at the event time. Without a rate provider
+// amounts are passed through and the store rejects a currency mismatch.
+func (s *Service) toAccountCurrency(ctx context.Context, accountID int64, amount domain.Money, at time.Time) (conversion, error) {
+	if s.rates == nil {
+		return conversion{amount: amount}, nil
+	}
+	acc, err := s.repo.GetAccount(ctx, accountID)
+	if err != nil {
+		return conversion{}, err
+	}
+	currency := acc.Currency
+	if currency == "" {
+		currency = acc.AvailableBalance.Currency()
+	}
+	if currency == amount.Currency() {
+		return conversion{amount: amount}, nil
+	}
+	if err := requireFeature(s.features.Load().ForeignCurrency, "foreign_currency"); err != nil {
+		return conversion{}, err
+	}
+	rate, err := s.rates.Rate(ctx, amount.Currency(), currency, at)
+	if err != nil {
+		return conversion{}, err
+	}
+	converted, err := rate.Convert(amount, currency)
+	if err != nil {
+		return conversion{}, err
+	}
+	if converted.IsZero() {
+		return conversion{}, fmt.Errorf("%w: %s converts to zero", ErrInvalidAmount, amount)
+	}
+	return conversion{amount: converted, original: &amount, rate: &rate}, nil
+}
+
+// limitIn returns limit, configured in one currency, as the same value in
+// currency at the rate in force at the given time. Without a rate for the
+// pair the limit cannot be enforced, which is ErrRateUnavailable.
+func (s *Service) limitIn(ctx context.Context, limit domain.Money, currency string, at time.Time) (domain.Money, error) {
+	if limit.Currency() == currency {
+		return limit, nil
+	}
+	if s.rates == nil {
+		return domain.Money{}, fmt.Errorf("%w: %s/%s", ErrRateUnavailable, limit.Currency(), currency)
+	}
+	rate, err := s.rates.Rate(ctx, limit.Currency(), currency, at)
+	if err != nil {
+		return domain.Money{}, err
+	}
+	return rate.Convert(limit, currency)
+}
+
+// apply records the conversion on t, whose amount is already signed.
+func (c conversion) apply(t *domain.Transaction) {
+	if c.original == nil {
+		return
+	}
+	original := *c.original
+	if t.Amount.IsNegative() {
+		original = original.Abs().Neg()
+	} else {
+		original = original.Abs()
+	}
+	t.OriginalAmount = &original
+	t.OriginalCurrency = original.Currency()
+	t.ExchangeRate = c.rate
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLoadRateFile(t *testing.T) {
+	ctx := context.Background()
+	rates, err := LoadRateFile("testdata/rates.csv")
+	assert.NoError(t, err)
+	table, err := NewRateTable(rates)
+	assert.NoError(t, err)
+
+	r, err := table.Rate(ctx, "USD", "BRL", time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, "5", r.String())
+	r, err = table.Rate(ctx, "USD", "BRL", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, "5.4321", r.String())
+
+	// Pairs are not inverted.
+	_, err = table.Rate(ctx, "BRL", "USD", time.Now())
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+
+	_, err = LoadRateFile("testdata/missing.csv")
+	assert.Error(t, err)
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates("usd/brl=5.10, USD/BRL@2024-06-01=5.45")
+	assert.NoError(t, err)
+	table, err := NewRateTable(rates)
+	assert.NoError(t, err)
+	r, err := table.Rate(context.Background(), "USD", "BRL", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, "5.1", r.String())
+
+	for _, spec := range []string{"USD/BRL", "USD/BRL=0", "USD/BRL=-1", "USD=5", "USD/BRL@June=5", "USD/USD=1"} {
+		rates, err := ParseRates(spec)
+		if err == nil {
+			_, err = NewRateTable(rates)
+		}
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCreateTransaction_ConvertsForeignCurrency(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	table, err := NewRateTable([]ExchangeRate{{From: "USD", To: "BRL", Rate: domain.MustParseRate("5.4321")}})
+	assert.NoError(t, err)
+	svc := New(repo, WithExchangeRates(table))
+	usd := func(s string) domain.Money { return domain.MustParseMoney(s, "USD") }
+
+	repo.On("GetOperationType", domain.OpCashPurchase).Return(builtin(domain.OpCashPurchase), nil)
+	repo.On("GetAccount", int64(1)).Return(domain.Account{ID: 1, Currency: "BRL"}, nil)
+	repo.On("CreateTransaction", mock.MatchedBy(func(tx domain.Transaction) bool {
+		return tx.Amount == brl("-54.32") && *tx.OriginalAmount == usd("-10") &&
+			tx.OriginalCurrency == "USD" && tx.ExchangeRate.String() == "5.4321"
+	})).Return(domain.Transaction{ID: 1}, nil)
+
+	_, err = svc.CreateTransaction(ctx, 1, domain.OpCashPurchase, usd("10"), nil)
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+
+	// Amounts already in the account currency are not converted.
+	repo.On("CreateTransaction", mock.MatchedBy(func(tx domain.Transaction) bool {
+		return tx.Amount == brl("-10") && tx.OriginalAmount == nil && tx.ExchangeRate == nil
+	})).Return(domain.Transaction{ID: 2}, nil)
+	res, err := svc.CreateTransaction(ctx, 1, domain.OpCashPurchase, brl("10"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), res.ID)
+
+	_, err = svc.CreateTransaction(ctx, 1, domain.OpCashPurchase, domain.MustParseMoney("10", "EUR"), nil)
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+}
+
+func TestCreateTransaction_ConvertsOperationTypeLimits(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	table, err := NewRateTable([]ExchangeRate{{From: "BRL", To: "JPY", Rate: domain.MustParseRate("30")}})
+	assert.NoError(t, err)
+	svc := New(repo, WithExchangeRates(table))
+	jpy := func(s string) domain.Money { return domain.MustParseMoney(s, "JPY") }
+	min, max := brl("1"), brl("100")
+	fee := domain.OperationType{ID: 100, Description: "FEE", Direction: domain.DirectionDebit, MinAmount: &min, MaxAmount: &max, Active: true}
+
+	repo.On("GetOperationType", 100).Return(fee, nil)
+	repo.On("GetAccount", int64(1)).Return(domain.Account{ID: 1, Currency: "JPY"}, nil)
+	repo.On("GetAccount", int64(2)).Return(domain.Account{ID: 2, Currency: "USD"}, nil)
+	repo.On("CreateTransaction", mock.Anything).Return(domain.Transaction{ID: 1}, nil)
+
+	// 100 BRL is 3000 JPY.
+	_, err = svc.CreateTransaction(ctx, 1, 100, jpy("3000"), nil)
+	assert.NoError(t, err)
+	_, err = svc.CreateTransaction(ctx, 1, 100, jpy("3001"), nil)
+	assert.ErrorIs(t, err, domain.ErrAmountOutOfRange)
+	_, err = svc.CreateTransaction(ctx, 1, 100, jpy("29"), nil)
+	assert.ErrorIs(t, err, domain.ErrAmountOutOfRange)
+
+	// Limits that cannot be converted are not skipped.
+	_, err = svc.CreateTransaction(ctx, 2, 100, domain.MustParseMoney("10", "USD"), nil)
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+	_, err = New(repo).CreateTransaction(ctx, 1, 100, jpy("3000"), nil)
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+)
+
+const MaxInstallments = 48
+
+var (
+	ErrInvalidInstallments = fmt.Errorf("installments must be between 2 and %d", MaxInstallments)
+	ErrInvalidInterestRate = errors.New("interest_rate must be between 0 and 100")
+	ErrNotInstallmentPlan  = errors.New("transaction is not an installment purchase")
+)
+
+// InstallmentPlan describes how an installment purchase is paid.
+type InstallmentPlan struct {
+	Count int
+	// MonthlyRate is the interest charged per month as a fraction, e.g. 0.0199
+	// for 1.99%. Nil or zero means interest-free.
+	MonthlyRate *big.Rat
+}
+
+// ScheduleInstallments returns the total to charge for amount under plan and
+// its split into plan.Count installments, one month apart starting at
+// purchase. The shares add up to the total exactly; the leftover cents go to
+// the first installment when remainderFirst is set and to the last otherwise.
+//
+// With interest the installments follow the Price table: the total is Count
+// times the fixed payment amount·r/(1−(1+r)^−Count), rounded to the cent.
+func ScheduleInstallments(amount domain.Money, purchase time.Time, plan InstallmentPlan, remainderFirst bool) (domain.Money, []domain.Transaction, error) {
+	if plan.Count < 2 || plan.Count > MaxInstallments {
+		return domain.Money{}, nil, ErrInvalidInstallments
+	}
+	total := amount.Abs()
+	if r := plan.MonthlyRate; r != nil && r.Sign() != 0 {
+		if r.Sign() < 0 || r.Cmp(big.NewRat(1, 1)) > 0 {
+			return domain.Money{}, nil, ErrInvalidInterestRate
+		}
+		var err error
+		if total, err = withInterest(total, r, plan.Count); err != nil {
+			return domain.Money{}, nil, err
+		}
+	}
+
+	shares, err := total.Neg().Split(plan.Count, !remainderFirst)
+	if err != nil {
+		return domain.Money{}, nil, err
+	}
+	schedule := make([]domain.Transaction, plan.Count)
+	for i, share := range shares {
+		schedule[i] = domain.Transaction{
+			OperationTypeID:   domain.OpInstallmentPurchase,
+			Amount:            share,
+			Balance:           share,
+			EventDate:         addMonths(purchase, i),
+			InstallmentNumber: i + 1,
+		}
+	}
+	return total, schedule, nil
+}
+
+// withInterest returns n Price-table payments of principal at rate r, rounded
+// half up to the currency's minor unit. A total too large for Money is
+// domain.ErrMoneyOverflow.
+func withInterest(principal domain.Money, r *big.Rat, n int) (domain.Money, error) {
+	one := big.NewRat(1, 1)
+	growth := new(big.Rat).Add(one, r)
+	pow := new(big.Rat).SetInt64(1)
+	for i := 0; i < n; i++ {
+		pow.Mul(pow, growth)
+	}
+	// payment = P·r·(1+r)^n / ((1+r)^n − 1)
+	total := new(big.Rat).SetInt64(principal.Units())
+	total.Mul(total, r)
+	total.Mul(total, pow)
+	total.Quo(total, new(big.Rat).Sub(pow, one))
+	total.Mul(total, big.NewRat(int64(n), 1))
+
+	// Round half up: floor((2·num + den) / (2·den)).
+	units := new(big.Int).Mul(total.Num(), big.NewInt(2))
+	units.Add(units, total.Denom())
+	units.Quo(units, new(big.Int).Mul(total.Denom(), big.NewInt(2)))
+	if !units.IsInt64() {
+		return domain.Money{}, fmt.Errorf("%w: %s with interest over %d installments", domain.ErrMoneyOverflow, principal, n)
+	}
+	return domain.NewMoney(units.Int64(), principal.Currency()), nil
+}
+
+// addMonths moves t forward by months, keeping the day of month where it
+// exists and using the month's last day otherwise (Jan 31 -> Feb 28).
+func addMonths(t time.Time, months int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+// CreateInstallmentPurchase records an installment purchase of amount and its
+// schedule. Each installment is taken from the available balance, and
+// becomes an open debit eligible for payments, from its due date; only those
+// due at purchase must fit the balance.
+func (s *Service) CreateInstallmentPurchase(ctx context.Context, accountID int64, amount domain.Money, eventTime *time.Time, plan InstallmentPlan) (_ TransactionResult, err error) {
+	ctx, end := startSpan(ctx, "CreateInstallmentPurchase", tracing.Int64("account.id", accountID), tracing.Int("installments", plan.Count))
+	defer end(&err)
+	defer func() { s.countTransaction(domain.OpInstallmentPurchase, err) }()
+	if err := requireFeature(s.features.Load().Installments, "installments"); err != nil {
+		return TransactionResult{}, err
+	}
+	ot, err := s.activeOperationType(ctx, domain.OpInstallmentPurchase)
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	if amount.IsZero() {
+		return TransactionResult{}, ErrInvalidAmount
+	}
+	purchase := time.Now().UTC()
+	if eventTime != nil && !eventTime.IsZero() {
+		purchase = eventTime.UTC()
+	}
+	conv, err := s.toAccountCurrency(ctx, accountID, amount, purchase)
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	total, schedule, err := ScheduleInstallments(conv.amount, purchase, plan, s.remainderFirst)
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	// The type's limits apply to what is charged, interest included.
+	if err := s.checkOperationType(ctx, ot, total, purchase); err != nil {
+		return TransactionResult{}, err
+	}
+
+	parent := domain.Transaction{
+		AccountID:        accountID,
+		OperationTypeID:  domain.OpInstallmentPurchase,
+		Amount:           total.Neg(),
+		Balance:          domain.NewMoney(0, total.Currency()),
+		EventDate:        purchase,
+		InstallmentCount: plan.Count,
+	}
+	conv.apply(&parent)
+	velocity, err := s.velocityCheck(ctx, total.Currency())
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	created, installments, err := s.repo.CreateInstallmentPurchase(ctx, parent, schedule, velocity)
+	if err != nil {
+		if errors.Is(err, respository.ErrOperationTypeNotFound) {
+			return TransactionResult{}, ErrInvalidOperationType
+		}
+		return TransactionResult{}, err
+	}
+	return TransactionResult{Transaction: created, Installments: installments}, nil
+}
+
+// ListInstallments returns the schedule of the installment purchase id,
+// ordered by due date.
+func (s *Service) ListInstallments(ctx context.Context, id int64) (_ []domain.Transaction, err error) {
+	ctx, end := startSpan(ctx, "ListInstallments")
+	defer end(&err)
+	parent, err := s.repo.GetTransaction(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if parent.InstallmentCount == 0 {
+		return nil, ErrNotInstallmentPlan
+	}
+	page, err := s.repo.ListTransactions(ctx, respository.TransactionFilter{
+		ParentTransactionID: &id,
+		Limit:               parent.InstallmentCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Transactions, nil
+}
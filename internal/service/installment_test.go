@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestScheduleInstallments_SplitsExactly(t *testing.T) {
+	purchase := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	total, schedule, err := ScheduleInstallments(brl("100"), purchase, InstallmentPlan{Count: 3}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("100"), total)
+	assert.Len(t, schedule, 3)
+	assert.Equal(t, brl("-33.33"), schedule[0].Amount)
+	assert.Equal(t, brl("-33.33"), schedule[1].Amount)
+	assert.Equal(t, brl("-33.34"), schedule[2].Amount)
+	assert.Equal(t, schedule[2].Amount, schedule[2].Balance)
+	assert.Equal(t, 3, schedule[2].InstallmentNumber)
+
+	assert.Equal(t, purchase, schedule[0].EventDate)
+	assert.Equal(t, time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), schedule[1].EventDate)
+	assert.Equal(t, time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC), schedule[2].EventDate)
+
+	_, schedule, err = ScheduleInstallments(brl("100"), purchase, InstallmentPlan{Count: 3}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("-33.34"), schedule[0].Amount)
+	assert.Equal(t, brl("-33.33"), schedule[2].Amount)
+}
+
+func TestScheduleInstallments_WithInterest(t *testing.T) {
+	// 1000 over 12 months at 2% a month is 12 payments of 94.56.
+	plan := InstallmentPlan{Count: 12, MonthlyRate: big.NewRat(2, 100)}
+	total, schedule, err := ScheduleInstallments(brl("1000"), time.Now(), plan, false)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("1134.72"), total)
+	sum := brl("0")
+	for _, inst := range schedule {
+		sum, _ = sum.Add(inst.Amount)
+	}
+	assert.Equal(t, total.Neg(), sum)
+}
+
+func TestScheduleInstallments_Invalid(t *testing.T) {
+	_, _, err := ScheduleInstallments(brl("100"), time.Now(), InstallmentPlan{Count: 1}, false)
+	assert.ErrorIs(t, err, ErrInvalidInstallments)
+	_, _, err = ScheduleInstallments(brl("100"), time.Now(), InstallmentPlan{Count: MaxInstallments + 1}, false)
+	assert.ErrorIs(t, err, ErrInvalidInstallments)
+	_, _, err = ScheduleInstallments(brl("100"), time.Now(), InstallmentPlan{Count: 2, MonthlyRate: big.NewRat(-1, 100)}, false)
+	assert.ErrorIs(t, err, ErrInvalidInterestRate)
+
+	// 100% a month over 48 months multiplies the principal by about 48, past
+	// what Money holds, which must not wrap around.
+	large := domain.NewMoney(math.MaxInt64/10, domain.DefaultCurrency)
+	_, _, err = ScheduleInstallments(large, time.Now(), InstallmentPlan{Count: MaxInstallments, MonthlyRate: big.NewRat(1, 1)}, false)
+	assert.ErrorIs(t, err, domain.ErrMoneyOverflow)
+}
+
+func TestCreateInstallmentPurchase(t *testing.T) {
+	repo := new(mockRepo)
+	svc := New(repo, WithRemainderOnFirstInstallment())
+	purchase := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+
+	repo.On("GetOperationType", domain.OpInstallmentPurchase).Return(builtin(domain.OpInstallmentPurchase), nil)
+	repo.On("CreateInstallmentPurchase", mock.MatchedBy(func(p domain.Transaction) bool {
+		return p.InstallmentCount == 3 && p.Amount == brl("-100") && p.Balance.IsZero() && p.EventDate.Equal(purchase)
+	}), 3).Return(domain.Transaction{ID: 10, AccountID: 1, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-100"), InstallmentCount: 3}, nil)
+
+	res, err := svc.CreateInstallmentPurchase(context.Background(), 1, brl("100"), &purchase, InstallmentPlan{Count: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), res.ID)
+	assert.Len(t, res.Installments, 3)
+	assert.Equal(t, brl("-33.34"), res.Installments[0].Amount)
+	assert.Equal(t, int64(10), *res.Installments[0].ParentTransactionID)
+	repo.AssertExpectations(t)
+}
+
+func TestCreateInstallmentPurchase_LimitsApplyToTotal(t *testing.T) {
+	repo := new(mockRepo)
+	svc := New(repo)
+	max := brl("1100")
+	ot := builtin(domain.OpInstallmentPurchase)
+	ot.MaxAmount = &max
+	repo.On("GetOperationType", domain.OpInstallmentPurchase).Return(ot, nil)
+
+	// 1000 at 2% a month over 12 months charges 1134.72.
+	plan := InstallmentPlan{Count: 12, MonthlyRate: big.NewRat(2, 100)}
+	_, err := svc.CreateInstallmentPurchase(context.Background(), 1, brl("1000"), nil, plan)
+	assert.ErrorIs(t, err, domain.ErrAmountOutOfRange)
+	repo.AssertNotCalled(t, "CreateInstallmentPurchase")
+}
+
+func TestListInstallments(t *testing.T) {
+	repo := new(mockRepo)
+	svc := New(repo)
+	parentID := int64(10)
+
+	repo.On("GetTransaction", int64(10)).Return(domain.Transaction{ID: 10, InstallmentCount: 2}, nil)
+	repo.On("GetTransaction", int64(11)).Return(domain.Transaction{ID: 11}, nil)
+	repo.On("ListTransactions", respository.TransactionFilter{ParentTransactionID: &parentID, Limit: 2}).
+		Return(respository.TransactionPage{Transactions: []domain.Transaction{{ID: 11}, {ID: 12}}}, nil)
+
+	installments, err := svc.ListInstallments(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, installments, 2)
+
+	_, err = svc.ListInstallments(context.Background(), 11)
+	assert.ErrorIs(t, err, ErrNotInstallmentPlan)
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+)
+
+// Transaction outcomes as counted in transactions_total.
+const (
+	OutcomeCreated  = "created"
+	OutcomeRejected = "rejected"
+	OutcomeFailed   = "failed"
+)
+
+// WithMetrics counts every attempt to create a transaction, installment
+// purchase or reversal in reg, by operation type and outcome.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *Service) {
+		s.transactions = reg.NewCounterVec("transactions_total",
+			"Attempts to create a transaction, by operation type and outcome (created, rejected or failed).",
+			"operation_type", "outcome")
+	}
+}
+
+// rejections are the errors that mean a request broke a business rule, as
+// opposed to the store failing.
+var rejections = []error{
+	ErrInvalidOperationType, ErrInvalidAmount, ErrRateUnavailable, ErrFeatureDisabled,
+	ErrInvalidInstallments, ErrInvalidInterestRate, ErrVelocityLimitExceeded,
+	ErrNotReversible, ErrAlreadyReversed, ErrReversalExceedsOriginal,
+	ErrInstallmentNotReversible, ErrPartialInstallmentReversal,
+	respository.ErrAccountNotFound, respository.ErrTransactionNotFound,
+	domain.ErrInsufficientBalance, domain.ErrAccountBlocked, domain.ErrAccountClosed,
+	domain.ErrAmountOutOfRange, domain.ErrOutsideAllowedHours,
+	domain.ErrCurrencyMismatch, domain.ErrMoneyScale, domain.ErrMoneyOverflow,
+}
+
+func outcome(err error) string {
+	if err == nil {
+		return OutcomeCreated
+	}
+	for _, target := range rejections {
+		if errors.Is(err, target) {
+			return OutcomeRejected
+		}
+	}
+	return OutcomeFailed
+}
+
+// countTransaction records one attempt of operation type op; 0 means the type
+// was never determined.
+func (s *Service) countTransaction(op int, err error) {
+	if s.transactions == nil {
+		return
+	}
+	label := "unknown"
+	if op != 0 {
+		label = strconv.Itoa(op)
+	}
+	s.transactions.Inc(label, outcome(err))
+}
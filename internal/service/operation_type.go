@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+var ErrInvalidOperationTypeDefinition = errors.New("invalid operation type")
+
+// validateOperationType normalises ot and checks that its direction and
+// rules make sense.
+func validateOperationType(ot domain.OperationType) (domain.OperationType, error) {
+	ot.Description = strings.ToUpper(strings.TrimSpace(ot.Description))
+	if ot.Description == "" {
+		return ot, fmt.Errorf("%w: description is required", ErrInvalidOperationTypeDefinition)
+	}
+	if ot.Direction != domain.DirectionDebit && ot.Direction != domain.DirectionCredit {
+		return ot, fmt.Errorf("%w: direction must be %q or %q", ErrInvalidOperationTypeDefinition, domain.DirectionDebit, domain.DirectionCredit)
+	}
+	for _, m := range []*domain.Money{ot.MinAmount, ot.MaxAmount} {
+		if m != nil && !m.IsPositive() {
+			return ot, fmt.Errorf("%w: amount limits must be greater than zero", ErrInvalidOperationTypeDefinition)
+		}
+	}
+	if ot.MinAmount != nil && ot.MaxAmount != nil {
+		if c, err := ot.MinAmount.Cmp(*ot.MaxAmount); err != nil || c > 0 {
+			return ot, fmt.Errorf("%w: min_amount is greater than max_amount", ErrInvalidOperationTypeDefinition)
+		}
+	}
+	if ot.AllowedHours != nil && !ot.AllowedHours.Valid() {
+		return ot, fmt.Errorf("%w: allowed_hours must be two different hours between 0 and 23", ErrInvalidOperationTypeDefinition)
+	}
+	return ot, nil
+}
+
+// checkOperationType enforces the rules of ot on amount at the given time.
+// Amount limits are set in one currency and converted into the amount's
+// first, so they bind accounts in every currency alike.
+func (s *Service) checkOperationType(ctx context.Context, ot domain.OperationType, amount domain.Money, at time.Time) error {
+	for _, limit := range []**domain.Money{&ot.MinAmount, &ot.MaxAmount} {
+		if *limit == nil {
+			continue
+		}
+		converted, err := s.limitIn(ctx, **limit, amount.Currency(), at)
+		if err != nil {
+			return err
+		}
+		*limit = &converted
+	}
+	return ot.Check(amount, at)
+}
+
+// GetOperationType returns the operation type id, active or not.
+func (s *Service) GetOperationType(ctx context.Context, id int) (_ domain.OperationType, err error) {
+	ctx, end := startSpan(ctx, "GetOperationType")
+	defer end(&err)
+	return s.repo.GetOperationType(ctx, id)
+}
+
+// CreateOperationType adds an active operation type. The id is assigned by
+// the repository.
+func (s *Service) CreateOperationType(ctx context.Context, ot domain.OperationType) (_ domain.OperationType, err error) {
+	ctx, end := startSpan(ctx, "CreateOperationType")
+	defer end(&err)
+	ot, err = validateOperationType(ot)
+	if err != nil {
+		return domain.OperationType{}, err
+	}
+	ot.Active = true
+	return s.repo.CreateOperationType(ctx, ot)
+}
+
+// UpdateOperationType replaces the description, rules and active flag of an
+// existing type. The direction cannot change, since it is already reflected
+// in the sign of every stored transaction of the type; an empty one keeps it.
+func (s *Service) UpdateOperationType(ctx context.Context, ot domain.OperationType) (_ domain.OperationType, err error) {
+	ctx, end := startSpan(ctx, "UpdateOperationType")
+	defer end(&err)
+	current, err := s.repo.GetOperationType(ctx, ot.ID)
+	if err != nil {
+		return domain.OperationType{}, err
+	}
+	if ot.Direction == "" {
+		ot.Direction = current.Direction
+	}
+	if ot.Direction != current.Direction {
+		return domain.OperationType{}, fmt.Errorf("%w: direction cannot change", ErrInvalidOperationTypeDefinition)
+	}
+	if ot, err = validateOperationType(ot); err != nil {
+		return domain.OperationType{}, err
+	}
+	return s.repo.UpdateOperationType(ctx, ot)
+}
+
+// DeactivateOperationType stops the type from accepting new transactions.
+// Existing transactions are unaffected.
+func (s *Service) DeactivateOperationType(ctx context.Context, id int) (_ domain.OperationType, err error) {
+	ctx, end := startSpan(ctx, "DeactivateOperationType")
+	defer end(&err)
+	ot, err := s.repo.GetOperationType(ctx, id)
+	if err != nil {
+		return domain.OperationType{}, err
+	}
+	if !ot.Active {
+		return ot, nil
+	}
+	ot.Active = false
+	return s.repo.UpdateOperationType(ctx, ot)
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateOperationType(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	min, max := brl("1"), brl("10")
+
+	repo.On("CreateOperationType", domain.OperationType{Description: "FEE", Direction: domain.DirectionDebit, MinAmount: &min, Active: true}).
+		Return(domain.OperationType{ID: 100, Description: "FEE", Direction: domain.DirectionDebit, MinAmount: &min, Active: true}, nil)
+	got, err := svc.CreateOperationType(ctx, domain.OperationType{Description: " fee ", Direction: domain.DirectionDebit, MinAmount: &min})
+	assert.NoError(t, err)
+	assert.Equal(t, 100, got.ID)
+
+	for _, ot := range []domain.OperationType{
+		{Direction: domain.DirectionDebit},
+		{Description: "X", Direction: "sideways"},
+		{Description: "X", Direction: domain.DirectionCredit, MinAmount: &max, MaxAmount: &min},
+		{Description: "X", Direction: domain.DirectionCredit, AllowedHours: &domain.HourWindow{From: 3, To: 3}},
+	} {
+		_, err := svc.CreateOperationType(ctx, ot)
+		assert.ErrorIs(t, err, ErrInvalidOperationTypeDefinition)
+	}
+}
+
+func TestUpdateAndDeactivateOperationType(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	fee := domain.OperationType{ID: 100, Description: "FEE", Direction: domain.DirectionDebit, Active: true}
+	repo.On("GetOperationType", 100).Return(fee, nil)
+	repo.On("GetOperationType", 999).Return(domain.OperationType{}, respository.ErrOperationTypeNotFound)
+
+	_, err := svc.UpdateOperationType(ctx, domain.OperationType{ID: 100, Description: "FEE", Direction: domain.DirectionCredit, Active: true})
+	assert.ErrorIs(t, err, ErrInvalidOperationTypeDefinition)
+
+	renamed := domain.OperationType{ID: 100, Description: "LATE FEE", Direction: domain.DirectionDebit, Active: true}
+	repo.On("UpdateOperationType", renamed).Return(renamed, nil)
+	got, err := svc.UpdateOperationType(ctx, domain.OperationType{ID: 100, Description: "late fee", Active: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "LATE FEE", got.Description)
+
+	inactive := fee
+	inactive.Active = false
+	repo.On("UpdateOperationType", inactive).Return(inactive, nil)
+	got, err = svc.DeactivateOperationType(ctx, 100)
+	assert.NoError(t, err)
+	assert.False(t, got.Active)
+
+	_, err = svc.DeactivateOperationType(ctx, 999)
+	assert.ErrorIs(t, err, respository.ErrOperationTypeNotFound)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+)
+
+var (
+	ErrNotReversible              = errors.New("transaction cannot be reversed")
+	ErrAlreadyReversed            = errors.New("transaction is already fully reversed")
+	ErrReversalExceedsOriginal    = errors.New("reversal amount exceeds what is left to reverse")
+	ErrInstallmentNotReversible   = errors.New("an installment cannot be reversed on its own; reverse the installment purchase")
+	ErrPartialInstallmentReversal = errors.New("an installment purchase can only be reversed in full")
+)
+
+// Reverse builds the transaction compensating original. previous are the
+// reversals original already has; amount is the absolute value to reverse,
+// or nil for everything that is left.
+//
+// The reversal first takes back the part of original that is still open (a
+// debit's unpaid balance or a payment's unspent surplus), so the original
+// carries its new balance in the second return value. Whatever is left over
+// becomes the reversal's own balance: a refund beyond the unpaid part is a
+// surplus credit, and a payment reversal beyond the surplus is a new open
+// debit.
+func Reverse(original domain.Transaction, previous []domain.Transaction, amount *domain.Money) (domain.Transaction, domain.Transaction, error) {
+	if original.ParentTransactionID != nil {
+		return domain.Transaction{}, domain.Transaction{}, ErrInstallmentNotReversible
+	}
+	op, ok := domain.ReversalOperation(original.OperationTypeID, original.Amount)
+	// The parent of an installment purchase carries no balance; it is
+	// reversed through ReverseInstallments.
+	if !ok || original.ReversesTransactionID != nil || original.InstallmentCount > 0 {
+		return domain.Transaction{}, domain.Transaction{}, ErrNotReversible
+	}
+
+	remaining := original.Amount.Abs()
+	for _, p := range previous {
+		var err error
+		if remaining, err = remaining.Sub(p.Amount.Abs()); err != nil {
+			return domain.Transaction{}, domain.Transaction{}, fmt.Errorf("reverse transaction %d: %w", original.ID, err)
+		}
+	}
+	if !remaining.IsPositive() {
+		return domain.Transaction{}, domain.Transaction{}, ErrAlreadyReversed
+	}
+
+	a := remaining
+	if amount != nil {
+		a = amount.Abs()
+		if a.IsZero() {
+			return domain.Transaction{}, domain.Transaction{}, ErrInvalidAmount
+		}
+		cmp, err := a.Cmp(remaining)
+		if err != nil {
+			return domain.Transaction{}, domain.Transaction{}, fmt.Errorf("reverse transaction %d: %w", original.ID, err)
+		}
+		if cmp > 0 {
+			return domain.Transaction{}, domain.Transaction{}, fmt.Errorf("%w: %s left", ErrReversalExceedsOriginal, remaining)
+		}
+	}
+
+	// open is the part of original the reversal can take back directly.
+	open := original.Balance.Abs()
+	cmp, err := open.Cmp(a)
+	if err != nil {
+		return domain.Transaction{}, domain.Transaction{}, fmt.Errorf("reverse transaction %d: %w", original.ID, err)
+	}
+	if cmp > 0 {
+		open = a
+	}
+	leftover, err := a.Sub(open)
+	if err != nil {
+		return domain.Transaction{}, domain.Transaction{}, fmt.Errorf("reverse transaction %d: %w", original.ID, err)
+	}
+
+	reversal := domain.Transaction{
+		AccountID:       original.AccountID,
+		OperationTypeID: op,
+		Amount:          a,
+		Balance:         leftover,
+	}
+	if original.Amount.IsNegative() {
+		original.Balance, err = original.Balance.Add(open)
+	} else {
+		original.Balance, err = original.Balance.Sub(open)
+		reversal.Amount, reversal.Balance = a.Neg(), leftover.Neg()
+	}
+	if err != nil {
+		return domain.Transaction{}, domain.Transaction{}, fmt.Errorf("reverse transaction %d: %w", original.ID, err)
+	}
+	return reversal, original, nil
+}
+
+// ReverseInstallments builds the transaction cancelling the installment
+// purchase parent. posted are its installments already taken from the
+// available balance, and the reversal gives back what they charged: the part
+// still open is taken back from them, which the second return value carries,
+// and the part already paid becomes the reversal's surplus credit. The
+// installments not yet posted are cancelled by the store, so a purchase is
+// only reversed in full and only once; amount must be nil.
+func ReverseInstallments(parent domain.Transaction, previous, posted []domain.Transaction, amount *domain.Money) (domain.Transaction, []domain.Transaction, error) {
+	op, ok := domain.ReversalOperation(parent.OperationTypeID, parent.Amount)
+	if !ok || parent.InstallmentCount == 0 {
+		return domain.Transaction{}, nil, ErrNotReversible
+	}
+	if len(previous) > 0 {
+		return domain.Transaction{}, nil, ErrAlreadyReversed
+	}
+	if amount != nil {
+		return domain.Transaction{}, nil, ErrPartialInstallmentReversal
+	}
+
+	charged := domain.NewMoney(0, parent.Amount.Currency())
+	paid := charged
+	settled := make([]domain.Transaction, len(posted))
+	for i, inst := range posted {
+		var err error
+		if charged, err = charged.Add(inst.Amount.Abs()); err != nil {
+			return domain.Transaction{}, nil, fmt.Errorf("reverse transaction %d: %w", parent.ID, err)
+		}
+		if paid, err = paid.Add(inst.Amount.Abs()); err != nil {
+			return domain.Transaction{}, nil, fmt.Errorf("reverse transaction %d: %w", parent.ID, err)
+		}
+		if paid, err = paid.Sub(inst.Balance.Abs()); err != nil {
+			return domain.Transaction{}, nil, fmt.Errorf("reverse transaction %d: %w", parent.ID, err)
+		}
+		inst.Balance = domain.NewMoney(0, inst.Balance.Currency())
+		settled[i] = inst
+	}
+	reversal := domain.Transaction{
+		AccountID:       parent.AccountID,
+		OperationTypeID: op,
+		Amount:          charged,
+		Balance:         paid,
+	}
+	return reversal, settled, nil
+}
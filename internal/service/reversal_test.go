@@ -0,0 +1,96 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverse_FullRefundOfOpenDebit(t *testing.T) {
+	original := domain.Transaction{ID: 1, AccountID: 7, OperationTypeID: domain.OpCashPurchase, Amount: brl("-50"), Balance: brl("-50")}
+	reversal, updated, err := Reverse(original, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.OpRefund, reversal.OperationTypeID)
+	assert.Equal(t, brl("50"), reversal.Amount)
+	assert.Equal(t, brl("0"), reversal.Balance)
+	assert.Equal(t, brl("0"), updated.Balance)
+}
+
+func TestReverse_RefundOfPaidDebitLeavesSurplus(t *testing.T) {
+	original := domain.Transaction{ID: 1, OperationTypeID: domain.OpCashPurchase, Amount: brl("-50"), Balance: brl("-20")}
+	amount := brl("30")
+	reversal, updated, err := Reverse(original, nil, &amount)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("30"), reversal.Amount)
+	assert.Equal(t, brl("10"), reversal.Balance)
+	assert.Equal(t, brl("0"), updated.Balance)
+}
+
+func TestReverse_PaymentBeyondSurplusOpensDebit(t *testing.T) {
+	original := domain.Transaction{ID: 1, OperationTypeID: domain.OpPayment, Amount: brl("60"), Balance: brl("15")}
+	reversal, updated, err := Reverse(original, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.OpPaymentReversal, reversal.OperationTypeID)
+	assert.Equal(t, brl("-60"), reversal.Amount)
+	assert.Equal(t, brl("-45"), reversal.Balance)
+	assert.Equal(t, brl("0"), updated.Balance)
+}
+
+func TestReverse_Limits(t *testing.T) {
+	original := domain.Transaction{ID: 1, OperationTypeID: domain.OpCashPurchase, Amount: brl("-50"), Balance: brl("-20")}
+	previous := []domain.Transaction{{OperationTypeID: domain.OpRefund, Amount: brl("30")}}
+
+	tooMuch := brl("20.01")
+	_, _, err := Reverse(original, previous, &tooMuch)
+	assert.ErrorIs(t, err, ErrReversalExceedsOriginal)
+
+	zero := brl("0")
+	_, _, err = Reverse(original, previous, &zero)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+
+	previous = append(previous, domain.Transaction{OperationTypeID: domain.OpRefund, Amount: brl("20")})
+	_, _, err = Reverse(original, previous, nil)
+	assert.ErrorIs(t, err, ErrAlreadyReversed)
+
+	id := int64(1)
+	_, _, err = Reverse(domain.Transaction{ID: 2, OperationTypeID: domain.OpRefund, Amount: brl("10"), ReversesTransactionID: &id}, nil, nil)
+	assert.ErrorIs(t, err, ErrNotReversible)
+}
+
+func TestReverse_InstallmentsGoThroughTheirPurchase(t *testing.T) {
+	parentID := int64(1)
+	parent := domain.Transaction{ID: 1, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-90"), Balance: brl("0"), InstallmentCount: 3}
+	_, _, err := Reverse(parent, nil, nil)
+	assert.ErrorIs(t, err, ErrNotReversible)
+
+	installment := domain.Transaction{ID: 2, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-30"), ParentTransactionID: &parentID, InstallmentNumber: 1}
+	_, _, err = Reverse(installment, nil, nil)
+	assert.ErrorIs(t, err, ErrInstallmentNotReversible)
+}
+
+func TestReverseInstallments(t *testing.T) {
+	parentID := int64(1)
+	parent := domain.Transaction{ID: 1, AccountID: 7, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-90"), Balance: brl("0"), InstallmentCount: 3}
+	// The first installment is paid in part, the second not at all.
+	posted := []domain.Transaction{
+		{ID: 2, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-10"), ParentTransactionID: &parentID, InstallmentNumber: 1},
+		{ID: 3, OperationTypeID: domain.OpInstallmentPurchase, Amount: brl("-30"), Balance: brl("-30"), ParentTransactionID: &parentID, InstallmentNumber: 2},
+	}
+	reversal, settled, err := ReverseInstallments(parent, nil, posted, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.OpRefund, reversal.OperationTypeID)
+	assert.Equal(t, brl("60"), reversal.Amount)
+	assert.Equal(t, brl("20"), reversal.Balance)
+	if assert.Len(t, settled, 2) {
+		assert.Equal(t, brl("0"), settled[0].Balance)
+		assert.Equal(t, brl("0"), settled[1].Balance)
+	}
+	assert.Equal(t, brl("-10"), posted[0].Balance, "posted must not be modified")
+
+	amount := brl("30")
+	_, _, err = ReverseInstallments(parent, nil, posted, &amount)
+	assert.ErrorIs(t, err, ErrPartialInstallmentReversal)
+	_, _, err = ReverseInstallments(parent, []domain.Transaction{reversal}, posted, nil)
+	assert.ErrorIs(t, err, ErrAlreadyReversed)
+}
@@ -1,80 +1,348 @@
 package service
 
 import (
+	"context"
 	"errors"
-	"math"
+	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/logger"
+	"github.com/animeshs34/transaction_routine/internal/metrics"
 	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+	"go.uber.org/zap"
 )
 
 var (
 	ErrInvalidDocument      = errors.New("invalid document_number")
 	ErrInvalidOperationType = errors.New("invalid operation_type_id")
 	ErrInvalidAmount        = errors.New("amount must be greater than zero")
+	ErrInvalidCreditLimit   = errors.New("credit_limit must not be negative")
+	ErrInvalidFilter        = errors.New("invalid filter")
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
 )
 
 type Repository = respository.Respository
 
 type Service struct {
-	repo Repository
+	repo               Repository
+	defaultCreditLimit domain.Money
+	documentValidators map[string]DocumentValidator
+	remainderFirst     bool
+	rates              ExchangeRateProvider
+	transactions       *metrics.CounterVec
+	velocity           atomic.Pointer[VelocityLimits]
+	features           atomic.Pointer[Features]
+}
+
+type Option func(*Service)
+
+// WithDefaultCreditLimit sets the credit limit given to accounts created
+// without an explicit one.
+func WithDefaultCreditLimit(limit domain.Money) Option {
+	return func(s *Service) {
+		s.defaultCreditLimit = limit
+	}
+}
+
+// WithDocumentValidator registers, or replaces, the validator used for
+// accounts opened with the given document_type.
+func WithDocumentValidator(documentType string, v DocumentValidator) Option {
+	return func(s *Service) {
+		s.documentValidators[strings.ToUpper(documentType)] = v
+	}
 }
 
-func New(repo Repository) *Service {
-	return &Service{repo: repo}
+// WithRemainderOnFirstInstallment puts the cents left over when splitting an
+// installment purchase on the first installment instead of the last.
+func WithRemainderOnFirstInstallment() Option {
+	return func(s *Service) {
+		s.remainderFirst = true
+	}
 }
 
-func (s *Service) CreateAccount(document string) (domain.Account, error) {
+// WithExchangeRates converts transactions made in a currency other than the
+// account's using p. Without it such transactions are rejected.
+func WithExchangeRates(p ExchangeRateProvider) Option {
+	return func(s *Service) {
+		s.rates = p
+	}
+}
+
+func New(repo Repository, opts ...Option) *Service {
+	s := &Service{
+		repo:               repo,
+		defaultCreditLimit: domain.NewMoney(0, domain.DefaultCurrency),
+		documentValidators: defaultDocumentValidators(),
+	}
+	s.SetFeatures(AllFeatures())
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// CreateAccount opens an account whose available balance starts at its credit
+// limit. The document is validated and normalised by the validator registered
+// for documentType; an empty documentType is inferred as CPF or CNPJ from the
+// number of digits. An empty currency is taken from creditLimit, or is
+// domain.DefaultCurrency. A nil creditLimit uses the service default,
+// converted into the account currency at the exchange rates.
+func (s *Service) CreateAccount(ctx context.Context, documentType, document, currency string, creditLimit *domain.Money) (_ domain.Account, err error) {
+	ctx, end := startSpan(ctx, "CreateAccount")
+	defer end(&err)
 	document = strings.TrimSpace(document)
 	if document == "" {
 		return domain.Account{}, ErrInvalidDocument
 	}
-	return s.repo.CreateAccount(document)
+	documentType = strings.ToUpper(strings.TrimSpace(documentType))
+	if documentType == "" {
+		if documentType, err = detectDocumentType(document); err != nil {
+			return domain.Account{}, err
+		}
+	}
+	validate, ok := s.documentValidators[documentType]
+	if !ok {
+		return domain.Account{}, fmt.Errorf("%w: %q", ErrUnsupportedDocumentType, documentType)
+	}
+	document, err = validate(document)
+	if err != nil {
+		return domain.Account{}, err
+	}
+
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		currency = domain.DefaultCurrency
+		if creditLimit != nil {
+			currency = creditLimit.Currency()
+		}
+	}
+	if !domain.ValidCurrency(currency) {
+		return domain.Account{}, fmt.Errorf("%w: %q", domain.ErrInvalidCurrency, currency)
+	}
+
+	var limit domain.Money
+	if creditLimit != nil {
+		limit = *creditLimit
+		if limit.Currency() != currency {
+			return domain.Account{}, fmt.Errorf("%w: credit_limit is in %s, account in %s", domain.ErrCurrencyMismatch, limit.Currency(), currency)
+		}
+	} else if s.defaultCreditLimit.IsZero() {
+		limit = domain.NewMoney(0, currency)
+	} else {
+		// The default is configured in one currency; accounts in another get
+		// its value at the current rate, or none at all without a rate.
+		limit, err = s.limitIn(ctx, s.defaultCreditLimit, currency, time.Now())
+		if err != nil {
+			return domain.Account{}, fmt.Errorf("default credit limit: %w", err)
+		}
+	}
+	if limit.IsNegative() {
+		return domain.Account{}, ErrInvalidCreditLimit
+	}
+	return s.repo.CreateAccount(ctx, domain.Account{DocumentType: documentType, DocumentNumber: document, Currency: currency, CreditLimit: limit})
+}
+
+func (s *Service) GetAccount(ctx context.Context, id int64) (_ domain.Account, err error) {
+	ctx, end := startSpan(ctx, "GetAccount", tracing.Int64("account.id", id))
+	defer end(&err)
+	return s.repo.GetAccount(ctx, id)
+}
+
+func (s *Service) GetTransaction(ctx context.Context, id int64) (_ domain.Transaction, err error) {
+	ctx, end := startSpan(ctx, "GetTransaction", tracing.Int64("transaction.id", id))
+	defer end(&err)
+	return s.repo.GetTransaction(ctx, id)
+}
+
+func (s *Service) ListOperationTypes(ctx context.Context) (_ []domain.OperationType, err error) {
+	ctx, end := startSpan(ctx, "ListOperationTypes")
+	defer end(&err)
+	return s.repo.ListOperationTypes(ctx)
 }
 
-func (s *Service) GetAccount(id int64) (domain.Account, error) {
-	return s.repo.GetAccount(id)
+// TransactionResult is a created transaction together with the debits a
+// payment settled or the schedule of an installment purchase, if any.
+type TransactionResult struct {
+	domain.Transaction
+	Settlements  []domain.Settlement  `json:"settlements,omitempty"`
+	Installments []domain.Transaction `json:"installments,omitempty"`
 }
 
-func (s *Service) CreateTransaction(accountID int64, operationTypeID int, amount float64, eventTime *time.Time) (domain.Transaction, error) {
-	if !s.repo.HasOperationType(operationTypeID) {
-		return domain.Transaction{}, ErrInvalidOperationType
+// activeOperationType returns the operation type id if clients may post it.
+// Unknown and deactivated types, and the reversal types, are
+// ErrInvalidOperationType.
+func (s *Service) activeOperationType(ctx context.Context, id int) (domain.OperationType, error) {
+	ot, err := s.repo.GetOperationType(ctx, id)
+	if err != nil {
+		if errors.Is(err, respository.ErrOperationTypeNotFound) {
+			return domain.OperationType{}, ErrInvalidOperationType
+		}
+		return domain.OperationType{}, err
 	}
-	a := math.Abs(amount)
-	if a <= 0 {
-		return domain.Transaction{}, ErrInvalidAmount
+	if !ot.Active || domain.IsReversalOperation(id) {
+		// Reversals need the transaction they compensate; see ReverseTransaction.
+		return domain.OperationType{}, ErrInvalidOperationType
 	}
+	return ot, nil
+}
 
-	if domain.IsDebitOperation(operationTypeID) {
-		a = -a
-	} else if domain.IsCreditOperation(operationTypeID) {
-		// positive, already correct value is here.
-	} else {
-		return domain.Transaction{}, ErrInvalidOperationType
+// CreateTransaction records a transaction of any active operation type. The
+// type's direction decides the sign of the amount and its rules are enforced
+// against the amount and event time. Amounts in another currency than the
+// account's are converted at the rate in force at the event time. Debits are
+// subject to the velocity limits; credits are discharged against the
+// account's open debits, oldest first.
+func (s *Service) CreateTransaction(ctx context.Context, accountID int64, operationTypeID int, amount domain.Money, eventTime *time.Time) (_ TransactionResult, err error) {
+	ctx, end := startSpan(ctx, "CreateTransaction", tracing.Int64("account.id", accountID), tracing.Int("operation_type.id", operationTypeID))
+	defer end(&err)
+	defer func() { s.countTransaction(operationTypeID, err) }()
+	ot, err := s.activeOperationType(ctx, operationTypeID)
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	if amount.IsZero() {
+		return TransactionResult{}, ErrInvalidAmount
 	}
 
 	var ts time.Time
 	if eventTime != nil && !eventTime.IsZero() {
 		ts = eventTime.UTC()
 	}
+	at := ts
+	if at.IsZero() {
+		at = time.Now()
+	}
+	conv, err := s.toAccountCurrency(ctx, accountID, amount, at)
+	if err != nil {
+		return TransactionResult{}, err
+	}
+	if err := s.checkOperationType(ctx, ot, conv.amount, at); err != nil {
+		return TransactionResult{}, err
+	}
+	a, err := ot.Signed(conv.amount)
+	if err != nil {
+		return TransactionResult{}, fmt.Errorf("%w: %v", ErrInvalidOperationType, err)
+	}
+	credit := a.IsPositive()
 
 	tx := domain.Transaction{
 		AccountID:       accountID,
 		OperationTypeID: operationTypeID,
 		Amount:          a,
+		Balance:         a,
 		EventDate:       ts,
 	}
-	created, err := s.repo.CreateTransaction(tx)
+	conv.apply(&tx)
+
+	var (
+		created     domain.Transaction
+		settlements []domain.Settlement
+	)
+	if credit {
+		created, err = s.repo.CreatePayment(ctx, tx, func(payment domain.Transaction, open []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+			var settled []domain.Transaction
+			var err error
+			payment, settled, settlements, err = Discharge(payment, open)
+			return payment, settled, err
+		})
+	} else {
+		var velocity *respository.VelocityCheck
+		if velocity, err = s.velocityCheck(ctx, a.Currency()); err != nil {
+			return TransactionResult{}, err
+		}
+		created, err = s.repo.CreateTransaction(ctx, tx, velocity)
+	}
 	if err != nil {
 		if errors.Is(err, respository.ErrAccountNotFound) {
-			return domain.Transaction{}, respository.ErrAccountNotFound
+			return TransactionResult{}, respository.ErrAccountNotFound
 		}
 		if errors.Is(err, respository.ErrOperationTypeNotFound) {
-			return domain.Transaction{}, ErrInvalidOperationType
+			return TransactionResult{}, ErrInvalidOperationType
 		}
+		return TransactionResult{}, err
+	}
+	logger.FromContext(ctx).Debug("Transaction created",
+		zap.Int64("transaction_id", created.ID),
+		zap.Int64("account_id", accountID),
+		zap.Int("operation_type_id", operationTypeID),
+		zap.Int("settlements", len(settlements)))
+	return TransactionResult{Transaction: created, Settlements: settlements}, nil
+}
+
+// ReverseTransaction records a refund or payment reversal of the transaction
+// id. A nil amount reverses everything not yet reversed. An installment
+// purchase is reversed in full, cancelling the installments not yet due.
+func (s *Service) ReverseTransaction(ctx context.Context, id int64, amount *domain.Money, eventTime *time.Time) (_ domain.Transaction, err error) {
+	ctx, end := startSpan(ctx, "ReverseTransaction", tracing.Int64("transaction.id", id))
+	defer end(&err)
+	var op int
+	defer func() { s.countTransaction(op, err) }()
+	if err := requireFeature(s.features.Load().Reversals, "reversals"); err != nil {
 		return domain.Transaction{}, err
 	}
-	return created, nil
+	return s.repo.CreateReversal(ctx, id, func(original domain.Transaction, previous, posted []domain.Transaction) (domain.Transaction, []domain.Transaction, error) {
+		op, _ = domain.ReversalOperation(original.OperationTypeID, original.Amount)
+		var (
+			reversal domain.Transaction
+			changed  []domain.Transaction
+			err      error
+		)
+		if original.InstallmentCount > 0 {
+			reversal, changed, err = ReverseInstallments(original, previous, posted, amount)
+		} else {
+			reversal, original, err = Reverse(original, previous, amount)
+			changed = []domain.Transaction{original}
+		}
+		if err != nil {
+			return domain.Transaction{}, nil, err
+		}
+		if eventTime != nil && !eventTime.IsZero() {
+			reversal.EventDate = eventTime.UTC()
+		}
+		return reversal, changed, nil
+	})
+}
+
+// ListTransactions returns one page of transactions matching f. A zero limit
+// means DefaultPageSize; larger limits are capped at MaxPageSize.
+func (s *Service) ListTransactions(ctx context.Context, f respository.TransactionFilter) (_ respository.TransactionPage, err error) {
+	ctx, end := startSpan(ctx, "ListTransactions")
+	defer end(&err)
+	switch {
+	case f.Limit < 0:
+		return respository.TransactionPage{}, fmt.Errorf("%w: limit must not be negative", ErrInvalidFilter)
+	case f.Limit == 0:
+		f.Limit = DefaultPageSize
+	case f.Limit > MaxPageSize:
+		f.Limit = MaxPageSize
+	}
+	if f.MinAmount != nil && f.MaxAmount != nil {
+		if c, err := f.MinAmount.Cmp(*f.MaxAmount); err != nil || c > 0 {
+			return respository.TransactionPage{}, fmt.Errorf("%w: min_amount is greater than max_amount", ErrInvalidFilter)
+		}
+	}
+	if f.From != nil && f.To != nil && !f.From.Before(*f.To) {
+		return respository.TransactionPage{}, fmt.Errorf("%w: from must be before to", ErrInvalidFilter)
+	}
+	return s.repo.ListTransactions(ctx, f)
+}
+
+// ListAccountTransactions is ListTransactions restricted to one account; it
+// fails with respository.ErrAccountNotFound for unknown accounts.
+func (s *Service) ListAccountTransactions(ctx context.Context, accountID int64, f respository.TransactionFilter) (_ respository.TransactionPage, err error) {
+	ctx, end := startSpan(ctx, "ListAccountTransactions")
+	defer end(&err)
+	if _, err := s.repo.GetAccount(ctx, accountID); err != nil {
+		return respository.TransactionPage{}, err
+	}
+	f.AccountID = &accountID
+	return s.ListTransactions(ctx, f)
 }
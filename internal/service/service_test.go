@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,141 +12,488 @@ import (
 	"github.com/stretchr/testify/mock"
 )
 
+func brl(s string) domain.Money {
+	return domain.MustParseMoney(s, domain.DefaultCurrency)
+}
+
 type mockRepo struct {
 	mock.Mock
 }
 
-func (m *mockRepo) CreateAccount(document string) (domain.Account, error) {
-	args := m.Called(document)
+func (m *mockRepo) CreateAccount(ctx context.Context, acc domain.Account) (domain.Account, error) {
+	args := m.Called(acc)
 	return args.Get(0).(domain.Account), args.Error(1)
 }
-func (m *mockRepo) GetAccount(id int64) (domain.Account, error) {
+func (m *mockRepo) GetAccount(ctx context.Context, id int64) (domain.Account, error) {
 	args := m.Called(id)
 	return args.Get(0).(domain.Account), args.Error(1)
 }
-func (m *mockRepo) HasOperationType(id int) bool {
+
+// ChangeAccountStatus is stubbed with the account to hand to change.
+func (m *mockRepo) ChangeAccountStatus(ctx context.Context, id int64, change respository.StatusChangeFunc) (domain.Account, error) {
+	args := m.Called(id)
+	if err := args.Error(1); err != nil {
+		return domain.Account{}, err
+	}
+	acc := args.Get(0).(domain.Account)
+	c, err := change(acc)
+	if err != nil {
+		return domain.Account{}, err
+	}
+	acc.Status = c.To
+	return acc, nil
+}
+func (m *mockRepo) ListAccountStatusChanges(ctx context.Context, accountID int64) ([]domain.AccountStatusChange, error) {
+	args := m.Called(accountID)
+	return args.Get(0).([]domain.AccountStatusChange), args.Error(1)
+}
+func (m *mockRepo) GetOperationType(ctx context.Context, id int) (domain.OperationType, error) {
 	args := m.Called(id)
-	return args.Bool(0)
+	return args.Get(0).(domain.OperationType), args.Error(1)
+}
+func (m *mockRepo) CreateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error) {
+	args := m.Called(ot)
+	return args.Get(0).(domain.OperationType), args.Error(1)
+}
+func (m *mockRepo) UpdateOperationType(ctx context.Context, ot domain.OperationType) (domain.OperationType, error) {
+	args := m.Called(ot)
+	return args.Get(0).(domain.OperationType), args.Error(1)
 }
-func (m *mockRepo) CreateTransaction(tx domain.Transaction) (domain.Transaction, error) {
+
+// builtin returns the built-in operation type id, as the stores seed it.
+func builtin(id int) domain.OperationType {
+	for _, ot := range domain.BuiltinOperationTypes {
+		if ot.ID == id {
+			return ot
+		}
+	}
+	panic("no built-in operation type")
+}
+func (m *mockRepo) CreateTransaction(ctx context.Context, tx domain.Transaction, velocity *respository.VelocityCheck) (domain.Transaction, error) {
 	args := m.Called(tx)
 	return args.Get(0).(domain.Transaction), args.Error(1)
 }
 
+// CreatePayment is stubbed with the open debits to hand to discharge.
+func (m *mockRepo) CreatePayment(ctx context.Context, tx domain.Transaction, discharge respository.DischargeFunc) (domain.Transaction, error) {
+	args := m.Called(tx)
+	if err := args.Error(1); err != nil {
+		return domain.Transaction{}, err
+	}
+	payment, _, err := discharge(tx, args.Get(0).([]domain.Transaction))
+	return payment, err
+}
+
+// CreateReversal is stubbed with the original, its previous reversals and
+// its posted installments.
+func (m *mockRepo) CreateReversal(ctx context.Context, originalID int64, reverse respository.ReversalFunc) (domain.Transaction, error) {
+	args := m.Called(originalID)
+	if err := args.Error(3); err != nil {
+		return domain.Transaction{}, err
+	}
+	reversal, _, err := reverse(args.Get(0).(domain.Transaction), args.Get(1).([]domain.Transaction), args.Get(2).([]domain.Transaction))
+	return reversal, err
+}
+
+// CreateInstallmentPurchase is stubbed with the stored parent; installments
+// are echoed back with ids following it.
+func (m *mockRepo) CreateInstallmentPurchase(ctx context.Context, parent domain.Transaction, installments []domain.Transaction, velocity *respository.VelocityCheck) (domain.Transaction, []domain.Transaction, error) {
+	args := m.Called(parent, len(installments))
+	if err := args.Error(1); err != nil {
+		return domain.Transaction{}, nil, err
+	}
+	created := args.Get(0).(domain.Transaction)
+	for i := range installments {
+		installments[i].ID = created.ID + int64(i) + 1
+		installments[i].AccountID = created.AccountID
+		installments[i].ParentTransactionID = &created.ID
+	}
+	return created, installments, nil
+}
+
+func (m *mockRepo) ListTransactions(ctx context.Context, f respository.TransactionFilter) (respository.TransactionPage, error) {
+	args := m.Called(f)
+	return args.Get(0).(respository.TransactionPage), args.Error(1)
+}
+
+func (m *mockRepo) GetTransaction(ctx context.Context, id int64) (domain.Transaction, error) {
+	args := m.Called(id)
+	return args.Get(0).(domain.Transaction), args.Error(1)
+}
+
+func (m *mockRepo) ListOperationTypes(ctx context.Context) ([]domain.OperationType, error) {
+	args := m.Called()
+	return args.Get(0).([]domain.OperationType), args.Error(1)
+}
+
 func TestCreateAccount_Valid(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	doc := "12345"
-	acc := domain.Account{ID: 1, DocumentNumber: doc}
-	repo.On("CreateAccount", doc).Return(acc, nil)
-	result, err := svc.CreateAccount(doc)
+	acc := domain.Account{ID: 1, DocumentType: DocumentCPF, DocumentNumber: "52998224725"}
+	repo.On("CreateAccount", domain.Account{DocumentType: DocumentCPF, DocumentNumber: "52998224725", Currency: "BRL", CreditLimit: brl("0")}).Return(acc, nil)
+	result, err := svc.CreateAccount(ctx, "", "529.982.247-25", "", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, acc, result)
 }
 
+func TestCreateAccount_CreditLimit(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo, WithDefaultCreditLimit(brl("1000")))
+	repo.On("CreateAccount", domain.Account{DocumentType: DocumentCPF, DocumentNumber: "52998224725", Currency: "BRL", CreditLimit: brl("1000")}).Return(domain.Account{ID: 1}, nil)
+	repo.On("CreateAccount", domain.Account{DocumentType: DocumentCPF, DocumentNumber: "11144477735", Currency: "BRL", CreditLimit: brl("250")}).Return(domain.Account{ID: 2}, nil)
+
+	_, err := svc.CreateAccount(ctx, "", "52998224725", "", nil)
+	assert.NoError(t, err)
+	limit := brl("250")
+	_, err = svc.CreateAccount(ctx, "", "11144477735", "", &limit)
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+
+	negative := brl("-1")
+	_, err = svc.CreateAccount(ctx, "", "12345678909", "", &negative)
+	assert.ErrorIs(t, err, ErrInvalidCreditLimit)
+}
+
+func TestCreateAccount_Currency(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	table, err := NewRateTable([]ExchangeRate{{From: "BRL", To: "USD", Rate: domain.MustParseRate("0.2")}})
+	assert.NoError(t, err)
+	svc := New(repo, WithDefaultCreditLimit(brl("1000")), WithExchangeRates(table))
+	repo.On("CreateAccount", domain.Account{DocumentType: DocumentCPF, DocumentNumber: "52998224725", Currency: "USD", CreditLimit: domain.MustParseMoney("200", "USD")}).Return(domain.Account{ID: 1}, nil)
+	repo.On("CreateAccount", domain.Account{DocumentType: DocumentCPF, DocumentNumber: "11144477735", Currency: "JPY", CreditLimit: domain.MustParseMoney("500", "JPY")}).Return(domain.Account{ID: 2}, nil)
+
+	// The default is converted into the account currency.
+	_, err = svc.CreateAccount(ctx, "", "52998224725", "usd", nil)
+	assert.NoError(t, err)
+	// Without a currency the account takes the one of its credit limit.
+	limit := domain.MustParseMoney("500", "JPY")
+	_, err = svc.CreateAccount(ctx, "", "11144477735", "", &limit)
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+
+	_, err = svc.CreateAccount(ctx, "", "12345678909", "EUR", &limit)
+	assert.ErrorIs(t, err, domain.ErrCurrencyMismatch)
+	_, err = svc.CreateAccount(ctx, "", "12345678909", "EURO", nil)
+	assert.ErrorIs(t, err, domain.ErrInvalidCurrency)
+
+	// A default that cannot be converted is not given at all.
+	_, err = svc.CreateAccount(ctx, "", "12345678909", "JPY", nil)
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+
+	// A zero default needs no rate.
+	repo = new(mockRepo)
+	svc = New(repo)
+	repo.On("CreateAccount", domain.Account{DocumentType: DocumentCPF, DocumentNumber: "52998224725", Currency: "JPY", CreditLimit: domain.NewMoney(0, "JPY")}).Return(domain.Account{ID: 3}, nil)
+	_, err = svc.CreateAccount(ctx, "", "52998224725", "JPY", nil)
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+}
+
 func TestCreateAccount_Invalid(t *testing.T) {
+	ctx := context.Background()
 	svc := New(new(mockRepo))
-	_, err := svc.CreateAccount("")
+	_, err := svc.CreateAccount(ctx, "", "", "", nil)
 	assert.ErrorIs(t, err, ErrInvalidDocument)
 }
 
 func TestCreateAccount_Whitespace(t *testing.T) {
+	ctx := context.Background()
 	svc := New(new(mockRepo))
-	_, err := svc.CreateAccount("   ")
+	_, err := svc.CreateAccount(ctx, "", "   ", "", nil)
+	assert.ErrorIs(t, err, ErrInvalidDocument)
+}
+
+func TestCreateAccount_DocumentValidation(t *testing.T) {
+	ctx := context.Background()
+	svc := New(new(mockRepo))
+	for _, doc := range []string{"abc", "12345", "52998224724", "11111111111", "11.222.333/0001-80"} {
+		_, err := svc.CreateAccount(ctx, "", doc, "", nil)
+		assert.ErrorIs(t, err, ErrInvalidDocument, doc)
+	}
+	_, err := svc.CreateAccount(ctx, "CNPJ", "52998224725", "", nil)
+	assert.ErrorIs(t, err, ErrInvalidDocument)
+	_, err = svc.CreateAccount(ctx, "passport", "X1234567", "", nil)
+	assert.ErrorIs(t, err, ErrUnsupportedDocumentType)
+}
+
+func TestCreateAccount_CustomDocumentValidator(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	passport := func(doc string) (string, error) { return strings.ToUpper(doc), nil }
+	svc := New(repo, WithDocumentValidator("passport", passport))
+	repo.On("CreateAccount", domain.Account{DocumentType: "PASSPORT", DocumentNumber: "X1234567", Currency: "BRL", CreditLimit: brl("0")}).Return(domain.Account{ID: 1}, nil)
+	_, err := svc.CreateAccount(ctx, "Passport", "x1234567", "", nil)
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+}
+
+func TestValidateCNPJ(t *testing.T) {
+	got, err := ValidateCNPJ("11.222.333/0001-81")
+	assert.NoError(t, err)
+	assert.Equal(t, "11222333000181", got)
+	_, err = ValidateCNPJ("11222333000182")
 	assert.ErrorIs(t, err, ErrInvalidDocument)
 }
 
 func TestGetAccount(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
 	acc := domain.Account{ID: 1, DocumentNumber: "doc"}
 	repo.On("GetAccount", int64(1)).Return(acc, nil)
-	result, err := svc.GetAccount(1)
+	result, err := svc.GetAccount(ctx, 1)
 	assert.NoError(t, err)
 	assert.Equal(t, acc, result)
 }
 
 func TestCreateTransaction_InvalidOperationType(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 99).Return(false)
-	_, err := svc.CreateTransaction(1, 99, 100, nil)
+	repo.On("GetOperationType", 99).Return(domain.OperationType{}, respository.ErrOperationTypeNotFound)
+	_, err := svc.CreateTransaction(ctx, 1, 99, brl("100"), nil)
 	assert.ErrorIs(t, err, ErrInvalidOperationType)
 }
 
 func TestCreateTransaction_InvalidAmount(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 1).Return(true)
-	_, err := svc.CreateTransaction(1, 1, 0, nil)
+	repo.On("GetOperationType", 1).Return(builtin(1), nil)
+	_, err := svc.CreateTransaction(ctx, 1, 1, brl("0"), nil)
 	assert.ErrorIs(t, err, ErrInvalidAmount)
 }
 
 func TestCreateTransaction_Success(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 1).Return(true)
+	repo.On("GetOperationType", 1).Return(builtin(1), nil)
 	timeNow := time.Now()
-	tx := domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: -100, EventDate: timeNow.UTC()}
-	repo.On("CreateTransaction", mock.AnythingOfType("domain.Transaction")).Return(tx, nil)
-	result, err := svc.CreateTransaction(1, 1, 100, &timeNow)
+	tx := domain.Transaction{AccountID: 1, OperationTypeID: 1, Amount: brl("-100"), EventDate: timeNow.UTC()}
+	repo.On("CreateTransaction", mock.MatchedBy(func(in domain.Transaction) bool {
+		return in.Amount == brl("-100")
+	})).Return(tx, nil)
+	result, err := svc.CreateTransaction(ctx, 1, 1, brl("100"), &timeNow)
 	assert.NoError(t, err)
 	assert.Equal(t, tx.AccountID, result.AccountID)
 	assert.Equal(t, tx.Amount, result.Amount)
 }
 
 func TestCreateTransaction_UnknownError(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 1).Return(true)
+	repo.On("GetOperationType", 1).Return(builtin(1), nil)
 	timeNow := time.Now()
 	repo.On("CreateTransaction", mock.AnythingOfType("domain.Transaction")).Return(domain.Transaction{}, assert.AnError)
-	result, err := svc.CreateTransaction(1, 1, 100, &timeNow)
+	result, err := svc.CreateTransaction(ctx, 1, 1, brl("100"), &timeNow)
 	assert.ErrorIs(t, err, assert.AnError)
-	assert.Equal(t, domain.Transaction{}, result)
+	assert.Equal(t, TransactionResult{}, result)
 }
 
 func TestCreateTransaction_AccountNotFound(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 1).Return(true)
+	repo.On("GetOperationType", 1).Return(builtin(1), nil)
 	timeNow := time.Now()
 	repo.On("CreateTransaction", mock.AnythingOfType("domain.Transaction")).Return(domain.Transaction{}, respository.ErrAccountNotFound)
-	result, err := svc.CreateTransaction(1, 1, 100, &timeNow)
+	result, err := svc.CreateTransaction(ctx, 1, 1, brl("100"), &timeNow)
 	assert.ErrorIs(t, err, respository.ErrAccountNotFound)
-	assert.Equal(t, domain.Transaction{}, result)
+	assert.Equal(t, TransactionResult{}, result)
+}
+
+func TestCreateTransaction_InsufficientBalance(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	repo.On("GetOperationType", domain.OpWithdrawal).Return(builtin(domain.OpWithdrawal), nil)
+	repo.On("CreateTransaction", mock.AnythingOfType("domain.Transaction")).Return(domain.Transaction{}, domain.ErrInsufficientBalance)
+	_, err := svc.CreateTransaction(ctx, 1, domain.OpWithdrawal, brl("100"), nil)
+	assert.ErrorIs(t, err, domain.ErrInsufficientBalance)
 }
 
 func TestCreateTransaction_OperationTypeNotFound(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 1).Return(true)
+	repo.On("GetOperationType", 1).Return(builtin(1), nil)
 	timeNow := time.Now()
 	repo.On("CreateTransaction", mock.AnythingOfType("domain.Transaction")).Return(domain.Transaction{}, respository.ErrOperationTypeNotFound)
-	result, err := svc.CreateTransaction(1, 1, 100, &timeNow)
+	result, err := svc.CreateTransaction(ctx, 1, 1, brl("100"), &timeNow)
 	assert.ErrorIs(t, err, ErrInvalidOperationType)
-	assert.Equal(t, domain.Transaction{}, result)
+	assert.Equal(t, TransactionResult{}, result)
 }
 
 func TestCreateTransaction_NeitherDebitNorCredit(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", 5).Return(true)
-	// Patch domain.IsDebitOperation and IsCreditOperation to false
-	result, err := svc.CreateTransaction(1, 5, 100, nil)
+	// A type stored without a direction cannot be posted.
+	repo.On("GetOperationType", 7).Return(domain.OperationType{ID: 7, Description: "BROKEN", Active: true}, nil)
+	result, err := svc.CreateTransaction(ctx, 1, 7, brl("100"), nil)
 	assert.ErrorIs(t, err, ErrInvalidOperationType)
-	assert.Equal(t, domain.Transaction{}, result)
+	assert.Equal(t, TransactionResult{}, result)
 }
 
 func TestCreateTransaction_CreditOperation(t *testing.T) {
+	ctx := context.Background()
 	repo := new(mockRepo)
 	svc := New(repo)
-	repo.On("HasOperationType", domain.OpPayment).Return(true)
+	repo.On("GetOperationType", domain.OpPayment).Return(builtin(domain.OpPayment), nil)
 	timeNow := time.Now()
-	tx := domain.Transaction{AccountID: 1, OperationTypeID: domain.OpPayment, Amount: 100, EventDate: timeNow.UTC()}
-	repo.On("CreateTransaction", mock.AnythingOfType("domain.Transaction")).Return(tx, nil)
-	result, err := svc.CreateTransaction(1, domain.OpPayment, 100, &timeNow)
+	open := []domain.Transaction{
+		{ID: 1, AccountID: 1, Amount: brl("-50"), Balance: brl("-50")},
+		{ID: 2, AccountID: 1, Amount: brl("-23.5"), Balance: brl("-23.5")},
+		{ID: 3, AccountID: 1, Amount: brl("-18.7"), Balance: brl("-18.7")},
+	}
+	repo.On("CreatePayment", mock.MatchedBy(func(in domain.Transaction) bool {
+		return in.Amount == brl("60") && in.Balance == brl("60")
+	})).Return(open, nil)
+	result, err := svc.CreateTransaction(ctx, 1, domain.OpPayment, brl("60"), &timeNow)
 	assert.NoError(t, err)
-	assert.Equal(t, tx.AccountID, result.AccountID)
-	assert.Equal(t, tx.Amount, result.Amount)
+	assert.Equal(t, int64(1), result.AccountID)
+	assert.Equal(t, brl("60"), result.Amount)
+	assert.Equal(t, brl("0"), result.Balance)
+	assert.Equal(t, []domain.Settlement{
+		{TransactionID: 1, Amount: brl("50")},
+		{TransactionID: 2, Amount: brl("10")},
+	}, result.Settlements)
+}
+
+func TestCreateTransaction_CreditOperationError(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	repo.On("GetOperationType", domain.OpPayment).Return(builtin(domain.OpPayment), nil)
+	repo.On("CreatePayment", mock.AnythingOfType("domain.Transaction")).Return(nil, respository.ErrAccountNotFound)
+	_, err := svc.CreateTransaction(ctx, 1, domain.OpPayment, brl("60"), nil)
+	assert.ErrorIs(t, err, respository.ErrAccountNotFound)
+}
+
+func TestListTransactions_Limits(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	repo.On("ListTransactions", respository.TransactionFilter{Limit: DefaultPageSize}).Return(respository.TransactionPage{}, nil)
+	repo.On("ListTransactions", respository.TransactionFilter{Limit: MaxPageSize}).Return(respository.TransactionPage{}, nil)
+
+	_, err := svc.ListTransactions(ctx, respository.TransactionFilter{})
+	assert.NoError(t, err)
+	_, err = svc.ListTransactions(ctx, respository.TransactionFilter{Limit: 10000})
+	assert.NoError(t, err)
+	repo.AssertExpectations(t)
+
+	_, err = svc.ListTransactions(ctx, respository.TransactionFilter{Limit: -1})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+}
+
+func TestListTransactions_InvalidRanges(t *testing.T) {
+	ctx := context.Background()
+	svc := New(new(mockRepo))
+	min, max := brl("10"), brl("5")
+	_, err := svc.ListTransactions(ctx, respository.TransactionFilter{MinAmount: &min, MaxAmount: &max})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	from := time.Now()
+	to := from.Add(-time.Hour)
+	_, err = svc.ListTransactions(ctx, respository.TransactionFilter{From: &from, To: &to})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+}
+
+func TestListAccountTransactions(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	accountID := int64(7)
+	repo.On("GetAccount", int64(7)).Return(domain.Account{ID: 7}, nil)
+	repo.On("GetAccount", int64(8)).Return(domain.Account{}, respository.ErrAccountNotFound)
+	page := respository.TransactionPage{Transactions: []domain.Transaction{{ID: 1, AccountID: 7}}}
+	repo.On("ListTransactions", respository.TransactionFilter{AccountID: &accountID, Limit: DefaultPageSize}).Return(page, nil)
+
+	got, err := svc.ListAccountTransactions(ctx, 7, respository.TransactionFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, page, got)
+
+	_, err = svc.ListAccountTransactions(ctx, 8, respository.TransactionFilter{})
+	assert.ErrorIs(t, err, respository.ErrAccountNotFound)
+}
+
+func TestGetTransaction(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	tx := domain.Transaction{ID: 3, AccountID: 1}
+	repo.On("GetTransaction", int64(3)).Return(tx, nil)
+	repo.On("GetTransaction", int64(4)).Return(domain.Transaction{}, respository.ErrTransactionNotFound)
+
+	result, err := svc.GetTransaction(ctx, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, tx, result)
+	_, err = svc.GetTransaction(ctx, 4)
+	assert.ErrorIs(t, err, respository.ErrTransactionNotFound)
+}
+
+func TestCreateTransaction_CancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	repo := new(mockRepo)
+	svc := New(repo)
+	repo.On("GetOperationType", 1).Return(domain.OperationType{}, context.Canceled)
+	_, err := svc.CreateTransaction(ctx, 1, 1, brl("100"), nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCreateTransaction_RejectsReversalOperations(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	repo.On("GetOperationType", domain.OpRefund).Return(builtin(domain.OpRefund), nil)
+	_, err := svc.CreateTransaction(ctx, 1, domain.OpRefund, brl("10"), nil)
+	assert.ErrorIs(t, err, ErrInvalidOperationType)
+}
+
+func TestReverseTransaction(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	original := domain.Transaction{ID: 1, AccountID: 1, OperationTypeID: domain.OpCashPurchase, Amount: brl("-50"), Balance: brl("-50")}
+	repo.On("CreateReversal", int64(1)).Return(original, []domain.Transaction(nil), []domain.Transaction(nil), nil)
+
+	when := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	amount := brl("20")
+	got, err := svc.ReverseTransaction(ctx, 1, &amount, &when)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.OpRefund, got.OperationTypeID)
+	assert.Equal(t, brl("20"), got.Amount)
+	assert.Equal(t, when, got.EventDate)
+}
+
+func TestCreateTransaction_OperationTypeRules(t *testing.T) {
+	ctx := context.Background()
+	repo := new(mockRepo)
+	svc := New(repo)
+	max := brl("50")
+	repo.On("GetOperationType", 100).Return(domain.OperationType{ID: 100, Description: "FEE", Direction: domain.DirectionDebit, MaxAmount: &max, Active: true}, nil)
+	repo.On("GetOperationType", 101).Return(domain.OperationType{ID: 101, Description: "CASHBACK", Direction: domain.DirectionCredit, Active: false}, nil)
+	repo.On("GetOperationType", 102).Return(domain.OperationType{ID: 102, Description: "NIGHT", Direction: domain.DirectionDebit, AllowedHours: &domain.HourWindow{From: 22, To: 6}, Active: true}, nil)
+
+	_, err := svc.CreateTransaction(ctx, 1, 100, brl("60"), nil)
+	assert.ErrorIs(t, err, domain.ErrAmountOutOfRange)
+	_, err = svc.CreateTransaction(ctx, 1, 101, brl("10"), nil)
+	assert.ErrorIs(t, err, ErrInvalidOperationType)
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	_, err = svc.CreateTransaction(ctx, 1, 102, brl("10"), &noon)
+	assert.ErrorIs(t, err, domain.ErrOutsideAllowedHours)
+
+	repo.On("CreateTransaction", mock.MatchedBy(func(in domain.Transaction) bool {
+		return in.OperationTypeID == 100 && in.Amount == brl("-50")
+	})).Return(domain.Transaction{ID: 1, OperationTypeID: 100, Amount: brl("-50")}, nil)
+	res, err := svc.CreateTransaction(ctx, 1, 100, brl("50"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, brl("-50"), res.Amount)
 }
@@ -0,0 +1,18 @@
+package service
+
+import (
+	"context"
+
+	"github.com/animeshs34/transaction_routine/internal/tracing"
+)
+
+// startSpan starts the span of the Service method name. The returned func
+// ends it, recording the error the method returns; pass it the address of
+// the named result so a deferred call sees the final value.
+func startSpan(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, func(*error)) {
+	ctx, span := tracing.Start(ctx, "Service."+name, tracing.SpanKindInternal, attrs...)
+	return ctx, func(err *error) {
+		span.RecordError(*err)
+		span.End()
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+)
+
+var ErrVelocityLimitExceeded = errors.New("velocity limit exceeded")
+
+// VelocityLimits caps the debits an account may make over a rolling window.
+// Purchases, withdrawals and installment purchases count; payments and
+// reversals do not. A zero MaxDebits or MaxAmount is not enforced.
+type VelocityLimits struct {
+	Window    time.Duration
+	MaxDebits int
+	// MaxAmount is the most an account may spend in Window. Accounts in
+	// another currency get its value at the current exchange rate; without a
+	// rate for their currency their debits are refused with
+	// ErrRateUnavailable.
+	MaxAmount domain.Money
+}
+
+// WithVelocityLimits refuses debits that would take an account over l with
+// ErrVelocityLimitExceeded.
+func WithVelocityLimits(l VelocityLimits) Option {
+	return func(s *Service) {
+		s.SetVelocityLimits(l)
+	}
+}
+
+// SetVelocityLimits replaces the velocity limits; limits without a window or
+// without a maximum turn them off. Transactions already being created keep
+// the limits they started with.
+func (s *Service) SetVelocityLimits(l VelocityLimits) {
+	if l.Window > 0 && (l.MaxDebits > 0 || l.MaxAmount.IsPositive()) {
+		s.velocity.Store(&l)
+	} else {
+		s.velocity.Store(nil)
+	}
+}
+
+// velocityCheck returns the check the store applies to debits in currency,
+// or nil.
+func (s *Service) velocityCheck(ctx context.Context, currency string) (*respository.VelocityCheck, error) {
+	current := s.velocity.Load()
+	if current == nil {
+		return nil, nil
+	}
+	l := *current
+	if l.MaxAmount.IsPositive() {
+		limit, err := s.limitIn(ctx, l.MaxAmount, currency, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("velocity max amount: %w", err)
+		}
+		l.MaxAmount = limit
+	}
+	return &respository.VelocityCheck{
+		Window: l.Window,
+		Check: func(recent respository.DebitActivity, t domain.Transaction) error {
+			if l.MaxDebits > 0 && recent.Count+1 > l.MaxDebits {
+				return fmt.Errorf("%w: at most %d debits per %s", ErrVelocityLimitExceeded, l.MaxDebits, l.Window)
+			}
+			if !l.MaxAmount.IsPositive() {
+				return nil
+			}
+			total, err := recent.Total.Add(t.Amount.Abs())
+			if err != nil {
+				return err
+			}
+			c, err := total.Cmp(l.MaxAmount)
+			if err != nil {
+				return err
+			}
+			if c > 0 {
+				return fmt.Errorf("%w: at most %s %s per %s", ErrVelocityLimitExceeded, l.MaxAmount, l.MaxAmount.Currency(), l.Window)
+			}
+			return nil
+		},
+	}, nil
+}
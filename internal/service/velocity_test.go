@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/animeshs34/transaction_routine/internal/domain"
+	"github.com/animeshs34/transaction_routine/internal/respository"
+	"github.com/stretchr/testify/assert"
+)
+
+// velocityCheck returns the check svc applies to debits in currency.
+func velocityCheck(t *testing.T, svc *Service, currency string) *respository.VelocityCheck {
+	t.Helper()
+	v, err := svc.velocityCheck(context.Background(), currency)
+	assert.NoError(t, err)
+	return v
+}
+
+func TestVelocityLimits(t *testing.T) {
+	assert.Nil(t, velocityCheck(t, New(new(mockRepo)), "BRL"))
+	assert.Nil(t, velocityCheck(t, New(new(mockRepo), WithVelocityLimits(VelocityLimits{MaxDebits: 3})), "BRL"), "a limit without a window is off")
+
+	svc := New(new(mockRepo), WithVelocityLimits(VelocityLimits{Window: time.Hour, MaxDebits: 3, MaxAmount: brl("100")}))
+	v := velocityCheck(t, svc, "BRL")
+	assert.Equal(t, time.Hour, v.Window)
+	debit := func(amount string) domain.Transaction { return domain.Transaction{Amount: brl(amount).Neg()} }
+	recent := func(count int, total string) respository.DebitActivity {
+		return respository.DebitActivity{Count: count, Total: brl(total)}
+	}
+
+	assert.NoError(t, v.Check(recent(0, "0"), debit("100")))
+	assert.NoError(t, v.Check(recent(2, "60"), debit("40")))
+	assert.ErrorIs(t, v.Check(recent(3, "10"), debit("1")), ErrVelocityLimitExceeded)
+	assert.ErrorIs(t, v.Check(recent(1, "60"), debit("40.01")), ErrVelocityLimitExceeded)
+	// Activity in another currency than the limit is a fault, not a breach.
+	err := v.Check(respository.DebitActivity{Total: domain.MustParseMoney("10", "JPY")}, domain.Transaction{Amount: domain.MustParseMoney("-1", "JPY")})
+	assert.ErrorIs(t, err, domain.ErrCurrencyMismatch)
+	assert.NotErrorIs(t, err, ErrVelocityLimitExceeded)
+
+	// The amount is converted into the account currency at the current rate.
+	table, err := NewRateTable([]ExchangeRate{{From: "BRL", To: "JPY", Rate: domain.MustParseRate("30")}})
+	assert.NoError(t, err)
+	limits := WithVelocityLimits(VelocityLimits{Window: time.Hour, MaxAmount: brl("100.50")})
+	jpyLimit := velocityCheck(t, New(new(mockRepo), WithExchangeRates(table), limits), "JPY")
+	jpy := func(s string) domain.Money { return domain.MustParseMoney(s, "JPY") }
+	assert.NoError(t, jpyLimit.Check(respository.DebitActivity{Total: jpy("3000")}, domain.Transaction{Amount: jpy("-15")}))
+	err = jpyLimit.Check(respository.DebitActivity{Total: jpy("3000")}, domain.Transaction{Amount: jpy("-16")})
+	assert.ErrorIs(t, err, ErrVelocityLimitExceeded)
+	assert.Contains(t, err.Error(), "3015 JPY")
+
+	// Without a rate the limit cannot be enforced, so debits are refused.
+	_, err = New(new(mockRepo), WithExchangeRates(table), limits).velocityCheck(context.Background(), "USD")
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+	_, err = New(new(mockRepo), limits).velocityCheck(context.Background(), "JPY")
+	assert.ErrorIs(t, err, ErrRateUnavailable)
+	assert.NotNil(t, velocityCheck(t, New(new(mockRepo), WithVelocityLimits(VelocityLimits{Window: time.Hour, MaxDebits: 3})), "JPY"),
+		"a count limit needs no rate")
+
+	amountOnly := velocityCheck(t, New(new(mockRepo), WithVelocityLimits(VelocityLimits{Window: time.Hour, MaxAmount: brl("100")})), "BRL")
+	assert.NoError(t, amountOnly.Check(recent(1000, "0"), debit("1")), "MaxDebits zero is not enforced")
+}
+
+func TestSetVelocityLimits(t *testing.T) {
+	svc := New(new(mockRepo), WithVelocityLimits(VelocityLimits{Window: time.Hour, MaxDebits: 3}))
+	svc.SetVelocityLimits(VelocityLimits{Window: time.Minute, MaxDebits: 1})
+	v := velocityCheck(t, svc, "BRL")
+	assert.Equal(t, time.Minute, v.Window)
+	assert.ErrorIs(t, v.Check(respository.DebitActivity{Count: 1, Total: brl("1")}, domain.Transaction{Amount: brl("-1")}), ErrVelocityLimitExceeded)
+
+	svc.SetVelocityLimits(VelocityLimits{})
+	assert.Nil(t, velocityCheck(t, svc, "BRL"))
+}
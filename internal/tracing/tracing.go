@@ -0,0 +1,415 @@
+// Package tracing records spans in the OpenTelemetry model and propagates
+// them with W3C Trace Context headers. Spans are handed to an Exporter in
+// batches; without a Tracer installed with SetTracer, Start is a no-op.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader carries the span context between services.
+const TraceparentHeader = "traceparent"
+
+type TraceID [16]byte
+
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+type SpanID [8]byte
+
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span within its trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+var errInvalidTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent reads a W3C traceparent header value. Versions above 00
+// are accepted as long as they start with the version 00 fields.
+func ParseTraceparent(h string) (SpanContext, error) {
+	h = strings.TrimSpace(h)
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !sc.IsValid() || parts[1] != strings.ToLower(parts[1]) || parts[2] != strings.ToLower(parts[2]) {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	}
+	return "internal"
+}
+
+// Attribute is a key and a string, int64, float64 or bool value.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute      { return Attribute{key, value} }
+func Int(key string, value int) Attribute     { return Attribute{key, int64(value)} }
+func Int64(key string, value int64) Attribute { return Attribute{key, value} }
+func Float64(key string, v float64) Attribute { return Attribute{key, v} }
+func Bool(key string, value bool) Attribute   { return Attribute{key, value} }
+
+// Event is a timestamped annotation of a span, such as a recorded error.
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// SpanData is a finished span as handed to exporters.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   []Attribute
+	Events       []Event
+	// Error is set, with a message, when the operation failed.
+	Error        bool
+	ErrorMessage string
+}
+
+// Span is an operation in progress. All methods are safe on a nil Span,
+// which is what Start returns while tracing is disabled.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SpanContext returns the identity of s, or the zero value for a nil Span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// RecordError adds an exception event for err and marks s as failed. A nil
+// err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Events = append(s.data.Events, Event{
+		Name:       "exception",
+		Time:       time.Now(),
+		Attributes: []Attribute{String("exception.type", fmt.Sprintf("%T", err)), String("exception.message", err.Error())},
+	})
+	s.data.Error = true
+	s.data.ErrorMessage = err.Error()
+}
+
+// SetError marks s as failed without recording an event, e.g. for a 5xx
+// response.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = true
+	s.data.ErrorMessage = message
+}
+
+// End finishes s and queues it for export. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if data.SpanContext.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithRemoteSpanContext makes sc, received from another service, the
+// parent of the next span started from the returned context.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanFromContext returns the span started last in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanContextFromContext returns the identity of the current span, falling
+// back to a remote parent.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+var global atomic.Pointer[Tracer]
+
+// SetTracer installs t as the tracer used by Start; nil disables tracing.
+func SetTracer(t *Tracer) {
+	global.Store(t)
+}
+
+// Start begins a span named name as a child of the span in ctx and returns a
+// context carrying it. Callers must End the span.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	t := global.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	return t.Start(ctx, name, kind, attrs...)
+}
+
+// Tracer creates spans and exports them in batches.
+type Tracer struct {
+	exporter     Exporter
+	batchSize    int
+	batchTimeout time.Duration
+	sampleRatio  float64
+
+	mu      sync.Mutex
+	pending []SpanData
+	closed  bool
+
+	exportMu sync.Mutex
+	kick     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+type Option func(*Tracer)
+
+// WithBatchSize sets how many spans are exported at once; a full batch is
+// exported without waiting for the batch timeout.
+func WithBatchSize(n int) Option {
+	return func(t *Tracer) {
+		t.batchSize = n
+	}
+}
+
+// WithBatchTimeout sets how long finished spans wait to be exported.
+func WithBatchTimeout(d time.Duration) Option {
+	return func(t *Tracer) {
+		t.batchTimeout = d
+	}
+}
+
+// WithSampleRatio keeps this fraction of new traces. Spans continuing a
+// trace follow the sampling decision of their parent.
+func WithSampleRatio(r float64) Option {
+	return func(t *Tracer) {
+		t.sampleRatio = r
+	}
+}
+
+// maxPending bounds the spans held while the exporter is slow or down.
+const maxPending = 8192
+
+func NewTracer(exporter Exporter, opts ...Option) *Tracer {
+	t := &Tracer{
+		exporter:     exporter,
+		batchSize:    512,
+		batchTimeout: 5 * time.Second,
+		sampleRatio:  1,
+		kick:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	s := &Span{tracer: t, data: SpanData{Name: name, Kind: kind, StartTime: time.Now(), Attributes: attrs}}
+	parent := SpanContextFromContext(ctx)
+	if parent.IsValid() {
+		s.data.SpanContext.TraceID = parent.TraceID
+		s.data.SpanContext.Sampled = parent.Sampled
+		s.data.ParentSpanID = parent.SpanID
+	} else {
+		s.data.SpanContext.TraceID = newTraceID()
+		s.data.SpanContext.Sampled = t.sample(s.data.SpanContext.TraceID)
+	}
+	s.data.SpanContext.SpanID = newSpanID()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample keeps a trace when the low 63 bits of its id fall below the ratio,
+// so every service using the same ratio agrees on the decision.
+func (t *Tracer) sample(id TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(t.sampleRatio*(1<<63))
+}
+
+func (t *Tracer) enqueue(s SpanData) {
+	t.mu.Lock()
+	if t.closed || len(t.pending) >= maxPending {
+		t.mu.Unlock()
+		return
+	}
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= t.batchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.batchTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		case <-t.kick:
+		}
+		_ = t.Flush(context.Background())
+	}
+}
+
+// Flush exports every finished span now. A batch the exporter fails on is
+// dropped rather than retried.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+	for {
+		t.mu.Lock()
+		n := min(len(t.pending), t.batchSize)
+		batch := t.pending[:n:n]
+		t.pending = t.pending[n:]
+		t.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			return fmt.Errorf("failed to export %d spans: %w", n, err)
+		}
+	}
+}
+
+// Shutdown exports the remaining spans and shuts the exporter down. Spans
+// ended afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.done) })
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	<-t.stopped
+	err := t.Flush(ctx)
+	return errors.Join(err, t.exporter.Shutdown(ctx))
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,171 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(valid)
+	if err != nil {
+		t.Fatalf("ParseTraceparent: %v", err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("unexpected span context %+v", sc)
+	}
+	if sc.Traceparent() != valid {
+		t.Fatalf("round trip gave %s", sc.Traceparent())
+	}
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(h); err == nil {
+			t.Errorf("expected %q to be rejected", h)
+		}
+	}
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Errorf("future versions may carry extra fields: %v", err)
+	}
+}
+
+func TestTracer_ParentChild(t *testing.T) {
+	exp := NewInMemoryExporter()
+	tr := NewTracer(exp)
+	SetTracer(tr)
+	defer SetTracer(nil)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemoteSpanContext(context.Background(), remote)
+	ctx, parent := Start(ctx, "parent", SpanKindServer, String("http.method", "POST"))
+	_, child := Start(ctx, "child", SpanKindInternal)
+	child.RecordError(errors.New("boom"))
+	child.End()
+	parent.End()
+	parent.End()
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	spans := exp.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if p.SpanContext.TraceID != remote.TraceID || p.ParentSpanID != remote.SpanID {
+		t.Errorf("parent did not continue the remote trace: %+v", p)
+	}
+	if c.SpanContext.TraceID != remote.TraceID || c.ParentSpanID != p.SpanContext.SpanID {
+		t.Errorf("child is not a child of parent: %+v", c)
+	}
+	if !c.Error || c.ErrorMessage != "boom" || len(c.Events) != 1 || c.Events[0].Name != "exception" {
+		t.Errorf("error not recorded: %+v", c)
+	}
+	if p.Error || len(p.Attributes) != 1 {
+		t.Errorf("unexpected parent: %+v", p)
+	}
+}
+
+func TestTracer_Sampling(t *testing.T) {
+	exp := NewInMemoryExporter()
+	tr := NewTracer(exp, WithSampleRatio(0))
+
+	_, root := tr.Start(context.Background(), "dropped", SpanKindInternal)
+	root.End()
+	sampled := SpanContext{TraceID: TraceID{1}, SpanID: SpanID{1}, Sampled: true}
+	_, child := tr.Start(ContextWithRemoteSpanContext(context.Background(), sampled), "kept", SpanKindInternal)
+	child.End()
+
+	tr.Shutdown(context.Background())
+	if spans := exp.Spans(); len(spans) != 1 || spans[0].Name != "kept" {
+		t.Fatalf("expected only the span of the sampled trace, got %+v", spans)
+	}
+}
+
+func TestStart_WithoutTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop", SpanKindInternal)
+	if span != nil || ctx != context.Background() {
+		t.Fatal("expected a no-op span")
+	}
+	span.SetAttributes(String("k", "v"))
+	span.RecordError(errors.New("ignored"))
+	span.End()
+}
+
+func TestWriterExporter(t *testing.T) {
+	var sb strings.Builder
+	tr := NewTracer(NewWriterExporter(&sb))
+	_, span := tr.Start(context.Background(), "query", SpanKindClient, Int("rows", 3))
+	span.End()
+	tr.Shutdown(context.Background())
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(sb.String()), &got); err != nil {
+		t.Fatalf("not a JSON line: %q", sb.String())
+	}
+	if got["name"] != "query" || got["kind"] != "client" || got["attributes"].(map[string]any)["rows"] != float64(3) {
+		t.Fatalf("unexpected span %v", got)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body otlpRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("invalid OTLP JSON: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	tr := NewTracer(NewOTLPExporter(srv.URL+"/v1/traces", "transaction-routine", WithOTLPHeaders(map[string]string{"Authorization": "Bearer x"})))
+	_, span := tr.Start(context.Background(), "POST /transactions", SpanKindServer, Int("http.status_code", 500), Bool("retry", false))
+	span.SetError("Internal Server Error")
+	span.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if auth != "Bearer x" || len(body.ResourceSpans) != 1 {
+		t.Fatalf("unexpected request: auth %q body %+v", auth, body)
+	}
+	rs := body.ResourceSpans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "transaction-routine" {
+		t.Errorf("service.name not set: %+v", rs.Resource)
+	}
+	s := rs.ScopeSpans[0].Spans[0]
+	if s.Name != "POST /transactions" || s.Kind != 2 || s.Status.Code != otlpStatusError || len(s.TraceID) != 32 {
+		t.Errorf("unexpected span %+v", s)
+	}
+	if *s.Attributes[0].Value.IntValue != "500" || *s.Attributes[1].Value.BoolValue {
+		t.Errorf("unexpected attributes %+v", s.Attributes)
+	}
+}
+
+func TestOTLPExporter_CollectorError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	err := NewOTLPExporter(srv.URL, "svc").Export(context.Background(), []SpanData{{Name: "x"}})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected collector error, got %v", err)
+	}
+}